@@ -111,6 +111,43 @@ func (as *AssignStatement) String() string {
 	return out.String()
 }
 
+// IncDecStatement represents an increment or decrement statement, e.g. `i++;` or `i--;`.
+type IncDecStatement struct {
+	Token   token.Token // token.INC or token.DEC
+	Operand Expression
+}
+
+func (ids *IncDecStatement) statementNode() {}
+
+// TokenLiteral returns a token literal of increment or decrement statement.
+func (ids *IncDecStatement) TokenLiteral() string {
+	return ids.Token.Literal
+}
+
+func (ids *IncDecStatement) String() string {
+	return ids.Operand.String() + ids.Token.Literal + ";"
+}
+
+// Assignment returns the assignment statement `ids` is a shorthand for, e.g. `i = i + 1;` for
+// `i++;`. The operand appears on both sides, so its subexpressions are evaluated twice.
+func (ids *IncDecStatement) Assignment() *AssignStatement {
+	op := token.Token{Type: token.PLUS, Literal: "+"}
+	if ids.Token.Type == token.DEC {
+		op = token.Token{Type: token.MINUS, Literal: "-"}
+	}
+
+	return &AssignStatement{
+		Token: token.Token{Type: token.ASSIGN, Literal: "="},
+		LHS:   ids.Operand,
+		RHS: &InfixExpression{
+			Token:    op,
+			Operator: op.Literal,
+			Left:     ids.Operand,
+			Right:    &IntegerLiteral{Token: token.Token{Type: token.INT, Literal: "1"}, Value: 1},
+		},
+	}
+}
+
 // Ident represents an identifier.
 type Ident struct {
 	Token token.Token // the token.IDENT token
@@ -325,6 +362,39 @@ func (ie *IfExpression) String() string {
 	return out.String()
 }
 
+// MatchExpression represents a match expression, which evaluates to the value of the first arm
+// whose pattern matches the subject, e.g. `match p { [x, y] => x + y, _ => 0 }`.
+type MatchExpression struct {
+	Token   token.Token // The 'match' token
+	Subject Expression
+	Arms    []*MatchArm
+}
+
+func (me *MatchExpression) expressionNode() {}
+
+// TokenLiteral returns a token literal of match expression.
+func (me *MatchExpression) TokenLiteral() string {
+	return me.Token.Literal
+}
+
+func (me *MatchExpression) String() string {
+	arms := make([]string, 0, len(me.Arms))
+	for _, arm := range me.Arms {
+		arms = append(arms, arm.Pattern.String()+" => "+arm.Value.String())
+	}
+
+	return "match " + me.Subject.String() + " { " + strings.Join(arms, ", ") + " }"
+}
+
+// MatchArm represents an arm of a match expression. A pattern is an identifier binding the value
+// it matches, `_` matching anything, a literal matching an equal value, or an array or hash
+// literal of patterns matching an array of the same length or a hash with the same keys whose
+// elements or values match them in turn.
+type MatchArm struct {
+	Pattern Expression
+	Value   Expression
+}
+
 // BlockStatement represents a block statement.
 type BlockStatement struct {
 	Token      token.Token // the '{' token
@@ -501,10 +571,51 @@ func (ie *IndexExpression) String() string {
 	return out.String()
 }
 
+// FieldExpression represents an expression accessing a field of a hash with dot notation,
+// e.g. `obj.field`, which is a syntax sugar for `obj["field"]`.
+type FieldExpression struct {
+	Token token.Token // the '.' token
+	Left  Expression
+	Field *Ident
+}
+
+func (*FieldExpression) expressionNode() {}
+
+// TokenLiteral returns a token literal of field access.
+func (fe *FieldExpression) TokenLiteral() string {
+	if fe == nil {
+		return ""
+	}
+	return fe.Token.Literal
+}
+
+func (fe *FieldExpression) String() string {
+	if fe == nil {
+		return ""
+	}
+
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(fe.Left.String())
+	out.WriteString(".")
+	out.WriteString(fe.Field.String())
+	out.WriteString(")")
+
+	return out.String()
+}
+
 // HashLiteral represents a hash literal.
 type HashLiteral struct {
 	Token token.Token // the '{' token
-	Pairs map[Expression]Expression
+	// Pairs holds the pairs in the order they appear in the source
+	Pairs []HashPair
+}
+
+// HashPair represents a pair of a key and a value in a hash literal.
+type HashPair struct {
+	Key   Expression
+	Value Expression
 }
 
 func (*HashLiteral) expressionNode() {}
@@ -522,9 +633,9 @@ func (hl *HashLiteral) String() string {
 		return ""
 	}
 
-	pairs := make([]string, len(hl.Pairs))
-	for key, value := range hl.Pairs {
-		pairs = append(pairs, key.String()+": "+value.String())
+	pairs := make([]string, 0, len(hl.Pairs))
+	for _, pair := range hl.Pairs {
+		pairs = append(pairs, pair.Key.String()+": "+pair.Value.String())
 	}
 
 	var out bytes.Buffer
@@ -0,0 +1,190 @@
+package ast
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// WriteDOT writes a graph of the AST rooted at `node` to `w` in the DOT language of Graphviz,
+// e.g. to render it with `dot -Tsvg`. Each node of the AST is a box labeled with its kind and
+// its value if any, e.g. `Infix +`, and edges to its children are labeled with their roles, e.g.
+// `left` and `right`, or their indexes in lists such as statements and arguments.
+func WriteDOT(w io.Writer, node Node) error {
+	d := &dotWriter{}
+	d.out.WriteString("digraph AST {\n\tnode [shape=box];\n")
+	d.writeNode(node)
+	d.out.WriteString("}\n")
+
+	_, err := io.WriteString(w, d.out.String())
+	return err
+}
+
+// dotWriter builds a graph of an AST in the DOT language.
+type dotWriter struct {
+	out strings.Builder
+	// count is the number of nodes written so far, which names the next node
+	count int
+}
+
+// dotChild is a child of a node in the graph with the label of the edge to it. It is either an
+// AST node or an arm of a match expression.
+type dotChild struct {
+	label string
+	node  Node
+	arm   *MatchArm
+}
+
+// writeNode writes `node` and its descendants, and returns the name of `node` in the graph.
+func (d *dotWriter) writeNode(node Node) string {
+	var label string
+	var children []dotChild
+	child := func(label string, node Node) {
+		children = append(children, dotChild{label: label, node: node})
+	}
+
+	// Nil nodes appear in programs with parse errors
+	if v := reflect.ValueOf(node); node == nil || v.Kind() == reflect.Ptr && v.IsNil() {
+		return d.writeVertex("<nil>", nil)
+	}
+
+	switch node := node.(type) {
+	case *Program:
+		label = "Program"
+		for i, stmt := range node.Statements {
+			child(strconv.Itoa(i), stmt)
+		}
+	case *BlockStatement:
+		label = "Block"
+		for i, stmt := range node.Statements {
+			child(strconv.Itoa(i), stmt)
+		}
+
+	case *LetStatement:
+		label = "Let"
+		child("name", node.Name)
+		child("value", node.Value)
+	case *AssignStatement:
+		label = "Assign"
+		child("lhs", node.LHS)
+		child("rhs", node.RHS)
+	case *IncDecStatement:
+		label = node.Token.Literal
+		child("operand", node.Operand)
+	case *ReturnStatement:
+		label = "Return"
+		child("value", node.ReturnValue)
+	case *ExpressionStatement:
+		label = "ExpressionStatement"
+		child("expression", node.Expression)
+
+	case *Ident:
+		label = "Ident " + node.Value
+	case *IntegerLiteral:
+		label = "Integer " + node.Token.Literal
+	case *FloatLiteral:
+		label = "Float " + node.Token.Literal
+	case *StringLiteral:
+		label = "String " + strconv.Quote(node.Value)
+	case *Boolean:
+		label = "Boolean " + strconv.FormatBool(node.Value)
+	case *Nil:
+		label = "Nil"
+
+	case *PrefixExpression:
+		label = "Prefix " + node.Operator
+		child("right", node.Right)
+	case *InfixExpression:
+		label = "Infix " + node.Operator
+		child("left", node.Left)
+		child("right", node.Right)
+	case *IfExpression:
+		label = "If"
+		child("condition", node.Condition)
+		child("consequence", node.Consequence)
+		if node.Alternative != nil {
+			child("alternative", node.Alternative)
+		}
+	case *MatchExpression:
+		label = "Match"
+		child("subject", node.Subject)
+		for i, arm := range node.Arms {
+			children = append(children, dotChild{label: "arm " + strconv.Itoa(i), arm: arm})
+		}
+	case *FunctionLiteral:
+		label = "Function"
+		if node.Name != "" {
+			label += " " + node.Name
+		}
+		for i, param := range node.Parameters {
+			child("param "+strconv.Itoa(i), param)
+		}
+		child("body", node.Body)
+	case *MacroLiteral:
+		label = "Macro"
+		for i, param := range node.Parameters {
+			child("param "+strconv.Itoa(i), param)
+		}
+		child("body", node.Body)
+	case *CallExpression:
+		label = "Call"
+		child("function", node.Function)
+		for i, arg := range node.Arguments {
+			child("arg "+strconv.Itoa(i), arg)
+		}
+	case *ArrayLiteral:
+		label = "Array"
+		for i, el := range node.Elements {
+			child(strconv.Itoa(i), el)
+		}
+	case *HashLiteral:
+		label = "Hash"
+		for i, pair := range node.Pairs {
+			child("key "+strconv.Itoa(i), pair.Key)
+			child("value "+strconv.Itoa(i), pair.Value)
+		}
+	case *IndexExpression:
+		label = "Index"
+		child("left", node.Left)
+		child("index", node.Index)
+	case *FieldExpression:
+		label = "Field"
+		child("left", node.Left)
+		child("field", node.Field)
+
+	default:
+		label = fmt.Sprintf("%T", node)
+	}
+
+	return d.writeVertex(label, children)
+}
+
+// writeVertex writes a node of the graph labeled `label` and its `children`, and returns the name
+// of the node.
+func (d *dotWriter) writeVertex(label string, children []dotChild) string {
+	name := "n" + strconv.Itoa(d.count)
+	d.count++
+	fmt.Fprintf(&d.out, "\t%s [label=%s];\n", name, dotQuote(label))
+
+	for _, c := range children {
+		var childName string
+		if c.arm != nil {
+			childName = d.writeVertex("Arm", []dotChild{
+				{label: "pattern", node: c.arm.Pattern},
+				{label: "value", node: c.arm.Value},
+			})
+		} else {
+			childName = d.writeNode(c.node)
+		}
+		fmt.Fprintf(&d.out, "\t%s -> %s [label=%s];\n", name, childName, dotQuote(c.label))
+	}
+	return name
+}
+
+// dotQuote returns `s` as a quoted string of the DOT language.
+func dotQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,79 @@
+package ast
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/token"
+)
+
+func TestWriteDOT(t *testing.T) {
+	// let s = "a" + f(-1); match s { _ => nil }
+	program := &Program{
+		Statements: []Statement{
+			&LetStatement{
+				Name: &Ident{Value: "s"},
+				Value: &InfixExpression{
+					Left:     &StringLiteral{Value: `"a"`},
+					Operator: "+",
+					Right: &CallExpression{
+						Function: &Ident{Value: "f"},
+						Arguments: []Expression{&PrefixExpression{
+							Operator: "-",
+							Right:    &IntegerLiteral{Token: token.Token{Literal: "1"}, Value: 1},
+						}},
+					},
+				},
+			},
+			&ExpressionStatement{Expression: &MatchExpression{
+				Subject: &Ident{Value: "s"},
+				Arms:    []*MatchArm{{Pattern: &Ident{Value: "_"}, Value: &Nil{}}},
+			}},
+			nil,
+		},
+	}
+
+	want := `digraph AST {
+	node [shape=box];
+	n0 [label="Program"];
+	n1 [label="Let"];
+	n2 [label="Ident s"];
+	n1 -> n2 [label="name"];
+	n3 [label="Infix +"];
+	n4 [label="String \"\\\"a\\\"\""];
+	n3 -> n4 [label="left"];
+	n5 [label="Call"];
+	n6 [label="Ident f"];
+	n5 -> n6 [label="function"];
+	n7 [label="Prefix -"];
+	n8 [label="Integer 1"];
+	n7 -> n8 [label="right"];
+	n5 -> n7 [label="arg 0"];
+	n3 -> n5 [label="right"];
+	n1 -> n3 [label="value"];
+	n0 -> n1 [label="0"];
+	n9 [label="ExpressionStatement"];
+	n10 [label="Match"];
+	n11 [label="Ident s"];
+	n10 -> n11 [label="subject"];
+	n12 [label="Arm"];
+	n13 [label="Ident _"];
+	n12 -> n13 [label="pattern"];
+	n14 [label="Nil"];
+	n12 -> n14 [label="value"];
+	n10 -> n12 [label="arm 0"];
+	n9 -> n10 [label="expression"];
+	n0 -> n9 [label="1"];
+	n15 [label="<nil>"];
+	n0 -> n15 [label="2"];
+}
+`
+
+	var out strings.Builder
+	if err := WriteDOT(&out, program); err != nil {
+		t.Fatalf("WriteDOT failed: %s", err)
+	}
+	if got := out.String(); got != want {
+		t.Errorf("wrong graph.\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
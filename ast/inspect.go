@@ -0,0 +1,87 @@
+package ast
+
+import "reflect"
+
+// Inspect traverses an AST in depth-first order. It calls `f` with `node` first, and then
+// inspects each of the children of `node` if `f` returns true. Nil nodes, which a program
+// with parse errors can contain, are skipped.
+func Inspect(node Node, f func(Node) bool) {
+	if node == nil {
+		return
+	}
+	if v := reflect.ValueOf(node); v.Kind() == reflect.Ptr && v.IsNil() {
+		return
+	}
+
+	if !f(node) {
+		return
+	}
+
+	switch node := node.(type) {
+	case *Program:
+		for _, stmt := range node.Statements {
+			Inspect(stmt, f)
+		}
+	case *LetStatement:
+		Inspect(node.Name, f)
+		Inspect(node.Value, f)
+	case *AssignStatement:
+		Inspect(node.LHS, f)
+		Inspect(node.RHS, f)
+	case *IncDecStatement:
+		Inspect(node.Operand, f)
+	case *ReturnStatement:
+		Inspect(node.ReturnValue, f)
+	case *ExpressionStatement:
+		Inspect(node.Expression, f)
+	case *BlockStatement:
+		for _, stmt := range node.Statements {
+			Inspect(stmt, f)
+		}
+	case *PrefixExpression:
+		Inspect(node.Right, f)
+	case *InfixExpression:
+		Inspect(node.Left, f)
+		Inspect(node.Right, f)
+	case *IfExpression:
+		Inspect(node.Condition, f)
+		Inspect(node.Consequence, f)
+		Inspect(node.Alternative, f)
+	case *MatchExpression:
+		Inspect(node.Subject, f)
+		for _, arm := range node.Arms {
+			Inspect(arm.Pattern, f)
+			Inspect(arm.Value, f)
+		}
+	case *FunctionLiteral:
+		for _, param := range node.Parameters {
+			Inspect(param, f)
+		}
+		Inspect(node.Body, f)
+	case *MacroLiteral:
+		for _, param := range node.Parameters {
+			Inspect(param, f)
+		}
+		Inspect(node.Body, f)
+	case *CallExpression:
+		Inspect(node.Function, f)
+		for _, arg := range node.Arguments {
+			Inspect(arg, f)
+		}
+	case *IndexExpression:
+		Inspect(node.Left, f)
+		Inspect(node.Index, f)
+	case *FieldExpression:
+		Inspect(node.Left, f)
+		Inspect(node.Field, f)
+	case *ArrayLiteral:
+		for _, el := range node.Elements {
+			Inspect(el, f)
+		}
+	case *HashLiteral:
+		for _, pair := range node.Pairs {
+			Inspect(pair.Key, f)
+			Inspect(pair.Value, f)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package ast
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	// let f = fn(x) { if (x) { g(x[0]) } else { -x.y } };
+	program := &Program{
+		Statements: []Statement{
+			&LetStatement{
+				Name: &Ident{Value: "f"},
+				Value: &FunctionLiteral{
+					Parameters: []*Ident{{Value: "x"}},
+					Body: &BlockStatement{Statements: []Statement{
+						&ExpressionStatement{Expression: &IfExpression{
+							Condition: &Ident{Value: "x"},
+							Consequence: &BlockStatement{Statements: []Statement{
+								&ExpressionStatement{Expression: &CallExpression{
+									Function: &Ident{Value: "g"},
+									Arguments: []Expression{&IndexExpression{
+										Left:  &Ident{Value: "x"},
+										Index: &IntegerLiteral{Value: 0},
+									}},
+								}},
+							}},
+							Alternative: &BlockStatement{Statements: []Statement{
+								&ExpressionStatement{Expression: &PrefixExpression{
+									Operator: "-",
+									Right: &FieldExpression{
+										Left:  &Ident{Value: "x"},
+										Field: &Ident{Value: "y"},
+									},
+								}},
+							}},
+						}},
+					}},
+				},
+			},
+		},
+	}
+
+	var idents []string
+	Inspect(program, func(node Node) bool {
+		if ident, ok := node.(*Ident); ok {
+			idents = append(idents, ident.Value)
+		}
+		return true
+	})
+
+	want := []string{"f", "x", "x", "g", "x", "x", "y"}
+	if !reflect.DeepEqual(idents, want) {
+		t.Errorf("wrong identifiers. want=%q, got=%q", want, idents)
+	}
+
+	// Children of a node are skipped if the function returns false
+	numNodes := 0
+	Inspect(program, func(node Node) bool {
+		numNodes++
+		_, ok := node.(*FunctionLiteral)
+		return !ok
+	})
+	if numNodes != 4 {
+		t.Errorf("wrong number of nodes. want=4, got=%d", numNodes)
+	}
+
+	// Nil nodes, e.g. the missing blocks here, are skipped
+	numNodes = 0
+	Inspect(&IfExpression{Condition: &Boolean{Value: true}}, func(node Node) bool {
+		numNodes++
+		return true
+	})
+	if numNodes != 2 {
+		t.Errorf("wrong number of nodes. want=2, got=%d", numNodes)
+	}
+}
@@ -1,57 +1,205 @@
 package ast
 
+import (
+	"fmt"
+	"reflect"
+)
+
 // ModifierFunc represents a function which modifies a node.
 type ModifierFunc func(Node) Node
 
-// Modify modifies a `node` using `modifier` function.
-func Modify(node Node, modifier ModifierFunc) Node {
+// Modify modifies a `node` and its descendants using `modifier` function, which is called with
+// each node after its children are modified and returns the node to replace it with. It reports
+// an error if `modifier` replaces a node with one which cannot take its place, e.g. an expression
+// with a statement or nil, or if `node` contains a node of an unknown type. Nil nodes, which a
+// program with parse errors can contain, are left as they are.
+func Modify(node Node, modifier ModifierFunc) (Node, error) {
+	if isNilNode(node) {
+		return node, nil
+	}
+
+	var err error
+	// Each of the helpers below does nothing once an error occurs
+	expr := func(e *Expression) {
+		if err == nil {
+			*e, err = modifyExpression(*e, modifier)
+		}
+	}
+	stmt := func(s *Statement) {
+		if err == nil {
+			*s, err = modifyStatement(*s, modifier)
+		}
+	}
+	block := func(b **BlockStatement) {
+		if err == nil {
+			*b, err = modifyBlock(*b, modifier)
+		}
+	}
+	ident := func(i **Ident) {
+		if err == nil {
+			*i, err = modifyIdent(*i, modifier)
+		}
+	}
+
 	switch node := node.(type) {
 	case *Program:
-		for i, stmt := range node.Statements {
-			node.Statements[i] = Modify(stmt, modifier).(Statement)
+		for i := range node.Statements {
+			stmt(&node.Statements[i])
 		}
+	case *LetStatement:
+		ident(&node.Name)
+		expr(&node.Value)
+	case *AssignStatement:
+		expr(&node.LHS)
+		expr(&node.RHS)
+	case *IncDecStatement:
+		expr(&node.Operand)
+	case *ReturnStatement:
+		expr(&node.ReturnValue)
 	case *ExpressionStatement:
-		node.Expression = Modify(node.Expression, modifier).(Expression)
-	case *InfixExpression:
-		node.Left = Modify(node.Left, modifier).(Expression)
-		node.Right = Modify(node.Right, modifier).(Expression)
+		expr(&node.Expression)
+	case *BlockStatement:
+		for i := range node.Statements {
+			stmt(&node.Statements[i])
+		}
+
+	case *Ident, *IntegerLiteral, *FloatLiteral, *StringLiteral, *Boolean, *Nil:
+		// Leaves have no children
+
 	case *PrefixExpression:
-		node.Right = Modify(node.Right, modifier).(Expression)
-	case *IndexExpression:
-		node.Left = Modify(node.Left, modifier).(Expression)
-		node.Index = Modify(node.Index, modifier).(Expression)
+		expr(&node.Right)
+	case *InfixExpression:
+		expr(&node.Left)
+		expr(&node.Right)
 	case *IfExpression:
-		node.Condition = Modify(node.Condition, modifier).(Expression)
-		node.Consequence = Modify(node.Consequence, modifier).(*BlockStatement)
-		if node.Alternative != nil {
-			node.Alternative = Modify(node.Alternative, modifier).(*BlockStatement)
+		expr(&node.Condition)
+		block(&node.Consequence)
+		block(&node.Alternative)
+	case *MatchExpression:
+		expr(&node.Subject)
+		for _, arm := range node.Arms {
+			expr(&arm.Pattern)
+			expr(&arm.Value)
 		}
-	case *BlockStatement:
-		for i, stmt := range node.Statements {
-			node.Statements[i] = Modify(stmt, modifier).(Statement)
-		}
-	case *ReturnStatement:
-		node.ReturnValue = Modify(node.ReturnValue, modifier).(Expression)
-	case *LetStatement:
-		node.Value = Modify(node.Value, modifier).(Expression)
 	case *FunctionLiteral:
-		for i, param := range node.Parameters {
-			node.Parameters[i] = Modify(param, modifier).(*Ident)
+		for i := range node.Parameters {
+			ident(&node.Parameters[i])
+		}
+		block(&node.Body)
+	case *MacroLiteral:
+		for i := range node.Parameters {
+			ident(&node.Parameters[i])
+		}
+		block(&node.Body)
+	case *CallExpression:
+		expr(&node.Function)
+		for i := range node.Arguments {
+			expr(&node.Arguments[i])
 		}
-		node.Body = Modify(node.Body, modifier).(*BlockStatement)
 	case *ArrayLiteral:
-		for i, elem := range node.Elements {
-			node.Elements[i] = Modify(elem, modifier).(Expression)
+		for i := range node.Elements {
+			expr(&node.Elements[i])
 		}
 	case *HashLiteral:
-		newPairs := make(map[Expression]Expression, len(node.Pairs))
-		for key, val := range node.Pairs {
-			newKey := Modify(key, modifier).(Expression)
-			newVal := Modify(val, modifier).(Expression)
-			newPairs[newKey] = newVal
+		for i := range node.Pairs {
+			expr(&node.Pairs[i].Key)
+			expr(&node.Pairs[i].Value)
 		}
-		node.Pairs = newPairs
+	case *IndexExpression:
+		expr(&node.Left)
+		expr(&node.Index)
+	case *FieldExpression:
+		expr(&node.Left)
+		ident(&node.Field)
+
+	default:
+		return nil, fmt.Errorf("cannot modify node of unknown type %T", node)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return modifier(node), nil
+}
+
+// modifyExpression modifies `expr` as Modify does, and reports an error unless it is replaced
+// with an expression.
+func modifyExpression(expr Expression, modifier ModifierFunc) (Expression, error) {
+	if isNilNode(expr) {
+		return expr, nil
+	}
+	node, err := Modify(expr, modifier)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := node.(Expression); ok && !isNilNode(e) {
+		return e, nil
+	}
+	return nil, replaceError(expr, node, "an expression")
+}
+
+// modifyStatement modifies `stmt` as Modify does, and reports an error unless it is replaced with
+// a statement.
+func modifyStatement(stmt Statement, modifier ModifierFunc) (Statement, error) {
+	if isNilNode(stmt) {
+		return stmt, nil
+	}
+	node, err := Modify(stmt, modifier)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := node.(Statement); ok && !isNilNode(s) {
+		return s, nil
+	}
+	return nil, replaceError(stmt, node, "a statement")
+}
+
+// modifyBlock modifies `block` as Modify does, and reports an error unless it is replaced with a
+// block statement.
+func modifyBlock(block *BlockStatement, modifier ModifierFunc) (*BlockStatement, error) {
+	if block == nil {
+		return nil, nil
+	}
+	node, err := Modify(block, modifier)
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := node.(*BlockStatement); ok && b != nil {
+		return b, nil
+	}
+	return nil, replaceError(block, node, "a block statement")
+}
+
+// modifyIdent modifies `ident` as Modify does, and reports an error unless it is replaced with an
+// identifier.
+func modifyIdent(ident *Ident, modifier ModifierFunc) (*Ident, error) {
+	if ident == nil {
+		return nil, nil
 	}
+	node, err := Modify(ident, modifier)
+	if err != nil {
+		return nil, err
+	}
+	if i, ok := node.(*Ident); ok && i != nil {
+		return i, nil
+	}
+	return nil, replaceError(ident, node, "an identifier")
+}
 
-	return modifier(node)
+// replaceError returns an error telling that `old` cannot be replaced with `node`, which is not
+// `want`.
+func replaceError(old, node Node, want string) error {
+	if isNilNode(node) {
+		return fmt.Errorf("cannot replace %s with nil, which is not %s", old, want)
+	}
+	return fmt.Errorf("cannot replace %s with %s, which is not %s", old, node, want)
+}
+
+// isNilNode reports whether `node` is nil or a nil pointer to a node.
+func isNilNode(node Node) bool {
+	if node == nil {
+		return true
+	}
+	v := reflect.ValueOf(node)
+	return v.Kind() == reflect.Ptr && v.IsNil()
 }
@@ -1,8 +1,11 @@
 package ast
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
+
+	"github.com/skatsuta/monkey-compiler/token"
 )
 
 func createIntLitFunc(i int64) func() Expression {
@@ -55,6 +58,10 @@ func TestModify(t *testing.T) {
 			input: &IndexExpression{Left: one(), Index: one()},
 			want:  &IndexExpression{Left: two(), Index: two()},
 		},
+		{
+			input: &FieldExpression{Left: one(), Field: &Ident{Value: "a"}},
+			want:  &FieldExpression{Left: two(), Field: &Ident{Value: "a"}},
+		},
 		{
 			input: &IfExpression{
 				Condition: one(),
@@ -101,10 +108,49 @@ func TestModify(t *testing.T) {
 			input: &ArrayLiteral{Elements: []Expression{one(), one()}},
 			want:  &ArrayLiteral{Elements: []Expression{two(), two()}},
 		},
+		{
+			input: &AssignStatement{LHS: &IndexExpression{Left: one(), Index: one()}, RHS: one()},
+			want:  &AssignStatement{LHS: &IndexExpression{Left: two(), Index: two()}, RHS: two()},
+		},
+		{
+			input: &IncDecStatement{Operand: &IndexExpression{Left: one(), Index: one()}},
+			want:  &IncDecStatement{Operand: &IndexExpression{Left: two(), Index: two()}},
+		},
+		{
+			input: &CallExpression{Function: one(), Arguments: []Expression{one(), one()}},
+			want:  &CallExpression{Function: two(), Arguments: []Expression{two(), two()}},
+		},
+		{
+			input: &MatchExpression{
+				Subject: one(),
+				Arms:    []*MatchArm{{Pattern: one(), Value: one()}},
+			},
+			want: &MatchExpression{
+				Subject: two(),
+				Arms:    []*MatchArm{{Pattern: two(), Value: two()}},
+			},
+		},
+		{
+			input: &MacroLiteral{
+				Parameters: []*Ident{},
+				Body: &BlockStatement{
+					Statements: []Statement{&ExpressionStatement{Expression: one()}},
+				},
+			},
+			want: &MacroLiteral{
+				Parameters: []*Ident{},
+				Body: &BlockStatement{
+					Statements: []Statement{&ExpressionStatement{Expression: two()}},
+				},
+			},
+		},
 	}
 
 	for _, tt := range tests {
-		got := Modify(tt.input, turnOneIntoTwo)
+		got, err := Modify(tt.input, turnOneIntoTwo)
+		if err != nil {
+			t.Fatalf("Modify failed: %s", err)
+		}
 
 		if !reflect.DeepEqual(got, tt.want) {
 			t.Errorf("expected %#v, but got %#v", tt.want, got)
@@ -114,22 +160,165 @@ func TestModify(t *testing.T) {
 	// Test for hash literals
 
 	hashLit := &HashLiteral{
-		Pairs: map[Expression]Expression{
-			one(): one(),
-			one(): one(),
+		Pairs: []HashPair{
+			{Key: one(), Value: one()},
+			{Key: one(), Value: one()},
 		},
 	}
 
-	Modify(hashLit, turnOneIntoTwo)
+	if _, err := Modify(hashLit, turnOneIntoTwo); err != nil {
+		t.Fatalf("Modify failed: %s", err)
+	}
 
-	for key, val := range hashLit.Pairs {
-		key := key.(*IntegerLiteral)
+	for _, pair := range hashLit.Pairs {
+		key := pair.Key.(*IntegerLiteral)
 		if key.Value != 2 {
 			t.Errorf("key is not %d and got %d", 2, key.Value)
 		}
-		val := val.(*IntegerLiteral)
+		val := pair.Value.(*IntegerLiteral)
 		if val.Value != 2 {
 			t.Errorf("value is not %d and got %d", 2, key.Value)
 		}
 	}
 }
+
+// allNodesProgram returns a program with a node of every type.
+func allNodesProgram() *Program {
+	ident := func(name string) *Ident { return &Ident{Value: name} }
+	block := func(exprs ...Expression) *BlockStatement {
+		b := &BlockStatement{}
+		for _, e := range exprs {
+			b.Statements = append(b.Statements, &ExpressionStatement{Expression: e})
+		}
+		return b
+	}
+
+	return &Program{Statements: []Statement{
+		&LetStatement{Name: ident("a"), Value: &ArrayLiteral{Elements: []Expression{
+			&IntegerLiteral{Token: token.Token{Literal: "1"}, Value: 1},
+			&FloatLiteral{Value: 1.5},
+			&StringLiteral{Value: "s"},
+		}}},
+		&AssignStatement{
+			LHS: &IndexExpression{Left: ident("a"), Index: &IntegerLiteral{Value: 0}},
+			RHS: &PrefixExpression{Operator: "-", Right: &Boolean{Value: true}},
+		},
+		&IncDecStatement{Operand: &FieldExpression{Left: ident("h"), Field: ident("n")}},
+		&ExpressionStatement{Expression: &MacroLiteral{
+			Parameters: []*Ident{ident("m")},
+			Body: block(&CallExpression{
+				Function:  ident("quote"),
+				Arguments: []Expression{ident("m")},
+			}),
+		}},
+		&ReturnStatement{ReturnValue: &FunctionLiteral{
+			Parameters: []*Ident{ident("x")},
+			Body: block(&IfExpression{
+				Condition: &InfixExpression{Left: ident("x"), Operator: "<", Right: &Nil{}},
+				Consequence: block(&HashLiteral{
+					Pairs: []HashPair{{Key: ident("k"), Value: ident("v")}},
+				}),
+				Alternative: block(&MatchExpression{
+					Subject: ident("x"),
+					Arms:    []*MatchArm{{Pattern: ident("_"), Value: ident("y")}},
+				}),
+			}),
+		}},
+	}}
+}
+
+func TestModifyVisitsEveryNode(t *testing.T) {
+	program := allNodesProgram()
+	src := program.String()
+
+	want := make(map[Node]int)
+	types := make(map[string]bool)
+	Inspect(program, func(node Node) bool {
+		want[node]++
+		types[fmt.Sprintf("%T", node)] = true
+		return true
+	})
+	// Every type of node but a MatchArm, which is not a node itself
+	if len(types) != 24 {
+		t.Fatalf("program has %d types of nodes, want 24: %v", len(types), types)
+	}
+
+	got := make(map[Node]int)
+	modified, err := Modify(program, func(node Node) Node {
+		got[node]++
+		return node
+	})
+	if err != nil {
+		t.Fatalf("Modify failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Modify visited %d nodes, want %d", len(got), len(want))
+		for node := range want {
+			if got[node] != 1 {
+				t.Errorf("%T %s visited %d times", node, node, got[node])
+			}
+		}
+	}
+	if modified != program || program.String() != src {
+		t.Errorf("program changed by an identity modifier. want=%q, got=%q", src,
+			modified.String())
+	}
+}
+
+type unknownNode struct{ Ident }
+
+func TestModifyErrors(t *testing.T) {
+	replaceInt := func(with Node) ModifierFunc {
+		return func(node Node) Node {
+			if _, ok := node.(*IntegerLiteral); ok {
+				return with
+			}
+			return node
+		}
+	}
+	rename := func(node Node) Node {
+		if ident, ok := node.(*Ident); ok && ident.Value == "x" {
+			return &StringLiteral{Token: token.Token{Literal: `"x"`}, Value: "x"}
+		}
+		return node
+	}
+
+	tests := []struct {
+		node     Node
+		modifier ModifierFunc
+		want     string
+	}{
+		{
+			allNodesProgram(),
+			replaceInt(nil),
+			"cannot replace 1 with nil, which is not an expression",
+		},
+		{
+			allNodesProgram(),
+			replaceInt(&ExpressionStatement{Expression: &Ident{Value: "s"}}),
+			"cannot replace 1 with s, which is not an expression",
+		},
+		{
+			allNodesProgram(),
+			rename,
+			`cannot replace x with "x", which is not an identifier`,
+		},
+		{
+			&ArrayLiteral{Elements: []Expression{&unknownNode{}}},
+			replaceInt(nil),
+			"cannot modify node of unknown type *ast.unknownNode",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := Modify(tt.node, tt.modifier)
+		if err == nil {
+			t.Errorf("expected an error but resulted in none")
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("wrong error. want=%q, got=%q", tt.want, err)
+		}
+	}
+}
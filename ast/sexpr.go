@@ -0,0 +1,151 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// SExpr returns a canonical representation of `node` as an s-expression, which is meant to be
+// compared with golden files in tests. Unlike String, it shows the structure of the AST, e.g.
+// `let x = 1 + 2;` becomes `(let x (infix + 1 2))`.
+//
+// Identifiers are symbols and literals are atoms: integers, floats, quoted strings, `true`,
+// `false` and `nil`. Other nodes are lists headed by their kind. Statements in programs and
+// blocks are put on separate lines, indented by two spaces for each level of nesting.
+func SExpr(node Node) string {
+	var out strings.Builder
+	writeSExpr(&out, node, 0)
+	return out.String()
+}
+
+func writeSExpr(out *strings.Builder, node Node, depth int) {
+	// Nil nodes appear in programs with parse errors
+	if node == nil {
+		out.WriteString("<nil>")
+		return
+	}
+	if v := reflect.ValueOf(node); v.Kind() == reflect.Ptr && v.IsNil() {
+		out.WriteString("<nil>")
+		return
+	}
+
+	list := func(head string, children ...Node) {
+		out.WriteString("(" + head)
+		for _, child := range children {
+			out.WriteString(" ")
+			writeSExpr(out, child, depth)
+		}
+		out.WriteString(")")
+	}
+
+	switch node := node.(type) {
+	case *Program:
+		writeStatements(out, "program", node.Statements, depth)
+	case *BlockStatement:
+		writeStatements(out, "block", node.Statements, depth)
+
+	case *LetStatement:
+		list("let", node.Name, node.Value)
+	case *AssignStatement:
+		list("assign", node.LHS, node.RHS)
+	case *IncDecStatement:
+		list(node.Token.Literal, node.Operand)
+	case *ReturnStatement:
+		list("return", node.ReturnValue)
+	case *ExpressionStatement:
+		writeSExpr(out, node.Expression, depth)
+
+	case *Ident:
+		out.WriteString(node.Value)
+	case *IntegerLiteral:
+		out.WriteString(strconv.FormatInt(node.Value, 10))
+	case *FloatLiteral:
+		// Floats always have a decimal point or an exponent to be told from integers
+		s := strconv.FormatFloat(node.Value, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eIN") {
+			s += ".0"
+		}
+		out.WriteString(s)
+	case *StringLiteral:
+		out.WriteString(strconv.Quote(node.Value))
+	case *Boolean:
+		out.WriteString(strconv.FormatBool(node.Value))
+	case *Nil:
+		out.WriteString("nil")
+
+	case *PrefixExpression:
+		list("prefix "+node.Operator, node.Right)
+	case *InfixExpression:
+		list("infix "+node.Operator, node.Left, node.Right)
+	case *IfExpression:
+		if node.Alternative == nil {
+			list("if", node.Condition, node.Consequence)
+		} else {
+			list("if", node.Condition, node.Consequence, node.Alternative)
+		}
+	case *MatchExpression:
+		out.WriteString("(match ")
+		writeSExpr(out, node.Subject, depth)
+		for _, arm := range node.Arms {
+			out.WriteString(" ")
+			list("arm", arm.Pattern, arm.Value)
+		}
+		out.WriteString(")")
+	case *FunctionLiteral:
+		head := "fn"
+		if node.Name != "" {
+			head += " " + node.Name
+		}
+		writeFunction(out, head, node.Parameters, node.Body, depth)
+	case *MacroLiteral:
+		writeFunction(out, "macro", node.Parameters, node.Body, depth)
+	case *CallExpression:
+		list("call", append([]Node{node.Function}, expressionNodes(node.Arguments)...)...)
+	case *ArrayLiteral:
+		list("array", expressionNodes(node.Elements)...)
+	case *HashLiteral:
+		out.WriteString("(hash")
+		for _, pair := range node.Pairs {
+			out.WriteString(" ")
+			list("pair", pair.Key, pair.Value)
+		}
+		out.WriteString(")")
+	case *IndexExpression:
+		list("index", node.Left, node.Index)
+	case *FieldExpression:
+		list("field", node.Left, node.Field)
+
+	default:
+		fmt.Fprintf(out, "(unknown %T)", node)
+	}
+}
+
+// writeStatements writes a list headed by `head` with `stmts` on separate lines.
+func writeStatements(out *strings.Builder, head string, stmts []Statement, depth int) {
+	out.WriteString("(" + head)
+	for _, stmt := range stmts {
+		out.WriteString("\n" + strings.Repeat("  ", depth+1))
+		writeSExpr(out, stmt, depth+1)
+	}
+	out.WriteString(")")
+}
+
+func writeFunction(out *strings.Builder, head string, params []*Ident, body Node, depth int) {
+	out.WriteString("(" + head + " (params")
+	for _, param := range params {
+		out.WriteString(" " + param.Value)
+	}
+	out.WriteString(") ")
+	writeSExpr(out, body, depth)
+	out.WriteString(")")
+}
+
+func expressionNodes(exprs []Expression) []Node {
+	nodes := make([]Node, 0, len(exprs))
+	for _, expr := range exprs {
+		nodes = append(nodes, expr)
+	}
+	return nodes
+}
@@ -66,7 +66,7 @@ func main() {
 		}
 
 		duration = time.Since(start)
-		result = machine.LastPoppedStackElem()
+		result = machine.Result()
 	} else {
 		env := object.NewEnvironment()
 		start := time.Now()
@@ -0,0 +1,165 @@
+// Package cache stores compiled bytecode on disk keyed by the hash of its source code, so that
+// running the same script again can skip parsing and compilation.
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/object"
+	"github.com/skatsuta/monkey-compiler/vm"
+)
+
+// Cache is a directory storing compiled bytecode.
+type Cache struct {
+	dir string
+}
+
+// New creates a new Cache which stores bytecode in the directory `dir`.
+func New(dir string) *Cache {
+	return &Cache{dir: dir}
+}
+
+// DefaultDir returns the default cache directory under the user's cache directory.
+func DefaultDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "monkey"), nil
+}
+
+// Key returns a cache key of source code `src`, which is a hex-encoded SHA-256 hash of the
+// source and the compiler version so that upgrading the compiler invalidates old entries.
+func Key(src []byte) string {
+	h := sha256.New()
+	io.WriteString(h, compiler.Version)
+	h.Write([]byte{0})
+	h.Write(src)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Cache) path(src []byte) string {
+	return filepath.Join(c.dir, Key(src)+".mkc")
+}
+
+// Get returns the bytecode compiled from source code `src` and the warnings about the source
+// code stored with it if they are in the cache. A missing or unreadable entry, or one whose
+// bytecode does not pass vm.Verify, e.g. because the file is corrupted, is reported as a cache
+// miss.
+func (c *Cache) Get(src []byte) (*compiler.Bytecode, []string, bool) {
+	f, err := os.Open(c.path(src))
+	if err != nil {
+		return nil, nil, false
+	}
+	defer f.Close()
+
+	bytecode, warnings, err := decode(f)
+	if err != nil {
+		return nil, nil, false
+	}
+	return bytecode, warnings, true
+}
+
+// Put stores `bytecode` compiled from source code `src` into the cache along with `warnings`
+// about the source code, so that they can be reported again when the bytecode is reused.
+func (c *Cache) Put(src []byte, bytecode *compiler.Bytecode, warnings []string) error {
+	var buf bytes.Buffer
+	if err := encode(&buf, bytecode, warnings); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that concurrent readers never see a partial entry
+	tmp, err := ioutil.TempFile(c.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path(src))
+}
+
+// entry is the serialized form of bytecode and the warnings about its source code.
+type entry struct {
+	Version      string
+	Instructions []byte
+	// Constants holds the constant pool encoded by object.Encode
+	Constants     []byte
+	MaxStackDepth int
+	Globals       map[string]int
+	Lines         code.LineTable
+	Builtins      []string
+	Warnings      []string
+}
+
+func encode(w io.Writer, bytecode *compiler.Bytecode, warnings []string) error {
+	var consts bytes.Buffer
+	if err := object.Encode(&consts, bytecode.Constants); err != nil {
+		return fmt.Errorf("cannot cache constants: %s", err)
+	}
+
+	return gob.NewEncoder(w).Encode(entry{
+		Version:       compiler.Version,
+		Instructions:  bytecode.Instructions,
+		Constants:     consts.Bytes(),
+		MaxStackDepth: bytecode.MaxStackDepth,
+		Globals:       bytecode.Globals,
+		Lines:         bytecode.Lines,
+		Builtins:      bytecode.Builtins,
+		Warnings:      warnings,
+	})
+}
+
+func decode(r io.Reader) (*compiler.Bytecode, []string, error) {
+	var e entry
+	if err := gob.NewDecoder(r).Decode(&e); err != nil {
+		return nil, nil, err
+	}
+
+	if e.Version != compiler.Version {
+		return nil, nil, fmt.Errorf("bytecode version mismatch: want=%s, got=%s",
+			compiler.Version, e.Version)
+	}
+
+	consts, err := object.Decode(bytes.NewReader(e.Constants))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bytecode := &compiler.Bytecode{
+		Instructions:  e.Instructions,
+		Constants:     consts,
+		MaxStackDepth: e.MaxStackDepth,
+		Globals:       e.Globals,
+		Lines:         e.Lines,
+		Builtins:      e.Builtins,
+	}
+	if err := bytecode.LinkBuiltins(); err != nil {
+		return nil, nil, err
+	}
+	if err := vm.Verify(bytecode); err != nil {
+		return nil, nil, err
+	}
+	return bytecode, e.Warnings, nil
+}
@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/lexer"
+	"github.com/skatsuta/monkey-compiler/parser"
+	"github.com/skatsuta/monkey-compiler/vm"
+)
+
+func TestPutAndGet(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	src := []byte(`
+	let greet = fn(name) { "Hello, " + name };
+	let pi = 3.14;
+	[greet("Monkey"), pi, 42]
+	`)
+	bytecode := compile(t, string(src))
+
+	warnings := []string{"a warning"}
+
+	c := New(dir)
+	if _, _, ok := c.Get(src); ok {
+		t.Fatalf("expected cache miss but got hit")
+	}
+
+	if err := c.Put(src, bytecode, warnings); err != nil {
+		t.Fatalf("failed to put bytecode: %s", err)
+	}
+
+	got, gotWarnings, ok := c.Get(src)
+	if !ok {
+		t.Fatalf("expected cache hit but got miss")
+	}
+	if !reflect.DeepEqual(got, bytecode) {
+		t.Errorf("wrong bytecode.\nwant=%+v\ngot=%+v", bytecode, got)
+	}
+	// Warnings are reported again when the bytecode is reused
+	if !reflect.DeepEqual(gotWarnings, warnings) {
+		t.Errorf("wrong warnings. want=%q, got=%q", warnings, gotWarnings)
+	}
+
+	machine := vm.New(got)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	want := "[Hello, Monkey, 3.14, 42]"
+	if result := machine.Result().Inspect(); result != want {
+		t.Errorf("wrong result. want=%s, got=%s", want, result)
+	}
+
+	// Different source code must not hit the cached entry
+	if _, _, ok := c.Get([]byte("1 + 2")); ok {
+		t.Errorf("expected cache miss for different source but got hit")
+	}
+}
+
+func TestGetCorruptedEntry(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	src := []byte("1 + 2")
+	c := New(dir)
+	if err := c.Put(src, compile(t, string(src)), nil); err != nil {
+		t.Fatalf("failed to put bytecode: %s", err)
+	}
+
+	path := filepath.Join(dir, Key(src)+".mkc")
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, ok := c.Get(src); ok {
+		t.Errorf("expected cache miss for corrupted entry but got hit")
+	}
+
+	// Bytecode which is decoded but malformed is rejected as well
+	malformed := &compiler.Bytecode{Instructions: code.Make(code.OpAdd)}
+	if err := c.Put(src, malformed, nil); err != nil {
+		t.Fatalf("failed to put bytecode: %s", err)
+	}
+	if _, _, ok := c.Get(src); ok {
+		t.Errorf("expected cache miss for malformed bytecode but got hit")
+	}
+}
+
+func TestGetRelinksBuiltins(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Bytecode compiled when `len` was the only built-in function
+	src := []byte(`len("abc")`)
+	bytecode := compile(t, string(src))
+	copy(bytecode.Instructions, code.Make(code.OpGetBuiltin, 0))
+	bytecode.Builtins = []string{"len"}
+
+	c := New(dir)
+	if err := c.Put(src, bytecode, nil); err != nil {
+		t.Fatalf("failed to put bytecode: %s", err)
+	}
+	got, _, ok := c.Get(src)
+	if !ok {
+		t.Fatalf("expected cache hit but got miss")
+	}
+
+	machine := vm.New(got)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if result := machine.Result().Inspect(); result != "3" {
+		t.Errorf("wrong result. want=3, got=%s", result)
+	}
+
+	// Bytecode referring to a removed built-in function is a cache miss
+	bytecode.Builtins = []string{"removed"}
+	if err := c.Put(src, bytecode, nil); err != nil {
+		t.Fatalf("failed to put bytecode: %s", err)
+	}
+	if _, _, ok := c.Get(src); ok {
+		t.Errorf("expected cache miss for unknown built-in function but got hit")
+	}
+}
+
+func TestKey(t *testing.T) {
+	a := Key([]byte("1 + 2"))
+	if len(a) != 64 {
+		t.Errorf("key is not a hex-encoded SHA-256 hash: %s", a)
+	}
+	if b := Key([]byte("1 + 2")); a != b {
+		t.Errorf("keys of the same source differ: %s and %s", a, b)
+	}
+	if b := Key([]byte("1 + 3")); a == b {
+		t.Errorf("keys of different sources are the same: %s", a)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "monkey-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func compile(t *testing.T, input string) *compiler.Bytecode {
+	program := parser.New(lexer.New(input)).ParseProgram()
+
+	c := compiler.New()
+	if err := c.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	return c.Bytecode()
+}
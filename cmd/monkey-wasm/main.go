@@ -0,0 +1,21 @@
+//go:build js && wasm
+// +build js,wasm
+
+// Command monkey-wasm is a WebAssembly module exposing the Monkey compiler and VM to JavaScript.
+// It registers a global function `runMonkey(source)` which returns the output of the program.
+//
+// Build it with:
+//
+//	GOOS=js GOARCH=wasm go build -o monkey.wasm ./cmd/monkey-wasm
+package main
+
+import (
+	"github.com/skatsuta/monkey-compiler/wasmapi"
+)
+
+func main() {
+	wasmapi.Register("runMonkey")
+
+	// Keep the Go runtime alive so that JavaScript can keep calling the registered function
+	select {}
+}
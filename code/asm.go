@@ -0,0 +1,203 @@
+package code
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The assembly format is a human-editable textual form of instructions. Each line holds one
+// instruction, an opcode name followed by its operands in decimal or hexadecimal notation:
+//
+//	OpConstant 3
+//	OpClosure 0x2 0
+//
+// Jump targets are written as labels, which are defined by a name followed by a colon on their
+// own line:
+//
+//	  OpTrue
+//	  OpJumpNotTruthy else
+//	  OpConstant 0
+//	  OpJump end
+//	else:
+//	  OpNil
+//	end:
+//	  OpPop
+//
+// Blank lines and comments starting with `#` are ignored.
+
+// jumpOps is a set of opcodes whose operand is a position in instructions.
+var jumpOps = map[Opcode]bool{
+	OpJump:          true,
+	OpJumpNotTruthy: true,
+	OpJumpTruthy:    true,
+}
+
+// lookupByName performs a lookup for an opcode by its name, e.g. "OpConstant".
+func lookupByName(name string) (Opcode, *Definition, bool) {
+	for op, def := range definitions {
+		if def.Name == name {
+			return op, def, true
+		}
+	}
+	return 0, nil, false
+}
+
+// asmLine is an instruction parsed from a line of assembly source.
+type asmLine struct {
+	num      int
+	op       Opcode
+	def      *Definition
+	operands []string
+}
+
+// Assemble assembles source code `src` written in the assembly format into instructions.
+func Assemble(src string) (Instructions, error) {
+	var lines []asmLine
+	labels := make(map[string]int)
+	pos := 0
+
+	// The first pass resolves the positions of labels
+	for i, line := range strings.Split(src, "\n") {
+		num := i + 1
+
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if strings.HasSuffix(fields[0], ":") {
+			name := strings.TrimSuffix(fields[0], ":")
+			if name == "" || len(fields) > 1 {
+				return nil, fmt.Errorf("line %d: invalid label definition %q", num, line)
+			}
+			if _, ok := labels[name]; ok {
+				return nil, fmt.Errorf("line %d: duplicate label %q", num, name)
+			}
+			labels[name] = pos
+			continue
+		}
+
+		op, def, ok := lookupByName(fields[0])
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown opcode %q", num, fields[0])
+		}
+
+		operands := fields[1:]
+		if len(operands) != len(def.OperandWidths) {
+			return nil, fmt.Errorf("line %d: %s expects %d operands, got %d",
+				num, def.Name, len(def.OperandWidths), len(operands))
+		}
+
+		lines = append(lines, asmLine{num: num, op: op, def: def, operands: operands})
+
+		pos += 1 + def.operandsWidth()
+	}
+
+	// The second pass encodes instructions
+	insns := make(Instructions, 0, pos)
+	for _, l := range lines {
+		operands := make([]int, len(l.operands))
+
+		for i, s := range l.operands {
+			if target, ok := labels[s]; ok && jumpOps[l.op] {
+				operands[i] = target
+				continue
+			}
+
+			n, err := strconv.ParseInt(s, 0, 64)
+			if err != nil {
+				if jumpOps[l.op] {
+					return nil, fmt.Errorf("line %d: undefined label %q", l.num, s)
+				}
+				return nil, fmt.Errorf("line %d: invalid operand %q", l.num, s)
+			}
+
+			if n < 0 || n > int64(MaxOperand(l.def.OperandWidths[i])) {
+				return nil, fmt.Errorf("line %d: operand %d out of range for %s",
+					l.num, n, l.def.Name)
+			}
+			operands[i] = int(n)
+		}
+
+		insns = append(insns, Make(l.op, operands...)...)
+	}
+
+	return insns, nil
+}
+
+// Disassemble converts instructions `insns` into source code in the assembly format, which
+// `Assemble` turns back into the same instructions.
+func Disassemble(insns Instructions) (string, error) {
+	type decoded struct {
+		pos      int
+		def      *Definition
+		operands []int
+	}
+
+	var decodedInsns []decoded
+	starts := make(map[int]bool)
+	targets := make(map[int]bool)
+
+	for pos := 0; pos < len(insns); {
+		def, err := Lookup(insns[pos])
+		if err != nil {
+			return "", fmt.Errorf("%04d: %s", pos, err)
+		}
+
+		if pos+1+def.operandsWidth() > len(insns) {
+			return "", fmt.Errorf("%04d: truncated instruction %s", pos, def.Name)
+		}
+
+		operands, read := ReadOperands(def, insns[pos+1:])
+		if jumpOps[Opcode(insns[pos])] {
+			targets[operands[0]] = true
+		}
+
+		decodedInsns = append(decodedInsns, decoded{pos: pos, def: def, operands: operands})
+		starts[pos] = true
+		pos += 1 + read
+	}
+	starts[len(insns)] = true
+
+	// Name labels after the order of their positions
+	positions := make([]int, 0, len(targets))
+	for pos := range targets {
+		if !starts[pos] {
+			return "", fmt.Errorf("jump target %04d is not at the start of an instruction", pos)
+		}
+		positions = append(positions, pos)
+	}
+	sort.Ints(positions)
+
+	labels := make(map[int]string, len(positions))
+	for i, pos := range positions {
+		labels[pos] = fmt.Sprintf("L%d", i)
+	}
+
+	var out strings.Builder
+	for _, d := range decodedInsns {
+		if label, ok := labels[d.pos]; ok {
+			fmt.Fprintf(&out, "%s:\n", label)
+		}
+
+		out.WriteString("  " + d.def.Name)
+		for _, o := range d.operands {
+			if label, ok := labels[o]; ok && jumpOps[Opcode(insns[d.pos])] {
+				out.WriteString(" " + label)
+			} else {
+				fmt.Fprintf(&out, " %d", o)
+			}
+		}
+		out.WriteString("\n")
+	}
+	if label, ok := labels[len(insns)]; ok {
+		fmt.Fprintf(&out, "%s:\n", label)
+	}
+
+	return out.String(), nil
+}
@@ -0,0 +1,140 @@
+package code
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAssemble(t *testing.T) {
+	src := `
+	# if (true) { 10 } else { nil }
+	  OpTrue
+	  OpJumpNotTruthy else
+	  OpConstant 0
+	  OpJump end
+	else:
+	  OpNil
+	end:
+	  OpPop
+	  OpClosure 0xFFFF 2 # hexadecimal operand
+	`
+
+	want := concat(
+		Make(OpTrue),
+		Make(OpJumpNotTruthy, 10),
+		Make(OpConstant, 0),
+		Make(OpJump, 11),
+		Make(OpNil),
+		Make(OpPop),
+		Make(OpClosure, 65535, 2),
+	)
+
+	got, err := Assemble(src)
+	if err != nil {
+		t.Fatalf("assembler error: %s", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("wrong instructions.\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"OpFoo", `line 1: unknown opcode "OpFoo"`},
+		{"OpConstant", "line 1: OpConstant expects 1 operands, got 0"},
+		{"OpPop 1", "line 1: OpPop expects 0 operands, got 1"},
+		{"OpConstant x", `line 1: invalid operand "x"`},
+		{"OpConstant 65536", "line 1: operand 65536 out of range for OpConstant"},
+		{"OpGetLocal -1", "line 1: operand -1 out of range for OpGetLocal"},
+		{"\nOpJump nowhere", `line 2: undefined label "nowhere"`},
+		{"a:\na:", `line 2: duplicate label "a"`},
+		{"a: OpPop", `line 1: invalid label definition "a: OpPop"`},
+	}
+
+	for _, tt := range tests {
+		_, err := Assemble(tt.src)
+		if err == nil {
+			t.Fatalf("expected assembler error for %q but resulted in none", tt.src)
+		}
+		if err.Error() != tt.want {
+			t.Errorf("wrong assembler error. want=%q, got=%q", tt.want, err)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	insns := concat(
+		Make(OpTrue),
+		Make(OpJumpNotTruthy, 10),
+		Make(OpConstant, 0),
+		Make(OpJump, 11),
+		Make(OpNil),
+		Make(OpClosure, 65535, 2),
+		Make(OpJumpTruthy, 0),
+		Make(OpJump, 21),
+	)
+
+	want := `L0:
+  OpTrue
+  OpJumpNotTruthy L1
+  OpConstant 0
+  OpJump L2
+L1:
+  OpNil
+L2:
+  OpClosure 65535 2
+  OpJumpTruthy L0
+  OpJump L3
+L3:
+`
+
+	got, err := Disassemble(insns)
+	if err != nil {
+		t.Fatalf("disassembler error: %s", err)
+	}
+	if got != want {
+		t.Errorf("wrong assembly.\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	// Assembling the disassembled code must produce the original instructions
+	roundTrip, err := Assemble(got)
+	if err != nil {
+		t.Fatalf("assembler error: %s", err)
+	}
+	if !bytes.Equal(roundTrip, insns) {
+		t.Errorf("round trip failed.\nwant:\n%s\ngot:\n%s", insns, roundTrip)
+	}
+}
+
+func TestDisassembleErrors(t *testing.T) {
+	tests := []struct {
+		insns Instructions
+		want  string
+	}{
+		{Instructions{255}, "0000: opcode 255 undefined"},
+		{Instructions{byte(OpPop), byte(OpConstant), 0}, "0001: truncated instruction OpConstant"},
+		{concat(Make(OpJump, 1), Make(OpPop)), "jump target 0001 is not at the start of an instruction"},
+	}
+
+	for _, tt := range tests {
+		_, err := Disassemble(tt.insns)
+		if err == nil {
+			t.Fatalf("expected disassembler error but resulted in none")
+		}
+		if err.Error() != tt.want {
+			t.Errorf("wrong disassembler error. want=%q, got=%q", tt.want, err)
+		}
+	}
+}
+
+func concat(insns ...[]byte) Instructions {
+	out := Instructions{}
+	for _, insn := range insns {
+		out = append(out, insn...)
+	}
+	return out
+}
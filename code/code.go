@@ -80,49 +80,177 @@ const (
 	OpGetFree
 	// OpCurrentClosure is an opcode to self-reference the current closure.
 	OpCurrentClosure
+	// OpGetMethod is an opcode to replace a receiver on top of the stack with its method named
+	// by a constant, followed by the receiver itself as the first argument of a method call.
+	OpGetMethod
+	// OpDup is an opcode to duplicate the topmost element on the stack.
+	OpDup
+	// OpSwap is an opcode to swap the two topmost elements on the stack.
+	OpSwap
+	// OpRot is an opcode to rotate the three topmost elements on the stack, moving the third
+	// element to the top: [a b c] becomes [b c a].
+	OpRot
+	// OpJumpTruthy is an opcode to jump if the condition is truthy.
+	OpJumpTruthy
+	// OpConcatN is an opcode to add up elements on the stack, the number of which is the operand,
+	// from the bottommost one. It concatenates strings at once.
+	OpConcatN
+	// OpSetLocalWide is a variant of OpSetLocal with a 2-byte operand for local bindings whose
+	// indices do not fit in a byte.
+	OpSetLocalWide
+	// OpGetLocalWide is a variant of OpGetLocal with a 2-byte operand.
+	OpGetLocalWide
+	// OpIn is an opcode to test whether the topmost element on the stack, which is a collection,
+	// contains the second one.
+	OpIn
+	// OpMatchArray is an opcode to test whether the topmost element on the stack is an array whose
+	// length is the operand, replacing it with the result.
+	OpMatchArray
+	// OpMatchHash is an opcode to test whether the topmost element on the stack is a hash,
+	// replacing it with the result.
+	OpMatchHash
+	// OpArrayAppend is an opcode to append elements on the stack, the number of which is the
+	// operand, to the array below them. It builds array literals with too many elements to push
+	// them on to the stack at once.
+	OpArrayAppend
+	// OpHashAppend is an opcode to add keys and values on the stack, the total number of which is
+	// the operand, to the hash below them, which must be a new one built by OpHash.
+	OpHashAppend
+
+	// numOpcodes is the number of opcodes, each of which must be defined in definitions. New
+	// opcodes are added above it.
+	numOpcodes
 )
 
 // Definition represents the definition of an opcode.
 type Definition struct {
 	Name          string
 	OperandWidths []int
+
+	// Pops is the number of elements the instruction pops off the stack, and Pushes is the
+	// number of elements it pushes on to the stack.
+	Pops   int
+	Pushes int
+	// popsFn computes the number of elements to pop from operands if it depends on them
+	popsFn func(operands []int) int
+}
+
+// operandsWidth returns the total width of the operands of the instruction in bytes. Each
+// operand is 1, 2 or 4 bytes wide and encoded in big endian.
+func (def *Definition) operandsWidth() int {
+	width := 0
+	for _, w := range def.OperandWidths {
+		width += w
+	}
+	return width
 }
 
+// StackEffect returns the number of elements the instruction pops off and pushes on to the
+// stack when executed with `operands`.
+func (def *Definition) StackEffect(operands []int) (pops, pushes int) {
+	if def.popsFn != nil {
+		return def.popsFn(operands), def.Pushes
+	}
+	return def.Pops, def.Pushes
+}
+
+// popOperand returns a function which computes the number of elements to pop as the operand at
+// index `i` plus `extra`.
+func popOperand(i, extra int) func(operands []int) int {
+	return func(operands []int) int {
+		return operands[i] + extra
+	}
+}
+
+// definitions is the authoritative table of opcodes, which the compiler, the VM, the assembler
+// and the verifier all rely on for names, operand widths and stack effects.
 var definitions = map[Opcode]*Definition{
-	OpConstant:           {Name: "OpConstant", OperandWidths: []int{2}},
-	OpPop:                {Name: "OpPop", OperandWidths: nil},
-	OpAdd:                {Name: "OpAdd", OperandWidths: nil},
-	OpSub:                {Name: "OpSub", OperandWidths: nil},
-	OpMul:                {Name: "OpMul", OperandWidths: nil},
-	OpDiv:                {Name: "OpDiv", OperandWidths: nil},
-	OpTrue:               {Name: "OpTrue", OperandWidths: nil},
-	OpFalse:              {Name: "OpFalse", OperandWidths: nil},
-	OpEqual:              {Name: "OpEqual", OperandWidths: nil},
-	OpNotEqual:           {Name: "OpNotEqual", OperandWidths: nil},
-	OpGreaterThan:        {Name: "OpGreaterThan", OperandWidths: nil},
-	OpGreaterThanOrEqual: {Name: "OpGreaterThanOrEqual", OperandWidths: nil},
-	OpAnd:                {Name: "OpAnd", OperandWidths: nil},
-	OpOr:                 {Name: "OpOr", OperandWidths: nil},
-	OpMinus:              {Name: "OpMinus", OperandWidths: nil},
-	OpBang:               {Name: "OpBang", OperandWidths: nil},
-	OpJumpNotTruthy:      {Name: "OpJumpNotTruthy", OperandWidths: []int{2}},
-	OpJump:               {Name: "OpJump", OperandWidths: []int{2}},
-	OpNil:                {Name: "OpNil", OperandWidths: nil},
-	OpSetGlobal:          {Name: "OpSetGlobal", OperandWidths: []int{2}},
-	OpGetGlobal:          {Name: "OpGetGlobal", OperandWidths: []int{2}},
-	OpArray:              {Name: "OpArray", OperandWidths: []int{2}},
-	OpHash:               {Name: "OpHash", OperandWidths: []int{2}},
-	OpSetIndex:           {Name: "OpSetIndex", OperandWidths: nil},
-	OpGetIndex:           {Name: "OpGetIndex", OperandWidths: nil},
-	OpCall:               {Name: "OpCall", OperandWidths: []int{1}},
-	OpReturnValue:        {Name: "OpReturnValue", OperandWidths: nil},
-	OpReturn:             {Name: "OpReturn", OperandWidths: nil},
-	OpSetLocal:           {Name: "OpSetLocal", OperandWidths: []int{1}},
-	OpGetLocal:           {Name: "OpGetLocal", OperandWidths: []int{1}},
-	OpGetBuiltin:         {Name: "OpGetBuiltin", OperandWidths: []int{1}},
-	OpClosure:            {Name: "OpClosure", OperandWidths: []int{2, 1}},
-	OpGetFree:            {Name: "OpGetFree", OperandWidths: []int{1}},
-	OpCurrentClosure:     {Name: "OpCurrentClosure", OperandWidths: nil},
+	OpConstant:           {Name: "OpConstant", OperandWidths: []int{2}, Pops: 0, Pushes: 1},
+	OpPop:                {Name: "OpPop", OperandWidths: nil, Pops: 1, Pushes: 0},
+	OpAdd:                {Name: "OpAdd", OperandWidths: nil, Pops: 2, Pushes: 1},
+	OpSub:                {Name: "OpSub", OperandWidths: nil, Pops: 2, Pushes: 1},
+	OpMul:                {Name: "OpMul", OperandWidths: nil, Pops: 2, Pushes: 1},
+	OpDiv:                {Name: "OpDiv", OperandWidths: nil, Pops: 2, Pushes: 1},
+	OpTrue:               {Name: "OpTrue", OperandWidths: nil, Pops: 0, Pushes: 1},
+	OpFalse:              {Name: "OpFalse", OperandWidths: nil, Pops: 0, Pushes: 1},
+	OpEqual:              {Name: "OpEqual", OperandWidths: nil, Pops: 2, Pushes: 1},
+	OpNotEqual:           {Name: "OpNotEqual", OperandWidths: nil, Pops: 2, Pushes: 1},
+	OpGreaterThan:        {Name: "OpGreaterThan", OperandWidths: nil, Pops: 2, Pushes: 1},
+	OpGreaterThanOrEqual: {Name: "OpGreaterThanOrEqual", OperandWidths: nil, Pops: 2, Pushes: 1},
+	OpAnd:                {Name: "OpAnd", OperandWidths: nil, Pops: 2, Pushes: 1},
+	OpOr:                 {Name: "OpOr", OperandWidths: nil, Pops: 2, Pushes: 1},
+	OpMinus:              {Name: "OpMinus", OperandWidths: nil, Pops: 1, Pushes: 1},
+	OpBang:               {Name: "OpBang", OperandWidths: nil, Pops: 1, Pushes: 1},
+	OpJumpNotTruthy:      {Name: "OpJumpNotTruthy", OperandWidths: []int{2}, Pops: 1, Pushes: 0},
+	OpJump:               {Name: "OpJump", OperandWidths: []int{2}, Pops: 0, Pushes: 0},
+	OpNil:                {Name: "OpNil", OperandWidths: nil, Pops: 0, Pushes: 1},
+	OpSetGlobal:          {Name: "OpSetGlobal", OperandWidths: []int{2}, Pops: 1, Pushes: 0},
+	OpGetGlobal:          {Name: "OpGetGlobal", OperandWidths: []int{2}, Pops: 0, Pushes: 1},
+	OpArray: {
+		Name: "OpArray", OperandWidths: []int{2}, Pushes: 1,
+		// Pops elements, the number of which is the operand
+		popsFn: popOperand(0, 0),
+	},
+	OpHash: {
+		Name: "OpHash", OperandWidths: []int{2}, Pushes: 1,
+		// Pops keys and values, the total number of which is the operand
+		popsFn: popOperand(0, 0),
+	},
+	OpSetIndex: {Name: "OpSetIndex", OperandWidths: nil, Pops: 3, Pushes: 0},
+	OpGetIndex: {Name: "OpGetIndex", OperandWidths: nil, Pops: 2, Pushes: 1},
+	OpCall: {
+		Name: "OpCall", OperandWidths: []int{1}, Pushes: 1,
+		// Pops the callee and arguments, the number of which is the operand
+		popsFn: popOperand(0, 1),
+	},
+	OpReturnValue: {Name: "OpReturnValue", OperandWidths: nil, Pops: 1, Pushes: 0},
+	OpReturn:      {Name: "OpReturn", OperandWidths: nil, Pops: 0, Pushes: 0},
+	OpSetLocal:    {Name: "OpSetLocal", OperandWidths: []int{1}, Pops: 1, Pushes: 0},
+	OpGetLocal:    {Name: "OpGetLocal", OperandWidths: []int{1}, Pops: 0, Pushes: 1},
+	OpGetBuiltin:  {Name: "OpGetBuiltin", OperandWidths: []int{1}, Pops: 0, Pushes: 1},
+	OpClosure: {
+		Name: "OpClosure", OperandWidths: []int{2, 1}, Pushes: 1,
+		// Pops free variables, the number of which is the second operand
+		popsFn: popOperand(1, 0),
+	},
+	OpGetFree:        {Name: "OpGetFree", OperandWidths: []int{1}, Pops: 0, Pushes: 1},
+	OpCurrentClosure: {Name: "OpCurrentClosure", OperandWidths: nil, Pops: 0, Pushes: 1},
+	OpGetMethod:      {Name: "OpGetMethod", OperandWidths: []int{2}, Pops: 1, Pushes: 2},
+	OpDup:            {Name: "OpDup", OperandWidths: nil, Pops: 1, Pushes: 2},
+	OpSwap:           {Name: "OpSwap", OperandWidths: nil, Pops: 2, Pushes: 2},
+	OpRot:            {Name: "OpRot", OperandWidths: nil, Pops: 3, Pushes: 3},
+	OpJumpTruthy:     {Name: "OpJumpTruthy", OperandWidths: []int{2}, Pops: 1, Pushes: 0},
+	OpConcatN: {
+		Name: "OpConcatN", OperandWidths: []int{1}, Pushes: 1,
+		// Pops operands, the number of which is the operand
+		popsFn: popOperand(0, 0),
+	},
+	OpSetLocalWide: {Name: "OpSetLocalWide", OperandWidths: []int{2}, Pops: 1, Pushes: 0},
+	OpGetLocalWide: {Name: "OpGetLocalWide", OperandWidths: []int{2}, Pops: 0, Pushes: 1},
+	OpIn:           {Name: "OpIn", OperandWidths: nil, Pops: 2, Pushes: 1},
+	OpMatchArray:   {Name: "OpMatchArray", OperandWidths: []int{2}, Pops: 1, Pushes: 1},
+	OpMatchHash:    {Name: "OpMatchHash", OperandWidths: nil, Pops: 1, Pushes: 1},
+	OpArrayAppend: {
+		Name: "OpArrayAppend", OperandWidths: []int{2}, Pushes: 1,
+		// Pops the array and elements, the number of which is the operand
+		popsFn: popOperand(0, 1),
+	},
+	OpHashAppend: {
+		Name: "OpHashAppend", OperandWidths: []int{2}, Pushes: 1,
+		// Pops the hash and keys and values, the total number of which is the operand
+		popsFn: popOperand(0, 1),
+	},
+}
+
+// Definitions returns a copy of the definitions of all opcodes.
+func Definitions() map[Opcode]Definition {
+	defs := make(map[Opcode]Definition, len(definitions))
+	for op, def := range definitions {
+		d := *def
+		d.OperandWidths = append([]int(nil), def.OperandWidths...)
+		defs[op] = d
+	}
+	return defs
 }
 
 // Lookup performs a lookup for `op` in the definitions of opcodes.
@@ -138,14 +266,26 @@ func Lookup(op byte) (*Definition, error) {
 type Instructions []byte
 
 func (insns Instructions) String() string {
+	return insns.Format(0, len(insns))
+}
+
+// Format formats the instructions from position `start` up to `end` like String, with their
+// positions in `insns`. `start` must be the position of an instruction.
+func (insns Instructions) Format(start, end int) string {
 	var out strings.Builder
 
-	i := 0
-	for i < len(insns) {
+	i := start
+	for i < end {
+		// The rest of malformed instructions cannot be decoded once an instruction is not
+		// defined
 		def, err := Lookup(insns[i])
 		if err != nil {
-			fmt.Fprintf(&out, "ERROR: %s\n", err)
-			continue
+			fmt.Fprintf(&out, "%04d ERROR: %s\n", i, err)
+			break
+		}
+		if i+1+def.operandsWidth() > len(insns) {
+			fmt.Fprintf(&out, "%04d ERROR: truncated instruction %s\n", i, def.Name)
+			break
 		}
 
 		operands, read := ReadOperands(def, insns[i+1:])
@@ -165,16 +305,12 @@ func (insns Instructions) formatInstruction(def *Definition, operands []int) str
 			len(operands), operandCount)
 	}
 
-	switch operandCount {
-	case 0:
-		return def.Name
-	case 1:
-		return fmt.Sprintf("%s 0x%X", def.Name, operands[0])
-	case 2:
-		return fmt.Sprintf("%s 0x%X 0x%X", def.Name, operands[0], operands[1])
+	var out strings.Builder
+	out.WriteString(def.Name)
+	for _, o := range operands {
+		fmt.Fprintf(&out, " 0x%X", o)
 	}
-
-	return fmt.Sprintf("ERROR: unhandled operand width for %s: %d", def.Name, operandCount)
+	return out.String()
 }
 
 // Make makes a bytecode instruction sequence from an opcode and operands.
@@ -184,12 +320,7 @@ func Make(op Opcode, operands ...int) []byte {
 		return nil
 	}
 
-	insnLen := 1
-	for _, w := range def.OperandWidths {
-		insnLen += w
-	}
-
-	insn := make([]byte, insnLen)
+	insn := make([]byte, 1+def.operandsWidth())
 	insn[0] = byte(op)
 	offset := 1
 
@@ -200,6 +331,8 @@ func Make(op Opcode, operands ...int) []byte {
 			insn[offset] = byte(o)
 		case 2: // 2 byte-width operand
 			binary.BigEndian.PutUint16(insn[offset:], uint16(o))
+		case 4: // 4 byte-width operand
+			binary.BigEndian.PutUint32(insn[offset:], uint32(o))
 		}
 		offset += width
 	}
@@ -218,6 +351,8 @@ func ReadOperands(def *Definition, insns Instructions) (operands []int, offset i
 			operands[i] = int(ReadUint8(insns[offset:]))
 		case 2: // 2 byte-width operand
 			operands[i] = int(ReadUint16(insns[offset:]))
+		case 4: // 4 byte-width operand
+			operands[i] = int(ReadUint32(insns[offset:]))
 		}
 
 		offset += width
@@ -226,6 +361,44 @@ func ReadOperands(def *Definition, insns Instructions) (operands []int, offset i
 	return operands, offset
 }
 
+// MaxOperand returns the largest value an operand `width` bytes wide can hold.
+func MaxOperand(width int) int {
+	return 1<<(8*uint(width)) - 1
+}
+
+// CheckRoundTrip makes an instruction of `op` with `operands` and reads it back, and reports an
+// error unless it has the expected length and the same operands, e.g. because an operand does
+// not fit in its width and gets truncated. It is meant for tests of opcodes.
+func CheckRoundTrip(op Opcode, operands ...int) error {
+	def, ok := definitions[op]
+	if !ok {
+		return fmt.Errorf("opcode %d undefined", op)
+	}
+	if len(operands) != len(def.OperandWidths) {
+		return fmt.Errorf("%s takes %d operands, got %d", def.Name, len(def.OperandWidths),
+			len(operands))
+	}
+
+	insn := Make(op, operands...)
+	if want := 1 + def.operandsWidth(); len(insn) != want {
+		return fmt.Errorf("%s is made into %d bytes, want %d", def.Name, len(insn), want)
+	}
+	if Opcode(insn[0]) != op {
+		return fmt.Errorf("%s is made with opcode %d", def.Name, insn[0])
+	}
+
+	got, n := ReadOperands(def, insn[1:])
+	if n != len(insn)-1 {
+		return fmt.Errorf("%s: %d bytes of operands read, want %d", def.Name, n, len(insn)-1)
+	}
+	for i, o := range operands {
+		if got[i] != o {
+			return fmt.Errorf("%s: operand %d is read as %d, want %d", def.Name, i, got[i], o)
+		}
+	}
+	return nil
+}
+
 // ReadUint8 reads a single uint8 value from bytecode instruction sequence.
 func ReadUint8(insns Instructions) uint8 {
 	return uint8(insns[0])
@@ -235,3 +408,8 @@ func ReadUint8(insns Instructions) uint8 {
 func ReadUint16(insns Instructions) uint16 {
 	return binary.BigEndian.Uint16(insns)
 }
+
+// ReadUint32 reads a single uint32 value from bytecode instruction sequence.
+func ReadUint32(insns Instructions) uint32 {
+	return binary.BigEndian.Uint32(insns)
+}
@@ -2,7 +2,10 @@ package code
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/quick"
 )
 
 func TestInstructionsString(t *testing.T) {
@@ -33,6 +36,28 @@ func TestInstructionsString(t *testing.T) {
 	}
 }
 
+func TestMalformedInstructionsString(t *testing.T) {
+	tests := []struct {
+		insns Instructions
+		want  string
+	}{
+		{
+			Instructions{byte(OpNil), 255, byte(OpNil)},
+			"0000 OpNil\n0001 ERROR: opcode 255 undefined\n",
+		},
+		{
+			Instructions{byte(OpNil), byte(OpClosure), 0, 1},
+			"0000 OpNil\n0001 ERROR: truncated instruction OpClosure\n",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.insns.String(); got != tt.want {
+			t.Errorf("instructions wrongly formatted.\nwant:\n%s\ngot:\n%s", tt.want, got)
+		}
+	}
+}
+
 func TestMake(t *testing.T) {
 	tests := []struct {
 		op       Opcode
@@ -59,6 +84,11 @@ func TestMake(t *testing.T) {
 			operands: []int{65534, 255},
 			want:     []byte{byte(OpClosure), 255, 254, 255},
 		},
+		{
+			op:       OpRot,
+			operands: nil,
+			want:     []byte{byte(OpRot)},
+		},
 	}
 
 	for _, tt := range tests {
@@ -86,6 +116,19 @@ func TestReadOperands(t *testing.T) {
 		{op: OpClosure, operands: []int{0xFFFF, 0xFF}, bytesRead: 3},
 	}
 
+	// No opcode has a 4-byte operand yet
+	def := &Definition{Name: "OpWide", OperandWidths: []int{4, 1, 2}}
+	insns := Instructions{0x12, 0x34, 0x56, 0x78, 0xFF, 0xAB, 0xCD}
+	operands, n := ReadOperands(def, insns)
+	if want := []int{0x12345678, 0xFF, 0xABCD}; n != 7 || !reflect.DeepEqual(operands, want) {
+		t.Errorf("wrong operands of 4-byte width. want=%v (7 bytes), got=%v (%d bytes)",
+			want, operands, n)
+	}
+	got, want := insns.formatInstruction(def, operands), "OpWide 0x12345678 0xFF 0xABCD"
+	if got != want {
+		t.Errorf("wrong format. want=%q, got=%q", want, got)
+	}
+
 	for _, tt := range tests {
 		b := byte(tt.op)
 		def, err := Lookup(b)
@@ -106,3 +149,181 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestOperandRoundTrip(t *testing.T) {
+	for op, def := range definitions {
+		widths := def.OperandWidths
+		// Each operand takes the values at the boundaries of its width, while the others are
+		// either the smallest or the largest
+		for i, width := range widths {
+			max := MaxOperand(width)
+			for _, v := range []int{0, 1, max - 1, max} {
+				for _, others := range []bool{false, true} {
+					operands := make([]int, len(widths))
+					for j, w := range widths {
+						if others {
+							operands[j] = MaxOperand(w)
+						}
+					}
+					operands[i] = v
+
+					if err := CheckRoundTrip(op, operands...); err != nil {
+						t.Errorf("operands %v: %s", operands, err)
+					}
+				}
+			}
+
+			operands := make([]int, len(widths))
+			operands[i] = max + 1
+			if err := CheckRoundTrip(op, operands...); err == nil {
+				t.Errorf("operand %d of %s is not reported to be truncated", i, def.Name)
+			}
+		}
+
+		if len(widths) == 0 {
+			if err := CheckRoundTrip(op); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestOperandRoundTripRandom(t *testing.T) {
+	for op, def := range definitions {
+		if len(def.OperandWidths) == 0 {
+			continue
+		}
+
+		op, def := op, def
+		f := func(values []uint32) bool {
+			operands := make([]int, len(def.OperandWidths))
+			for i, w := range def.OperandWidths {
+				if i < len(values) {
+					operands[i] = int(values[i]) & MaxOperand(w)
+				}
+			}
+			if err := CheckRoundTrip(op, operands...); err != nil {
+				t.Logf("operands %v: %s", operands, err)
+				return false
+			}
+			return true
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Errorf("%s: %s", def.Name, err)
+		}
+	}
+}
+
+func TestStackEffect(t *testing.T) {
+	tests := []struct {
+		op         Opcode
+		operands   []int
+		wantPops   int
+		wantPushes int
+	}{
+		{OpConstant, []int{0}, 0, 1},
+		{OpAdd, nil, 2, 1},
+		{OpSetIndex, nil, 3, 0},
+		{OpArray, []int{3}, 3, 1},
+		{OpHash, []int{4}, 4, 1},
+		{OpCall, []int{2}, 3, 1},
+		{OpClosure, []int{0, 2}, 2, 1},
+		{OpRot, nil, 3, 3},
+		{OpConcatN, []int{4}, 4, 1},
+	}
+
+	for _, tt := range tests {
+		def, err := Lookup(byte(tt.op))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pops, pushes := def.StackEffect(tt.operands)
+		if pops != tt.wantPops || pushes != tt.wantPushes {
+			t.Errorf("wrong stack effect of %s. want=(%d, %d), got=(%d, %d)",
+				def.Name, tt.wantPops, tt.wantPushes, pops, pushes)
+		}
+	}
+}
+
+func TestEveryOpcodeDefined(t *testing.T) {
+	if len(definitions) != int(numOpcodes) {
+		t.Errorf("wrong number of definitions. want=%d, got=%d", numOpcodes, len(definitions))
+	}
+
+	names := make(map[string]Opcode)
+	for op := Opcode(0); op < numOpcodes; op++ {
+		def, err := Lookup(byte(op))
+		if err != nil {
+			t.Errorf("opcode %d is not defined", op)
+			continue
+		}
+		if !strings.HasPrefix(def.Name, "Op") {
+			t.Errorf("name of opcode %d does not start with Op: %q", op, def.Name)
+		}
+		if other, ok := names[def.Name]; ok {
+			t.Errorf("opcodes %d and %d have the same name %q", other, op, def.Name)
+		}
+		names[def.Name] = op
+
+		if found, _, ok := lookupByName(def.Name); !ok || found != op {
+			t.Errorf("opcode %d is not found by its name %q", op, def.Name)
+		}
+		insn := Make(op, make([]int, len(def.OperandWidths))...)
+		if got := len(insn); got != 1+def.operandsWidth() {
+			t.Errorf("wrong length of %s instruction. want=%d, got=%d",
+				def.Name, 1+def.operandsWidth(), got)
+		}
+	}
+}
+
+func TestDefinitions(t *testing.T) {
+	defs := Definitions()
+
+	def, ok := defs[OpConstant]
+	if !ok {
+		t.Fatalf("OpConstant is not defined")
+	}
+	if def.Name != "OpConstant" {
+		t.Errorf("wrong name. want=%q, got=%q", "OpConstant", def.Name)
+	}
+
+	// Modifying the returned definitions must not affect the original ones
+	def.Pushes = 2
+	defs[OpConstant] = def
+	delete(defs, OpPop)
+
+	if orig, _ := Lookup(byte(OpConstant)); orig.Pushes != 1 {
+		t.Errorf("original definition modified. want=%d, got=%d", 1, orig.Pushes)
+	}
+	if _, err := Lookup(byte(OpPop)); err != nil {
+		t.Errorf("original definition deleted: %s", err)
+	}
+}
+
+func TestLineTable(t *testing.T) {
+	var lt LineTable
+	lt = lt.Add(0, 1)
+	lt = lt.Add(3, 1)
+	lt = lt.Add(5, 2)
+	// Nothing is emitted for line 3 before line 4
+	lt = lt.Add(8, 3)
+	lt = lt.Add(8, 4)
+	lt = lt.Add(10, 4)
+
+	want := LineTable{{Pos: 0, Line: 1}, {Pos: 5, Line: 2}, {Pos: 8, Line: 4}}
+	if !reflect.DeepEqual(lt, want) {
+		t.Fatalf("wrong line table. want=%v, got=%v", want, lt)
+	}
+
+	for pos, line := range []int{1, 1, 1, 1, 1, 2, 2, 2, 4, 4, 4, 4} {
+		if got := lt.Line(pos); got != line {
+			t.Errorf("wrong line of position %d. want=%d, got=%d", pos, line, got)
+		}
+	}
+
+	lt = lt.Truncate(5)
+	if want := (LineTable{{Pos: 0, Line: 1}}); !reflect.DeepEqual(lt, want) {
+		t.Errorf("wrong truncated line table. want=%v, got=%v", want, lt)
+	}
+}
@@ -0,0 +1,49 @@
+package code
+
+// LineEntry tells that the instructions from position `Pos` were compiled from line `Line` of the
+// source code.
+type LineEntry struct {
+	Pos  int
+	Line int
+}
+
+// LineTable maps positions of instructions to the lines of the source code they were compiled
+// from. Its entries are sorted by their positions, and each of them covers the instructions up to
+// the position of the next one. Line 0 means that the line is unknown.
+type LineTable []LineEntry
+
+// Line returns the line the instruction at position `pos` was compiled from, or 0 if it is
+// unknown.
+func (lt LineTable) Line(pos int) int {
+	line := 0
+	for _, e := range lt {
+		if e.Pos > pos {
+			break
+		}
+		line = e.Line
+	}
+	return line
+}
+
+// Add returns `lt` with an entry which tells that the instructions from `pos` are compiled from
+// `line`. `pos` must not be less than the positions of the entries in `lt`. An entry with the same
+// position is replaced, and no entry is added if the instructions before `pos` are from `line`
+// as well.
+func (lt LineTable) Add(pos, line int) LineTable {
+	if n := len(lt); n > 0 && lt[n-1].Pos == pos {
+		lt = lt[:n-1]
+	}
+	if n := len(lt); n > 0 && lt[n-1].Line == line {
+		return lt
+	}
+	return append(lt, LineEntry{Pos: pos, Line: line})
+}
+
+// Truncate returns `lt` without entries for instructions at `end` and beyond, e.g. after the
+// instructions are cut off at `end`.
+func (lt LineTable) Truncate(end int) LineTable {
+	for len(lt) > 0 && lt[len(lt)-1].Pos >= end {
+		lt = lt[:len(lt)-1]
+	}
+	return lt
+}
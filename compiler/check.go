@@ -0,0 +1,448 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/skatsuta/monkey-compiler/ast"
+	"github.com/skatsuta/monkey-compiler/lexer"
+	"github.com/skatsuta/monkey-compiler/object"
+	"github.com/skatsuta/monkey-compiler/parser"
+)
+
+// Warning is a diagnostic about an expression which is certain to fail at runtime if it is
+// evaluated, or which is likely to be a mistake.
+type Warning struct {
+	// Node is the expression the warning is about
+	Node    ast.Node
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Message, w.Node.String())
+}
+
+// Check looks for operations in `node` which are certain to fail at runtime because the types
+// of their operands are known from literals, e.g. `"a" - 1`, `-true` or `1[0]`, and returns
+// warnings about them in the order they appear. They are not compilation errors, as the
+// operations may never be evaluated, e.g. in a branch which is not taken.
+//
+// It also warns about code which is likely to be a mistake: expression statements other than
+// the last one of a block whose values are unused and which have no effects, e.g. `x + 1;`,
+// statements following a return statement in the same block, which are never run, empty blocks
+// of if expressions, and conditions of if expressions which are constant, e.g. because they
+// refer to a binding which is only ever bound to a literal by a prior let statement.
+func Check(node ast.Node) []Warning {
+	unused := findUnusedValues(node)
+	unreachable := findUnreachableCode(node)
+	constNames := findConstantBindings(node)
+	consts := make(map[string]object.Object)
+
+	var warnings []Warning
+	warn := func(n ast.Node, msg string) {
+		warnings = append(warnings, Warning{Node: n, Message: msg})
+	}
+
+	ast.Inspect(node, func(n ast.Node) bool {
+		if stmt, ok := n.(ast.Statement); ok && unreachable[stmt] {
+			warn(stmt, "unreachable code")
+		}
+
+		switch n := n.(type) {
+		case *ast.LetStatement:
+			// Conditions after the let statement refer to the constant
+			if constNames[n] {
+				consts[n.Name.Value], _ = constantValue(n.Value, nil)
+			}
+
+		case *ast.ExpressionStatement:
+			if unused[n] {
+				warn(n.Expression, "value is never used")
+			}
+
+		case *ast.IfExpression:
+			if msg := checkCondition(n.Condition, consts); msg != "" {
+				warn(n.Condition, msg)
+			}
+			if len(n.Consequence.Statements) == 0 {
+				warn(n.Condition, "empty block in if expression")
+			}
+			if n.Alternative != nil && len(n.Alternative.Statements) == 0 {
+				warn(n.Condition, "empty else block in if expression")
+			}
+		}
+
+		if msg := checkExpression(n); msg != "" {
+			warn(n, msg)
+		}
+		return true
+	})
+	return warnings
+}
+
+// findUnusedValues returns the expression statements in `node` whose values are unused because
+// they are not the last statement of a block or a program, and which have no effects.
+func findUnusedValues(node ast.Node) map[*ast.ExpressionStatement]bool {
+	unused := make(map[*ast.ExpressionStatement]bool)
+	check := func(stmts []ast.Statement) {
+		for i := 0; i < len(stmts)-1; i++ {
+			if es, ok := stmts[i].(*ast.ExpressionStatement); ok && hasNoEffect(es.Expression) {
+				unused[es] = true
+			}
+		}
+	}
+
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Program:
+			check(n.Statements)
+		case *ast.BlockStatement:
+			check(n.Statements)
+		}
+		return true
+	})
+	return unused
+}
+
+// findUnreachableCode returns the first statements following a return statement in each block
+// or program in `node`, which are never run.
+func findUnreachableCode(node ast.Node) map[ast.Statement]bool {
+	unreachable := make(map[ast.Statement]bool)
+	check := func(stmts []ast.Statement) {
+		for i := 0; i < len(stmts)-1; i++ {
+			if _, ok := stmts[i].(*ast.ReturnStatement); ok {
+				unreachable[stmts[i+1]] = true
+				return
+			}
+		}
+	}
+
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Program:
+			check(n.Statements)
+		case *ast.BlockStatement:
+			check(n.Statements)
+		}
+		return true
+	})
+	return unreachable
+}
+
+// CheckComments looks for comments in source code `src` which are likely to be code commented
+// out, i.e. whose text parses as Monkey statements, e.g. `# let x = f(1);`, and returns warnings
+// about them in the order they appear. The node of each warning is the program parsed from the
+// comment.
+func CheckComments(src string) []Warning {
+	var warnings []Warning
+	for _, c := range lexer.Comments(src) {
+		p := parser.New(lexer.New(c.Text))
+		program := p.ParseProgram()
+		if len(p.Errors()) == 0 && isCode(program) {
+			warnings = append(warnings, Warning{
+				Node:    program,
+				Message: fmt.Sprintf("commented-out code on line %d", c.Line),
+			})
+		}
+	}
+	return warnings
+}
+
+// isCode reports whether a program parsed from a comment is likely to be code rather than prose.
+// A sentence parses as a sequence of bare identifiers and literals, so every statement must be
+// more than that.
+func isCode(program *ast.Program) bool {
+	if len(program.Statements) == 0 {
+		return false
+	}
+	for _, stmt := range program.Statements {
+		es, ok := stmt.(*ast.ExpressionStatement)
+		if !ok {
+			continue
+		}
+		switch es.Expression.(type) {
+		case *ast.Ident, *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral, *ast.Boolean,
+			*ast.Nil:
+			return false
+		}
+	}
+	return true
+}
+
+// hasNoEffect reports whether evaluating `expr` is certain to have no effects other than
+// producing its value, i.e. it neither calls functions nor fails.
+func hasNoEffect(expr ast.Expression) bool {
+	switch expr := expr.(type) {
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral, *ast.Boolean, *ast.Nil,
+		*ast.Ident, *ast.FunctionLiteral:
+		return true
+
+	case *ast.PrefixExpression:
+		if !hasNoEffect(expr.Right) {
+			return false
+		}
+		return expr.Operator == "!" || isNumeric(staticType(expr.Right))
+
+	case *ast.InfixExpression:
+		if !hasNoEffect(expr.Left) || !hasNoEffect(expr.Right) {
+			return false
+		}
+		// Operators on hash maps may call functions overloading them
+		left, right := staticType(expr.Left), staticType(expr.Right)
+		if left == "" || right == "" || left == object.HashType || right == object.HashType {
+			return false
+		}
+		_, ok := infixType(expr.Operator, left, right)
+		return ok
+
+	case *ast.ArrayLiteral:
+		for _, el := range expr.Elements {
+			if !hasNoEffect(el) {
+				return false
+			}
+		}
+		return true
+
+	default:
+		return false
+	}
+}
+
+// findConstantBindings returns the let statements in `node` which bind a name to a constant
+// scalar value computed from literals, e.g. `-1`, so that the name refers to the value wherever
+// it is visible after them. Such a let statement must be run whenever its scope is, i.e. not in
+// a block of an if expression, and the name must not be bound anywhere else, including by
+// parameters and patterns.
+func findConstantBindings(node ast.Node) map[*ast.LetStatement]bool {
+	bindings := countBindings(node)
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FunctionLiteral:
+			for _, p := range n.Parameters {
+				bindings[p.Value]++
+			}
+		case *ast.MacroLiteral:
+			for _, p := range n.Parameters {
+				bindings[p.Value]++
+			}
+		}
+		return true
+	})
+
+	lets := make(map[*ast.LetStatement]bool)
+	add := func(stmts []ast.Statement) {
+		for _, stmt := range stmts {
+			ls, ok := stmt.(*ast.LetStatement)
+			if !ok || ls.Name == nil || bindings[ls.Name.Value] != 1 {
+				continue
+			}
+			if _, ok := constantValue(ls.Value, nil); ok {
+				lets[ls] = true
+			}
+		}
+	}
+
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Program:
+			add(n.Statements)
+		case *ast.FunctionLiteral:
+			if n.Body != nil {
+				add(n.Body.Statements)
+			}
+		}
+		return true
+	})
+	return lets
+}
+
+// checkCondition returns a message describing why a condition `cond` of an if expression is
+// constant, or an empty string if it is not known without running the program. `consts` maps
+// names of constant bindings to their values. A literal `true` or `false` is not reported, as
+// it is usually written on purpose.
+func checkCondition(cond ast.Expression, consts map[string]object.Object) string {
+	if _, ok := cond.(*ast.Boolean); ok {
+		return ""
+	}
+	v, ok := constantValue(cond, consts)
+	if !ok {
+		return ""
+	}
+
+	switch v := v.(type) {
+	case *object.Boolean:
+		return fmt.Sprintf("condition is always %t", v.Value)
+	case *object.Nil:
+		return "condition is always false"
+	default:
+		return "condition is always true"
+	}
+}
+
+// constantValue returns the value of `expr` if it consists of literals, names of constant
+// bindings in `consts` and operators on them which are certain to succeed.
+func constantValue(expr ast.Expression, consts map[string]object.Object) (object.Object, bool) {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		v, ok := consts[expr.Value]
+		return v, ok
+
+	case *ast.PrefixExpression:
+		right, ok := constantValue(expr.Right, consts)
+		if !ok {
+			return nil, false
+		}
+		return evalConstPrefix(expr.Operator, right)
+
+	case *ast.InfixExpression:
+		left, ok := constantValue(expr.Left, consts)
+		if !ok {
+			return nil, false
+		}
+		right, ok := constantValue(expr.Right, consts)
+		if !ok {
+			return nil, false
+		}
+		return evalConstInfix(expr.Operator, left, right)
+
+	default:
+		return literalValue(expr)
+	}
+}
+
+// checkExpression returns a message describing why `node` is certain to fail, or an empty
+// string if it may succeed.
+func checkExpression(node ast.Node) string {
+	switch node := node.(type) {
+	case *ast.PrefixExpression:
+		typ := staticType(node.Right)
+		if node.Operator == "-" && typ != "" && !isNumeric(typ) {
+			return fmt.Sprintf("unsupported type for negation: %s", typ)
+		}
+
+	case *ast.InfixExpression:
+		left, right := staticType(node.Left), staticType(node.Right)
+		if left == "" || right == "" {
+			return ""
+		}
+		if _, ok := infixType(node.Operator, left, right); !ok {
+			return fmt.Sprintf("unsupported types for %s: %s and %s", node.Operator, left, right)
+		}
+
+	case *ast.IndexExpression:
+		left, idx := staticType(node.Left), staticType(node.Index)
+		switch left {
+		case "":
+		case object.ArrayType, object.StringType:
+			if idx != "" && idx != object.IntegerType {
+				return fmt.Sprintf("index of %s must be Integer, got %s", left, idx)
+			}
+		case object.HashType:
+			if idx != "" && !isHashable(idx) {
+				return fmt.Sprintf("unusable as hash key: %s", idx)
+			}
+		default:
+			return fmt.Sprintf("index operator not supported: %s", left)
+		}
+
+	case *ast.CallExpression:
+		if typ := staticType(node.Function); typ != "" && typ != object.ClosureType {
+			return fmt.Sprintf("calling non-function: %s", typ)
+		}
+	}
+
+	return ""
+}
+
+// staticType returns the type `expr` is certain to evaluate to, or an empty string if it is
+// not known without running the program.
+func staticType(expr ast.Expression) object.Type {
+	switch expr := expr.(type) {
+	case *ast.IntegerLiteral:
+		return object.IntegerType
+	case *ast.FloatLiteral:
+		return object.FloatType
+	case *ast.StringLiteral:
+		return object.StringType
+	case *ast.Boolean:
+		return object.BooleanType
+	case *ast.Nil:
+		return object.NilType
+	case *ast.ArrayLiteral:
+		return object.ArrayType
+	case *ast.HashLiteral:
+		return object.HashType
+	case *ast.FunctionLiteral:
+		return object.ClosureType
+
+	case *ast.PrefixExpression:
+		typ := staticType(expr.Right)
+		switch {
+		case expr.Operator == "!":
+			return object.BooleanType
+		case expr.Operator == "-" && isNumeric(typ):
+			return typ
+		}
+
+	case *ast.InfixExpression:
+		left, right := staticType(expr.Left), staticType(expr.Right)
+		if left == "" || right == "" {
+			return ""
+		}
+		if typ, ok := infixType(expr.Operator, left, right); ok {
+			return typ
+		}
+	}
+
+	return ""
+}
+
+// infixType returns the type of the result of an infix operation on operands of types `left`
+// and `right`, which may be empty if it is not known, and reports whether the operation can
+// succeed.
+func infixType(op string, left, right object.Type) (object.Type, bool) {
+	switch op {
+	case "+", "-", "*", "/":
+		switch {
+		case isNumeric(left) && isNumeric(right):
+			if op == "/" || left == object.FloatType || right == object.FloatType {
+				return object.FloatType, true
+			}
+			// The result may be promoted to BigInt on overflow, which supports the same
+			// operations as Integer
+			return object.IntegerType, true
+		case op == "+" && left == object.StringType && right == object.StringType:
+			return object.StringType, true
+		}
+		return "", false
+
+	case "<", ">", "<=", ">=":
+		return object.BooleanType, isNumeric(left) && isNumeric(right)
+
+	case "==", "!=":
+		return object.BooleanType, true
+
+	case "in", "not in":
+		ok := right == object.ArrayType ||
+			(right == object.HashType && isHashable(left)) ||
+			(right == object.StringType && left == object.StringType)
+		return object.BooleanType, ok
+
+	default:
+		// Logical operators evaluate to one of the operands
+		return "", true
+	}
+}
+
+func isNumeric(typ object.Type) bool {
+	return typ == object.IntegerType || typ == object.FloatType
+}
+
+// isHashable reports whether values of a known type `typ` can be hash keys.
+func isHashable(typ object.Type) bool {
+	switch typ {
+	case object.ArrayType, object.HashType, object.ClosureType:
+		return false
+	default:
+		return true
+	}
+}
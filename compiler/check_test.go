@@ -0,0 +1,126 @@
+package compiler
+
+import "testing"
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{`[1 + 2 * 3, "a" + "b", 1.5 / 2, -1, -2.5, !true, 1 < 2.5, [1] == [1]]`, nil},
+		{`x - 1; f(1); a[0]; -x; {}[x]; if (x) { 1 } else { "a" } + 1`, nil},
+		{`[true && 1, [1, 2][0], "abc"[1], {"a": 1}["a"], {}[1.5], fn(x) { x }(1)]`, nil},
+		{`"a" - 1`, []string{"unsupported types for -: String and Integer: (a - 1)"}},
+		{`"a" * "b"`, []string{"unsupported types for *: String and String: (a * b)"}},
+		{`1 + true`, []string{"unsupported types for +: Integer and Boolean: (1 + true)"}},
+		{`[1] + [2]`, []string{"unsupported types for +: Array and Array: ([1] + [2])"}},
+		{`1 < "a"`, []string{"unsupported types for <: Integer and String: (1 < a)"}},
+		{`nil > nil`, []string{"unsupported types for >: Nil and Nil: (nil > nil)"}},
+		{`"a" < "b"`, []string{"unsupported types for <: String and String: (a < b)"}},
+		{`"a" >= "b"`, []string{"unsupported types for >=: String and String: (a >= b)"}},
+		{`-true`, []string{"unsupported type for negation: Boolean: (-true)"}},
+		{`-"a"`, []string{"unsupported type for negation: String: (-a)"}},
+		{`1[0]`, []string{"index operator not supported: Integer: (1[0])"}},
+		{`[1]["a"]`, []string{"index of Array must be Integer, got String: ([1][a])"}},
+		{`{}[[]]`, []string{"unusable as hash key: Array: ({}[[]])"}},
+		{`"a"(1)`, []string{"calling non-function: String: a(1)"}},
+		{`[1 in [1], [] in [{}], "a" not in "ab", x in y]`, nil},
+		{`1 in 2`, []string{"unsupported types for in: Integer and Integer: (1 in 2)"}},
+		{`1 not in "a"`, []string{"unsupported types for not in: Integer and String: (1 not in a)"}},
+		// Types are inferred through operations on literals
+		{`(1 + 2) * "a"`, []string{"unsupported types for *: Integer and String: ((1 + 2) * a)"}},
+		{`(1 / 2)[0]`, []string{"index operator not supported: Float: ((1 / 2)[0])"}},
+		{`(!x)()`, []string{"calling non-function: Boolean: (!x)()"}},
+		// Warnings are reported in nested expressions in the order they appear
+		{`let f = fn() { -[1] + 1; 2 - "b" }`, []string{
+			"unsupported type for negation: Array: (-[1])",
+			"unsupported types for -: Integer and String: (2 - b)",
+		}},
+		// Values which are never used
+		{`1; x; "a" + "b"; -1; [x, !x]; let g = fn() { x + 1; 2 }; 3`, []string{
+			"value is never used: 1",
+			"value is never used: x",
+			"value is never used: (a + b)",
+			"value is never used: (-1)",
+			"value is never used: [x, (!x)]",
+		}},
+		{`f(1); x = 1; x + 1; -x; x[0]; {}; if (x) { 1 }; 2`, nil},
+		{`"a" - 1; 2`, []string{
+			"unsupported types for -: String and Integer: (a - 1)",
+		}},
+		// Empty blocks
+		{`if (x) { }; if (x) { 1 } else { }`, []string{
+			"empty block in if expression: x",
+			"empty else block in if expression: x",
+		}},
+		// Constant conditions
+		{`let d = false; if (d) { 1 }; if (!d) { 2 }; if (d == true) { 3 }`, []string{
+			"condition is always false: d",
+			"condition is always true: (!d)",
+			"condition is always false: (d == true)",
+		}},
+		{`let n = -1; let s = "a"; let z = nil; if (n < 0) { 1 }; if (s) { 2 }; if (z) { 3 }`,
+			[]string{
+				"condition is always true: (n < 0)",
+				"condition is always true: s",
+				"condition is always false: z",
+			}},
+		{`let f = fn() { let d = true; fn() { if (d) { 1 } } }`, []string{
+			"condition is always true: d",
+		}},
+		{`if (true) { 1 }; if (1 > 2) { 2 }`, []string{"condition is always false: (1 > 2)"}},
+		// Conditions which may not be constant
+		{`if (d) { 1 }; let d = true`, nil},
+		{`let d = true; d = false; if (d) { 1 }`, nil},
+		{`let d = true; let f = fn(d) { if (d) { 1 } }`, nil},
+		{`let d = true; match x { [d] => if (d) { 1 } }`, nil},
+		{`if (x) { let d = true }; if (d) { 1 }`, nil},
+		{`let d = x; if (d) { 1 }`, nil},
+		// Unreachable code
+		{`let f = fn(x) { return x; puts(x); x }; return 1; let y = 2`, []string{
+			"unreachable code: puts(x)",
+			"unreachable code: let y = 2;",
+		}},
+		{`let f = fn(x) { if (x) { return 1 }; 2 }; return f(1)`, nil},
+	}
+
+	for _, tt := range tests {
+		warnings := Check(parse(tt.input))
+
+		if len(warnings) != len(tt.want) {
+			t.Errorf("wrong number of warnings for %q. want=%q, got=%q", tt.input, tt.want, warnings)
+			continue
+		}
+		for i, w := range warnings {
+			if got := w.String(); got != tt.want[i] {
+				t.Errorf("wrong warning for %q. want=%q, got=%q", tt.input, tt.want[i], got)
+			}
+		}
+	}
+}
+
+func TestCheckComments(t *testing.T) {
+	input := `# let x = f(1);
+# Define ` + "`unless`" + ` macro which does the opposite to ` + "`if`" + `
+# x + 1 is the answer
+#puts("debug")
+let y = "# not a comment"; # return y
+# TODO fix this
+#`
+
+	want := []string{
+		"commented-out code on line 1: let x = f(1);",
+		"commented-out code on line 4: puts(debug)",
+		"commented-out code on line 5: return y;",
+	}
+
+	warnings := CheckComments(input)
+	if len(warnings) != len(want) {
+		t.Fatalf("wrong number of warnings. want=%q, got=%q", want, warnings)
+	}
+	for i, w := range warnings {
+		if got := w.String(); got != want[i] {
+			t.Errorf("wrong warning. want=%q, got=%q", want[i], got)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package compiler
+
+import (
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+// MaxConstants is the maximum number of constants a constant pool can hold, which is limited by
+// the 2-byte operands of OpConstant, OpClosure and OpGetMethod.
+const MaxConstants = 1 << 16
+
+// CompactConstants returns a constant pool with only the constants of `consts` which compiled
+// functions in it refer to, along with the functions themselves, and rewrites the instructions of
+// the functions to refer to the constants at their new indexes.
+//
+// It is meant for a REPL, which compiles each input with the constant pool of the previous ones:
+// once the main program of an input has run, the constants only it referred to are never used
+// again, but they would otherwise stay in the pool for the rest of the session. Every function
+// is kept regardless of whether it is still reachable, as closures can be hidden from the host,
+// e.g. by the `partial` built-in function.
+func CompactConstants(consts []object.Object) []object.Object {
+	keep := make([]bool, len(consts))
+	numKept := 0
+	for i, c := range consts {
+		if fn, ok := c.(*object.CompiledFunction); ok && fn.Constants == nil {
+			keep[i] = true
+			forEachConstantOperand(fn.Instructions, func(_ int, operands []int) {
+				if operands[0] < len(keep) {
+					keep[operands[0]] = true
+				}
+			})
+		}
+	}
+	for _, k := range keep {
+		if k {
+			numKept++
+		}
+	}
+	if numKept == len(consts) {
+		return consts
+	}
+
+	newIdx := make([]int, len(consts))
+	compacted := make([]object.Object, 0, numKept)
+	for i, c := range consts {
+		if keep[i] {
+			newIdx[i] = len(compacted)
+			compacted = append(compacted, c)
+		}
+	}
+
+	for _, c := range compacted {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok || fn.Constants != nil {
+			continue
+		}
+		// Closures of the function may be running elsewhere, so the instructions are replaced
+		// rather than changed in place
+		insns := make(code.Instructions, len(fn.Instructions))
+		copy(insns, fn.Instructions)
+		forEachConstantOperand(insns, func(pos int, operands []int) {
+			if operands[0] < len(newIdx) {
+				operands[0] = newIdx[operands[0]]
+				copy(insns[pos:], code.Make(code.Opcode(insns[pos]), operands...))
+			}
+		})
+		fn.Instructions = insns
+	}
+	return compacted
+}
+
+// forEachConstantOperand calls `f` with the position and the operands of each instruction in
+// `insns` whose first operand is an index into the constant pool.
+func forEachConstantOperand(insns code.Instructions, f func(pos int, operands []int)) {
+	forEachInstruction(insns, func(pos int, op code.Opcode, operands []int) {
+		switch op {
+		case code.OpConstant, code.OpClosure, code.OpGetMethod:
+			f(pos, operands)
+		}
+	})
+}
+
+// forEachInstruction calls `f` with the position, the opcode and the operands of each
+// instruction in `insns`. It stops at an undefined opcode.
+func forEachInstruction(insns code.Instructions, f func(pos int, op code.Opcode, operands []int)) {
+	for pos := 0; pos < len(insns); {
+		def, err := code.Lookup(insns[pos])
+		if err != nil {
+			return
+		}
+		operands, read := code.ReadOperands(def, insns[pos+1:])
+
+		f(pos, code.Opcode(insns[pos]), operands)
+		pos += 1 + read
+	}
+}
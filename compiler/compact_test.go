@@ -0,0 +1,79 @@
+package compiler
+
+import (
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+func TestCompactConstants(t *testing.T) {
+	fnF := []code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpAdd),
+		code.Make(code.OpReturnValue),
+	}
+	fnG := []code.Instructions{
+		code.Make(code.OpConstant, 3),
+		code.Make(code.OpReturnValue),
+	}
+
+	// Inputs are compiled one by one as in a REPL, compacting the constant pool after each
+	tests := []struct {
+		input      string
+		wantConsts []interface{}
+	}{
+		{
+			input:      `1; let f = fn() { "a" + 2 }; "b"`,
+			wantConsts: []interface{}{"a", 2, fnF},
+		},
+		{
+			input:      `4; let g = fn() { "c" }`,
+			wantConsts: []interface{}{"a", 2, fnF, "c", fnG},
+		},
+		{
+			// Functions are kept even if they are no longer bound
+			input: `5; let g = fn() { fn() { 6 } }`,
+			wantConsts: []interface{}{
+				"a", 2, fnF, "c", fnG, 6,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 5),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpClosure, 6, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+		},
+	}
+
+	symTbl := NewSymbolTable()
+	var consts []object.Object
+	for _, tt := range tests {
+		cmplr := NewWithState(symTbl, consts)
+		if err := cmplr.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		consts = CompactConstants(cmplr.Bytecode().Constants)
+		if err := testConstants(tt.wantConsts, consts); err != nil {
+			t.Errorf("%s: testConstants failed: %s", tt.input, err)
+		}
+	}
+}
+
+func TestTooManyConstants(t *testing.T) {
+	consts := make([]object.Object, MaxConstants)
+	for i := range consts {
+		consts[i] = &object.Integer{Value: int64(i)}
+	}
+
+	cmplr := NewWithState(NewSymbolTable(), consts)
+	err := cmplr.Compile(parse(`"a"`))
+	want := "too many constants: 65537 exceeds the limit of 65536"
+	if err == nil || err.Error() != want {
+		t.Errorf("wrong error. want=%q, got=%v", want, err)
+	}
+}
@@ -1,14 +1,35 @@
 package compiler
 
 import (
+	"errors"
 	"fmt"
-	"sort"
+	"math"
+	"reflect"
 
 	"github.com/skatsuta/monkey-compiler/ast"
 	"github.com/skatsuta/monkey-compiler/code"
 	"github.com/skatsuta/monkey-compiler/object"
 )
 
+// MaxGlobals is the maximum number of global bindings a program can define, which is limited by
+// the 2-byte operand of OpSetGlobal and OpGetGlobal.
+const MaxGlobals = 1 << 16
+
+// MaxLocals is the maximum number of local bindings a function can define, which is limited by
+// the 2-byte operand of OpSetLocalWide and OpGetLocalWide.
+const MaxLocals = 1 << 16
+
+// maxNarrowLocals is the number of local bindings OpSetLocal and OpGetLocal can address with
+// their 1-byte operand.
+const maxNarrowLocals = 1 << 8
+
+// Version identifies the bytecode the compiler generates. It must be changed whenever the same
+// source code may compile to different bytecode, e.g. when the code generation or opcodes
+// change, so that cached bytecode gets invalidated. Built-in functions are linked by name when
+// cached bytecode or a saved REPL session is loaded, so adding or reordering them does not need
+// a new version.
+const Version = "32"
+
 // EmittedInstruction represents an instruction emitted at a position.
 type EmittedInstruction struct {
 	Opcode   code.Opcode
@@ -19,21 +40,109 @@ type EmittedInstruction struct {
 type CompilationScope struct {
 	insns              code.Instructions
 	lastInsn, prevInsn EmittedInstruction
+	// lines maps the instructions to the lines of the source code they are compiled from
+	lines code.LineTable
 }
 
 // Compiler is a bytecode compiler.
 type Compiler struct {
 	// consts is a slice that serves as a constant pool.
 	consts []object.Object
+	// strings maps the values of string constants to their indexes in the constant pool, so
+	// that identical string literals share a single constant
+	strings map[string]int
+	// numbers does the same for integer and float constants
+	numbers map[numberKey]int
 
 	symTbl *SymbolTable
 
 	scopes   []CompilationScope
 	scopeIdx int
+
+	// maxStackDepth is the maximum stack depth of the main program
+	maxStackDepth int
+
+	optLevel int
+	// inlineLets is the set of let statements of the program binding functions to inline, and
+	// inlineFns maps global bindings defined by them to the functions
+	inlineLets map[*ast.LetStatement]bool
+	inlineFns  map[int]*ast.FunctionLiteral
+	// inlineParams maps parameters of a function being inlined to bindings of its arguments
+	inlineParams map[string]Symbol
+	// foldLets is the set of let statements of the program binding functions whose calls may be
+	// evaluated at compile time, and foldFns maps global bindings defined by them to the functions
+	foldLets map[*ast.LetStatement]bool
+	foldFns  map[int]*ast.FunctionLiteral
+	// bindings counts bindings of each name in the program
+	bindings map[string]int
+
+	// keepLast makes the main program leave the value of its last expression statement on the
+	// stack instead of popping it
+	keepLast bool
+
+	// matchDepth is the number of match expressions enclosing the expression being compiled
+	matchDepth int
+
+	// line is the line of the statement being compiled, which emitted instructions are
+	// attributed to
+	line int
+
+	// logger logs the progress of compilation if it is not nil
+	logger Logger
+}
+
+// UndefinedVariableError is returned by Compile when the program refers to a variable `Name`
+// which is not defined.
+type UndefinedVariableError struct {
+	Name string
+}
+
+func (e *UndefinedVariableError) Error() string {
+	return fmt.Sprintf("undefined variable %q", e.Name)
+}
+
+// Logger logs messages at debug level with alternating keys and values, e.g. "index", 1. It is
+// satisfied by *slog.Logger.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+}
+
+// Option is a functional option to configure a Compiler.
+type Option func(*Compiler)
+
+// WithOptimizationLevel sets the optimization level of the compiler. Level 0, the default,
+// disables optimizations. Level 1 and above inline calls to small functions bound by top-level
+// let statements. Level 2 and above also evaluate calls of pure functions with constant arguments
+// at compile time.
+//
+// Both assume that the whole program is compiled by a single call to Compile, so they must not
+// be enabled for a compiler which compiles a program incrementally, e.g. in a REPL, where later
+// input may rebind the functions.
+func WithOptimizationLevel(level int) Option {
+	return func(c *Compiler) {
+		c.optLevel = level
+	}
+}
+
+// WithKeepLastValue makes the compiler omit the OpPop of the last expression statement of the
+// main program, so that its value stays on top of the stack when the program finishes and can
+// be read with VM.ReturnValue, e.g. to print the value of an input in a REPL.
+func WithKeepLastValue() Option {
+	return func(c *Compiler) {
+		c.keepLast = true
+	}
+}
+
+// WithLogger makes the compiler log entering and leaving function scopes and adding constants
+// to `logger`, e.g. to diagnose compilation of scripts in production.
+func WithLogger(logger Logger) Option {
+	return func(c *Compiler) {
+		c.logger = logger
+	}
 }
 
 // New creates a new Compiler.
-func New() *Compiler {
+func New(opts ...Option) *Compiler {
 	symTbl := NewSymbolTable()
 
 	// Define built-in functions
@@ -41,32 +150,79 @@ func New() *Compiler {
 		symTbl.DefineBuiltin(i, builtin.Name)
 	}
 
-	return NewWithState(symTbl, make([]object.Object, 0))
+	return NewWithState(symTbl, make([]object.Object, 0), opts...)
 }
 
 // NewWithState creates a new Compiler with a given symbol table and constant pool.
-func NewWithState(symTbl *SymbolTable, consts []object.Object) *Compiler {
+func NewWithState(symTbl *SymbolTable, consts []object.Object, opts ...Option) *Compiler {
 	mainScope := CompilationScope{
 		insns: make(code.Instructions, 0),
 	}
 
-	return &Compiler{
+	c := &Compiler{
 		consts: consts,
 		symTbl: symTbl,
 		scopes: []CompilationScope{mainScope},
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 // Compile compiles an AST node to a bytecode.
 func (c *Compiler) Compile(node ast.Node) error {
+	// A program with parse errors can contain nil nodes
+	if isNilNode(node) {
+		return errors.New("cannot compile a missing node; the program may have parse errors")
+	}
+
+	if stmt, ok := node.(ast.Statement); ok {
+		if line := statementLine(stmt); line > 0 {
+			outer := c.line
+			c.line = line
+			defer func() { c.line = outer }()
+		}
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
+		if c.optLevel >= 1 {
+			c.bindings = countBindings(node)
+			c.inlineLets = findInlinableFunctions(node, c.bindings)
+			c.inlineFns = make(map[int]*ast.FunctionLiteral)
+		}
+		if c.optLevel >= 2 {
+			c.foldLets = findFoldableFunctions(node, c.bindings)
+			c.foldFns = make(map[int]*ast.FunctionLiteral)
+		}
+
 		for _, s := range node.Statements {
 			if err := c.Compile(s); err != nil {
 				return err
 			}
 		}
 
+		if len(c.consts) > MaxConstants {
+			return fmt.Errorf("too many constants: %d exceeds the limit of %d", len(c.consts),
+				MaxConstants)
+		}
+		if c.scopeIdx != 0 {
+			return fmt.Errorf("unbalanced scopes: %d function scopes left at the end of the "+
+				"program", c.scopeIdx)
+		}
+
+		// Only an expression statement ends with OpPop
+		if c.keepLast && c.lastInstructionIs(code.OpPop) {
+			c.removeLastInstruction()
+		}
+
+		depth, err := MaxStackDepth(c.currentInsns())
+		if err != nil {
+			return fmt.Errorf("stack analysis of main program failed: %s", err)
+		}
+		c.maxStackDepth = depth
+
 	case *ast.BlockStatement:
 		for _, stmt := range node.Statements {
 			if err := c.Compile(stmt); err != nil {
@@ -92,10 +248,15 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 		// Define an identifier as a symbol in a proper scope
-		if sym.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, sym.Index)
-		} else {
-			c.emit(code.OpSetLocal, sym.Index)
+		if err := c.storeSymbol(sym); err != nil {
+			return err
+		}
+
+		if c.inlineLets[node] && sym.Scope == GlobalScope {
+			c.inlineFns[sym.Index] = node.Value.(*ast.FunctionLiteral)
+		}
+		if c.foldLets[node] && sym.Scope == GlobalScope {
+			c.foldFns[sym.Index] = node.Value.(*ast.FunctionLiteral)
 		}
 
 	case *ast.AssignStatement:
@@ -120,7 +281,28 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 
 			c.emit(code.OpSetIndex)
+
+		case *ast.FieldExpression:
+			if err := c.Compile(lhs.Left); err != nil {
+				return err
+			}
+			c.emitFieldName(lhs.Field)
+
+			if err := c.Compile(node.RHS); err != nil {
+				return err
+			}
+
+			c.emit(code.OpSetIndex)
+
+		default:
+			return fmt.Errorf("cannot assign to %s", node.LHS)
+		}
+
+	case *ast.IncDecStatement:
+		if ident, ok := node.Operand.(*ast.Ident); ok {
+			return c.compileIncDec(node, ident)
 		}
+		return c.Compile(node.Assignment())
 
 	case *ast.ReturnStatement:
 		if err := c.Compile(node.ReturnValue); err != nil {
@@ -131,7 +313,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 	case *ast.PrefixExpression:
 		if err := c.Compile(node.Right); err != nil {
-			return nil
+			return err
 		}
 
 		switch node.Operator {
@@ -165,6 +347,16 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return nil
 		}
 
+		if opr == "&&" || opr == "||" {
+			return c.compileLogicalExpression(node)
+		}
+
+		if opr == "+" {
+			if operands := concatOperands(node); operands != nil {
+				return c.compileConcatenation(operands)
+			}
+		}
+
 		if err := c.Compile(node.Left); err != nil {
 			return err
 		}
@@ -190,10 +382,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpEqual)
 		case "!=":
 			c.emit(code.OpNotEqual)
-		case "&&":
-			c.emit(code.OpAnd)
-		case "||":
-			c.emit(code.OpOr)
+		case "in":
+			c.emit(code.OpIn)
+		case "not in":
+			c.emit(code.OpIn)
+			c.emit(code.OpBang)
 		default:
 			return fmt.Errorf("unknown operator: %s", opr)
 		}
@@ -209,6 +402,14 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpGetIndex)
 
+	case *ast.FieldExpression:
+		if err := c.Compile(node.Left); err != nil {
+			return err
+		}
+
+		c.emitFieldName(node.Field)
+		c.emit(code.OpGetIndex)
+
 	case *ast.IfExpression:
 		if err := c.Compile(node.Condition); err != nil {
 			return err
@@ -221,15 +422,15 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastInstruction()
-		}
+		c.keepLastValue()
 
 		// Emit an `OpJump` with a bogus value
 		jumpPos := c.emit(code.OpJump, 9999)
 
 		afterConsequencePos := len(c.currentInsns())
-		c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
+		if err := c.changeOperand(jumpNotTruthyPos, afterConsequencePos); err != nil {
+			return err
+		}
 
 		if node.Alternative == nil {
 			c.emit(code.OpNil)
@@ -238,15 +439,31 @@ func (c *Compiler) Compile(node ast.Node) error {
 				return err
 			}
 
-			if c.lastInstructionIs(code.OpPop) {
-				c.removeLastInstruction()
-			}
+			c.keepLastValue()
 		}
 
 		afterAlternativePos := len(c.currentInsns())
-		c.changeOperand(jumpPos, afterAlternativePos)
+		if err := c.changeOperand(jumpPos, afterAlternativePos); err != nil {
+			return err
+		}
+
+	case *ast.MatchExpression:
+		return c.compileMatchExpression(node)
 
 	case *ast.CallExpression:
+		// A method call `obj.method(args)` passes the receiver `obj` as an implicit first argument
+		if fe, ok := node.Function.(*ast.FieldExpression); ok {
+			return c.compileMethodCall(fe, node.Arguments)
+		}
+
+		if c.foldCall(node) {
+			return nil
+		}
+
+		if fn := c.inlineFunction(node); fn != nil {
+			return c.compileInlineCall(fn, node.Arguments)
+		}
+
 		if err := c.Compile(node.Function); err != nil {
 			return err
 		}
@@ -260,9 +477,14 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpCall, len(node.Arguments))
 
 	case *ast.Ident:
+		if sym, ok := c.inlineParams[node.Value]; ok {
+			c.loadSymbol(sym)
+			return nil
+		}
+
 		sym, ok := c.symTbl.Resolve(node.Value)
 		if !ok {
-			return fmt.Errorf("undefined variable %q", node.Value)
+			return &UndefinedVariableError{Name: node.Value}
 		}
 
 		c.loadSymbol(sym)
@@ -278,46 +500,19 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpNil)
 
 	case *ast.IntegerLiteral:
-		i := &object.Integer{Value: node.Value}
-		c.emit(code.OpConstant, c.addConstant(i))
+		c.emit(code.OpConstant, c.addNumber(&object.Integer{Value: node.Value}))
 
 	case *ast.FloatLiteral:
-		f := &object.Float{Value: node.Value}
-		c.emit(code.OpConstant, c.addConstant(f))
+		c.emit(code.OpConstant, c.addNumber(&object.Float{Value: node.Value}))
 
 	case *ast.StringLiteral:
-		s := &object.String{Value: node.Value}
-		c.emit(code.OpConstant, c.addConstant(s))
+		c.emit(code.OpConstant, c.addString(node.Value))
 
 	case *ast.ArrayLiteral:
-		for _, el := range node.Elements {
-			if err := c.Compile(el); err != nil {
-				return err
-			}
-		}
-
-		c.emit(code.OpArray, len(node.Elements))
+		return c.compileArrayLiteral(node)
 
 	case *ast.HashLiteral:
-		l := len(node.Pairs)
-		keys := make([]ast.Expression, 0, l)
-		for k := range node.Pairs {
-			keys = append(keys, k)
-		}
-		sort.Slice(keys, func(i, j int) bool {
-			return keys[i].String() < keys[j].String()
-		})
-
-		for _, k := range keys {
-			if err := c.Compile(k); err != nil {
-				return err
-			}
-			if err := c.Compile(node.Pairs[k]); err != nil {
-				return err
-			}
-		}
-
-		c.emit(code.OpHash, l*2)
+		return c.compileHashLiteral(node)
 
 	case *ast.FunctionLiteral:
 		c.enterScope()
@@ -331,6 +526,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 		if err := c.Compile(node.Body); err != nil {
+			// Leave the scope anyway, so that the compiler stays usable. It fails only if the
+			// scopes are inconsistent, which is reported along with the error.
+			if _, lerr := c.leaveScope(); lerr != nil {
+				return fmt.Errorf("%w (leaving the scope failed: %s)", err, lerr)
+			}
 			return err
 		}
 
@@ -345,8 +545,17 @@ func (c *Compiler) Compile(node ast.Node) error {
 		// in the current scope from the symbol table *before* leaving the scope
 		freeSymbols := c.symTbl.freeSymbols
 		numLocals := c.symTbl.numDefs
+		lines := c.currentScope().lines
+
+		insns, err := c.leaveScope()
+		if err != nil {
+			return err
+		}
 
-		insns := c.leaveScope()
+		maxDepth, err := MaxStackDepth(insns)
+		if err != nil {
+			return fmt.Errorf("stack analysis of function %s failed: %s", node, err)
+		}
 
 		// Iterate through and load free symbols *after* we left the scope
 		for _, s := range freeSymbols {
@@ -354,22 +563,127 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 		compiledFn := &object.CompiledFunction{
+			Name:          node.Name,
 			Instructions:  insns,
 			NumLocals:     numLocals,
 			NumParameters: len(node.Parameters),
+			MaxStackDepth: maxDepth,
+			Lines:         lines,
 		}
 		fnIdx := c.addConstant(compiledFn)
 		c.emit(code.OpClosure, fnIdx, len(freeSymbols))
+
+	case *ast.MacroLiteral:
+		return errors.New("macro literals must be expanded before compilation")
+
+	default:
+		return fmt.Errorf("cannot compile %T", node)
 	}
 
 	return nil
 }
 
+// statementLine returns the line of the source code `stmt` starts at, or 0 if it is unknown.
+func statementLine(stmt ast.Statement) int {
+	switch stmt := stmt.(type) {
+	case *ast.LetStatement:
+		return stmt.Token.Line
+	case *ast.AssignStatement:
+		return stmt.Token.Line
+	case *ast.IncDecStatement:
+		return stmt.Token.Line
+	case *ast.ReturnStatement:
+		return stmt.Token.Line
+	case *ast.ExpressionStatement:
+		return stmt.Token.Line
+	default:
+		return 0
+	}
+}
+
+// isNilNode reports whether `node` is nil or a nil pointer to an AST node.
+func isNilNode(node ast.Node) bool {
+	if node == nil {
+		return true
+	}
+	v := reflect.ValueOf(node)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
 // addConstant adds a constant object to the compiler's constant pool and returns an identifier
 // for the constant.
 func (c *Compiler) addConstant(obj object.Object) (id int) {
 	c.consts = append(c.consts, obj)
-	return len(c.consts) - 1
+	id = len(c.consts) - 1
+	if c.logger != nil {
+		c.logger.Debug("add constant", "index", id, "type", obj.Type())
+	}
+	return id
+}
+
+// addString adds a string constant of value `s` to the constant pool unless it already has one,
+// and returns its index. The constant has its hash key computed in advance, as string literals
+// are often used as hash keys.
+func (c *Compiler) addString(s string) (id int) {
+	if c.strings == nil {
+		c.strings = make(map[string]int)
+		// The constant pool given to NewWithState may already have strings
+		for i := len(c.consts) - 1; i >= 0; i-- {
+			if str, ok := c.consts[i].(*object.String); ok {
+				c.strings[str.Value] = i
+			}
+		}
+	}
+
+	if id, ok := c.strings[s]; ok {
+		return id
+	}
+	id = c.addConstant(object.NewHashedString(s))
+	c.strings[s] = id
+	return id
+}
+
+// numberKey identifies an integer or float constant by its type and the bits of its value. Unlike
+// hash keys, it tells `1` from `1.0` and `0.0` from `-0.0`.
+type numberKey struct {
+	typ  object.Type
+	bits uint64
+}
+
+// addNumber adds an integer or float constant `num` to the constant pool unless it already has
+// an identical one, and returns its index, so that generated data with many repeated numbers
+// fits in the constant pool.
+func (c *Compiler) addNumber(num object.Object) (id int) {
+	keyOf := func(obj object.Object) (numberKey, bool) {
+		switch obj := obj.(type) {
+		case *object.Integer:
+			return numberKey{typ: obj.Type(), bits: uint64(obj.Value)}, true
+		case *object.Float:
+			return numberKey{typ: obj.Type(), bits: math.Float64bits(obj.Value)}, true
+		}
+		return numberKey{}, false
+	}
+
+	if c.numbers == nil {
+		c.numbers = make(map[numberKey]int)
+		// The constant pool given to NewWithState may already have numbers
+		for i := len(c.consts) - 1; i >= 0; i-- {
+			if key, ok := keyOf(c.consts[i]); ok {
+				c.numbers[key] = i
+			}
+		}
+	}
+
+	key, ok := keyOf(num)
+	if !ok {
+		return c.addConstant(num)
+	}
+	if id, ok := c.numbers[key]; ok {
+		return id
+	}
+	id = c.addConstant(num)
+	c.numbers[key] = id
+	return id
 }
 
 // emit generates a bytecode corresponding to `op` and `operands`, adds it to the compiler's
@@ -383,6 +697,12 @@ func (c *Compiler) emit(op code.Opcode, operands ...int) (pos int) {
 	return pos
 }
 
+// emitFieldName emits an instruction to push the name of a `field` in dot notation as a string
+// constant, which is used as a hash key.
+func (c *Compiler) emitFieldName(field *ast.Ident) {
+	c.emit(code.OpConstant, c.addString(field.Value))
+}
+
 func (c *Compiler) currentScope() CompilationScope {
 	return c.scopes[c.scopeIdx]
 }
@@ -395,6 +715,7 @@ func (c *Compiler) addInstruction(insn []byte) (pos int) {
 	insns := c.currentInsns()
 	pos = len(insns)
 	c.scopes[c.scopeIdx].insns = append(insns, insn...)
+	c.scopes[c.scopeIdx].lines = c.scopes[c.scopeIdx].lines.Add(pos, c.line)
 	return pos
 }
 
@@ -411,6 +732,7 @@ func (c *Compiler) lastInstructionIs(op code.Opcode) bool {
 func (c *Compiler) removeLastInstruction() {
 	scope := c.currentScope()
 	c.scopes[c.scopeIdx].insns = scope.insns[:scope.lastInsn.Position]
+	c.scopes[c.scopeIdx].lines = scope.lines.Truncate(scope.lastInsn.Position)
 	c.scopes[c.scopeIdx].lastInsn = scope.prevInsn
 }
 
@@ -421,9 +743,35 @@ func (c *Compiler) replaceInstruction(pos int, newInsn []byte) {
 	copy(insns[pos:pos+len(newInsn)], newInsn)
 }
 
-func (c *Compiler) changeOperand(opPos, operand int) {
+// changeOperand changes the operand of the instruction at `opPos`, which is a jump, to `operand`.
+// It reports an error if the operand does not fit in the instruction, i.e. the instructions are
+// too long to jump across.
+func (c *Compiler) changeOperand(opPos, operand int) error {
 	op := code.Opcode(c.currentInsns()[opPos])
+	def, err := code.Lookup(byte(op))
+	if err != nil {
+		return err
+	}
+	if max := code.MaxOperand(def.OperandWidths[0]); operand > max {
+		return fmt.Errorf("too many instructions: jump target %d exceeds the limit of %d",
+			operand, max)
+	}
+
 	c.replaceInstruction(opPos, code.Make(op, operand))
+	return nil
+}
+
+// keepLastValue makes a block just compiled leave its value on the stack, which is the value of
+// its last expression statement, or nil if the block is empty or ends with another statement.
+func (c *Compiler) keepLastValue() {
+	switch {
+	case c.lastInstructionIs(code.OpPop):
+		c.removeLastInstruction()
+	case c.lastInstructionIs(code.OpReturnValue):
+		// Control never reaches the end of the block
+	default:
+		c.emit(code.OpNil)
+	}
 }
 
 func (c *Compiler) replaceLastInsnWithReturn() {
@@ -441,9 +789,24 @@ func (c *Compiler) enterScope() {
 
 	// Create a new nested symbol table
 	c.symTbl = NewEnclosedSymbolTable(c.symTbl)
+
+	if c.logger != nil {
+		c.logger.Debug("enter scope", "depth", c.scopeIdx)
+	}
 }
 
-func (c *Compiler) leaveScope() code.Instructions {
+// leaveScope leaves the function scope entered last by enterScope, and returns the instructions
+// compiled in it. It reports an error if no function scope has been entered or the scopes are
+// inconsistent, which means a bug in the compiler.
+func (c *Compiler) leaveScope() (code.Instructions, error) {
+	if c.scopeIdx == 0 {
+		return nil, errors.New("cannot leave the scope of the main program")
+	}
+	if len(c.scopes) != c.scopeIdx+1 || !c.symTbl.hasOuter() {
+		return nil, fmt.Errorf("inconsistent scopes: %d scopes at depth %d", len(c.scopes),
+			c.scopeIdx)
+	}
+
 	insns := c.currentInsns()
 	c.scopes = c.scopes[:len(c.scopes)-1]
 	c.scopeIdx--
@@ -451,7 +814,16 @@ func (c *Compiler) leaveScope() code.Instructions {
 	// Restore the outer symbol table
 	c.symTbl = c.symTbl.outer
 
-	return insns
+	if c.logger != nil {
+		c.logger.Debug("leave scope", "depth", c.scopeIdx+1, "instructions", len(insns))
+	}
+	return insns, nil
+}
+
+// ScopeDepth returns the number of function scopes enclosing the code being compiled, which is
+// 0 at the top level of the program.
+func (c *Compiler) ScopeDepth() int {
+	return c.scopeIdx
 }
 
 func (c *Compiler) loadSymbol(s Symbol) {
@@ -459,7 +831,11 @@ func (c *Compiler) loadSymbol(s Symbol) {
 	case GlobalScope:
 		c.emit(code.OpGetGlobal, s.Index)
 	case LocalScope:
-		c.emit(code.OpGetLocal, s.Index)
+		if s.Index >= maxNarrowLocals {
+			c.emit(code.OpGetLocalWide, s.Index)
+		} else {
+			c.emit(code.OpGetLocal, s.Index)
+		}
 	case BuiltinScope:
 		c.emit(code.OpGetBuiltin, s.Index)
 	case FreeScope:
@@ -483,20 +859,269 @@ func (c *Compiler) compileVariableAssignment(lhs *ast.Ident, rhs ast.Expression)
 	}
 
 	// Define an identifier as a symbol in a proper scope
-	if sym.Scope == GlobalScope {
-		c.emit(code.OpSetGlobal, sym.Index)
+	return c.storeSymbol(sym)
+}
+
+// compileIncDec compiles an increment or decrement statement `ids` of a variable `ident`. Unlike
+// an assignment, it updates the variable the name refers to rather than defining one in the
+// current scope, so the variable must be defined in advance, and it must be a global variable or
+// a local variable of the current function since free variables are captured by value.
+func (c *Compiler) compileIncDec(ids *ast.IncDecStatement, ident *ast.Ident) error {
+	sym, ok := c.symTbl.Resolve(ident.Value)
+	if !ok {
+		return &UndefinedVariableError{Name: ident.Value}
+	}
+	if sym.Scope != GlobalScope && sym.Scope != LocalScope {
+		return fmt.Errorf("cannot update %q with %s: it is not a global or local variable",
+			ident.Value, ids.Token.Literal)
+	}
+
+	// Compile the right-hand side expression of the equivalent assignment
+	if err := c.Compile(ids.Assignment().RHS); err != nil {
+		return err
+	}
+	return c.storeSymbol(sym)
+}
+
+// storeSymbol emits an instruction to store the value on top of the stack into the binding of
+// a global or local symbol `s`.
+func (c *Compiler) storeSymbol(s Symbol) error {
+	if s.Scope == GlobalScope {
+		if s.Index >= MaxGlobals {
+			return fmt.Errorf("too many global bindings: %q exceeds the limit of %d",
+				s.Name, MaxGlobals)
+		}
+
+		c.emit(code.OpSetGlobal, s.Index)
+		return nil
+	}
+
+	switch {
+	case s.Index >= MaxLocals:
+		return fmt.Errorf("too many local bindings: %q exceeds the limit of %d", s.Name, MaxLocals)
+	case s.Index >= maxNarrowLocals:
+		c.emit(code.OpSetLocalWide, s.Index)
+	default:
+		c.emit(code.OpSetLocal, s.Index)
+	}
+	return nil
+}
+
+// compileLogicalExpression compiles a logical AND (&&) or OR (||) expression `ie` so that the
+// right-hand side is evaluated only if the left-hand side does not decide the result.
+func (c *Compiler) compileLogicalExpression(ie *ast.InfixExpression) error {
+	if err := c.Compile(ie.Left); err != nil {
+		return err
+	}
+
+	// Keep the left-hand side value as the result if we skip the right-hand side
+	c.dup()
+
+	// Emit a jump with a bogus value
+	var jumpPos int
+	if ie.Operator == "&&" {
+		jumpPos = c.emit(code.OpJumpNotTruthy, 9999)
 	} else {
-		c.emit(code.OpSetLocal, sym.Index)
+		jumpPos = c.emit(code.OpJumpTruthy, 9999)
+	}
+
+	c.emit(code.OpPop)
+
+	if err := c.Compile(ie.Right); err != nil {
+		return err
+	}
+
+	return c.changeOperand(jumpPos, len(c.currentInsns()))
+}
+
+// maxConcatOperands is the maximum number of operands of OpConcatN, limited by its 1-byte operand.
+const maxConcatOperands = 1<<8 - 1
+
+// concatOperands returns the operands of a chain of additions `ie`, e.g. a, b and c of
+// `a + b + c`, if it has more than two operands including a string literal, i.e. it is likely to
+// concatenate strings, and all of them are literals or identifiers. Otherwise it returns nil.
+//
+// Operands evaluated by OpConcatN before any of them are added must be free of side effects, or
+// e.g. `1 + "a" + f()` would call f before failing to add 1 and "a".
+func concatOperands(ie *ast.InfixExpression) []ast.Expression {
+	var operands []ast.Expression
+	var expr ast.Expression = ie
+	for {
+		add, ok := expr.(*ast.InfixExpression)
+		if !ok || add.Operator != "+" {
+			break
+		}
+		// Additions are left-associative, so the chain continues on the left-hand side
+		operands = append(operands, add.Right)
+		expr = add.Left
+	}
+	operands = append(operands, expr)
+
+	if len(operands) < 3 {
+		return nil
+	}
+
+	// Put the operands in order of evaluation
+	for i, j := 0, len(operands)-1; i < j; i, j = i+1, j-1 {
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+
+	hasString := false
+	for _, operand := range operands {
+		switch operand.(type) {
+		case *ast.StringLiteral:
+			hasString = true
+		case *ast.Ident, *ast.IntegerLiteral, *ast.FloatLiteral, *ast.Boolean, *ast.Nil:
+		default:
+			return nil
+		}
+	}
+	if !hasString {
+		return nil
+	}
+	return operands
+}
+
+// compileConcatenation compiles a chain of additions of `operands` with OpConcatN, so that
+// strings are concatenated at once instead of building an intermediate string for each addition.
+// The operands are all evaluated before any of them are added.
+func (c *Compiler) compileConcatenation(operands []ast.Expression) error {
+	if err := c.Compile(operands[0]); err != nil {
+		return err
+	}
+
+	// Add up the rest in groups, each of which is added to the sum so far
+	for rest := operands[1:]; len(rest) > 0; {
+		n := len(rest)
+		if n > maxConcatOperands-1 {
+			n = maxConcatOperands - 1
+		}
+
+		for _, operand := range rest[:n] {
+			if err := c.Compile(operand); err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpConcatN, n+1)
+
+		rest = rest[n:]
 	}
 
 	return nil
 }
 
+// maxLiteralChunk is the maximum number of elements of an array literal, or pairs of a hash
+// literal, pushed on to the stack at once. Larger literals are built in chunks, so that they
+// neither overflow the stack nor the 2-byte operands of OpArray and OpHash.
+const maxLiteralChunk = 1 << 8
+
+// compileArrayLiteral compiles an array literal `al`. Its first chunk of elements is built into
+// an array by OpArray, and each of the rest is appended to it by OpArrayAppend.
+func (c *Compiler) compileArrayLiteral(al *ast.ArrayLiteral) error {
+	op := code.OpArray
+	rest := al.Elements
+	for {
+		n := len(rest)
+		if n > maxLiteralChunk {
+			n = maxLiteralChunk
+		}
+
+		for _, el := range rest[:n] {
+			if err := c.Compile(el); err != nil {
+				return err
+			}
+		}
+		c.emit(op, n)
+
+		rest = rest[n:]
+		if len(rest) == 0 {
+			return nil
+		}
+		op = code.OpArrayAppend
+	}
+}
+
+// compileHashLiteral compiles a hash literal `hl` in chunks of pairs as compileArrayLiteral does,
+// with OpHash and OpHashAppend.
+func (c *Compiler) compileHashLiteral(hl *ast.HashLiteral) error {
+	op := code.OpHash
+	rest := hl.Pairs
+	for {
+		n := len(rest)
+		if n > maxLiteralChunk {
+			n = maxLiteralChunk
+		}
+
+		// Pairs are compiled in the source order, which is the order the hash enumerates them in
+		for _, pair := range rest[:n] {
+			if err := c.Compile(pair.Key); err != nil {
+				return err
+			}
+			if err := c.Compile(pair.Value); err != nil {
+				return err
+			}
+		}
+		c.emit(op, n*2)
+
+		rest = rest[n:]
+		if len(rest) == 0 {
+			return nil
+		}
+		op = code.OpHashAppend
+	}
+}
+
+func (c *Compiler) compileMethodCall(fe *ast.FieldExpression, args []ast.Expression) error {
+	// Compile the receiver
+	if err := c.Compile(fe.Left); err != nil {
+		return err
+	}
+
+	// Replace the receiver with the method and the receiver itself as the first argument
+	c.emit(code.OpGetMethod, c.addString(fe.Field.Value))
+
+	for _, arg := range args {
+		if err := c.Compile(arg); err != nil {
+			return err
+		}
+	}
+
+	c.emit(code.OpCall, len(args)+1)
+
+	return nil
+}
+
+// dup emits an instruction to duplicate the value on top of the stack.
+func (c *Compiler) dup() {
+	c.emit(code.OpDup)
+}
+
+// swap emits an instruction to swap the two values on top of the stack.
+func (c *Compiler) swap() {
+	c.emit(code.OpSwap)
+}
+
+// rot emits an instruction to move the third value from the top of the stack to the top.
+func (c *Compiler) rot() {
+	c.emit(code.OpRot)
+}
+
 // Bytecode returns a bytecode generated by the compiler.
 func (c *Compiler) Bytecode() *Bytecode {
+	globals := make(map[string]int)
+	for _, sym := range c.symTbl.Symbols() {
+		if sym.Scope == GlobalScope {
+			globals[sym.Name] = sym.Index
+		}
+	}
+
 	return &Bytecode{
-		Instructions: c.currentInsns(),
-		Constants:    c.consts,
+		Instructions:  c.currentInsns(),
+		Constants:     c.consts,
+		MaxStackDepth: c.maxStackDepth,
+		Globals:       globals,
+		Lines:         c.currentScope().lines,
+		Builtins:      BuiltinNames(),
 	}
 }
 
@@ -504,4 +1129,13 @@ func (c *Compiler) Bytecode() *Bytecode {
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	// MaxStackDepth is the maximum number of elements the main program can push on to the stack
+	MaxStackDepth int
+	// Globals maps the names of global bindings to their indexes in the globals store
+	Globals map[string]int
+	// Lines maps the instructions of the main program to the lines of the source code
+	Lines code.LineTable
+	// Builtins holds the names of the built-in functions in the order of the indexes
+	// OpGetBuiltin instructions refer to them by. See LinkBuiltins.
+	Builtins []string
 }
@@ -1,7 +1,11 @@
 package compiler
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/skatsuta/monkey-compiler/ast"
@@ -312,8 +316,10 @@ func TestBooleanExpressions(t *testing.T) {
 			wantConsts: []interface{}{},
 			wantInsns: []code.Instructions{
 				code.Make(code.OpTrue),
+				code.Make(code.OpDup),
+				code.Make(code.OpJumpNotTruthy, 7),
+				code.Make(code.OpPop),
 				code.Make(code.OpFalse),
-				code.Make(code.OpAnd),
 				code.Make(code.OpPop),
 			},
 		},
@@ -322,8 +328,10 @@ func TestBooleanExpressions(t *testing.T) {
 			wantConsts: []interface{}{},
 			wantInsns: []code.Instructions{
 				code.Make(code.OpTrue),
+				code.Make(code.OpDup),
+				code.Make(code.OpJumpTruthy, 7),
+				code.Make(code.OpPop),
 				code.Make(code.OpFalse),
-				code.Make(code.OpOr),
 				code.Make(code.OpPop),
 			},
 		},
@@ -363,18 +371,50 @@ func TestLogicalExpressions(t *testing.T) {
 			wantConsts: []interface{}{1, 2},
 			wantInsns: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpDup),
+				code.Make(code.OpJumpNotTruthy, 11),
+				code.Make(code.OpPop),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAnd),
 				code.Make(code.OpPop),
 			},
 		},
 		{
 			input:      "1 || 2",
 			wantConsts: []interface{}{1, 2},
+			wantInsns: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpDup),
+				code.Make(code.OpJumpTruthy, 11),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestInExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:      `"a" in "abc"`,
+			wantConsts: []interface{}{"a", "abc"},
 			wantInsns: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpOr),
+				code.Make(code.OpIn),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:      `"a" not in "abc"`,
+			wantConsts: []interface{}{"a", "abc"},
+			wantInsns: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpIn),
+				code.Make(code.OpBang),
 				code.Make(code.OpPop),
 			},
 		},
@@ -527,6 +567,26 @@ func TestGlobalAssignmentStatements(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input: `
+			a = 1;
+			a++;
+			a--;
+			`,
+			wantConsts: []interface{}{1},
+			wantInsns: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSub),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
 		{
 			input: `
 			a = 1;
@@ -596,11 +656,159 @@ func TestStringExpressions(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:      `let s = 1; "<" + s + ">"`,
+			wantConsts: []interface{}{1, "<", ">"},
+			wantInsns: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConcatN, 3),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Chains with operands which may have side effects are compiled as usual, so that
+			// the operands are evaluated in order with the additions
+			input: `let f = fn() { "" }; "<" + f() + ">"`,
+			wantConsts: []interface{}{
+				"",
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+				"<", ">",
+			},
+			wantInsns: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Chains without string literals are compiled as usual
+			input:      "1 + 2 + 3",
+			wantConsts: []interface{}{1, 2, 3},
+			wantInsns: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
 	}
 
 	runCompilerTests(t, tests)
 }
 
+func TestLongStringConcatenation(t *testing.T) {
+	// 600 operands are added up in groups of at most 255. They share a single string constant.
+	input := `"a"` + strings.Repeat(` + "a"`, 599)
+
+	cmplr := New()
+	if err := cmplr.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var wantInsns []code.Instructions
+	for i := 0; i < 600; i++ {
+		wantInsns = append(wantInsns, code.Make(code.OpConstant, 0))
+		switch i {
+		case 254:
+			wantInsns = append(wantInsns, code.Make(code.OpConcatN, 255))
+		case 508:
+			wantInsns = append(wantInsns, code.Make(code.OpConcatN, 255))
+		case 599:
+			wantInsns = append(wantInsns, code.Make(code.OpConcatN, 92))
+		}
+	}
+	wantInsns = append(wantInsns, code.Make(code.OpPop))
+
+	if err := testInstructions(wantInsns, cmplr.Bytecode().Instructions); err != nil {
+		t.Errorf("testInstructions failed: %s", err)
+	}
+}
+
+func TestLargeLiterals(t *testing.T) {
+	// Elements and pairs after the first 256 are added to the literal in chunks of at most 256
+	tests := []struct {
+		input     string
+		op        code.Opcode
+		appendOp  code.Opcode
+		numConsts int
+		chunks    []int
+	}{
+		{"[" + strings.Repeat(`"a", `, 599) + `"a"]`, code.OpArray, code.OpArrayAppend, 1,
+			[]int{256, 256, 88}},
+		{"{" + strings.Repeat(`"k": "v", `, 299) + `"k": "v"}`, code.OpHash, code.OpHashAppend,
+			2, []int{256, 44}},
+	}
+
+	for _, tt := range tests {
+		cmplr := New()
+		if err := cmplr.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var wantInsns []code.Instructions
+		for i, n := range tt.chunks {
+			for j := 0; j < n; j++ {
+				for k := 0; k < tt.numConsts; k++ {
+					wantInsns = append(wantInsns, code.Make(code.OpConstant, k))
+				}
+			}
+			op := tt.op
+			if i > 0 {
+				op = tt.appendOp
+			}
+			wantInsns = append(wantInsns, code.Make(op, n*tt.numConsts))
+		}
+		wantInsns = append(wantInsns, code.Make(code.OpPop))
+
+		if err := testInstructions(wantInsns, cmplr.Bytecode().Instructions); err != nil {
+			t.Errorf("testInstructions failed: %s", err)
+		}
+	}
+}
+
+func TestNumberConstants(t *testing.T) {
+	// Identical numbers share a constant, so literals with more elements than the constant pool
+	// can hold still compile, while integers and floats of equal values stay apart
+	input := "[" + strings.Repeat("0, 1, 1.0, ", MaxConstants) + "2.5]"
+
+	cmplr := New()
+	if err := cmplr.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	if err := testConstants([]interface{}{0, 1, 1.0, 2.5}, cmplr.Bytecode().Constants); err != nil {
+		t.Errorf("testConstants failed: %s", err)
+	}
+}
+
+func TestTooLongJumps(t *testing.T) {
+	// Jumps cannot reach instructions beyond the range of their 2-byte operands
+	input := "let a = [" + strings.Repeat(`"a", `, 22000) + `"a"]; if (true) { 1 }`
+
+	err := New().Compile(parse(input))
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none")
+	}
+	want := "too many instructions: jump target "
+	if !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("wrong compiler error. want prefix %q, got=%q", want, err)
+	}
+}
+
 func TestArrayLiterals(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -693,14 +901,14 @@ func TestGetIndexExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input:      "[1, 2, 3][1 + 1]",
-			wantConsts: []interface{}{1, 2, 3, 1, 1},
+			wantConsts: []interface{}{1, 2, 3},
 			wantInsns: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpArray, 3),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpAdd),
 				code.Make(code.OpGetIndex),
 				code.Make(code.OpPop),
@@ -708,13 +916,13 @@ func TestGetIndexExpressions(t *testing.T) {
 		},
 		{
 			input:      "{1: 2}[2 - 1]",
-			wantConsts: []interface{}{1, 2, 2, 1},
+			wantConsts: []interface{}{1, 2},
 			wantInsns: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpHash, 2),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSub),
 				code.Make(code.OpGetIndex),
 				code.Make(code.OpPop),
@@ -729,7 +937,7 @@ func TestSetIndexExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input:      "a = [1, 2, 3]; a[1 + 1] = 2 - 2",
-			wantConsts: []interface{}{1, 2, 3, 1, 1, 2, 2},
+			wantConsts: []interface{}{1, 2, 3},
 			wantInsns: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
@@ -737,11 +945,11 @@ func TestSetIndexExpressions(t *testing.T) {
 				code.Make(code.OpArray, 3),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpConstant, 6),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 1),
 				code.Make(code.OpSub),
 				code.Make(code.OpSetIndex),
 			},
@@ -767,6 +975,169 @@ func TestSetIndexExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestStringConstants(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:      `["a", "b", "a"]`,
+			wantConsts: []interface{}{"a", "b"},
+			wantInsns: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	// String constants are shared with programs compiled later with the same constant pool
+	complr := New()
+	if err := complr.Compile(parse(`"a"; "b"`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	complr = NewWithState(complr.symTbl, complr.Bytecode().Constants)
+	if err := complr.Compile(parse(`"b"; "c"`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	consts := complr.Bytecode().Constants
+	if err := testConstants([]interface{}{"a", "b", "c"}, consts); err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
+	for i, c := range consts {
+		if !c.(*object.String).Hashed() {
+			t.Errorf("hash key of constant %d is not computed in advance", i)
+		}
+	}
+}
+
+func TestBytecodeGlobals(t *testing.T) {
+	complr := New()
+	if err := complr.Compile(parse(`let a = 1; let main = fn(x) { let b = x; b }; a = 2`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	// Local bindings and built-in functions are not included
+	want := map[string]int{"a": 0, "main": 1}
+	if got := complr.Bytecode().Globals; !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong globals. want=%v, got=%v", want, got)
+	}
+}
+
+func TestCompileExpr(t *testing.T) {
+	fn, err := CompileExpr(`"a" + "b"`)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	wantInsns := []code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpAdd),
+		code.Make(code.OpReturnValue),
+	}
+	if err := testInstructions(wantInsns, fn.Instructions); err != nil {
+		t.Errorf("testInstructions failed: %s", err)
+	}
+	// The function itself is the last constant
+	if err := testConstants([]interface{}{"a", "b"}, fn.Constants[:2]); err != nil {
+		t.Errorf("testConstants failed: %s", err)
+	}
+	if fn.NumParameters != 0 {
+		t.Errorf("wrong number of parameters. want=0, got=%d", fn.NumParameters)
+	}
+
+	// Variables are read from the globals store in order
+	fn, err = CompileExpr("b - a", "a", "b")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	wantInsns = []code.Instructions{
+		code.Make(code.OpGetGlobal, 1),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpSub),
+		code.Make(code.OpReturnValue),
+	}
+	if err := testInstructions(wantInsns, fn.Instructions); err != nil {
+		t.Errorf("testInstructions failed: %s", err)
+	}
+
+	tests := []struct {
+		input string
+		vars  []string
+		want  string
+	}{
+		{"1; 2", nil, "expected a single expression, got 2 statements"},
+		{"let a = 1", nil, "expected an expression, got let a = 1;"},
+		{"a + 1", nil, `undefined variable "a"`},
+		{"a + 1", []string{"a", "a"}, `variable "a" is defined more than once`},
+		{"1 +", nil, "no prefix parse function for EOF found"},
+	}
+	for _, tt := range tests {
+		_, err := CompileExpr(tt.input, tt.vars...)
+		if err == nil {
+			t.Errorf("%q: expected error but got none", tt.input)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("%q: wrong error. want=%q, got=%q", tt.input, tt.want, err)
+		}
+	}
+}
+
+func TestFieldExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:      `{"a": 1}.a`,
+			wantConsts: []interface{}{"a", 1},
+			wantInsns: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpGetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:      "h = {}; h.a = 1",
+			wantConsts: []interface{}{"a", 1},
+			wantInsns: []code.Instructions{
+				code.Make(code.OpHash, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetIndex),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestMethodCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:      "h = {}; h.f(1)",
+			wantConsts: []interface{}{"f", 1},
+			wantInsns: []code.Instructions{
+				code.Make(code.OpHash, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpGetMethod, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCall, 2),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestFunctions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -850,6 +1221,9 @@ func TestCompilerScopes(t *testing.T) {
 	if c.scopeIdx != 1 {
 		t.Errorf("scopeIdx wrong. want=%d, got=%d", 1, c.scopeIdx)
 	}
+	if depth := c.ScopeDepth(); depth != 1 {
+		t.Errorf("ScopeDepth wrong. want=%d, got=%d", 1, depth)
+	}
 
 	c.emit(code.OpSub)
 
@@ -866,10 +1240,15 @@ func TestCompilerScopes(t *testing.T) {
 		t.Errorf("compiler did not enclose global symbol table")
 	}
 
-	c.leaveScope()
+	if _, err := c.leaveScope(); err != nil {
+		t.Fatalf("leaveScope failed: %s", err)
+	}
 	if c.scopeIdx != 0 {
 		t.Errorf("scopeIdx wrong. want=%d, got=%d", 0, c.scopeIdx)
 	}
+	if depth := c.ScopeDepth(); depth != 0 {
+		t.Errorf("ScopeDepth wrong. want=%d, got=%d", 0, depth)
+	}
 
 	if c.symTbl != globalSymTab {
 		t.Errorf("compiler did not restore global symbol table")
@@ -891,6 +1270,28 @@ func TestCompilerScopes(t *testing.T) {
 	if prev := scope.prevInsn; prev.Opcode != code.OpMul {
 		t.Errorf("prevInsn.Opcode wrong. want=%d, got=%d", code.OpMul, prev.Opcode)
 	}
+
+	// Leaving a scope never entered is reported rather than corrupting the compiler
+	if _, err := c.leaveScope(); err == nil {
+		t.Errorf("leaving the scope of the main program is not reported")
+	}
+	if c.scopeIdx != 0 || c.symTbl != globalSymTab {
+		t.Errorf("compiler state changed by leaving the scope of the main program")
+	}
+}
+
+func TestScopesAfterErrors(t *testing.T) {
+	c := New()
+	err := c.Compile(parse("let f = fn() { fn() { undefined } };"))
+	if _, ok := err.(*UndefinedVariableError); !ok {
+		t.Fatalf("wrong error. want=*UndefinedVariableError, got=%T (%v)", err, err)
+	}
+	if depth := c.ScopeDepth(); depth != 0 {
+		t.Errorf("scopes left after the error. want=%d, got=%d", 0, depth)
+	}
+	if c.symTbl.hasOuter() {
+		t.Errorf("symbol table of a function left after the error")
+	}
 }
 
 func TestFunctionCalls(t *testing.T) {
@@ -1372,13 +1773,12 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpCall, 1),
 					code.Make(code.OpReturnValue),
 				},
-				1,
 			},
 			wantInsns: []code.Instructions{
 				code.Make(code.OpClosure, 1, 0),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpCall, 1),
 				code.Make(code.OpPop),
 			},
@@ -1401,18 +1801,17 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpCall, 1),
 					code.Make(code.OpReturnValue),
 				},
-				1,
 				[]code.Instructions{
 					code.Make(code.OpClosure, 1, 0),
 					code.Make(code.OpSetLocal, 0),
 					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpConstant, 2),
+					code.Make(code.OpConstant, 0),
 					code.Make(code.OpCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
 			wantInsns: []code.Instructions{
-				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpCall, 0),
@@ -1424,6 +1823,371 @@ func TestRecursiveFunctions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestFunctionNames(t *testing.T) {
+	input := `
+	let outer = fn() { let inner = fn() { 1 }; inner };
+	fn() { 2 };
+	`
+
+	cmplr := New()
+	if err := cmplr.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var names []string
+	for _, c := range cmplr.Bytecode().Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			names = append(names, fn.Name)
+		}
+	}
+
+	want := []string{"inner", "outer", ""}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("wrong function names. want=%q, got=%q", want, names)
+	}
+}
+
+func TestLineTable(t *testing.T) {
+	input := `let add = fn(a, b) {
+	a + b
+};
+
+add(1,
+	2);`
+
+	cmplr := New()
+	if err := cmplr.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := cmplr.Bytecode()
+
+	want := code.LineTable{{Pos: 0, Line: 1}, {Pos: 7, Line: 5}}
+	if !reflect.DeepEqual(bytecode.Lines, want) {
+		t.Errorf("wrong lines of main program. want=%v, got=%v", want, bytecode.Lines)
+	}
+
+	fn := bytecode.Constants[0].(*object.CompiledFunction)
+	want = code.LineTable{{Pos: 0, Line: 2}}
+	if !reflect.DeepEqual(fn.Lines, want) {
+		t.Errorf("wrong lines of function. want=%v, got=%v", want, fn.Lines)
+	}
+
+	// Statements spanning lines, e.g. if and match expressions, start at their first lines
+	input = `let x = 1;
+if (x > 0) {
+	puts("a")
+}
+match x {
+	1 => puts("b")
+}`
+
+	cmplr = New()
+	if err := cmplr.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode = cmplr.Bytecode()
+	for _, tt := range []struct{ pos, line int }{
+		{0, 1},  // OpConstant of 1
+		{6, 2},  // OpGetGlobal of x in the condition
+		{13, 2}, // OpJumpNotTruthy
+		{16, 3}, // OpGetBuiltin of puts
+		{28, 5}, // OpGetGlobal of x as the subject
+	} {
+		if got := bytecode.Lines.Line(tt.pos); got != tt.line {
+			t.Errorf("wrong line of instruction at %d. want=%d, got=%d", tt.pos, tt.line, got)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var logger testLogger
+	c := New(WithLogger(&logger))
+	if err := c.Compile(parse(`let f = fn(x) { x + 1 }; f("a")`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	want := []string{
+		"enter scope depth=1",
+		"add constant index=0 type=Integer",
+		"leave scope depth=1 instructions=7",
+		"add constant index=1 type=CompiledFunction",
+		"add constant index=2 type=String",
+	}
+	if !reflect.DeepEqual(logger.messages, want) {
+		t.Errorf("wrong messages.\nwant=%q\ngot=%q", want, logger.messages)
+	}
+}
+
+// testLogger records messages logged to it along with their keys and values.
+type testLogger struct {
+	messages []string
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) {
+	for i := 0; i+1 < len(args); i += 2 {
+		msg += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+	l.messages = append(l.messages, msg)
+}
+
+func TestKeepLastValue(t *testing.T) {
+	tests := []struct {
+		input     string
+		wantInsns []code.Instructions
+	}{
+		{
+			"1; 2",
+			[]code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+			},
+		},
+		{
+			"let x = 1;",
+			[]code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			// Only the main program keeps the value
+			"fn() { 1 }",
+			[]code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		cmplr := New(WithKeepLastValue())
+		if err := cmplr.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := cmplr.Bytecode()
+		if err := testInstructions(tt.wantInsns, bytecode.Instructions); err != nil {
+			t.Errorf("testInstructions failed for %q: %s", tt.input, err)
+		}
+		if bytecode.MaxStackDepth != 1 {
+			t.Errorf("wrong max stack depth for %q. want=1, got=%d", tt.input, bytecode.MaxStackDepth)
+		}
+	}
+}
+
+func TestInlining(t *testing.T) {
+	input := `
+	let add = fn(a, b) { a + b };
+	add(1, 2);
+	`
+
+	cmplr := New(WithOptimizationLevel(1))
+	if err := cmplr.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := cmplr.Bytecode()
+
+	wantInsns := []code.Instructions{
+		code.Make(code.OpClosure, 0, 0),
+		code.Make(code.OpSetGlobal, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpConstant, 2),
+		code.Make(code.OpSetGlobal, 2),
+		code.Make(code.OpSetGlobal, 1),
+		code.Make(code.OpGetGlobal, 1),
+		code.Make(code.OpGetGlobal, 2),
+		code.Make(code.OpAdd),
+		code.Make(code.OpPop),
+	}
+	if err := testInstructions(wantInsns, bytecode.Instructions); err != nil {
+		t.Errorf("testInstructions failed: %s", err)
+	}
+
+	wantConsts := []interface{}{
+		[]code.Instructions{
+			code.Make(code.OpGetLocal, 0),
+			code.Make(code.OpGetLocal, 1),
+			code.Make(code.OpAdd),
+			code.Make(code.OpReturnValue),
+		},
+		1,
+		2,
+	}
+	if err := testConstants(wantConsts, bytecode.Constants); err != nil {
+		t.Errorf("testConstants failed: %s", err)
+	}
+}
+
+func TestInliningCandidates(t *testing.T) {
+	tests := []struct {
+		input string
+		// wantCalls is the number of calls left in the main program and the functions
+		wantCalls int
+	}{
+		{"let f = fn(x) { x * 2 }; f(1);", 0},
+		{"let f = fn(x) { return x * 2; }; let g = fn() { f(1) }; g();", 1},
+		{"let f = fn(x) { x.y }; f({\"y\": 1});", 0},
+		{"let f = fn(x) { -x }; f(f(1));", 0},
+		// Wrong number of arguments
+		{"let f = fn(x) { x }; f(1, 2);", 1},
+		// Recursive
+		{"let f = fn(x) { f(x) }; f(1);", 2},
+		// Referring to a global binding
+		{"let a = 1; let f = fn(x) { x + a }; f(1);", 1},
+		// Referring to a builtin
+		{"let f = fn(x) { len(x) }; f([]);", 2},
+		// Capturing parameters in a closure
+		{"let f = fn(x) { fn() { x } }; f(1);", 1},
+		// More than one statement
+		{"let f = fn(x) { let y = x; y }; f(1);", 1},
+		// Rebound
+		{"let f = fn(x) { x }; f = fn(x) { 2 }; f(1);", 1},
+		{"let f = fn(x) { x }; let g = fn() { let f = 1; f }; f(1);", 1},
+		// Not a top-level binding
+		{"if (true) { let f = fn(x) { x }; f(1) };", 1},
+		// Shadowed by a parameter
+		{"let f = fn(x) { x }; let g = fn(f) { f(1) }; g(fn(x) { 2 });", 2},
+		// Too large
+		{"let f = fn(x) { x + x + x + x + x + x + x + x + x }; f(1);", 1},
+	}
+
+	for _, tt := range tests {
+		cmplr := New(WithOptimizationLevel(1))
+		if err := cmplr.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		if calls := countCalls(cmplr.Bytecode()); calls != tt.wantCalls {
+			t.Errorf("wrong number of calls in %q. want=%d, got=%d", tt.input, tt.wantCalls, calls)
+		}
+	}
+
+	// Inlining is disabled by default
+	cmplr := New()
+	if err := cmplr.Compile(parse(tests[0].input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	if calls := countCalls(cmplr.Bytecode()); calls != 1 {
+		t.Errorf("call inlined at the default optimization level")
+	}
+}
+
+func TestFolding(t *testing.T) {
+	input := `
+	let twice = fn(s) { s + s };
+	len(twice("ab"));
+	`
+
+	cmplr := New(WithOptimizationLevel(2))
+	if err := cmplr.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := cmplr.Bytecode()
+
+	wantInsns := []code.Instructions{
+		code.Make(code.OpClosure, 0, 0),
+		code.Make(code.OpSetGlobal, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpPop),
+	}
+	if err := testInstructions(wantInsns, bytecode.Instructions); err != nil {
+		t.Errorf("testInstructions failed: %s", err)
+	}
+
+	wantConsts := []interface{}{
+		[]code.Instructions{
+			code.Make(code.OpGetLocal, 0),
+			code.Make(code.OpGetLocal, 0),
+			code.Make(code.OpAdd),
+			code.Make(code.OpReturnValue),
+		},
+		4,
+	}
+	if err := testConstants(wantConsts, bytecode.Constants); err != nil {
+		t.Errorf("testConstants failed: %s", err)
+	}
+}
+
+func TestFoldingCandidates(t *testing.T) {
+	tests := []struct {
+		input string
+		// wantFolded tells whether the program compiles differently at optimization level 2 than
+		// at level 1, i.e. some calls are evaluated at compile time
+		wantFolded bool
+	}{
+		{`len("abc");`, true},
+		{`first(rest([1, -2, 3])) * 2;`, true},
+		{`to_str(1.5) + chr(ord("a") + 1);`, true},
+		{`len("a") == 1;`, true},
+		{"let f = fn(x) { x * 2 }; let g = fn() { f(21) }; g();", true},
+		{"let sq = fn(x) { x * x }; let f = fn(x, y) { sq(x) + sq(y) }; f(3, 4);", true},
+		{`let f = fn(x) { len(x) > 1 }; f([1, 2]);`, true},
+		{"let f = fn(x) { len(x) }; let g = fn(y) { f(y) }; g([1]);", true},
+		// Shadowing a built-in function
+		{`let len = fn(x) { 0 }; len("a");`, true},
+		// Results other than scalars
+		{"push([], 1);", false},
+		{`big("1");`, false},
+		// Errors are left to the runtime
+		{`len(1);`, false},
+		{`len("a", "b");`, false},
+		{"let f = fn(x) { len(x) / 0 }; f([]);", false},
+		{"let f = fn(x) { len(x) * 2 }; f([9223372036854775807 * 2]);", false},
+		{"let f = fn(x) { len(x) }; f(1, 2);", false},
+		// Impure built-in functions
+		{`puts("a");`, false},
+		// Arguments which are not constants
+		{"let a = [1]; len(a);", false},
+		// Referring to a global binding
+		{"let a = 1; let f = fn(x) { len(x) + a }; f([1]);", false},
+		// Recursive
+		{"let f = fn(x) { f(x) }; f(1);", false},
+		// Rebound
+		{"let f = fn(x) { len(x) }; f = fn(x) { 2 }; f([]);", false},
+		{`let f = fn(x) { len(x) }; let len = fn(x) { 0 }; f("a");`, false},
+		// Shadowed by a parameter
+		{`let g = fn(len) { len("a") }; g(fn(x) { 2 });`, false},
+		// Not a top-level binding
+		{"if (true) { let f = fn(x) { len(x) }; f([]) };", false},
+		// Evaluating within the limits
+		{"let d = fn(a) { concat(a, a) }; len(d(d(d([1]))));", true},
+		{"let g0 = fn(x) { x + 1 };" + exponentialCalls(8) + "g8(1);", true},
+		// Building values exceeding the limits
+		{"let d = fn(a) { concat(a, a) }; len(" + strings.Repeat("d(", 26) + "[1]" +
+			strings.Repeat(")", 26) + ");", false},
+		// Evaluating too many expressions
+		{"let g0 = fn(x) { x + 1 };" + exponentialCalls(20) + "g20(1);", false},
+	}
+
+	compile := func(input string, level int) string {
+		cmplr := New(WithOptimizationLevel(level))
+		if err := cmplr.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := cmplr.Bytecode()
+		return bytecode.Instructions.String() + fmt.Sprint(len(bytecode.Constants))
+	}
+
+	for _, tt := range tests {
+		folded := compile(tt.input, 2) != compile(tt.input, 1)
+		if folded != tt.wantFolded {
+			t.Errorf("wrong folding of %q. want=%t, got=%t", tt.input, tt.wantFolded, folded)
+		}
+	}
+}
+
+// exponentialCalls returns let statements binding functions g1 to gn, each of which calls the
+// previous one twice, so that a call of gn evaluates 2^n calls of g0.
+func exponentialCalls(n int) string {
+	var out strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&out, "let g%d = fn(x) { g%d(x) + g%d(x) };", i, i-1, i-1)
+	}
+	return out.String()
+}
+
 func TestShadowingBuiltinFunctions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -1485,6 +2249,273 @@ func TestShadowingBuiltinFunctions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestTooManyGlobals(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < MaxGlobals; i++ {
+		fmt.Fprintf(&input, "let %s = nil;\n", identName("g_", i))
+	}
+
+	if err := New().Compile(parse(input.String())); err != nil {
+		t.Fatalf("compiler error with %d globals: %s", MaxGlobals, err)
+	}
+
+	tests := []string{
+		input.String() + "let overflow = nil;",
+		input.String() + "overflow = nil;",
+	}
+
+	want := fmt.Sprintf(`too many global bindings: "overflow" exceeds the limit of %d`, MaxGlobals)
+	for _, tt := range tests {
+		err := New().Compile(parse(tt))
+		if err == nil {
+			t.Fatalf("expected compiler error but resulted in none")
+		}
+		if err.Error() != want {
+			t.Errorf("wrong compiler error. want=%q, got=%q", want, err)
+		}
+	}
+}
+
+func TestWideLocals(t *testing.T) {
+	var input strings.Builder
+	input.WriteString("fn() {\n")
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&input, "let %s = %d;\n", identName("l_", i), i)
+	}
+	fmt.Fprintf(&input, "%s + %s\n}", identName("l_", 0), identName("l_", 299))
+
+	complr := New()
+	if err := complr.Compile(parse(input.String())); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	fn := complr.Bytecode().Constants[len(complr.Bytecode().Constants)-1].(*object.CompiledFunction)
+	wants := []code.Instructions{
+		code.Make(code.OpSetLocal, 255),
+		code.Make(code.OpSetLocalWide, 256),
+		code.Make(code.OpSetLocalWide, 299),
+		concatInstructions([]code.Instructions{
+			code.Make(code.OpGetLocal, 0),
+			code.Make(code.OpGetLocalWide, 299),
+		}),
+	}
+	for _, want := range wants {
+		if !bytes.Contains(fn.Instructions, want) {
+			t.Errorf("instructions do not contain %q", want)
+		}
+	}
+}
+
+func TestTooManyLocals(t *testing.T) {
+	var input strings.Builder
+	input.WriteString("fn() {\n")
+	for i := 0; i < MaxLocals; i++ {
+		fmt.Fprintf(&input, "let %s = nil;\n", identName("l_", i))
+	}
+
+	if err := New().Compile(parse(input.String() + "}")); err != nil {
+		t.Fatalf("compiler error with %d locals: %s", MaxLocals, err)
+	}
+
+	err := New().Compile(parse(input.String() + "let overflow = nil; }"))
+	want := fmt.Sprintf(`too many local bindings: "overflow" exceeds the limit of %d`, MaxLocals)
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none")
+	}
+	if err.Error() != want {
+		t.Errorf("wrong compiler error. want=%q, got=%q", want, err)
+	}
+}
+
+// identName returns an identifier consisting of `prefix` followed by index `i` spelled out in
+// letters, as identifiers cannot contain digits.
+func identName(prefix string, i int) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	for ; i > 0 || b.Len() == len(prefix); i /= 26 {
+		b.WriteByte(byte('a' + i%26))
+	}
+	return b.String()
+}
+
+func TestMaxStackDepth(t *testing.T) {
+	tests := []struct {
+		input     string
+		wantMain  int
+		wantFuncs []int
+	}{
+		{"1; 2; 3", 1, nil},
+		{"1 + 2 * 3", 3, nil},
+		{"[1, [2, 3], 4]", 3, nil},
+		{"let x = 1; x = 2;", 1, nil},
+		{"if (true) { 1 } else { let y = 2; }", 1, nil},
+		{"fn(a, b) { let c = [a, b]; c[0] + c[1] }", 1, []int{3}},
+		{"let f = fn() { fn(x) { x + 1 } }; f()(2)", 2, []int{2, 1}},
+		{"let h = {}; h.m = fn(self, x) { x }; h.m(1)", 3, []int{1}},
+	}
+
+	for _, tt := range tests {
+		c := New()
+		if err := c.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := c.Bytecode()
+		if bytecode.MaxStackDepth != tt.wantMain {
+			t.Errorf("wrong stack depth of main program for %q. want=%d, got=%d",
+				tt.input, tt.wantMain, bytecode.MaxStackDepth)
+		}
+
+		var gotFuncs []int
+		for _, c := range bytecode.Constants {
+			if fn, ok := c.(*object.CompiledFunction); ok {
+				gotFuncs = append(gotFuncs, fn.MaxStackDepth)
+			}
+		}
+		if !reflect.DeepEqual(gotFuncs, tt.wantFuncs) {
+			t.Errorf("wrong stack depths of functions for %q. want=%v, got=%v",
+				tt.input, tt.wantFuncs, gotFuncs)
+		}
+	}
+}
+
+func TestMaxStackDepthErrors(t *testing.T) {
+	tests := []struct {
+		insns []code.Instructions
+		want  string
+	}{
+		{
+			insns: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+			},
+			want: "stack underflow at 0003: OpAdd",
+		},
+		{
+			insns: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 7),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+			want: "inconsistent stack depth at 0007: 0 and 1",
+		},
+		{
+			insns: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpRot),
+			},
+			want: "stack underflow at 0006: OpRot",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := MaxStackDepth(concatInstructions(tt.insns))
+		if err == nil {
+			t.Fatalf("expected error but resulted in none")
+		}
+		if err.Error() != tt.want {
+			t.Errorf("wrong error. want=%q, got=%q", tt.want, err)
+		}
+	}
+}
+
+func TestCompileNilNodes(t *testing.T) {
+	// Programs with parse errors must be rejected without panicking
+	inputs := []string{
+		"let = 5;",
+		"let x = ;",
+		"1 + ;",
+		"return ;",
+		"x = ;",
+		"if (true) { 1 + }",
+		"fn(x) { let y = ; }",
+		"[1, 2][];",
+		"{1: };",
+		"-;",
+	}
+
+	for _, input := range inputs {
+		if err := New().Compile(parse(input)); err == nil {
+			t.Errorf("expected compiler error for %q but resulted in none", input)
+		}
+	}
+
+	nodes := []ast.Node{
+		nil,
+		(*ast.Program)(nil),
+		&ast.Program{Statements: []ast.Statement{(*ast.LetStatement)(nil)}},
+		&ast.ExpressionStatement{Expression: (*ast.Ident)(nil)},
+		&ast.InfixExpression{Left: &ast.IntegerLiteral{Value: 1}, Operator: "+"},
+		&ast.MacroLiteral{},
+	}
+
+	for _, node := range nodes {
+		if err := New().Compile(node); err == nil {
+			t.Errorf("expected compiler error for %#v but resulted in none", node)
+		}
+	}
+}
+
+func TestUndefinedVariables(t *testing.T) {
+	inputs := []string{
+		"x",
+		"1 + x",
+		"-x",
+		"!x",
+		"[x]",
+		"fn() { x }",
+		"x++",
+		"fn() { x-- }",
+	}
+
+	for _, input := range inputs {
+		err := New().Compile(parse(input))
+		if err == nil {
+			t.Errorf("expected compiler error for %q but resulted in none", input)
+			continue
+		}
+		if want := `undefined variable "x"`; err.Error() != want {
+			t.Errorf("wrong error for %q. want=%q, got=%q", input, want, err)
+		}
+
+		var undefined *UndefinedVariableError
+		if !errors.As(err, &undefined) || undefined.Name != "x" {
+			t.Errorf("wrong error type for %q: %#v", input, err)
+		}
+	}
+}
+
+func TestIncDecErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		// A captured variable is a copy, which the enclosing function would not see updated
+		{
+			"let f = fn() { let c = 0; fn() { c++; c } }; f()()",
+			`cannot update "c" with ++: it is not a global or local variable`,
+		},
+		{"len--", `cannot update "len" with --: it is not a global or local variable`},
+		{
+			"let f = fn() { f++ }; f()",
+			`cannot update "f" with ++: it is not a global or local variable`,
+		},
+	}
+
+	for _, tt := range tests {
+		err := New().Compile(parse(tt.input))
+		if err == nil {
+			t.Errorf("expected compiler error for %q but resulted in none", tt.input)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.want, err)
+		}
+	}
+}
+
 func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	t.Helper()
 
@@ -1508,6 +2539,35 @@ func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	}
 }
 
+// countCalls returns the number of OpCall instructions in the main program and the compiled
+// functions of `bytecode`.
+func countCalls(bytecode *Bytecode) int {
+	count := func(insns code.Instructions) int {
+		n := 0
+		for ip := 0; ip < len(insns); {
+			def, err := code.Lookup(insns[ip])
+			if err != nil {
+				return n
+			}
+			if code.Opcode(insns[ip]) == code.OpCall {
+				n++
+			}
+
+			_, width := code.ReadOperands(def, insns[ip+1:])
+			ip += 1 + width
+		}
+		return n
+	}
+
+	calls := count(bytecode.Instructions)
+	for _, c := range bytecode.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			calls += count(fn.Instructions)
+		}
+	}
+	return calls
+}
+
 func parse(input string) *ast.Program {
 	return parser.New(lexer.New(input)).ParseProgram()
 }
@@ -0,0 +1,56 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/skatsuta/monkey-compiler/ast"
+	"github.com/skatsuta/monkey-compiler/lexer"
+	"github.com/skatsuta/monkey-compiler/object"
+	"github.com/skatsuta/monkey-compiler/parser"
+)
+
+// CompileExpr compiles source code `src` of a single expression into a function which takes no
+// arguments and returns the value of the expression. It suits expressions evaluated repeatedly,
+// e.g. config expressions, filters or formulas, which can be called by vm.CallFunction.
+//
+// The function carries its own constant pool, as it is not a part of any program. The
+// expression can refer to built-in functions and variables named `vars`, which are defined as
+// globals in order, i.e. the value of vars[i] is read from the i-th slot of the globals store.
+func CompileExpr(src string, vars ...string) (*object.CompiledFunction, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) != 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+
+	if len(program.Statements) != 1 {
+		return nil, fmt.Errorf("expected a single expression, got %d statements",
+			len(program.Statements))
+	}
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		return nil, fmt.Errorf("expected an expression, got %s", program.Statements[0])
+	}
+
+	// Compile the expression as the body of a function literal, which is the last constant
+	fn := &ast.FunctionLiteral{
+		Parameters: []*ast.Ident{},
+		Body:       &ast.BlockStatement{Statements: []ast.Statement{stmt}},
+	}
+	c := New()
+	for _, name := range vars {
+		if sym, ok := c.symTbl.Resolve(name); ok && sym.Scope == GlobalScope {
+			return nil, fmt.Errorf("variable %q is defined more than once", name)
+		}
+		c.symTbl.Define(name)
+	}
+	if err := c.Compile(&ast.ExpressionStatement{Expression: fn}); err != nil {
+		return nil, err
+	}
+
+	compiled := c.consts[len(c.consts)-1].(*object.CompiledFunction)
+	compiled.Constants = c.consts
+	return compiled, nil
+}
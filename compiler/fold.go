@@ -0,0 +1,415 @@
+package compiler
+
+import (
+	"math"
+
+	"github.com/skatsuta/monkey-compiler/ast"
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+// Limits on evaluation of a call at compile time, which keep the compiler from exhausting its
+// time or memory on calls doubling strings or arrays or on functions calling others many times.
+const (
+	// maxFoldedStringLen is the maximum length of a string built by concatenation
+	maxFoldedStringLen = 1 << 12
+	// maxFoldSteps is the maximum number of expressions evaluated for a call
+	maxFoldSteps = 1 << 12
+	// maxFoldedSize is the maximum total length of the strings, byte arrays, arrays and hashes
+	// built for a call
+	maxFoldedSize = 1 << 16
+)
+
+// findFoldableFunctions returns the top-level let statements in `program` which bind a name to
+// a function whose calls may be evaluated at compile time, i.e. a function whose body is a single
+// expression. Whether a call is actually evaluated depends on its arguments and on what the body
+// refers to. Like for inlining, the name must not be bound anywhere else in the program.
+func findFoldableFunctions(
+	program *ast.Program, bindings map[string]int,
+) map[*ast.LetStatement]bool {
+	lets := make(map[*ast.LetStatement]bool)
+	for _, stmt := range program.Statements {
+		ls, ok := stmt.(*ast.LetStatement)
+		if !ok || ls.Name == nil || bindings[ls.Name.Value] != 1 {
+			continue
+		}
+		if fn, ok := ls.Value.(*ast.FunctionLiteral); ok && expressionBody(fn) != nil {
+			lets[ls] = true
+		}
+	}
+	return lets
+}
+
+// foldCall evaluates `call` at compile time if it is a call of a pure function with constant
+// arguments, e.g. `len("abc")`, and emits an instruction to push the result instead of the call.
+// It reports whether it did so.
+//
+// Pure functions are built-in functions marked as pure and functions found by
+// findFoldableFunctions whose bodies use nothing but their parameters, constants, operators on
+// them which cannot fail and calls of other pure functions. A call is evaluated only if it
+// returns an integer, a float, a string, a boolean or nil without an error, so any error is
+// still reported when the program runs, and if it is evaluated within the limits of
+// maxFoldSteps and maxFoldedSize.
+func (c *Compiler) foldCall(call *ast.CallExpression) bool {
+	if c.optLevel < 2 {
+		return false
+	}
+
+	f := &folder{c: c, active: make(map[*ast.FunctionLiteral]bool)}
+	result, ok := f.eval(call, nil)
+	if !ok {
+		return false
+	}
+
+	switch result := result.(type) {
+	case *object.Integer, *object.Float:
+		c.emit(code.OpConstant, c.addNumber(result))
+	case *object.String:
+		c.emit(code.OpConstant, c.addString(result.Value))
+	case *object.Boolean:
+		if result.Value {
+			c.emit(code.OpTrue)
+		} else {
+			c.emit(code.OpFalse)
+		}
+	case *object.Nil:
+		c.emit(code.OpNil)
+	default:
+		return false
+	}
+	return true
+}
+
+// folder evaluates expressions of pure function calls at compile time.
+type folder struct {
+	c *Compiler
+	// active is the set of user functions being evaluated. A pure function has no conditionals,
+	// so a recursive call of one would never return.
+	active map[*ast.FunctionLiteral]bool
+	// steps is the number of expressions evaluated so far
+	steps int
+	// size is the total length of the values built so far, as counted by allocate
+	size int
+}
+
+// allocate accounts for `obj` built while evaluating a call and reports false if the values
+// built so far exceed maxFoldedSize. Only the length of `obj` itself is counted, as its elements
+// are counted when they are built.
+func (f *folder) allocate(obj object.Object) bool {
+	switch obj := obj.(type) {
+	case *object.String:
+		f.size += len(obj.Value)
+	case *object.Bytes:
+		f.size += len(obj.Value)
+	case object.ArrayObject:
+		f.size += obj.Len()
+	case object.HashObject:
+		f.size += obj.Len()
+	}
+	return f.size <= maxFoldedSize
+}
+
+// eval evaluates `expr` with `params` mapping the parameters of the function being evaluated to
+// their arguments, or nil outside of any function. It reports false if `expr` cannot be
+// evaluated at compile time.
+func (f *folder) eval(expr ast.Expression, params map[string]object.Object) (object.Object, bool) {
+	if f.steps++; f.steps > maxFoldSteps {
+		return nil, false
+	}
+
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		arg, ok := params[expr.Value]
+		return arg, ok
+
+	case *ast.ArrayLiteral:
+		elems := make([]object.Object, len(expr.Elements))
+		for i, el := range expr.Elements {
+			v, ok := f.eval(el, params)
+			if !ok {
+				return nil, false
+			}
+			elems[i] = v
+		}
+		arr := &object.Array{Elements: elems}
+		return arr, f.allocate(arr)
+
+	case *ast.PrefixExpression:
+		right, ok := f.eval(expr.Right, params)
+		if !ok {
+			return nil, false
+		}
+		return evalConstPrefix(expr.Operator, right)
+
+	case *ast.InfixExpression:
+		left, ok := f.eval(expr.Left, params)
+		if !ok {
+			return nil, false
+		}
+		right, ok := f.eval(expr.Right, params)
+		if !ok {
+			return nil, false
+		}
+		result, ok := evalConstInfix(expr.Operator, left, right)
+		return result, ok && f.allocate(result)
+
+	case *ast.CallExpression:
+		return f.evalCall(expr, params)
+
+	default:
+		return literalValue(expr)
+	}
+}
+
+// literalValue returns the value of `expr` if it is a literal of a scalar value.
+func literalValue(expr ast.Expression) (object.Object, bool) {
+	switch expr := expr.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: expr.Value}, true
+	case *ast.FloatLiteral:
+		return &object.Float{Value: expr.Value}, true
+	case *ast.StringLiteral:
+		return &object.String{Value: expr.Value}, true
+	case *ast.Boolean:
+		return &object.Boolean{Value: expr.Value}, true
+	case *ast.Nil:
+		return &object.Nil{}, true
+	default:
+		return nil, false
+	}
+}
+
+// evalCall evaluates a call expression `call` with `params` as eval does.
+func (f *folder) evalCall(
+	call *ast.CallExpression, params map[string]object.Object,
+) (object.Object, bool) {
+	ident, ok := call.Function.(*ast.Ident)
+	if !ok {
+		return nil, false
+	}
+	builtin, fn := f.callee(ident.Value, params)
+	if builtin == nil && fn == nil {
+		return nil, false
+	}
+
+	args := make([]object.Object, len(call.Arguments))
+	for i, arg := range call.Arguments {
+		v, ok := f.eval(arg, params)
+		if !ok {
+			return nil, false
+		}
+		args[i] = v
+	}
+
+	if builtin != nil {
+		// Pure built-in functions do not use the host
+		switch result := builtin.Fn(nil, args...).(type) {
+		case nil:
+			return &object.Nil{}, true
+		case *object.Error, *object.Abort:
+			return nil, false
+		default:
+			return result, f.allocate(result)
+		}
+	}
+
+	if f.active[fn] || len(fn.Parameters) != len(args) {
+		return nil, false
+	}
+	fnParams := make(map[string]object.Object, len(args))
+	for i, p := range fn.Parameters {
+		fnParams[p.Value] = args[i]
+	}
+
+	f.active[fn] = true
+	defer delete(f.active, fn)
+	return f.eval(expressionBody(fn), fnParams)
+}
+
+// callee returns the pure built-in function or the foldable user function which `name` refers
+// to where it is called, if any. `params` are the parameters of the function whose body is being
+// evaluated, or nil if the call is in the code being compiled.
+func (f *folder) callee(
+	name string, params map[string]object.Object,
+) (*object.Builtin, *ast.FunctionLiteral) {
+	c := f.c
+
+	var sym Symbol
+	var ok bool
+	if params == nil {
+		// The name may be shadowed by a parameter of a function being inlined
+		if _, ok := c.inlineParams[name]; ok {
+			return nil, nil
+		}
+		sym, ok = c.symTbl.Resolve(name)
+	} else {
+		if _, ok := params[name]; ok {
+			return nil, nil
+		}
+		// The body was compiled at the top level when the function was defined, where a
+		// built-in function may have been shadowed by a global binding since then
+		if object.GetBuiltinByName(name) != nil && c.bindings[name] > 0 {
+			return nil, nil
+		}
+		sym, ok = c.globalSymbols().Resolve(name)
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	switch sym.Scope {
+	case BuiltinScope:
+		if builtin := object.Builtins[sym.Index].Builtin; builtin.Pure {
+			return builtin, nil
+		}
+	case GlobalScope:
+		if fn := c.foldFns[sym.Index]; fn != nil {
+			return nil, fn
+		}
+	}
+	return nil, nil
+}
+
+// globalSymbols returns the symbol table of the global scope.
+func (c *Compiler) globalSymbols() *SymbolTable {
+	s := c.symTbl
+	for s.hasOuter() {
+		s = s.outer
+	}
+	return s
+}
+
+// evalConstPrefix evaluates a prefix expression with `operator` on a constant `right`. It
+// reports false if the VM could fail or behave differently depending on its options.
+func evalConstPrefix(operator string, right object.Object) (object.Object, bool) {
+	switch operator {
+	case "!":
+		switch right := right.(type) {
+		case *object.Boolean:
+			return &object.Boolean{Value: !right.Value}, true
+		case *object.Nil:
+			return &object.Boolean{Value: true}, true
+		default:
+			return &object.Boolean{Value: false}, true
+		}
+	case "-":
+		switch right := right.(type) {
+		case *object.Integer:
+			// Negating the minimum integer overflows
+			if right.Value == math.MinInt64 {
+				return nil, false
+			}
+			return &object.Integer{Value: -right.Value}, true
+		case *object.Float:
+			return &object.Float{Value: -right.Value}, true
+		}
+	}
+	return nil, false
+}
+
+// evalConstInfix evaluates an infix expression with `operator` on constants `left` and `right`.
+// It reports false if the VM could fail or behave differently depending on its options, e.g.
+// on integer overflow.
+func evalConstInfix(operator string, left, right object.Object) (object.Object, bool) {
+	switch left := left.(type) {
+	case *object.Integer:
+		right, ok := right.(*object.Integer)
+		if !ok {
+			return nil, false
+		}
+		return evalConstIntInfix(operator, left.Value, right.Value)
+
+	case *object.Float:
+		right, ok := right.(*object.Float)
+		if !ok {
+			return nil, false
+		}
+		l, r := left.Value, right.Value
+		switch operator {
+		case "+":
+			return &object.Float{Value: l + r}, true
+		case "-":
+			return &object.Float{Value: l - r}, true
+		case "*":
+			return &object.Float{Value: l * r}, true
+		}
+		return evalConstComparison(operator, l < r, l == r, l > r)
+
+	case *object.String:
+		right, ok := right.(*object.String)
+		if !ok {
+			return nil, false
+		}
+		switch operator {
+		case "+":
+			if len(left.Value)+len(right.Value) > maxFoldedStringLen {
+				return nil, false
+			}
+			return &object.String{Value: left.Value + right.Value}, true
+		case "==":
+			return &object.Boolean{Value: left.Value == right.Value}, true
+		case "!=":
+			return &object.Boolean{Value: left.Value != right.Value}, true
+		}
+
+	case *object.Boolean:
+		right, ok := right.(*object.Boolean)
+		if !ok {
+			return nil, false
+		}
+		switch operator {
+		case "==":
+			return &object.Boolean{Value: left.Value == right.Value}, true
+		case "!=":
+			return &object.Boolean{Value: left.Value != right.Value}, true
+		}
+	}
+	return nil, false
+}
+
+// evalConstIntInfix evaluates an infix expression with `operator` on integers `l` and `r`.
+func evalConstIntInfix(operator string, l, r int64) (object.Object, bool) {
+	var result int64
+	var overflow bool
+
+	switch operator {
+	case "+":
+		result = l + r
+		overflow = (l > 0 && r > 0 && result < 0) || (l < 0 && r < 0 && result >= 0)
+	case "-":
+		result = l - r
+		overflow = (l >= 0 && r < 0 && result < 0) || (l < 0 && r > 0 && result >= 0)
+	case "*":
+		result = l * r
+		overflow = l != 0 && (result/l != r || (l == -1 && r == math.MinInt64))
+	default:
+		return evalConstComparison(operator, l < r, l == r, l > r)
+	}
+
+	if overflow {
+		return nil, false
+	}
+	return &object.Integer{Value: result}, true
+}
+
+// evalConstComparison evaluates a comparison with `operator` given the order of its operands.
+func evalConstComparison(operator string, less, equal, greater bool) (object.Object, bool) {
+	var result bool
+	switch operator {
+	case "<":
+		result = less
+	case "<=":
+		result = less || equal
+	case ">":
+		result = greater
+	case ">=":
+		result = greater || equal
+	case "==":
+		result = equal
+	case "!=":
+		result = !equal
+	default:
+		return nil, false
+	}
+	return &object.Boolean{Value: result}, true
+}
@@ -0,0 +1,51 @@
+package compiler
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// TestGolden compiles each testdata/*.monkey file and compares the bytecode with the golden
+// file next to it. Run `go test -update` to regenerate the golden files after changing the code
+// generation, and review the diff.
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.monkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := New()
+		if err := c.Compile(parse(string(src))); err != nil {
+			t.Errorf("%s: compiler error: %s", file, err)
+			continue
+		}
+		got := c.Bytecode().SExpr() + "\n"
+
+		golden := strings.TrimSuffix(file, ".monkey") + ".golden"
+		if *update {
+			if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%s: bytecode does not match %s.\nwant=\n%s\ngot=\n%s", file, golden, want, got)
+		}
+	}
+}
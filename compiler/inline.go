@@ -0,0 +1,197 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/skatsuta/monkey-compiler/ast"
+)
+
+// maxInlineNodes is the maximum number of AST nodes in the body of a function to inline.
+const maxInlineNodes = 16
+
+// inlineTempPrefix prefixes the names of hidden bindings holding arguments of inlined calls.
+// It cannot appear in identifiers in source code.
+const inlineTempPrefix = "$inline"
+
+// findInlinableFunctions returns the top-level let statements in `program` which bind a name to
+// a function that can be inlined, i.e. a small non-recursive function whose body is a single
+// expression referring to nothing but its parameters. The name must not be bound anywhere else
+// in the program according to `bindings` counted by countBindings, so that it refers to the same
+// function wherever it is visible.
+func findInlinableFunctions(
+	program *ast.Program, bindings map[string]int,
+) map[*ast.LetStatement]bool {
+	lets := make(map[*ast.LetStatement]bool)
+	for _, stmt := range program.Statements {
+		ls, ok := stmt.(*ast.LetStatement)
+		if !ok || ls.Name == nil || bindings[ls.Name.Value] != 1 {
+			continue
+		}
+		if fn, ok := ls.Value.(*ast.FunctionLiteral); ok && inlineBody(fn) != nil {
+			lets[ls] = true
+		}
+	}
+	return lets
+}
+
+// countBindings counts bindings of each name in `node` by let, assignment and increment or
+// decrement statements and by patterns of match expressions, which shadow the name in their
+// arms.
+func countBindings(node ast.Node) map[string]int {
+	bindings := make(map[string]int)
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.LetStatement:
+			if node.Name != nil {
+				bindings[node.Name.Value]++
+			}
+		case *ast.AssignStatement:
+			if ident, ok := node.LHS.(*ast.Ident); ok {
+				bindings[ident.Value]++
+			}
+		case *ast.IncDecStatement:
+			if ident, ok := node.Operand.(*ast.Ident); ok {
+				bindings[ident.Value]++
+			}
+		case *ast.MatchExpression:
+			for _, arm := range node.Arms {
+				ast.Inspect(arm.Pattern, func(n ast.Node) bool {
+					if ident, ok := n.(*ast.Ident); ok && ident.Value != "_" {
+						bindings[ident.Value]++
+					}
+					return true
+				})
+			}
+		}
+		return true
+	})
+	return bindings
+}
+
+// expressionBody returns the expression which function `fn` evaluates to if its body is a
+// single expression, otherwise nil.
+func expressionBody(fn *ast.FunctionLiteral) ast.Expression {
+	if fn.Body == nil || len(fn.Body.Statements) != 1 {
+		return nil
+	}
+
+	var body ast.Expression
+	switch stmt := fn.Body.Statements[0].(type) {
+	case *ast.ExpressionStatement:
+		body = stmt.Expression
+	case *ast.ReturnStatement:
+		body = stmt.ReturnValue
+	}
+	if isNilNode(body) {
+		return nil
+	}
+	return body
+}
+
+// inlineBody returns the expression which function `fn` evaluates to if it can be inlined,
+// otherwise nil.
+func inlineBody(fn *ast.FunctionLiteral) ast.Expression {
+	body := expressionBody(fn)
+	if body == nil {
+		return nil
+	}
+
+	params := make(map[string]bool, len(fn.Parameters))
+	for _, p := range fn.Parameters {
+		params[p.Value] = true
+	}
+
+	numNodes := 0
+	ok := true
+	var inspect func(node ast.Node) bool
+	inspect = func(node ast.Node) bool {
+		numNodes++
+
+		switch node := node.(type) {
+		case *ast.Ident:
+			// Any other name may be a global, a builtin or the function itself
+			ok = ok && params[node.Value]
+		case *ast.FieldExpression:
+			// The field name is not a reference to a binding
+			ast.Inspect(node.Left, inspect)
+			return false
+		case *ast.FunctionLiteral, *ast.MacroLiteral:
+			ok = false
+		}
+		return ok
+	}
+	ast.Inspect(body, inspect)
+
+	if !ok || numNodes > maxInlineNodes {
+		return nil
+	}
+	return body
+}
+
+// inlineFunction returns the function to inline in place of `call` if any, otherwise nil.
+func (c *Compiler) inlineFunction(call *ast.CallExpression) *ast.FunctionLiteral {
+	ident, ok := call.Function.(*ast.Ident)
+	if !ok || len(c.inlineFns) == 0 {
+		return nil
+	}
+
+	// The name may be shadowed by a parameter of a function being inlined or a local binding
+	if _, ok := c.inlineParams[ident.Value]; ok {
+		return nil
+	}
+	sym, ok := c.symTbl.Resolve(ident.Value)
+	if !ok || sym.Scope != GlobalScope {
+		return nil
+	}
+
+	fn := c.inlineFns[sym.Index]
+	if fn == nil || len(fn.Parameters) != len(call.Arguments) {
+		return nil
+	}
+	return fn
+}
+
+// compileInlineCall compiles a call of function `fn` with `args` by evaluating the arguments
+// into hidden bindings and then the body of `fn` in place, with its parameters referring to
+// the bindings. The number of arguments must match the number of parameters.
+func (c *Compiler) compileInlineCall(fn *ast.FunctionLiteral, args []ast.Expression) error {
+	for _, arg := range args {
+		if err := c.Compile(arg); err != nil {
+			return err
+		}
+	}
+
+	params := make(map[string]Symbol, len(fn.Parameters))
+	temps := make([]Symbol, len(args))
+	for i, p := range fn.Parameters {
+		temps[i] = c.inlineTemp(i)
+		params[p.Value] = temps[i]
+	}
+
+	// The last argument is on top of the stack
+	for i := len(temps) - 1; i >= 0; i-- {
+		if err := c.storeSymbol(temps[i]); err != nil {
+			return err
+		}
+	}
+
+	outer := c.inlineParams
+	c.inlineParams = params
+	defer func() { c.inlineParams = outer }()
+
+	return c.Compile(inlineBody(fn))
+}
+
+// inlineTemp returns a hidden binding in the current scope for the `i`-th argument of an
+// inlined call.
+//
+// Inlined calls in the same scope share the bindings, which is safe because arguments are all
+// evaluated before they are stored, and the body of an inlined function contains no inlined
+// calls. Calls in the body run in frames of their own, which have separate local bindings.
+func (c *Compiler) inlineTemp(i int) Symbol {
+	name := fmt.Sprintf("%s%d", inlineTempPrefix, i)
+	if sym, ok := c.symTbl.ResolveCurrentScope(name); ok {
+		return sym
+	}
+	return c.symTbl.Define(name)
+}
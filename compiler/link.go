@@ -0,0 +1,84 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+// BuiltinNames returns the names of the built-in functions in the order of object.Builtins,
+// whose indexes are the operands of OpGetBuiltin instructions the compiler emits.
+func BuiltinNames() []string {
+	names := make([]string, len(object.Builtins))
+	for i, def := range object.Builtins {
+		names[i] = def.Name
+	}
+	return names
+}
+
+// LinkBuiltins makes the OpGetBuiltin instructions of `b`, which refer to built-in functions by
+// their indexes in b.Builtins, refer to the same functions by their indexes in object.Builtins
+// instead, so that bytecode compiled before built-in functions were added or reordered keeps
+// working. The instructions of the main program and of the compiled functions in the constant
+// pool are changed in place. It reports an error if the bytecode refers to a built-in function
+// which no longer exists.
+//
+// Bytecode without b.Builtins is assumed to refer to the built-in functions as they are now.
+func (b *Bytecode) LinkBuiltins() error {
+	if b.Builtins == nil {
+		return nil
+	}
+
+	current := make(map[string]int, len(object.Builtins))
+	for i, def := range object.Builtins {
+		current[def.Name] = i
+	}
+
+	relinked := false
+	indexes := make([]int, len(b.Builtins))
+	for i, name := range b.Builtins {
+		idx, ok := current[name]
+		if !ok {
+			idx = -1
+		}
+		indexes[i] = idx
+		relinked = relinked || idx != i
+	}
+
+	if relinked {
+		if err := relinkBuiltins(b.Instructions, b.Builtins, indexes); err != nil {
+			return err
+		}
+		for i, c := range b.Constants {
+			if fn, ok := c.(*object.CompiledFunction); ok {
+				if err := relinkBuiltins(fn.Instructions, b.Builtins, indexes); err != nil {
+					return fmt.Errorf("constant %d: %s", i, err)
+				}
+			}
+		}
+	}
+
+	b.Builtins = BuiltinNames()
+	return nil
+}
+
+// relinkBuiltins changes the operand of each OpGetBuiltin instruction in `insns` from an index
+// into `names` to the corresponding index in `indexes`, which is -1 for a removed function.
+func relinkBuiltins(insns code.Instructions, names []string, indexes []int) error {
+	var err error
+	forEachInstruction(insns, func(pos int, op code.Opcode, operands []int) {
+		if op != code.OpGetBuiltin || err != nil {
+			return
+		}
+		switch idx := operands[0]; {
+		case idx >= len(indexes):
+			err = fmt.Errorf("built-in function %d out of range", idx)
+		case indexes[idx] < 0:
+			err = fmt.Errorf("unknown built-in function: %s", names[idx])
+		default:
+			copy(insns[pos:], code.Make(op, indexes[idx]))
+		}
+	})
+	return err
+}
@@ -0,0 +1,106 @@
+package compiler
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+func TestLinkBuiltins(t *testing.T) {
+	index := func(name string) int {
+		for i, def := range object.Builtins {
+			if def.Name == name {
+				return i
+			}
+		}
+		t.Fatalf("built-in function %s not found", name)
+		return -1
+	}
+
+	// Bytecode compiled when `puts` and `len` were the only built-in functions
+	fn := &object.CompiledFunction{Instructions: concatInstructions([]code.Instructions{
+		code.Make(code.OpGetBuiltin, 0),
+		code.Make(code.OpReturnValue),
+	})}
+	b := &Bytecode{
+		Instructions: concatInstructions([]code.Instructions{
+			code.Make(code.OpGetBuiltin, 1),
+			code.Make(code.OpPop),
+		}),
+		Constants: []object.Object{fn},
+		Builtins:  []string{"puts", "len"},
+	}
+
+	if err := b.LinkBuiltins(); err != nil {
+		t.Fatalf("LinkBuiltins failed: %s", err)
+	}
+
+	err := testInstructions([]code.Instructions{
+		code.Make(code.OpGetBuiltin, index("len")),
+		code.Make(code.OpPop),
+	}, b.Instructions)
+	if err != nil {
+		t.Errorf("testInstructions failed for the main program: %s", err)
+	}
+	err = testInstructions([]code.Instructions{
+		code.Make(code.OpGetBuiltin, index("puts")),
+		code.Make(code.OpReturnValue),
+	}, fn.Instructions)
+	if err != nil {
+		t.Errorf("testInstructions failed for the function: %s", err)
+	}
+	if got, want := fmt.Sprint(b.Builtins), fmt.Sprint(BuiltinNames()); got != want {
+		t.Errorf("wrong built-in functions after linking. want=%s, got=%s", want, got)
+	}
+
+	// Bytecode compiled now is left as it is
+	c := New()
+	if err := c.Compile(parse(`len("abc")`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	b = c.Bytecode()
+	want := append(code.Instructions(nil), b.Instructions...)
+	if err := b.LinkBuiltins(); err != nil {
+		t.Fatalf("LinkBuiltins failed: %s", err)
+	}
+	if b.Instructions.String() != want.String() {
+		t.Errorf("instructions changed by linking. want=%q, got=%q", want, b.Instructions)
+	}
+}
+
+func TestLinkBuiltinsErrors(t *testing.T) {
+	tests := []struct {
+		builtins []string
+		operand  int
+		want     string
+	}{
+		{[]string{"len", "removed"}, 1, "unknown built-in function: removed"},
+		{[]string{"removed", "len"}, 2, "built-in function 2 out of range"},
+	}
+
+	for _, tt := range tests {
+		b := &Bytecode{
+			Instructions: code.Make(code.OpGetBuiltin, tt.operand),
+			Builtins:     tt.builtins,
+		}
+		err := b.LinkBuiltins()
+		if err == nil {
+			t.Errorf("expected an error but resulted in none")
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("wrong error. want=%q, got=%q", tt.want, err)
+		}
+	}
+
+	// Functions which are not used may be removed
+	b := &Bytecode{
+		Instructions: code.Make(code.OpGetBuiltin, 0),
+		Builtins:     []string{"len", "removed"},
+	}
+	if err := b.LinkBuiltins(); err != nil {
+		t.Errorf("LinkBuiltins failed: %s", err)
+	}
+}
@@ -0,0 +1,190 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/skatsuta/monkey-compiler/ast"
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+// loader emits instructions to push a value on to the stack, e.g. a part of the subject of a
+// match expression.
+type loader func() error
+
+// patternBinding is a binding of a name to the part of a subject a pattern matches.
+type patternBinding struct {
+	name string
+	load loader
+}
+
+// shadowedSymbol is a symbol of the current scope which a name bound by a pattern shadows in
+// its arm. `ok` is false if the name is not defined in the scope.
+type shadowedSymbol struct {
+	name string
+	sym  Symbol
+	ok   bool
+}
+
+// compileMatchExpression compiles a match expression `me`. The subject is stored into a hidden
+// binding, from which each arm loads the parts its pattern tests, jumping to the next arm as soon
+// as a test fails. When all the tests of an arm pass, the names its pattern binds are defined in
+// the current scope and its value is evaluated. The names are visible only in the arm, where
+// they shadow bindings of the same names around it. If no arm matches, the value is nil.
+func (c *Compiler) compileMatchExpression(me *ast.MatchExpression) error {
+	if err := c.Compile(me.Subject); err != nil {
+		return err
+	}
+
+	// Nested match expressions need their own hidden bindings, while sequential ones share them
+	name := fmt.Sprintf("$match%d", c.matchDepth)
+	subject, ok := c.symTbl.ResolveCurrentScope(name)
+	if !ok {
+		subject = c.symTbl.Define(name)
+	}
+	if err := c.storeSymbol(subject); err != nil {
+		return err
+	}
+
+	c.matchDepth++
+	defer func() { c.matchDepth-- }()
+
+	var endJumps []int
+	for _, arm := range me.Arms {
+		var failJumps []int
+		var bindings []patternBinding
+		load := func() error {
+			c.loadSymbol(subject)
+			return nil
+		}
+		if err := c.compilePattern(arm.Pattern, load, &failJumps, &bindings); err != nil {
+			return err
+		}
+
+		shadowed := make([]shadowedSymbol, len(bindings))
+		for i, b := range bindings {
+			shadowed[i].name = b.name
+			shadowed[i].sym, shadowed[i].ok = c.symTbl.ResolveCurrentScope(b.name)
+
+			sym := c.symTbl.Define(b.name)
+			if err := b.load(); err != nil {
+				return err
+			}
+			if err := c.storeSymbol(sym); err != nil {
+				return err
+			}
+		}
+
+		err := c.Compile(arm.Value)
+		// A name bound twice by the pattern is restored to what it was before the first binding
+		for i := len(shadowed) - 1; i >= 0; i-- {
+			c.symTbl.restore(shadowed[i].name, shadowed[i].sym, shadowed[i].ok)
+		}
+		if err != nil {
+			return err
+		}
+		endJumps = append(endJumps, c.emit(code.OpJump, 9999))
+
+		next := len(c.currentInsns())
+		for _, pos := range failJumps {
+			if err := c.changeOperand(pos, next); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.emit(code.OpNil)
+
+	end := len(c.currentInsns())
+	for _, pos := range endJumps {
+		if err := c.changeOperand(pos, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compilePattern emits tests of whether the value `load` pushes matches `pattern`, each of which
+// jumps away if it fails, and appends the positions of the jumps to `failJumps`. The names the
+// pattern binds are appended to `bindings`, to be defined once all the tests pass.
+func (c *Compiler) compilePattern(
+	pattern ast.Expression, load loader, failJumps *[]int, bindings *[]patternBinding,
+) error {
+	switch pattern := pattern.(type) {
+	case *ast.Ident:
+		if pattern.Value != "_" {
+			*bindings = append(*bindings, patternBinding{name: pattern.Value, load: load})
+		}
+		return nil
+
+	case *ast.ArrayLiteral:
+		if err := load(); err != nil {
+			return err
+		}
+		c.emit(code.OpMatchArray, len(pattern.Elements))
+		*failJumps = append(*failJumps, c.emit(code.OpJumpNotTruthy, 9999))
+
+		for i, el := range pattern.Elements {
+			idx := c.addNumber(&object.Integer{Value: int64(i)})
+			elLoad := func() error {
+				if err := load(); err != nil {
+					return err
+				}
+				c.emit(code.OpConstant, idx)
+				c.emit(code.OpGetIndex)
+				return nil
+			}
+			if err := c.compilePattern(el, elLoad, failJumps, bindings); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case *ast.HashLiteral:
+		if err := load(); err != nil {
+			return err
+		}
+		c.emit(code.OpMatchHash)
+		*failJumps = append(*failJumps, c.emit(code.OpJumpNotTruthy, 9999))
+
+		for _, pair := range pattern.Pairs {
+			key := pair.Key
+			if err := c.Compile(key); err != nil {
+				return err
+			}
+			if err := load(); err != nil {
+				return err
+			}
+			c.emit(code.OpIn)
+			*failJumps = append(*failJumps, c.emit(code.OpJumpNotTruthy, 9999))
+
+			valLoad := func() error {
+				if err := load(); err != nil {
+					return err
+				}
+				if err := c.Compile(key); err != nil {
+					return err
+				}
+				c.emit(code.OpGetIndex)
+				return nil
+			}
+			err := c.compilePattern(pair.Value, valLoad, failJumps, bindings)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		// A literal matches an equal value
+		if err := load(); err != nil {
+			return err
+		}
+		if err := c.Compile(pattern); err != nil {
+			return err
+		}
+		c.emit(code.OpEqual)
+		*failJumps = append(*failJumps, c.emit(code.OpJumpNotTruthy, 9999))
+		return nil
+	}
+}
@@ -0,0 +1,78 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+// SExpr returns a canonical representation of `b` as an s-expression, which is meant to be
+// compared with golden files in tests instead of instructions made by code.Make one by one.
+//
+// Each instruction is put on a separate line as a list of its offset, opcode and operands in
+// decimal, e.g. `(0003 OpConstant 1)`, and each constant as a list of its index and value.
+// Compiled functions show their instructions in the same way.
+func (b *Bytecode) SExpr() string {
+	var out strings.Builder
+	out.WriteString("(bytecode\n  ")
+	writeInstructions(&out, b.Instructions, 1)
+	out.WriteString("\n  (constants")
+	for i, c := range b.Constants {
+		fmt.Fprintf(&out, "\n    (%d ", i)
+		writeConstant(&out, c, 2)
+		out.WriteString(")")
+	}
+	out.WriteString("))")
+	return out.String()
+}
+
+func writeConstant(out *strings.Builder, obj object.Object, depth int) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		fmt.Fprintf(out, "(integer %d)", obj.Value)
+	case *object.Float:
+		fmt.Fprintf(out, "(float %s)", strconv.FormatFloat(obj.Value, 'g', -1, 64))
+	case *object.String:
+		fmt.Fprintf(out, "(string %s)", strconv.Quote(obj.Value))
+	case *object.CompiledFunction:
+		out.WriteString("(function")
+		if obj.Name != "" {
+			out.WriteString(" " + obj.Name)
+		}
+		fmt.Fprintf(out, " (params %d) (locals %d)\n%s", obj.NumParameters, obj.NumLocals,
+			strings.Repeat("  ", depth+1))
+		writeInstructions(out, obj.Instructions, depth+1)
+		out.WriteString(")")
+	default:
+		fmt.Fprintf(out, "(%s %s)", strings.ToLower(string(obj.Type())), strconv.Quote(obj.Inspect()))
+	}
+}
+
+// writeInstructions writes `insns` as a list of instructions on separate lines indented for
+// `depth` levels of nesting.
+func writeInstructions(out *strings.Builder, insns code.Instructions, depth int) {
+	indent := strings.Repeat("  ", depth+1)
+
+	out.WriteString("(instructions")
+	for i := 0; i < len(insns); {
+		def, err := code.Lookup(insns[i])
+		if err != nil {
+			fmt.Fprintf(out, "\n%s(%04d <undefined opcode %d>)", indent, i, insns[i])
+			i++
+			continue
+		}
+
+		fmt.Fprintf(out, "\n%s(%04d %s", indent, i, def.Name)
+		operands, read := code.ReadOperands(def, insns[i+1:])
+		for _, operand := range operands {
+			fmt.Fprintf(out, " %d", operand)
+		}
+		out.WriteString(")")
+
+		i += 1 + read
+	}
+	out.WriteString(")")
+}
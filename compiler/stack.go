@@ -0,0 +1,86 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/skatsuta/monkey-compiler/code"
+)
+
+// MaxStackDepth analyzes instructions `insns` of a function and returns the maximum number of
+// elements they can leave on the stack at once, not counting the slots reserved for local
+// bindings. It reports an error if some path through the instructions underflows the stack or
+// if paths reach the same instruction with different stack depths, both of which indicate a bug
+// in the compiler or malformed bytecode. The instructions must be well-formed otherwise, i.e.
+// every instruction is defined and has all its operands, and jumps land on instructions.
+func MaxStackDepth(insns code.Instructions) (int, error) {
+	// depths[ip] is the stack depth right before executing the instruction at ip; -1 means the
+	// instruction has not been reached yet
+	depths := make([]int, len(insns))
+	for i := range depths {
+		depths[i] = -1
+	}
+
+	max := 0
+	var worklist []int
+
+	// visit records that the instruction at `ip` is reachable with stack depth `depth`
+	visit := func(ip, depth int) error {
+		if ip >= len(insns) {
+			return nil
+		}
+		if depths[ip] < 0 {
+			depths[ip] = depth
+			worklist = append(worklist, ip)
+			return nil
+		}
+		if depths[ip] != depth {
+			return fmt.Errorf("inconsistent stack depth at %04d: %d and %d", ip, depths[ip], depth)
+		}
+		return nil
+	}
+
+	if err := visit(0, 0); err != nil {
+		return 0, err
+	}
+
+	for len(worklist) > 0 {
+		ip := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+
+		op := code.Opcode(insns[ip])
+		def, err := code.Lookup(byte(op))
+		if err != nil {
+			return 0, err
+		}
+		operands, n := code.ReadOperands(def, insns[ip+1:])
+
+		pops, pushes := def.StackEffect(operands)
+		depth := depths[ip] - pops
+		if depth < 0 {
+			return 0, fmt.Errorf("stack underflow at %04d: %s", ip, def.Name)
+		}
+		depth += pushes
+		if depth > max {
+			max = depth
+		}
+
+		next := ip + 1 + n
+		switch op {
+		case code.OpJump:
+			err = visit(operands[0], depth)
+		case code.OpJumpNotTruthy, code.OpJumpTruthy:
+			if err = visit(operands[0], depth); err == nil {
+				err = visit(next, depth)
+			}
+		case code.OpReturnValue, code.OpReturn:
+			// Control never falls through to the next instruction
+		default:
+			err = visit(next, depth)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return max, nil
+}
@@ -1,5 +1,7 @@
 package compiler
 
+import "sort"
+
 // SymbolScope represents a scope of symbols.
 type SymbolScope string
 
@@ -59,6 +61,35 @@ func (s *SymbolTable) Define(name string) Symbol {
 	return sym
 }
 
+// DefineAt defines an identifier as a symbol at the `index` in a scope. It is meant to restore
+// symbols returned by Symbols; symbols defined by Define afterwards get indices after it.
+func (s *SymbolTable) DefineAt(name string, index int) Symbol {
+	scope := GlobalScope
+	if s.hasOuter() {
+		scope = LocalScope
+	}
+
+	sym := s.define(name, scope, index)
+	if index >= s.numDefs {
+		s.numDefs = index + 1
+	}
+	return sym
+}
+
+// Symbols returns the symbols defined by Define or DefineAt in the table itself, sorted by
+// their indices.
+func (s *SymbolTable) Symbols() []Symbol {
+	syms := make([]Symbol, 0, len(s.store))
+	for _, sym := range s.store {
+		if sym.Scope == GlobalScope || sym.Scope == LocalScope {
+			syms = append(syms, sym)
+		}
+	}
+
+	sort.Slice(syms, func(i, j int) bool { return syms[i].Index < syms[j].Index })
+	return syms
+}
+
 // DefineBuiltin defines a built-in function with `name` at the `index`.
 func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	return s.define(name, BuiltinScope, index)
@@ -91,8 +122,9 @@ func (s *SymbolTable) Resolve(name string) (sym Symbol, exists bool) {
 	}
 
 	sym, exists = s.outer.Resolve(name)
-	if exists && (sym.Scope == LocalScope || sym.Scope == FreeScope) {
-		// Define an outer local or free variable as a free variable in the current scope
+	if exists && (sym.Scope == LocalScope || sym.Scope == FreeScope || sym.Scope == FunctionScope) {
+		// Define an outer local or free variable, or the name of an enclosing function, as a
+		// free variable in the current scope
 		sym = s.defineFree(sym)
 	}
 	return sym, exists
@@ -105,6 +137,22 @@ func (s *SymbolTable) ResolveCurrentScope(name string) (sym Symbol, exists bool)
 	return sym, exists
 }
 
+// restore defines `name` as `sym` in the current scope again, or removes it if `ok` is false, once
+// a symbol which has shadowed it goes out of scope.
+func (s *SymbolTable) restore(name string, sym Symbol, ok bool) {
+	if ok {
+		s.store[name] = sym
+	} else {
+		delete(s.store, name)
+	}
+}
+
+// FreeCount returns the number of free variables the function of the table captures from the
+// enclosing scopes, including those its nested functions capture through it.
+func (s *SymbolTable) FreeCount() int {
+	return len(s.freeSymbols)
+}
+
 // hasOuter returns true if `s` has an outer symbol table, otherwise false.
 func (s *SymbolTable) hasOuter() bool {
 	return s.outer != nil
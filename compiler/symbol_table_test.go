@@ -1,6 +1,9 @@
 package compiler
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestDefine(t *testing.T) {
 	want := map[string]Symbol{
@@ -278,6 +281,63 @@ func TestResolveFree(t *testing.T) {
 	}
 }
 
+func TestResolveFreeThroughNestedScopes(t *testing.T) {
+	// fn(a) { let b; fn() { fn() { fn() { a } }; fn() { a + b } } }
+	global := NewSymbolTable()
+	first := NewEnclosedSymbolTable(global)
+	first.Define("a")
+	first.Define("b")
+	second := NewEnclosedSymbolTable(first)
+	third := NewEnclosedSymbolTable(second)
+	fourth := NewEnclosedSymbolTable(third)
+	sibling := NewEnclosedSymbolTable(second)
+
+	// A variable used in the innermost function is captured by each function in between
+	got, ok := fourth.Resolve("a")
+	if want := (Symbol{Name: "a", Scope: FreeScope, Index: 0}); !ok || got != want {
+		t.Fatalf("expected %q to resolve to %+v, but got %+v", "a", want, got)
+	}
+
+	// A sibling function captures what its enclosing function has captured already, and adds
+	// what it has not
+	for i, name := range []string{"a", "b"} {
+		got, ok := sibling.Resolve(name)
+		if want := (Symbol{Name: name, Scope: FreeScope, Index: i}); !ok || got != want {
+			t.Errorf("expected %q to resolve to %+v, but got %+v", name, want, got)
+		}
+	}
+
+	tests := []struct {
+		name            string
+		table           *SymbolTable
+		wantFreeSymbols []Symbol
+	}{
+		{"first", first, []Symbol{}},
+		{"second", second, []Symbol{
+			{Name: "a", Scope: LocalScope, Index: 0},
+			{Name: "b", Scope: LocalScope, Index: 1},
+		}},
+		{"third", third, []Symbol{{Name: "a", Scope: FreeScope, Index: 0}}},
+		{"fourth", fourth, []Symbol{{Name: "a", Scope: FreeScope, Index: 0}}},
+		{"sibling", sibling, []Symbol{
+			{Name: "a", Scope: FreeScope, Index: 0},
+			{Name: "b", Scope: FreeScope, Index: 1},
+		}},
+	}
+
+	for _, tt := range tests {
+		if got, want := tt.table.FreeCount(), len(tt.wantFreeSymbols); got != want {
+			t.Errorf("%s: wrong number of free symbols. want=%d, got=%d", tt.name, want, got)
+			continue
+		}
+		for i, want := range tt.wantFreeSymbols {
+			if got := tt.table.freeSymbols[i]; got != want {
+				t.Errorf("%s: wrong free symbol. want=%+v, got=%+v", tt.name, want, got)
+			}
+		}
+	}
+}
+
 func TestResolveUnresolvable(t *testing.T) {
 	global := NewSymbolTable()
 	global.Define("a")
@@ -403,6 +463,28 @@ func TestDefineAndResolveFunctionName(t *testing.T) {
 	}
 }
 
+func TestResolveFunctionNameInNestedScope(t *testing.T) {
+	global := NewSymbolTable()
+	outer := NewEnclosedSymbolTable(global)
+	outer.DefineFunctionName("a")
+	inner := NewEnclosedSymbolTable(outer)
+
+	// The name of an enclosing function refers to its closure, not to the inner function
+	want := Symbol{Name: "a", Scope: FreeScope, Index: 0}
+
+	got, ok := inner.Resolve(want.Name)
+	if !ok {
+		t.Fatalf("function name %q not resolvable", want.Name)
+	}
+
+	if got != want {
+		t.Errorf("expected %q to resolve to %+v, but got %+v", want.Name, want, got)
+	}
+	if free := inner.freeSymbols; len(free) != 1 || free[0].Scope != FunctionScope {
+		t.Errorf("wrong free symbols: %+v", free)
+	}
+}
+
 func TestDefineAndResolveCurrentScopeFunctionName(t *testing.T) {
 	global := NewSymbolTable()
 	global.DefineFunctionName("a")
@@ -452,3 +534,34 @@ func TestShadowingFunctionNameCurrentScope(t *testing.T) {
 		t.Errorf("expected %q to resolve to %+v, but got %+v", want.Name, want, got)
 	}
 }
+
+func TestSymbolsAndDefineAt(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+	global.Define("a")
+	global.Define("b")
+	global.Define("a") // Redefinition leaves index 0 unused
+
+	want := []Symbol{
+		{Name: "b", Scope: GlobalScope, Index: 1},
+		{Name: "a", Scope: GlobalScope, Index: 2},
+	}
+	got := global.Symbols()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong symbols. want=%+v, got=%+v", want, got)
+	}
+
+	restored := NewSymbolTable()
+	for _, sym := range got {
+		restored.DefineAt(sym.Name, sym.Index)
+	}
+	if got := restored.Symbols(); !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong restored symbols. want=%+v, got=%+v", want, got)
+	}
+
+	// New symbols must not overwrite the restored ones
+	c := restored.Define("c")
+	if want := (Symbol{Name: "c", Scope: GlobalScope, Index: 3}); c != want {
+		t.Errorf("wrong symbol defined after restore. want=%+v, got=%+v", want, c)
+	}
+}
@@ -0,0 +1,378 @@
+package difftest
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/ast"
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/eval"
+	"github.com/skatsuta/monkey-compiler/lexer"
+	"github.com/skatsuta/monkey-compiler/object"
+	"github.com/skatsuta/monkey-compiler/parser"
+	"github.com/skatsuta/monkey-compiler/vm"
+)
+
+// corpus is a list of programs exercising various features of the language. Each program must
+// end with an expression statement so that both engines produce its value as the result.
+//
+// Some differences between the engines are intended and not covered here: the evaluator does not
+// support assignment statements, including those to indices and fields, nor checks the number of
+// arguments to functions, nor calls functions of hashes overloading operators, and it divides
+// integers into an integer while the VM always divides numbers into a floating-point number.
+var corpus = []string{
+	// Arithmetic and comparison
+	"1 + 2 * 3 - 4 * 2",
+	"-(5 + 5) * 2",
+	"--5",
+	"let a = 3; let b = 1; a--b",
+	"1.5 + 2",
+	"3 * 2.5",
+	"10 / 4.0",
+	"1e+21 * 2.5e-3",
+	"1 < 2",
+	"2 <= 2",
+	"3 >= 4",
+	"1 > 2.5",
+	"1 == 1",
+	"1 != 1",
+	"true == false",
+	`"a" == "a"`,
+	`"a" != "b"`,
+	`"foo" + "bar"`,
+	"1.0 / 0",
+	`1 + "a"`,
+	`"a" - "b"`,
+	"-true",
+
+	// Truthiness and logical operators
+	"!true",
+	"!!5",
+	"!nil",
+	"!0",
+	`!""`,
+	"1 && 2",
+	"0 && 2",
+	"nil && 2",
+	"false || 3",
+	"nil || nil",
+	`"" || 1`,
+	"if (0) { 1 } else { 2 }",
+	`if ("") { 1 } else { 2 }`,
+	"if ([]) { 1 } else { 2 }",
+	"if (nil) { 1 }",
+	"if (false) { 1 }",
+
+	// Bindings and functions
+	"let a = 1; let b = a + 1; a + b",
+	"let add = fn(a, b) { a + b }; add(1, 2)",
+	"let f = fn() { return 1; 2 }; f()",
+	"let f = fn() { }; f()",
+	"let f = fn(x) { if (x > 1) { return x; } 0 }; [f(1), f(2)]",
+	"let newAdder = fn(x) { fn(y) { x + y } }; newAdder(2)(3)",
+	"let x = x + 1; x",
+	"let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(15)",
+	"1(2)",
+
+	// Arrays, hashes and strings
+	"[1, 2 * 2, 3 + 3]",
+	"[1, 2, 3][1]",
+	"[1, 2, 3][3]",
+	"[1, 2, 3][-1]",
+	`{"a": 1}["a"]`,
+	`{"a": 1}["b"]`,
+	`{1: "one"}[1]`,
+	`{true: 1}[true]`,
+	`{1: "one"}[1.0]`,
+	`{1.0: "one"}[1]`,
+	`{1: "a", 1.0: "b"}`,
+	`{1.5: "a"}[1.5]`,
+	`{-0.0: "zero"}[0]`,
+	`{big("100000000000000000000"): "big"}[100000000000000000000.0]`,
+	`{0.0 / 0.0: 1, 0.0 / 0.0: 2}`,
+	`let h = {"a": 1}; h.a`,
+	`let h = {"f": fn(self, x) { x * 2 }}; h.f(21)`,
+	`"hello"[1]`,
+	`"hello"[10]`,
+	`{[1]: 2}`,
+
+	// Match expressions
+	"let x = 10; match 3 { x => x }",
+	"let x = 10; match [3, 4] { [x, y] => x + y }; x",
+
+	// Built-in functions
+	`len("héllo")`,
+	"len([1, 2, 3])",
+	"len(1)",
+	"first([1, 2])",
+	"first([])",
+	"last([1, 2])",
+	"rest([1, 2, 3])",
+	"rest([])",
+	"push([1], 2)",
+	`to_str(bytes("abc"))`,
+	`len(bytes([1, 2, 256]))`,
+	`slice(bytes("hello"), 1, 3)`,
+	`to_str(123)`,
+	`big("123456789012345678901234567890")`,
+}
+
+func TestCorpus(t *testing.T) {
+	for _, src := range corpus {
+		compare(t, src)
+	}
+}
+
+func TestRandomPrograms(t *testing.T) {
+	const seed = 1
+
+	g := &generator{r: rand.New(rand.NewSource(seed))}
+	for i := 0; i < 2000; i++ {
+		compare(t, g.program())
+	}
+}
+
+func TestEvaluationOrder(t *testing.T) {
+	// Operands and arguments print themselves when evaluated, so that the outputs differ if the
+	// engines evaluate them in different orders or one of them stops earlier than the other
+	const prelude = `let p = fn(x) { puts(x); x }; `
+	programs := []string{
+		`p("a") + p("b") + p("c")`,
+		`p("<") + p(1) + p(">")`,
+		`p(1) + "x" + p("y")`,
+		`1 + "x" + p("y")`,
+		`"x" + p(1) + p("y")`,
+		`[p(1), p(2)][p(0)]`,
+		`len(p("a")) + len(p("bc"))`,
+	}
+
+	defer func(w io.Writer) { eval.Stdout = w }(eval.Stdout)
+	for _, program := range programs {
+		src := prelude + program
+
+		var evalOut, vmOut strings.Builder
+		eval.Stdout = &evalOut
+		_, evalErr := runEval(src)
+		_, vmErr := runVM(src, vm.WithStdout(&vmOut))
+
+		if (evalErr == nil) != (vmErr == nil) {
+			t.Errorf("%s\nonly one engine failed.\neval: %v\nvm:   %v", src, evalErr, vmErr)
+		}
+		if evalOut.String() != vmOut.String() {
+			t.Errorf("%s\noutputs differ.\neval: %q\nvm:   %q", src, evalOut.String(),
+				vmOut.String())
+		}
+	}
+}
+
+// compare runs source code `src` on both engines and reports if their results differ.
+func compare(t *testing.T, src string) {
+	t.Helper()
+
+	evalResult, evalErr := runEval(src)
+	vmResult, vmErr := runVM(src)
+
+	switch {
+	case evalErr != nil && vmErr != nil:
+		// Both engines failed; error messages are allowed to differ
+	case evalErr != nil:
+		t.Errorf("%s\neval failed but vm did not.\neval: %s\nvm:   %s", src, evalErr, vmResult)
+	case vmErr != nil:
+		t.Errorf("%s\nvm failed but eval did not.\neval: %s\nvm:   %s", src, evalResult, vmErr)
+	case evalResult != vmResult:
+		t.Errorf("%s\nresults differ.\neval: %s\nvm:   %s", src, evalResult, vmResult)
+	}
+}
+
+func runEval(src string) (result string, err error) {
+	program, err := parse(src)
+	if err != nil {
+		return "", err
+	}
+
+	obj := eval.Eval(program, object.NewEnvironment())
+	if obj == nil {
+		return "nil", nil
+	}
+	if e, ok := obj.(*object.Error); ok {
+		return "", fmt.Errorf("%s", e.Message)
+	}
+	return inspect(obj), nil
+}
+
+func runVM(src string, opts ...vm.Option) (result string, err error) {
+	program, err := parse(src)
+	if err != nil {
+		return "", err
+	}
+
+	c := compiler.New()
+	if err := c.Compile(program); err != nil {
+		return "", err
+	}
+
+	machine := vm.New(c.Bytecode(), opts...)
+	if err := machine.Run(); err != nil {
+		return "", err
+	}
+	// Errors returned by built-in functions are values in the VM
+	obj := machine.Result()
+	if e, ok := obj.(*object.Error); ok {
+		return "", fmt.Errorf("%s", e.Message)
+	}
+	return inspect(obj), nil
+}
+
+func parse(src string) (*ast.Program, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("parse errors: %s", strings.Join(p.Errors(), "; "))
+	}
+	return program, nil
+}
+
+// inspect returns a representation of `obj` which is comparable across the engines. Functions
+// are represented only by their types since the engines represent them differently.
+func inspect(obj object.Object) string {
+	switch obj := obj.(type) {
+	case *object.Function, *object.Closure:
+		return "<function>"
+	case *object.Builtin:
+		return "<builtin>"
+	case *object.Array:
+		elems := make([]string, len(obj.Elements))
+		for i, el := range obj.Elements {
+			elems[i] = inspect(el)
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	default:
+		return fmt.Sprintf("%s(%s)", obj.Type(), obj.Inspect())
+	}
+}
+
+// generator generates random programs.
+type generator struct {
+	r *rand.Rand
+	// defined is the number of the global bindings x, y and f defined so far. Only defined
+	// bindings are referred to because the compiler rejects undefined ones even if they are
+	// never evaluated.
+	defined int
+	// inFunc reports whether an expression is being generated in the body of f, where its
+	// parameter a is available but f must not be called because unbounded recursion crashes
+	// the evaluator
+	inFunc bool
+}
+
+// program generates a random program consisting of let statements followed by an expression.
+func (g *generator) program() string {
+	g.defined = 0
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "let x = %s; ", g.intExpr(2))
+	g.defined++
+	fmt.Fprintf(&b, "let y = %s; ", g.boolExpr(2))
+	g.defined++
+	g.inFunc = true
+	fmt.Fprintf(&b, "let f = fn(a) { %s }; ", g.anyExpr(2))
+	g.inFunc = false
+	g.defined++
+	b.WriteString(g.anyExpr(3))
+	return b.String()
+}
+
+func (g *generator) anyExpr(depth int) string {
+	switch g.r.Intn(6) {
+	case 0, 1:
+		return g.intExpr(depth)
+	case 2:
+		return g.boolExpr(depth)
+	case 3:
+		return g.stringExpr(depth)
+	case 4:
+		return fmt.Sprintf("[%s, %s]", g.anyExpr(depth-1), g.anyExpr(depth-1))
+	default:
+		if g.defined < 3 || g.inFunc {
+			return g.intExpr(depth)
+		}
+		return fmt.Sprintf("f(%s)", g.anyExpr(depth-1))
+	}
+}
+
+func (g *generator) intExpr(depth int) string {
+	if depth <= 0 || g.r.Intn(4) == 0 {
+		switch g.r.Intn(4) {
+		case 0:
+			// x is referred to even in its own definition, where both engines fail at runtime
+			return "x"
+		case 1:
+			if g.inFunc {
+				return "a"
+			}
+			fallthrough
+		default:
+			return fmt.Sprint(g.r.Intn(21) - 10)
+		}
+	}
+
+	switch g.r.Intn(7) {
+	case 0:
+		return fmt.Sprintf("-%s", g.intExpr(depth-1))
+	case 1:
+		return fmt.Sprintf("if (%s) { %s } else { %s }",
+			g.boolExpr(depth-1), g.intExpr(depth-1), g.intExpr(depth-1))
+	case 2:
+		return fmt.Sprintf("[%s, %s][%d]", g.intExpr(depth-1), g.intExpr(depth-1), g.r.Intn(3))
+	case 3:
+		return fmt.Sprintf("len(%s)", g.stringExpr(depth-1))
+	default:
+		// Division is left out since it is intended to differ between the engines
+		ops := []string{"+", "-", "*"}
+		return fmt.Sprintf("(%s %s %s)",
+			g.intExpr(depth-1), ops[g.r.Intn(len(ops))], g.intExpr(depth-1))
+	}
+}
+
+func (g *generator) boolExpr(depth int) string {
+	if depth <= 0 || g.r.Intn(4) == 0 {
+		switch g.r.Intn(3) {
+		case 0:
+			if g.defined >= 2 {
+				return "y"
+			}
+			fallthrough
+		case 1:
+			return "true"
+		default:
+			return "false"
+		}
+	}
+
+	switch g.r.Intn(4) {
+	case 0:
+		return fmt.Sprintf("!%s", g.anyExpr(depth-1))
+	case 1:
+		ops := []string{"&&", "||"}
+		return fmt.Sprintf("(%s %s %s)",
+			g.anyExpr(depth-1), ops[g.r.Intn(len(ops))], g.anyExpr(depth-1))
+	default:
+		ops := []string{"<", ">", "<=", ">=", "==", "!="}
+		return fmt.Sprintf("(%s %s %s)",
+			g.intExpr(depth-1), ops[g.r.Intn(len(ops))], g.intExpr(depth-1))
+	}
+}
+
+func (g *generator) stringExpr(depth int) string {
+	if depth <= 0 || g.r.Intn(3) == 0 {
+		strs := []string{`""`, `"a"`, `"bc"`, `"héllo"`}
+		return strs[g.r.Intn(len(strs))]
+	}
+
+	if g.r.Intn(2) == 0 {
+		return fmt.Sprintf("(%s + %s)", g.stringExpr(depth-1), g.stringExpr(depth-1))
+	}
+	return fmt.Sprintf("to_str(%s)", g.anyExpr(depth-1))
+}
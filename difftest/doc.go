@@ -0,0 +1,4 @@
+// Package difftest runs Monkey programs through both the tree-walking evaluator and the
+// compiler and VM, and checks that the two engines agree on the results. It only contains
+// tests.
+package difftest
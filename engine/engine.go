@@ -0,0 +1,271 @@
+// Package engine runs Monkey scripts in long-running Go programs, e.g. servers calling
+// functions defined by a script, which can be edited and reloaded while the program runs.
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/eval"
+	"github.com/skatsuta/monkey-compiler/lexer"
+	"github.com/skatsuta/monkey-compiler/object"
+	"github.com/skatsuta/monkey-compiler/parser"
+	"github.com/skatsuta/monkey-compiler/vm"
+)
+
+// Script is a script file which has been compiled and run, so that its top-level bindings can
+// be used by the host. It is safe for concurrent use; calls into the script are serialized.
+type Script struct {
+	filename string
+	opts     []vm.Option
+
+	mu      sync.Mutex
+	prog    *program
+	modTime time.Time
+}
+
+// program is a compiled script together with the VM which has run it.
+type program struct {
+	bytecode *compiler.Bytecode
+	globals  []object.Object
+	machine  *vm.VM
+	result   object.Object
+}
+
+// Load compiles a script file `filename` and runs its top-level statements on a VM configured
+// with `opts`.
+func Load(filename string, opts ...vm.Option) (*Script, error) {
+	s := &Script{filename: filename, opts: opts}
+	prog, modTime, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	s.prog, s.modTime = prog, modTime
+	return s, nil
+}
+
+// load compiles and runs the script file, and returns it with its modification time.
+func (s *Script) load() (*program, time.Time, error) {
+	info, err := os.Stat(s.filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	src, err := ioutil.ReadFile(s.filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	bytecode, err := compile(string(src))
+	if err != nil {
+		return nil, info.ModTime(), fmt.Errorf("%s: %w", s.filename, err)
+	}
+
+	globals := make([]object.Object, vm.GlobalSize)
+	machine := vm.NewWithGlobalStore(bytecode, globals, s.opts...)
+	if err := machine.Run(); err != nil {
+		return nil, info.ModTime(), fmt.Errorf("%s: %w", s.filename, err)
+	}
+
+	prog := &program{
+		bytecode: bytecode,
+		globals:  globals,
+		machine:  machine,
+		result:   machine.Result(),
+	}
+	return prog, info.ModTime(), nil
+}
+
+// compile parses source code `src`, expands macros in it and compiles it to bytecode.
+func compile(src string) (*compiler.Bytecode, error) {
+	p := parser.New(lexer.New(src))
+	prog := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, errors.New(strings.Join(p.Errors(), "\n"))
+	}
+
+	macroEnv := object.NewEnvironment()
+	eval.DefineMacros(prog, macroEnv)
+	expanded, err := eval.ExpandMacros(prog, macroEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	c := compiler.New()
+	if err := c.Compile(expanded); err != nil {
+		return nil, err
+	}
+	return c.Bytecode(), nil
+}
+
+// Global returns the value bound to `name` at the top level of the script, and true if any.
+func (s *Script) Global(name string) (object.Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx, ok := s.prog.bytecode.Globals[name]
+	if !ok || s.prog.globals[idx] == nil {
+		return nil, false
+	}
+	return s.prog.globals[idx], true
+}
+
+// Result returns the value of the script loaded last, i.e. the value of its last top-level
+// statement if it is an expression, the same as the REPL prints for an input. It returns nil if
+// the script ends with another kind of statement.
+func (s *Script) Result() object.Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.prog.result
+}
+
+// Call calls the function bound to `name` at the top level of the script with `args`.
+func (s *Script) Call(name string, args ...object.Object) (object.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx, ok := s.prog.bytecode.Globals[name]
+	if !ok || s.prog.globals[idx] == nil {
+		return nil, fmt.Errorf("%s: %s is not defined", s.filename, name)
+	}
+	return s.prog.machine.Call(s.prog.globals[idx], args...)
+}
+
+// Reload compiles and runs the script file again, and then swaps it in for the current one.
+// Top-level bindings which the new script binds to values of the same type as the current one
+// keep their current values, so that the state of the script survives reloading, while
+// functions always take their new definitions. So do values holding functions, e.g. a hash of
+// handlers, as the functions are compiled against the constant pool of the current script and
+// cannot run with the one of the new script.
+//
+// If the new script fails to compile or run, Reload returns the error and the current one
+// stays in use.
+func (s *Script) Reload() error {
+	prog, modTime, err := s.load()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !modTime.IsZero() {
+		s.modTime = modTime
+	}
+	if err != nil {
+		return err
+	}
+
+	for name, idx := range prog.bytecode.Globals {
+		oldIdx, ok := s.prog.bytecode.Globals[name]
+		if !ok {
+			continue
+		}
+
+		old, cur := s.prog.globals[oldIdx], prog.globals[idx]
+		if old == nil || cur == nil {
+			continue
+		}
+		if object.TypeName(cur) == object.TypeName(old) && !holdsFunction(old, nil) {
+			prog.globals[idx] = old
+		}
+	}
+
+	s.prog = prog
+	return nil
+}
+
+// holdsFunction reports whether `obj` is a function or holds one, e.g. as an element of an
+// array or in a thunk. `seen` is the set of arrays and hashes visited so far, which may contain
+// themselves.
+func holdsFunction(obj object.Object, seen map[object.Object]bool) bool {
+	switch obj := obj.(type) {
+	case *object.Thunk:
+		return true
+	case *object.Future:
+		return obj.Value != nil && holdsFunction(obj.Value, seen)
+	case object.ArrayObject:
+		if seen[obj] {
+			return false
+		}
+		if seen == nil {
+			seen = make(map[object.Object]bool)
+		}
+		seen[obj] = true
+		for i := 0; i < obj.Len(); i++ {
+			if holdsFunction(obj.Get(i), seen) {
+				return true
+			}
+		}
+		return false
+	case object.HashObject:
+		if seen[obj] {
+			return false
+		}
+		if seen == nil {
+			seen = make(map[object.Object]bool)
+		}
+		seen[obj] = true
+		found := false
+		obj.Range(func(_ object.HashKey, pair object.HashPair) {
+			found = found || holdsFunction(pair.Key, seen) || holdsFunction(pair.Value, seen)
+		})
+		return found
+	default:
+		return object.TypeName(obj) == "Function"
+	}
+}
+
+// Watch checks the modification time of the script file every `interval` in a new goroutine,
+// and reloads the script when it changes. Errors in reloading are passed to `onError` if it is
+// not nil, and the script keeps running the last program loaded successfully. Watch returns a
+// function which stops watching.
+func (s *Script) Watch(interval time.Duration, onError func(error)) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		// missing reports whether the file could not be found at the last check, so that it is
+		// reported once while, e.g., an editor replaces the file
+		missing := false
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(s.filename)
+			if err != nil {
+				if !missing && onError != nil {
+					onError(err)
+				}
+				missing = true
+				continue
+			}
+
+			wasMissing := missing
+			missing = false
+			if !wasMissing && info.ModTime().Equal(s.lastModTime()) {
+				continue
+			}
+			if err := s.Reload(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (s *Script) lastModTime() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.modTime
+}
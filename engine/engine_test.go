@@ -0,0 +1,216 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+func TestReload(t *testing.T) {
+	filename := writeScript(t, "", `
+	let state = {"count": 0};
+	let limit = 3;
+	let incr = fn() { state.count = state.count + 1 };
+	`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	s, err := Load(filename)
+	if err != nil {
+		t.Fatalf("failed to load script: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s.Call("incr"); err != nil {
+			t.Fatalf("failed to call incr: %s", err)
+		}
+	}
+
+	// state keeps its value while incr takes its new definition, and limit becomes a string
+	writeScript(t, filename, `
+	let state = {"count": 0};
+	let limit = "three";
+	let incr = fn() { state.count = state.count + 10; state.count };
+	let added = true;
+	`)
+	if err := s.Reload(); err != nil {
+		t.Fatalf("failed to reload script: %s", err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"state", "{count: 2}"},
+		{"limit", "three"},
+		{"added", "true"},
+	}
+	for _, tt := range tests {
+		got, ok := s.Global(tt.name)
+		if !ok {
+			t.Errorf("global %s is not defined", tt.name)
+			continue
+		}
+		if got.Inspect() != tt.want {
+			t.Errorf("wrong value of %s. want=%s, got=%s", tt.name, tt.want, got.Inspect())
+		}
+	}
+
+	result, err := s.Call("incr")
+	if err != nil {
+		t.Fatalf("failed to call incr: %s", err)
+	}
+	if got := result.Inspect(); got != "12" {
+		t.Errorf("wrong result of incr. want=12, got=%s", got)
+	}
+
+	// A broken script is reported and the current one stays in use
+	writeScript(t, filename, `let incr = fn() { missing }`)
+	if err := s.Reload(); err == nil {
+		t.Errorf("expected error in reloading but got none")
+	}
+	if _, err := s.Call("incr"); err != nil {
+		t.Errorf("failed to call incr after failed reload: %s", err)
+	}
+	_, err = s.Call("decr")
+	if err == nil || !strings.HasSuffix(err.Error(), "decr is not defined") {
+		t.Errorf("wrong error for undefined function: %v", err)
+	}
+}
+
+func TestReloadValuesHoldingFunctions(t *testing.T) {
+	filename := writeScript(t, "", `
+	let handlers = {"scale": fn(x) { x * 2 }};
+	let pipeline = [fn(x) { x + 1 }];
+	let run = fn(x) { pipeline[0](handlers["scale"](x)) };
+	`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	s, err := Load(filename)
+	if err != nil {
+		t.Fatalf("failed to load script: %s", err)
+	}
+
+	// The constants the old functions refer to are at different indexes in the new script
+	writeScript(t, filename, `
+	let unit = 1.5;
+	let handlers = {"scale": fn(x) { x * 3 }};
+	let pipeline = [fn(x) { x + 100 }];
+	let run = fn(x) { pipeline[0](handlers["scale"](x)) };
+	`)
+	if err := s.Reload(); err != nil {
+		t.Fatalf("failed to reload script: %s", err)
+	}
+
+	result, err := s.Call("run", &object.Integer{Value: 1})
+	if err != nil {
+		t.Fatalf("failed to call run: %s", err)
+	}
+	if got := result.Inspect(); got != "103" {
+		t.Errorf("wrong result of run. want=103, got=%s", got)
+	}
+}
+
+func TestResult(t *testing.T) {
+	filename := writeScript(t, "", `
+	let port = 8080;
+	{"host": "localhost", "port": port}
+	`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	s, err := Load(filename)
+	if err != nil {
+		t.Fatalf("failed to load script: %s", err)
+	}
+	if got := s.Result(); got == nil || got.Inspect() != "{host: localhost, port: 8080}" {
+		t.Errorf("wrong result. want={host: localhost, port: 8080}, got=%v", got)
+	}
+
+	// A script ending with a let statement has no value
+	writeScript(t, filename, `let port = 8080;`)
+	if err := s.Reload(); err != nil {
+		t.Fatalf("failed to reload script: %s", err)
+	}
+	if got := s.Result(); got != nil {
+		t.Errorf("result is not nil: %s", got.Inspect())
+	}
+}
+
+func TestWatch(t *testing.T) {
+	filename := writeScript(t, "", `let version = 1;`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	s, err := Load(filename)
+	if err != nil {
+		t.Fatalf("failed to load script: %s", err)
+	}
+
+	errs := make(chan error, 10)
+	stop := s.Watch(10*time.Millisecond, func(err error) { errs <- err })
+	defer stop()
+
+	update := func(src string, modTime time.Time) {
+		writeScript(t, filename, src)
+		// Set the modification time explicitly, which may not change within a short time
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatalf("failed to change modification time: %s", err)
+		}
+	}
+
+	update(`let version = fn() { 2 };`, time.Now().Add(time.Hour))
+	waitFor(t, func() bool {
+		v, _ := s.Global("version")
+		return v.Inspect() != "1"
+	})
+
+	update(`let version = missing;`, time.Now().Add(2*time.Hour))
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), filename) {
+			t.Errorf("error does not mention the file: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("compile error is not reported")
+	}
+
+	// The error is reported once until the file changes again
+	time.Sleep(50 * time.Millisecond)
+	if len(errs) != 0 {
+		t.Errorf("error is reported more than once: %s", <-errs)
+	}
+	if result, err := s.Call("version"); err != nil || result.Inspect() != "2" {
+		t.Errorf("wrong result of version after failed reload: %v, %v", result, err)
+	}
+}
+
+func writeScript(t *testing.T, filename, src string) string {
+	t.Helper()
+
+	if filename == "" {
+		dir, err := ioutil.TempDir("", "monkey-engine")
+		if err != nil {
+			t.Fatalf("failed to create temporary directory: %s", err)
+		}
+		filename = filepath.Join(dir, "script.monkey")
+	}
+
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatalf("failed to write script: %s", err)
+	}
+	return filename
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for reload")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
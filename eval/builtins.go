@@ -1,14 +1,98 @@
 package eval
 
 import (
+	"errors"
+	"io"
+	"os"
+
 	"github.com/skatsuta/monkey-compiler/object"
 )
 
 var builtins = map[string]*object.Builtin{
-	"len":   object.GetBuiltinByName("len"),
-	"puts":  object.GetBuiltinByName("puts"),
-	"first": object.GetBuiltinByName("first"),
-	"last":  object.GetBuiltinByName("last"),
-	"rest":  object.GetBuiltinByName("rest"),
-	"push":  object.GetBuiltinByName("push"),
+	"len":          object.GetBuiltinByName("len"),
+	"puts":         object.GetBuiltinByName("puts"),
+	"first":        object.GetBuiltinByName("first"),
+	"last":         object.GetBuiltinByName("last"),
+	"rest":         object.GetBuiltinByName("rest"),
+	"push":         object.GetBuiltinByName("push"),
+	"freeze":       object.GetBuiltinByName("freeze"),
+	"clone":        object.GetBuiltinByName("clone"),
+	"bytes":        object.GetBuiltinByName("bytes"),
+	"slice":        object.GetBuiltinByName("slice"),
+	"to_str":       object.GetBuiltinByName("to_str"),
+	"big":          object.GetBuiltinByName("big"),
+	"test":         object.GetBuiltinByName("test"),
+	"assert_eq":    object.GetBuiltinByName("assert_eq"),
+	"assert":       object.GetBuiltinByName("assert"),
+	"panic":        object.GetBuiltinByName("panic"),
+	"set":          object.GetBuiltinByName("set"),
+	"print":        object.GetBuiltinByName("print"),
+	"format":       object.GetBuiltinByName("format"),
+	"chr":          object.GetBuiltinByName("chr"),
+	"ord":          object.GetBuiltinByName("ord"),
+	"delay":        object.GetBuiltinByName("delay"),
+	"force":        object.GetBuiltinByName("force"),
+	"apply":        object.GetBuiltinByName("apply"),
+	"arity":        object.GetBuiltinByName("arity"),
+	"compose":      object.GetBuiltinByName("compose"),
+	"partial":      object.GetBuiltinByName("partial"),
+	"parse_int":    object.GetBuiltinByName("parse_int"),
+	"parse_float":  object.GetBuiltinByName("parse_float"),
+	"concat":       object.GetBuiltinByName("concat"),
+	"index_of":     object.GetBuiltinByName("index_of"),
+	"flatten":      object.GetBuiltinByName("flatten"),
+	"zip":          object.GetBuiltinByName("zip"),
+	"take":         object.GetBuiltinByName("take"),
+	"drop":         object.GetBuiltinByName("drop"),
+	"round":        object.GetBuiltinByName("round"),
+	"trunc":        object.GetBuiltinByName("trunc"),
+	"to_fixed":     object.GetBuiltinByName("to_fixed"),
+	"b64_encode":   object.GetBuiltinByName("b64_encode"),
+	"b64_decode":   object.GetBuiltinByName("b64_decode"),
+	"hex_encode":   object.GetBuiltinByName("hex_encode"),
+	"hex_decode":   object.GetBuiltinByName("hex_decode"),
+	"csv_parse":    object.GetBuiltinByName("csv_parse"),
+	"csv_format":   object.GetBuiltinByName("csv_format"),
+	"exec":         object.GetBuiltinByName("exec"),
+	"path_join":    object.GetBuiltinByName("path_join"),
+	"basename":     object.GetBuiltinByName("basename"),
+	"dirname":      object.GetBuiltinByName("dirname"),
+	"glob":         object.GetBuiltinByName("glob"),
+	"tcp_listen":   object.GetBuiltinByName("tcp_listen"),
+	"tcp_accept":   object.GetBuiltinByName("tcp_accept"),
+	"tcp_connect":  object.GetBuiltinByName("tcp_connect"),
+	"tcp_send":     object.GetBuiltinByName("tcp_send"),
+	"tcp_recv":     object.GetBuiltinByName("tcp_recv"),
+	"tcp_close":    object.GetBuiltinByName("tcp_close"),
+	"serve":        object.GetBuiltinByName("serve"),
+	"set_timeout":  object.GetBuiltinByName("set_timeout"),
+	"set_interval": object.GetBuiltinByName("set_interval"),
+	"clear_timer":  object.GetBuiltinByName("clear_timer"),
+	"async":        object.GetBuiltinByName("async"),
+	"sleep":        object.GetBuiltinByName("sleep"),
+	"await":        object.GetBuiltinByName("await"),
+	"is_error":     object.GetBuiltinByName("is_error"),
+}
+
+// Stdout is a writer to which built-in functions called by the evaluator, such as `puts` and
+// `print`, print output. It defaults to the standard output.
+var Stdout io.Writer = os.Stdout
+
+// stdHost is a host of built-in functions called by the evaluator, which prints output to
+// Stdout.
+type stdHost struct{}
+
+// Stdout returns Stdout.
+func (stdHost) Stdout() io.Writer {
+	return Stdout
+}
+
+// Call calls a function `fn` with arguments `args`. It makes stdHost satisfy object.Caller
+// interface, reporting an error the function evaluates to as a Go error.
+func (stdHost) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	result := applyFunction(fn, args)
+	if err, ok := result.(*object.Error); ok {
+		return nil, errors.New(err.Message)
+	}
+	return result, nil
 }
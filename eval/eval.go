@@ -9,11 +9,11 @@ import (
 
 var (
 	// NilValue represents a value of nil reference.
-	NilValue = &object.Nil{}
+	NilValue = object.NilValue
 	// TrueValue represents a value of true literals.
-	TrueValue = &object.Boolean{Value: true}
+	TrueValue = object.True
 	// FalseValue represents a value of false literals.
-	FalseValue = &object.Boolean{Value: false}
+	FalseValue = object.False
 )
 
 // Eval evaluates the given node and returns an evaluated object.
@@ -55,6 +55,9 @@ func Eval(node ast.Node, env object.Environment) object.Object {
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
 
+	case *ast.Nil:
+		return NilValue
+
 	case *ast.PrefixExpression:
 		right := Eval(node.Right, env)
 		if isError(right) {
@@ -67,15 +70,34 @@ func Eval(node ast.Node, env object.Environment) object.Object {
 		if isError(left) {
 			return left
 		}
+		// Logical operators short-circuit and yield one of their operands as the VM does
+		switch node.Operator {
+		case "&&":
+			if !isTruthy(left) {
+				return left
+			}
+			return Eval(node.Right, env)
+		case "||":
+			if isTruthy(left) {
+				return left
+			}
+			return Eval(node.Right, env)
+		}
 		right := Eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
+		if node.Operator == "in" || node.Operator == "not in" {
+			return evalInExpression(node.Operator, left, right)
+		}
 		return evalInfixExpression(node.Operator, left, right)
 
 	case *ast.IfExpression:
 		return evalIfExpression(node, env)
 
+	case *ast.MatchExpression:
+		return evalMatchExpression(node, env)
+
 	case *ast.Ident:
 		return evalIdent(node, env)
 
@@ -91,6 +113,10 @@ func Eval(node ast.Node, env object.Environment) object.Object {
 			return quote(node.Arguments[0], env)
 		}
 
+		if fe, ok := node.Function.(*ast.FieldExpression); ok {
+			return evalMethodCall(fe, node.Arguments, env)
+		}
+
 		function := Eval(node.Function, env)
 		if isError(function) {
 			return function
@@ -124,6 +150,13 @@ func Eval(node ast.Node, env object.Environment) object.Object {
 		}
 		return evalIndexExpression(left, index)
 
+	case *ast.FieldExpression:
+		left := Eval(node.Left, env)
+		if isError(left) {
+			return left
+		}
+		return evalIndexExpression(left, &object.String{Value: node.Field.Value})
+
 	case *ast.HashLiteral:
 		return evalHashLiteral(node, env)
 	}
@@ -203,6 +236,14 @@ func evalInfixExpression(operator string, left, right object.Object) object.Obje
 	}
 }
 
+func evalInExpression(operator string, el, coll object.Object) object.Object {
+	found, err := object.Contains(coll, el)
+	if err != nil {
+		return newError("%s", err)
+	}
+	return nativeBoolToBooleanObject(found == (operator == "in"))
+}
+
 func evalIntegerInfixExpression(operator string, left, right object.Object) object.Object {
 	leftVal := left.(*object.Integer).Value
 	rightVal := right.(*object.Integer).Value
@@ -215,6 +256,9 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 	case "*":
 		return &object.Integer{Value: leftVal * rightVal}
 	case "/":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
 		return &object.Integer{Value: leftVal / rightVal}
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
@@ -310,6 +354,10 @@ func evalBlockStatement(block *ast.BlockStatement, env object.Environment) objec
 		}
 	}
 
+	// A block without a value, e.g. an empty one or one ending with a let statement, yields nil
+	if result == nil {
+		return NilValue
+	}
 	return result
 }
 
@@ -327,6 +375,107 @@ func evalIfExpression(ie *ast.IfExpression, env object.Environment) object.Objec
 	return NilValue
 }
 
+func evalMatchExpression(me *ast.MatchExpression, env object.Environment) object.Object {
+	subject := Eval(me.Subject, env)
+	if isError(subject) {
+		return subject
+	}
+
+	for _, arm := range me.Arms {
+		bindings := make(map[string]object.Object)
+		matched, err := matchPattern(arm.Pattern, subject, bindings, env)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			continue
+		}
+
+		return Eval(arm.Value, &armEnvironment{bindings: bindings, outer: env})
+	}
+
+	return NilValue
+}
+
+// armEnvironment is the environment of an arm of a match expression. The names its pattern
+// binds are visible only in the arm, where they shadow the variables of the same names in the
+// enclosing environment `outer`, which other names are set in.
+type armEnvironment struct {
+	bindings map[string]object.Object
+	outer    object.Environment
+}
+
+func (e *armEnvironment) Get(name string) (object.Object, bool) {
+	if val, ok := e.bindings[name]; ok {
+		return val, true
+	}
+	return e.outer.Get(name)
+}
+
+func (e *armEnvironment) Set(name string, val object.Object) object.Object {
+	if _, ok := e.bindings[name]; ok {
+		e.bindings[name] = val
+		return val
+	}
+	return e.outer.Set(name, val)
+}
+
+// matchPattern reports whether `val` matches `pattern` of a match arm, adding the values of the
+// names the pattern binds to `bindings`. It returns an error object if evaluating a literal in
+// the pattern fails.
+func matchPattern(
+	pattern ast.Expression, val object.Object, bindings map[string]object.Object,
+	env object.Environment,
+) (bool, object.Object) {
+	switch pattern := pattern.(type) {
+	case *ast.Ident:
+		if pattern.Value != "_" {
+			bindings[pattern.Value] = val
+		}
+		return true, nil
+
+	case *ast.ArrayLiteral:
+		arr, ok := val.(object.ArrayObject)
+		if !ok || arr.Len() != len(pattern.Elements) {
+			return false, nil
+		}
+		for i, el := range pattern.Elements {
+			if matched, err := matchPattern(el, arr.Get(i), bindings, env); !matched {
+				return false, err
+			}
+		}
+		return true, nil
+
+	case *ast.HashLiteral:
+		hash, ok := val.(object.HashObject)
+		if !ok {
+			return false, nil
+		}
+		for _, patPair := range pattern.Pairs {
+			k := Eval(patPair.Key, env)
+			if isError(k) {
+				return false, k
+			}
+			pair, ok := hash.Get(k.(object.Hashable).HashKey())
+			if !ok {
+				return false, nil
+			}
+			if matched, err := matchPattern(patPair.Value, pair.Value, bindings, env); !matched {
+				return false, err
+			}
+		}
+		return true, nil
+
+	default:
+		// A literal matches an equal value
+		lit := Eval(pattern, env)
+		if isError(lit) {
+			return false, lit
+		}
+		return evalInfixExpression("==", val, lit) == TrueValue, nil
+	}
+}
+
 func isTruthy(obj object.Object) bool {
 	return obj != NilValue && obj != FalseValue
 }
@@ -382,15 +531,50 @@ func applyFunction(fn object.Object, args []object.Object) object.Object {
 		evaluated := Eval(fn.Body, extendedEnv)
 		return unwrapReturnValue(evaluated)
 	case *object.Builtin:
-		if result := fn.Fn(args...); result != nil {
+		switch result := fn.Fn(stdHost{}, args...).(type) {
+		case nil:
+			return NilValue
+		case *object.Abort:
+			if result.Panic {
+				return newError("panic: %s", result.Message)
+			}
+			return newError("%s", result.Message)
+		default:
 			return result
 		}
-		return NilValue
 	default:
 		return newError("not a function: %s", fn.Type())
 	}
 }
 
+func evalMethodCall(
+	fe *ast.FieldExpression, argNodes []ast.Expression, env object.Environment,
+) object.Object {
+	receiver := Eval(fe.Left, env)
+	if isError(receiver) {
+		return receiver
+	}
+
+	hash, ok := receiver.(*object.Hash)
+	if !ok {
+		return newError("cannot call method %s on %s", fe.Field.Value, receiver.Type())
+	}
+
+	name := &object.String{Value: fe.Field.Value}
+	pair, ok := hash.Pairs[name.HashKey()]
+	if !ok {
+		return newError("undefined method %s for %s", fe.Field.Value, receiver.Type())
+	}
+
+	args := evalExpressions(argNodes, env)
+	if len(args) == 1 && isError(args[0]) {
+		return args[0]
+	}
+
+	// The receiver is passed as an implicit first argument
+	return applyFunction(pair.Value, append([]object.Object{receiver}, args...))
+}
+
 func unwrapReturnValue(obj object.Object) object.Object {
 	if returnValue, ok := obj.(*object.ReturnValue); ok {
 		return returnValue.Value
@@ -402,6 +586,10 @@ func evalIndexExpression(left, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ArrayType && index.Type() == object.IntegerType:
 		return evalArrayIndexExpression(left, index)
+	case left.Type() == object.StringType && index.Type() == object.IntegerType:
+		return evalStringIndexExpression(left, index)
+	case left.Type() == object.BytesType && index.Type() == object.IntegerType:
+		return evalBytesIndexExpression(left, index)
 	case left.Type() == object.HashType:
 		return evalHashIndexExpression(left, index)
 	default:
@@ -421,11 +609,35 @@ func evalArrayIndexExpression(array, index object.Object) object.Object {
 	return arrObj.Elements[idx]
 }
 
+func evalStringIndexExpression(str, index object.Object) object.Object {
+	strObj := str.(*object.String)
+	idx := index.(*object.Integer).Value
+
+	char, ok := strObj.CharAt(idx)
+	if !ok {
+		return NilValue
+	}
+
+	return char
+}
+
+func evalBytesIndexExpression(bytes, index object.Object) object.Object {
+	bytesObj := bytes.(*object.Bytes)
+	idx := index.(*object.Integer).Value
+	max := int64(len(bytesObj.Value) - 1)
+
+	if idx < 0 || idx > max {
+		return NilValue
+	}
+
+	return &object.Integer{Value: int64(bytesObj.Value[idx])}
+}
+
 func evalHashLiteral(node *ast.HashLiteral, env object.Environment) object.Object {
-	pairs := make(map[object.HashKey]object.HashPair, len(node.Pairs))
+	hash := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair, len(node.Pairs))}
 
-	for keyNode, valueNode := range node.Pairs {
-		key := Eval(keyNode, env)
+	for _, pair := range node.Pairs {
+		key := Eval(pair.Key, env)
 		if isError(key) {
 			return key
 		}
@@ -435,19 +647,15 @@ func evalHashLiteral(node *ast.HashLiteral, env object.Environment) object.Objec
 			return newError("unusable as hash key: %s", key.Type())
 		}
 
-		value := Eval(valueNode, env)
+		value := Eval(pair.Value, env)
 		if isError(value) {
 			return value
 		}
 
-		hashed := hashKey.HashKey()
-		pairs[hashed] = object.HashPair{
-			Key:   key,
-			Value: value,
-		}
+		hash.Set(hashKey.HashKey(), object.HashPair{Key: key, Value: value})
 	}
 
-	return &object.Hash{Pairs: pairs}
+	return hash
 }
 
 func evalHashIndexExpression(left, index object.Object) object.Object {
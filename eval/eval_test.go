@@ -1,6 +1,7 @@
 package eval
 
 import (
+	"io"
 	"strings"
 	"testing"
 
@@ -158,6 +159,35 @@ func TestBangOperator(t *testing.T) {
 	}
 }
 
+func TestLogicalExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"1 && 2", 2},
+		{"false && 2", false},
+		{"nil && 2", nil},
+		{"1 || 2", 1},
+		{"false || 2", 2},
+		{"nil || false", false},
+		// The right-hand side is not evaluated if the left-hand side determines the result
+		{"false && foobar", false},
+		{"1 || foobar", 1},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		default:
+			testNilObject(t, evaluated)
+		}
+	}
+}
+
 func TestIfExpression(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -170,6 +200,44 @@ func TestIfExpression(t *testing.T) {
 		{"if (1 > 2) { 10 }", nil},
 		{"if (1 < 2) { 10 } else { 20 }", 10},
 		{"if (1 > 2) { 10 } else { 20 }", 20},
+		{"if (true) { }", nil},
+		{"if (true) { let x = 10; }", nil},
+		{"if (nil) { 10 }", nil},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		if i, ok := tt.expected.(int); ok {
+			testIntegerObject(t, evaluated, int64(i))
+		} else {
+			testNilObject(t, evaluated)
+		}
+	}
+}
+
+func TestMatchExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`match 2 { 1 => 10, 2 => 20, _ => 30 }`, 20},
+		{`match 3 { 1 => 10, 2 => 20 }`, nil},
+		{`match -1 { -1 => 10, _ => 20 }`, 10},
+		{`match "a" { 1 => 10, "a" => 20 }`, 20},
+		{`match 5 { n => n * 2 }`, 10},
+		{`match [1, 2] { [x] => x, [x, y] => x + y, _ => 0 }`, 3},
+		{`match [1, [2, 3]] { [a, [b, c]] => a + b + c }`, 6},
+		{`match 1 { [] => 1, _ => 2 }`, 2},
+		{`match {"type": "circle", "r": 2} {
+			{"type": "square", "side": s} => s * s,
+			{"type": "circle", "r": r} => r * r * 3,
+		}`, 12},
+		{`match {"a": 1} { {"b": b} => b, {} => 2 }`, 2},
+		{`let x = 1; match [2, 3] { [x, 4] => x, _ => x }`, 1},
+		{`let x = 10; match 3 { x => x }`, 3},
+		{`let x = 10; match 3 { x => x }; x`, 10},
+		{`let f = fn() { let x = 10; match 3 { x => fn() { x } } }; f()()`, 3},
+		{`let f = fn(v) { match v { [h, t] => h + f(t), _ => 0 } }; f([1, [2, [3, nil]]])`, 6},
 	}
 
 	for _, tt := range tests {
@@ -236,9 +304,12 @@ func TestErrorHandling(t *testing.T) {
 		`, "unknown operator: Boolean + Boolean"},
 		{"foobar", "identifier not found: foobar"},
 		{`"Hello" - "World"`, "unknown operator: String - String"},
+		{"1 / 0", "division by zero"},
+		{"true && foobar", "identifier not found: foobar"},
 		{`1.5 + "World"`, "unknown operator: Float + String"},
 		{`{[1, 2]: "Monkey"}`, "unusable as hash key: Array"},
 		{`{"name": "Monkey"}[fn(x) { x }]`, "unusable as hash key: Function"},
+		{`1 in 1`, "right operand of `in` must be Array, Hash or String, got Integer"},
 	}
 
 	for _, tt := range tests {
@@ -256,6 +327,27 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestInExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"2 in [1, 2, 3]", true},
+		{"4 not in [1, 2, 3]", true},
+		{"1 in [1.0]", true},
+		{"1.5 in [1]", false},
+		{`"a" in {"a": 1}`, true},
+		{`"b" in {"a": 1}`, false},
+		{`"ell" in "hello"`, true},
+		{`"x" not in "hello"`, true},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
 func TestLetStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -361,6 +453,8 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
 		{`len("hello" + " " + "world")`, 11},
+		{`len("∑")`, 1},
+		{`len("héllo, 世界")`, 9},
 		{`len(1)`, "argument to `len` not supported, got Integer"},
 		{`len("one", "two")`, "wrong number of arguments. want=1, got=2"},
 		// len for arrays
@@ -389,6 +483,102 @@ func TestBuiltinFunctions(t *testing.T) {
 		{"push(1, 2)", "first argument to `push` must be Array, got Integer"},
 		// puts
 		{"puts(1)", nil},
+		// print
+		{"print(1)", nil},
+		// freeze
+		{"freeze(1)", 1},
+		{"freeze([1, 2])", []int64{1, 2}},
+		{"freeze()", "wrong number of arguments. want=1, got=0"},
+		// clone
+		{"clone(1)", 1},
+		{"clone([1, 2])", []int64{1, 2}},
+		{"clone()", "wrong number of arguments. want=1, got=0"},
+		// bytes
+		{`len(bytes("abc"))`, 3},
+		{`bytes("abc")[1]`, 98},
+		{`bytes("abc")[3]`, nil},
+		{`len(slice(bytes("hello"), 1, 3))`, 2},
+		{`bytes(1)`, "argument to `bytes` not supported, got Integer"},
+		// assert_eq
+		{`assert_eq([1, "a"], [1, "a"])`, nil},
+		{`assert_eq(1, 2)`, "assertion failed: got 1, want 2"},
+		{`assert_eq(1, 1.0); assert_eq([2.0], [2]); 3`, 3},
+		{`assert_eq(1, 2); 3`, "assertion failed: got 1, want 2"},
+		// assert and panic
+		{`assert(true, "ok")`, nil},
+		{`assert(1 > 2, "wrong")`, "assertion failed: wrong"},
+		{`panic("boom")`, "panic: boom"},
+		{`panic(1, 2)`, "wrong number of arguments. want=1, got=2"},
+		// test
+		{`test("a", fn() { })`, "tests can only be defined when running tests"},
+		{`test(1, fn() { })`, "first argument to `test` must be String, got Integer"},
+		// delay and force
+		{`force(delay(fn() { 1 + 2 }))`, 3},
+		{`let t = delay(fn() { [1] }); force(t)[0] + force(t)[0]`, 2},
+		{`force(delay(fn() { }))`, nil},
+		{`force(1)`, 1},
+		{`force(delay(fn() { 1 + true }))`, "type mismatch: Integer + Boolean"},
+		{`delay(1)`, "argument to `delay` must be a function, got Integer"},
+		// apply and arity
+		{`apply(fn(a, b) { a - b }, [3, 1])`, 2},
+		{`apply(len, ["abc"])`, 3},
+		{`apply(fn() { 1 }, 1)`, "second argument to `apply` must be Array, got Integer"},
+		{`arity(fn(a, b) { a })`, 2},
+		{`arity(len)`, "arity of built-in functions is not fixed"},
+		// compose and partial
+		{`compose(fn(x) { x + 1 }, fn(x) { x * 2 })(5)`, 11},
+		{`compose(len, fn(x) { x + 1 })(1)`, "argument to `len` not supported, got Integer"},
+		{`partial(fn(a, b) { a - b }, 10)(1)`, 9},
+		{`partial(1)`, "first argument to `partial` must be a function, got Integer"},
+		// parse_int and parse_float
+		{`parse_int("42")`, 42},
+		{`parse_int("ff", 16)`, 255},
+		{`parse_int("4x")`, `could not parse "4x" as integer`},
+		{`parse_int("1", 1)`, "invalid base 1"},
+		{`parse_float("2.5")`, 2.5},
+		{`parse_float("")`, `could not parse "" as float`},
+		// Errors stop evaluation before is_error is called
+		{`is_error(parse_int("4x"))`, `could not parse "4x" as integer`},
+		{`if (is_error(1)) { 1 } else { 2 }`, 2},
+		// array functions
+		{"concat([1], [2, 3])", []int64{1, 2, 3}},
+		{"index_of([1, 2], 2)", 1},
+		{"index_of([1.0], 1)", 0},
+		{"flatten([[1], 2, [3]])", []int64{1, 2, 3}},
+		{"len(zip([1, 2], [3]))", 1},
+		{"take([1, 2, 3], 2)", []int64{1, 2}},
+		{"drop([1, 2, 3], 2)", []int64{3}},
+		{"take([1], -1)", "second argument to `take` must not be negative, got -1"},
+		// rounding
+		{"round(2.5)", 3.0},
+		{"round(1234.5678, 2)", 1234.57},
+		{"round(1250, -2)", 1300},
+		{"trunc(-2.7)", -2},
+		{"trunc(10000000000000000000.0)", "10000000000000000000.0 is out of range of Integer"},
+		{`len(to_fixed(2.5, 2))`, 4},
+		{"to_fixed(1.5, -1)", "number of digits -1 is out of range [0, 1000]"},
+		// encodings
+		{`len(b64_encode("hello"))`, 8},
+		{`len(b64_decode(b64_encode("hello")))`, 5},
+		{`len(hex_encode(bytes([1, 2])))`, 4},
+		{`hex_decode("1")`, "invalid hex: encoding/hex: odd length hex string"},
+		// CSV
+		{"len(csv_parse(\"a,b\n1,2\n3,4\"))", 3},
+		{"parse_int(csv_parse(\"x,y\n1,2\", true)[0][\"y\"])", 2},
+		{`len(csv_format([["a", 1], [nil, "b"]]))`, 7},
+		{`csv_format(1)`, "argument to `csv_format` must be Array, got Integer"},
+		{`exec("echo")`, "`exec` is not allowed: the exec capability is not granted"},
+		// paths
+		{`len(path_join("a", "b"))`, 3},
+		{`len(dirname("a/b/c"))`, 3},
+		{`glob("*")`, "`glob` is not allowed: the fs capability is not granted"},
+		// networking
+		{`tcp_listen(":0")`, "`tcp_listen` is not allowed: the net capability is not granted"},
+		{`serve(":0", fn(req) { "" })`, "`serve` is not allowed: the net capability is not granted"},
+		// timers
+		{`set_timeout(1, fn() { 1 })`, "timers are not supported here"},
+		{`async(fn() { 1 })`, "timers are not supported here"},
+		{`await(1)`, 1},
 	}
 
 	for _, tt := range tests {
@@ -397,6 +587,8 @@ func TestBuiltinFunctions(t *testing.T) {
 		switch expected := tt.expected.(type) {
 		case int:
 			testIntegerObject(t, evaluated, int64(expected))
+		case float64:
+			testFloatObject(t, evaluated, expected)
 		case string:
 			errObj, ok := evaluated.(*object.Error)
 			if !ok {
@@ -428,6 +620,19 @@ func TestBuiltinFunctions(t *testing.T) {
 	}
 }
 
+func TestStdout(t *testing.T) {
+	var out strings.Builder
+	defer func(w io.Writer) { Stdout = w }(Stdout)
+	Stdout = &out
+
+	testEval(t, `puts("hello", 1 + 2); puts([1, "a"]); print("x", 4, nil); print()`)
+
+	want := "hello\n3\n[1, a]\nx4nil"
+	if got := out.String(); got != want {
+		t.Errorf("wrong output. want=%q, got=%q", want, got)
+	}
+}
+
 func TestArrayLiterals(t *testing.T) {
 	input := "[1, 2 * 2, 3 + 3]"
 
@@ -473,6 +678,39 @@ func TestArrayIndexExpressions(t *testing.T) {
 	}
 }
 
+func TestStringIndexExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`"abc"[0]`, "a"},
+		{`"abc"[1 + 1]`, "c"},
+		{`"héllo, 世界"[1]`, "é"},
+		{`"héllo, 世界"[8]`, "界"},
+		{`"abc"[3]`, nil},
+		{`"abc"[-1]`, nil},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+
+		str, ok := tt.expected.(string)
+		if !ok {
+			testNilObject(t, evaluated)
+			continue
+		}
+
+		result, ok := evaluated.(*object.String)
+		if !ok {
+			t.Errorf("object is not *object.String. got=%#v", evaluated)
+			continue
+		}
+		if result.Value != str {
+			t.Errorf("String has wrong value. want=%q, got=%q", str, result.Value)
+		}
+	}
+}
+
 func TestHashLiterals(t *testing.T) {
 	input := `
 	let two = "two";
@@ -513,6 +751,10 @@ func TestHashLiterals(t *testing.T) {
 		}
 		testIntegerObject(t, pair.Value, value)
 	}
+
+	if got, want := hash.Inspect(), "{one: 1, two: 2, three: 3, 4: 4, true: 5, false: 6}"; got != want {
+		t.Errorf("pairs in wrong order. want=%s, got=%s", want, got)
+	}
 }
 
 func TestHashIndexExpressions(t *testing.T) {
@@ -539,6 +781,57 @@ func TestHashIndexExpressions(t *testing.T) {
 	}
 }
 
+func TestFieldExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`{"name": 5}.name`, 5},
+		{`let p = {"pos": {"x": 1, "y": 2}}; p.pos.x + p.pos.y`, 3},
+		{`{"name": 5}.age`, nil},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		integer, ok := tt.expected.(int)
+		if ok {
+			testIntegerObject(t, evaluated, int64(integer))
+		} else {
+			testNilObject(t, evaluated)
+		}
+	}
+}
+
+func TestMethodCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let p = {"x": 1, "y": 2, "sum": fn(self) { self.x + self.y }}; p.sum()`, 3},
+		{`let p = {"x": 1, "add": fn(self, n) { self.x + n }}; p.add(2)`, 3},
+		{`let a = 1; a.f()`, "cannot call method f on Integer"},
+		{`let h = {}; h.f()`, "undefined method f for Hash"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not *object.Error. got=%#v", evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
 func TestQuote(t *testing.T) {
 	tests := []struct {
 		input string
@@ -1,6 +1,8 @@
 package eval
 
 import (
+	"fmt"
+
 	"github.com/skatsuta/monkey-compiler/ast"
 	"github.com/skatsuta/monkey-compiler/object"
 )
@@ -46,7 +48,10 @@ func addMacro(stmt ast.Statement, env object.Environment) {
 }
 
 // ExpandMacros expands defined macros and replaces AST nodes with the result of macro expansion.
-func ExpandMacros(program ast.Node, env object.Environment) ast.Node {
+// It reports an error if a macro does not return a quoted AST node, or the node cannot replace
+// the call of the macro.
+func ExpandMacros(program ast.Node, env object.Environment) (ast.Node, error) {
+	var err error
 	modifier := func(node ast.Node) ast.Node {
 		call, ok := node.(*ast.CallExpression)
 		if !ok {
@@ -61,15 +66,27 @@ func ExpandMacros(program ast.Node, env object.Environment) ast.Node {
 		args := quoteArgs(call)
 		evalEnv := extendMacroEnv(macro, args)
 
-		quote, ok := Eval(macro.Body, evalEnv).(*object.Quote)
+		result := Eval(macro.Body, evalEnv)
+		quote, ok := result.(*object.Quote)
 		if !ok {
-			panic("we only support returning AST-nodes from macros")
+			if err == nil {
+				got := "nothing"
+				if result != nil {
+					got = result.Inspect()
+				}
+				err = fmt.Errorf("macro %s must return a quote, got %s", call.Function, got)
+			}
+			return node
 		}
 
 		return quote.Node
 	}
 
-	return ast.Modify(program, modifier)
+	expanded, modErr := ast.Modify(program, modifier)
+	if err != nil {
+		return nil, err
+	}
+	return expanded, modErr
 }
 
 func isMacroCall(call *ast.CallExpression, env object.Environment) (macro *object.Macro, ok bool) {
@@ -111,7 +111,11 @@ func TestExpandMacros(t *testing.T) {
 		program := testParseProgram(tt.input)
 		env := object.NewEnvironment()
 		DefineMacros(program, env)
-		got := ExpandMacros(program, env).String()
+		expanded, err := ExpandMacros(program, env)
+		if err != nil {
+			t.Fatalf("macro expansion error: %s", err)
+		}
+		got := expanded.String()
 
 		want := testParseProgram(tt.want).String()
 		if got != want {
@@ -120,6 +124,42 @@ func TestExpandMacros(t *testing.T) {
 	}
 }
 
+func TestExpandMacrosErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{
+			"let m = macro() { 1 }; m();",
+			"macro m must return a quote, got 1",
+		},
+		{
+			`let m = macro() { quote(1 + unquote("a")) }; m();`,
+			"macro m must return a quote, got " +
+				"Error: cannot replace unquote(a) with nil, which is not an expression",
+		},
+		{
+			`let m = macro() { quote(unquote("a")) }; m() + 1;`,
+			"cannot replace m() with nil, which is not an expression",
+		},
+	}
+
+	for _, tt := range tests {
+		program := testParseProgram(tt.input)
+		env := object.NewEnvironment()
+		DefineMacros(program, env)
+
+		_, err := ExpandMacros(program, env)
+		if err == nil {
+			t.Errorf("expected an error but resulted in none")
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("wrong error. want=%q, got=%q", tt.want, err)
+		}
+	}
+}
+
 func testParseProgram(input string) *ast.Program {
 	return parser.New(lexer.New(input)).ParseProgram()
 }
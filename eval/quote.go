@@ -16,11 +16,14 @@ const (
 )
 
 func quote(node ast.Node, env object.Environment) object.Object {
-	node = evalUnquoteCalls(node, env)
+	node, err := evalUnquoteCalls(node, env)
+	if err != nil {
+		return newError("%s", err)
+	}
 	return &object.Quote{Node: node}
 }
 
-func evalUnquoteCalls(quoted ast.Node, env object.Environment) ast.Node {
+func evalUnquoteCalls(quoted ast.Node, env object.Environment) (ast.Node, error) {
 	modifier := func(node ast.Node) ast.Node {
 		call, ok := node.(*ast.CallExpression)
 		if !ok || call.Function.TokenLiteral() != FuncNameUnquote || len(call.Arguments) != 1 {
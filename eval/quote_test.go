@@ -52,6 +52,10 @@ func TestQuoteUnquote(t *testing.T) {
 		   quote(unquote(4 + 4) + unquote(quotedInfixExpr))`,
 			`(8 + (4 + 4))`,
 		},
+		{
+			`quote(f(unquote(4 + 4), [unquote(1 + 1)]))`,
+			`f(8, [2])`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -71,3 +75,17 @@ func TestQuoteUnquote(t *testing.T) {
 		}
 	}
 }
+
+func TestUnquoteUnsupportedValue(t *testing.T) {
+	// Strings cannot be converted back to AST nodes
+	evaluated := testEval(t, `quote(1 + unquote("a"))`)
+	err, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("expected *object.Error, but got %T (%#v)", evaluated, evaluated)
+	}
+
+	want := "cannot replace unquote(a) with nil, which is not an expression"
+	if err.Message != want {
+		t.Errorf("wrong error message. want=%q, got=%q", want, err.Message)
+	}
+}
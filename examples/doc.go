@@ -0,0 +1,5 @@
+// Package examples is a corpus of Monkey programs, each of which is a *.monkey file along with
+// the output it is expected to print in the *.out file next to it. They serve as documentation
+// by example, and as integration tests running the programs through the whole pipeline of
+// macro expansion, compilation and execution on the VM. It only contains tests.
+package examples
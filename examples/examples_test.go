@@ -0,0 +1,90 @@
+package examples
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/eval"
+	"github.com/skatsuta/monkey-compiler/lexer"
+	"github.com/skatsuta/monkey-compiler/object"
+	"github.com/skatsuta/monkey-compiler/parser"
+	"github.com/skatsuta/monkey-compiler/vm"
+)
+
+var update = flag.Bool("update", false, "update the expected outputs of the examples")
+
+// TestExamples runs each *.monkey file and compares its output with the *.out file next to it.
+// Run `go test -update` to regenerate the expected outputs after adding an example, and review
+// them.
+func TestExamples(t *testing.T) {
+	files, err := filepath.Glob("*.monkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := run(string(src))
+		if err != nil {
+			t.Errorf("%s: %s", file, err)
+			continue
+		}
+
+		out := strings.TrimSuffix(file, ".monkey") + ".out"
+		if *update {
+			if err := ioutil.WriteFile(out, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		want, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%s: output does not match %s.\nwant=\n%s\ngot=\n%s", file, out, want, got)
+		}
+	}
+}
+
+// run expands macros in source code `src`, compiles it and runs it on the VM, and returns the
+// output it prints. Integers are promoted to big integers on overflow, so that the outputs are
+// exact, e.g. of large Fibonacci numbers.
+func run(src string) (string, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return "", errors.New(strings.Join(p.Errors(), "\n"))
+	}
+
+	macroEnv := object.NewEnvironment()
+	eval.DefineMacros(program, macroEnv)
+	expanded, err := eval.ExpandMacros(program, macroEnv)
+	if err != nil {
+		return "", fmt.Errorf("macro expansion error: %s", err)
+	}
+
+	c := compiler.New()
+	if err := c.Compile(expanded); err != nil {
+		return "", fmt.Errorf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	machine := vm.New(c.Bytecode(), vm.WithStdout(&out), vm.WithOverflowMode(vm.OverflowPromote))
+	if err := machine.Run(); err != nil {
+		return "", fmt.Errorf("vm error: %s", err)
+	}
+	return out.String(), nil
+}
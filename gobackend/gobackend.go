@@ -0,0 +1,119 @@
+// Package gobackend generates a standalone Go program from compiled Monkey bytecode. The
+// generated program embeds the bytecode and executes it with the VM, so it can be built into
+// a native binary with the Go toolchain.
+package gobackend
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"strconv"
+
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+const header = `// Code generated by monkey-compiler build; DO NOT EDIT.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/object"
+	"github.com/skatsuta/monkey-compiler/vm"
+)
+
+func main() {
+	if err := bytecode.LinkBuiltins(); err != nil {
+		fmt.Fprintf(os.Stderr, "Woops! Linking bytecode failed: %s\n", err)
+		os.Exit(1)
+	}
+
+	machine := vm.New(bytecode)
+	if err := machine.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Woops! Executing bytecode failed: %s\n", err)
+		os.Exit(1)
+	}
+	if err := machine.RunEventLoop(); err != nil {
+		fmt.Fprintf(os.Stderr, "Woops! Executing bytecode failed: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+`
+
+// Generate writes the source code of a Go program executing `bytecode` to `w`.
+func Generate(w io.Writer, bytecode *compiler.Bytecode) error {
+	var buf bytes.Buffer
+	buf.WriteString(header)
+
+	buf.WriteString("var bytecode = &compiler.Bytecode{\n")
+	buf.WriteString("Instructions: ")
+	writeInstructions(&buf, bytecode.Instructions)
+	buf.WriteString(",\nConstants: []object.Object{\n")
+	for _, c := range bytecode.Constants {
+		if err := writeConstant(&buf, c); err != nil {
+			return err
+		}
+		buf.WriteString(",\n")
+	}
+	fmt.Fprintf(&buf, "},\nMaxStackDepth: %d,\n", bytecode.MaxStackDepth)
+	buf.WriteString("Builtins: []string{")
+	for i, name := range bytecode.Builtins {
+		if i%8 == 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "%s,", strconv.Quote(name))
+	}
+	buf.WriteString("\n},\n}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("generated invalid Go code: %s", err)
+	}
+
+	_, err = w.Write(src)
+	return err
+}
+
+func writeConstant(buf *bytes.Buffer, obj object.Object) error {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		fmt.Fprintf(buf, "&object.Integer{Value: %d}", obj.Value)
+	case *object.Float:
+		fmt.Fprintf(buf, "&object.Float{Value: %s}", strconv.FormatFloat(obj.Value, 'g', -1, 64))
+	case *object.String:
+		fmt.Fprintf(buf, "&object.String{Value: %s}", strconv.Quote(obj.Value))
+	case *object.CompiledFunction:
+		buf.WriteString("&object.CompiledFunction{\n")
+		if obj.Name != "" {
+			fmt.Fprintf(buf, "Name: %s,\n", strconv.Quote(obj.Name))
+		}
+		buf.WriteString("Instructions: ")
+		writeInstructions(buf, obj.Instructions)
+		fmt.Fprintf(buf, ",\nNumLocals: %d,\nNumParameters: %d,\nMaxStackDepth: %d,\n}",
+			obj.NumLocals, obj.NumParameters, obj.MaxStackDepth)
+	default:
+		return fmt.Errorf("cannot generate Go code for constant of type %s", obj.Type())
+	}
+
+	return nil
+}
+
+func writeInstructions(buf *bytes.Buffer, insns code.Instructions) {
+	buf.WriteString("code.Instructions{")
+	for i, b := range insns {
+		// Break lines regularly to keep the generated code readable
+		if i%16 == 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(buf, "0x%02x,", b)
+	}
+	buf.WriteString("\n}")
+}
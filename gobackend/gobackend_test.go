@@ -0,0 +1,52 @@
+package gobackend
+
+import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/lexer"
+	monkeyparser "github.com/skatsuta/monkey-compiler/parser"
+)
+
+func TestGenerate(t *testing.T) {
+	input := `
+	let add = fn(a, b) { a + b };
+	puts(add(40, 2), 1.5, "C:\monkey")
+	`
+
+	program := monkeyparser.New(lexer.New(input)).ParseProgram()
+	c := compiler.New()
+	if err := c.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := Generate(&buf, c.Bytecode()); err != nil {
+		t.Fatalf("failed to generate Go code: %s", err)
+	}
+	src := buf.String()
+
+	if _, err := parser.ParseFile(token.NewFileSet(), "main.go", src, 0); err != nil {
+		t.Fatalf("generated code is not valid Go: %s\n%s", err, src)
+	}
+
+	wants := []string{
+		"package main",
+		"func main() {",
+		"&object.Integer{Value: 40}",
+		"&object.Float{Value: 1.5}",
+		`&object.String{Value: "C:\\monkey"}`,
+		"NumParameters: 2,",
+		"bytecode.LinkBuiltins()",
+		`"len", "puts", "first",`,
+	}
+	for _, want := range wants {
+		if !strings.Contains(src, want) {
+			t.Errorf("generated code does not contain %q:\n%s", want, src)
+		}
+	}
+}
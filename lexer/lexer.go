@@ -16,16 +16,46 @@ type lexer struct {
 	readPosition int
 	// current char under examination
 	ch byte
+	// line of the current char, counting from 1
+	line int
+	// position in input where the line of the current char starts
+	lineStart int
+
+	// comments holds the comments skipped so far if keepComments is true
+	comments     []Comment
+	keepComments bool
+}
+
+// Comment is a comment in source code, which runs from `#` to the end of the line.
+type Comment struct {
+	// Text is the text of the comment following `#`
+	Text string
+	// Line is the line of the comment, counting from 1
+	Line int
 }
 
 // New returns a new Lexer.
 func New(input string) Lexer {
-	l := &lexer{input: input}
+	l := &lexer{input: input, line: 1}
 	l.readChar()
 	return l
 }
 
+// Comments returns the comments in `input` in the order they appear. `#` in string literals
+// does not start a comment.
+func Comments(input string) []Comment {
+	l := &lexer{input: input, line: 1, keepComments: true}
+	l.readChar()
+	for l.NextToken().Type != token.EOF {
+	}
+	return l.comments
+}
+
 func (l *lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.lineStart = l.readPosition
+	}
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -38,17 +68,28 @@ func (l *lexer) readChar() {
 func (l *lexer) NextToken() token.Token {
 	l.skipWhitespace()
 
-	// skip comments
-	if l.ch == '#' {
+	// skip comments, which may span consecutive lines
+	for l.ch == '#' {
 		l.skipComment()
 	}
 
+	line, column := l.line, l.position-l.lineStart+1
+	tok := l.readToken()
+	tok.Line, tok.Column = line, column
+	return tok
+}
+
+// readToken reads a token starting at the current char.
+func (l *lexer) readToken() token.Token {
 	var tok token.Token
 	switch l.ch {
 	case '=':
-		if l.peekChar() == '=' {
+		switch l.peekChar() {
+		case '=':
 			tok = l.readTwoCharToken(token.EQ)
-		} else {
+		case '>':
+			tok = l.readTwoCharToken(token.ARROW)
+		default:
 			tok = newToken(token.ASSIGN, l.ch)
 		}
 	case '!':
@@ -61,6 +102,8 @@ func (l *lexer) NextToken() token.Token {
 		tok = newToken(token.SEMICOLON, l.ch)
 	case ':':
 		tok = newToken(token.COLON, l.ch)
+	case '.':
+		tok = newToken(token.DOT, l.ch)
 	case '(':
 		tok = newToken(token.LPAREN, l.ch)
 	case ')':
@@ -68,9 +111,17 @@ func (l *lexer) NextToken() token.Token {
 	case ',':
 		tok = newToken(token.COMMA, l.ch)
 	case '+':
-		tok = newToken(token.PLUS, l.ch)
+		if l.peekChar() == '+' && l.endsStatementAt(l.readPosition+1) {
+			tok = l.readTwoCharToken(token.INC)
+		} else {
+			tok = newToken(token.PLUS, l.ch)
+		}
 	case '-':
-		tok = newToken(token.MINUS, l.ch)
+		if l.peekChar() == '-' && l.endsStatementAt(l.readPosition+1) {
+			tok = l.readTwoCharToken(token.DEC)
+		} else {
+			tok = newToken(token.MINUS, l.ch)
+		}
 	case '*':
 		tok = newToken(token.ASTARISK, l.ch)
 	case '/':
@@ -105,7 +156,10 @@ func (l *lexer) NextToken() token.Token {
 		tok = newToken(token.RBRACKET, l.ch)
 	case '"':
 		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		tok.Literal = l.readString('"')
+	case '\'':
+		tok.Type = token.CHAR
+		tok.Literal = l.readString('\'')
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
@@ -134,12 +188,37 @@ func (l *lexer) skipWhitespace() {
 }
 
 func (l *lexer) skipComment() {
-	for l.ch != '\n' && l.ch != '\r' {
+	line, start := l.line, l.position+1
+	for l.ch != '\n' && l.ch != '\r' && l.ch != 0 {
 		l.readChar()
 	}
+	if l.keepComments {
+		l.comments = append(l.comments, Comment{Text: l.input[start:l.position], Line: line})
+	}
 	l.skipWhitespace()
 }
 
+// endsStatementAt reports whether a statement ends at position `pos` of the input, i.e. only
+// whitespace and comments precede a semicolon, a closing brace or the end of the input there. `++`
+// and `--` are read as INC and DEC only if a statement ends after them, so that e.g. `a--b` and
+// `--5` are still a subtraction and a double negation.
+func (l *lexer) endsStatementAt(pos int) bool {
+	for ; pos < len(l.input); pos++ {
+		switch l.input[pos] {
+		case ' ', '\t', '\n', '\r':
+		case '#':
+			for pos < len(l.input) && l.input[pos] != '\n' && l.input[pos] != '\r' {
+				pos++
+			}
+		case ';', '}':
+			return true
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func (l *lexer) peekChar() byte {
 	if l.readPosition >= len(l.input) {
 		return 0
@@ -156,11 +235,12 @@ func (l *lexer) readTwoCharToken(tokenType token.Type) token.Token {
 	}
 }
 
-func (l *lexer) readString() string {
+// readString reads characters up to a closing `quote` and returns them without the quotes.
+func (l *lexer) readString(quote byte) string {
 	position := l.position + 1
 	for {
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
+		if l.ch == quote || l.ch == 0 {
 			break
 		}
 	}
@@ -175,28 +255,48 @@ func (l *lexer) read(checkFn func(byte) bool) string {
 	return l.input[position:l.position]
 }
 
+// readIdent reads an identifier, which starts with a letter and may contain digits after it,
+// e.g. `b64_encode`.
 func (l *lexer) readIdent() string {
-	return l.read(isLetter)
+	return l.read(func(ch byte) bool { return isLetter(ch) || isDigit(ch) })
 }
 
 func (l *lexer) readNumber() string {
 	return l.read(isDigit)
 }
 
+// readNumberToken reads an integer or a float, which has a fractional part, an exponent, e.g.
+// `1e+21` or `2.5e-3`, or both. Floats are printed in the same form, so that they read back as
+// the same values.
 func (l *lexer) readNumberToken() token.Token {
-	intPart := l.readNumber()
-	if l.ch != '.' {
-		return token.Token{
-			Type:    token.INT,
-			Literal: intPart,
+	start := l.position
+	l.readNumber()
+	var typ token.Type = token.INT
+
+	if l.ch == '.' {
+		l.readChar()
+		l.readNumber()
+		typ = token.FLOAT
+	}
+
+	// `e` not followed by digits starts an identifier instead, as in `2e`
+	if l.ch == 'e' || l.ch == 'E' {
+		digits := l.readPosition
+		if sign := l.peekChar(); sign == '+' || sign == '-' {
+			digits++
+		}
+		if digits < len(l.input) && isDigit(l.input[digits]) {
+			for l.position < digits {
+				l.readChar()
+			}
+			l.readNumber()
+			typ = token.FLOAT
 		}
 	}
 
-	l.readChar()
-	fracPart := l.readNumber()
 	return token.Token{
-		Type:    token.FLOAT,
-		Literal: intPart + "." + fracPart,
+		Type:    typ,
+		Literal: l.input[start:l.position],
 	}
 }
 
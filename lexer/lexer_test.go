@@ -1,6 +1,7 @@
 package lexer
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/skatsuta/monkey-compiler/token"
@@ -49,6 +50,18 @@ func TestNextToken(t *testing.T) {
 	b = nil;
 
 	macro(x, y) { x + y; };
+
+	p.name = "foo";
+
+	'a' 'é';
+
+	i++; i--;
+
+	match p { _ => 1 };
+
+	x1 2y;
+
+	a--b; --5 # --
 	`
 
 	tests := []struct {
@@ -201,6 +214,41 @@ func TestNextToken(t *testing.T) {
 		{token.SEMICOLON, ";"},
 		{token.RBRACE, "}"},
 		{token.SEMICOLON, ";"},
+		{token.IDENT, "p"},
+		{token.DOT, "."},
+		{token.IDENT, "name"},
+		{token.ASSIGN, "="},
+		{token.STRING, "foo"},
+		{token.SEMICOLON, ";"},
+		{token.CHAR, "a"},
+		{token.CHAR, "é"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "i"},
+		{token.INC, "++"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "i"},
+		{token.DEC, "--"},
+		{token.SEMICOLON, ";"},
+		{token.MATCH, "match"},
+		{token.IDENT, "p"},
+		{token.LBRACE, "{"},
+		{token.IDENT, "_"},
+		{token.ARROW, "=>"},
+		{token.INT, "1"},
+		{token.RBRACE, "}"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "x1"},
+		{token.INT, "2"},
+		{token.IDENT, "y"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.MINUS, "-"},
+		{token.MINUS, "-"},
+		{token.IDENT, "b"},
+		{token.SEMICOLON, ";"},
+		{token.MINUS, "-"},
+		{token.MINUS, "-"},
+		{token.INT, "5"},
 		{token.EOF, ""},
 	}
 
@@ -220,3 +268,83 @@ func TestNextToken(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenPositions(t *testing.T) {
+	input := `let x = 1;
+# comment
+let s = "a
+b"; x
+
+  + 1`
+
+	tests := []struct {
+		expectedLiteral string
+		expectedLine    int
+		expectedColumn  int
+	}{
+		{"let", 1, 1}, {"x", 1, 5}, {"=", 1, 7}, {"1", 1, 9}, {";", 1, 10},
+		{"let", 3, 1}, {"s", 3, 5}, {"=", 3, 7}, {"a\nb", 3, 9}, {";", 4, 3}, {"x", 4, 5},
+		{"+", 6, 3}, {"1", 6, 5},
+		{"", 6, 6},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Line != tt.expectedLine || tok.Column != tt.expectedColumn {
+			t.Errorf("tests[%d] - position of %q wrong. expected=%d:%d, got=%d:%d",
+				i, tok.Literal, tt.expectedLine, tt.expectedColumn, tok.Line, tok.Column)
+		}
+	}
+}
+
+func TestNumberTokens(t *testing.T) {
+	input := "1 2.5 1e+21 2.5e-3 1E5 2e x3e1 4e+"
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INT, "1"},
+		{token.FLOAT, "2.5"},
+		{token.FLOAT, "1e+21"},
+		{token.FLOAT, "2.5e-3"},
+		{token.FLOAT, "1E5"},
+		// `e` not followed by digits is not an exponent
+		{token.INT, "2"},
+		{token.IDENT, "e"},
+		{token.IDENT, "x3e1"},
+		{token.INT, "4"},
+		{token.IDENT, "e"},
+		{token.PLUS, "+"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - wrong token. expected=%s %q, got=%s %q",
+				i, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := "# a\n#b\r\nlet s = \"# no\"; # c\n#"
+
+	want := []Comment{{" a", 1}, {"b", 2}, {" c", 3}, {"", 4}}
+	if got := Comments(input); !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong comments. want=%+v, got=%+v", want, got)
+	}
+
+	// Consecutive comment lines are skipped together
+	if tok := New(input).NextToken(); tok.Literal != "let" {
+		t.Errorf("wrong first token. want=%q, got=%q", "let", tok.Literal)
+	}
+}
@@ -1,65 +1,680 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
+	"github.com/skatsuta/monkey-compiler/ast"
+	"github.com/skatsuta/monkey-compiler/cache"
+	"github.com/skatsuta/monkey-compiler/code"
 	"github.com/skatsuta/monkey-compiler/compiler"
 	"github.com/skatsuta/monkey-compiler/eval"
+	"github.com/skatsuta/monkey-compiler/gobackend"
 	"github.com/skatsuta/monkey-compiler/lexer"
 	"github.com/skatsuta/monkey-compiler/object"
 	"github.com/skatsuta/monkey-compiler/parser"
 	"github.com/skatsuta/monkey-compiler/repl"
+	"github.com/skatsuta/monkey-compiler/testrunner"
+	"github.com/skatsuta/monkey-compiler/token"
+	"github.com/skatsuta/monkey-compiler/transpile/js"
 	"github.com/skatsuta/monkey-compiler/vm"
 )
 
 func main() {
 	// Start Monkey REPL
 	if len(os.Args) == 1 {
-		fmt.Println("This is the Monkey programming language!")
-		fmt.Println("Feel free to type in commands")
-		repl.Start(os.Stdin, os.Stdout)
+		startREPL()
 		return
 	}
 
-	// Run a Monkey script
-	if err := runScript(os.Args[1]); err != nil {
+	var err error
+	switch os.Args[1] {
+	case "repl":
+		err = replCommand(os.Args[2:])
+	case "run":
+		err = runCommand(os.Args[2:])
+	case "build":
+		err = buildCommand(os.Args[2:])
+	case "test":
+		err = testCommand(os.Args[2:])
+	case "explain":
+		err = explainCommand(os.Args[2:])
+	case "ast":
+		err = astCommand(os.Args[2:])
+	case "tokens":
+		err = tokensCommand(os.Args[2:])
+	default:
+		// Run a Monkey script
+		err = runScript(os.Args[1], os.Args[2:], nil, false, nil)
+	}
+
+	if status, ok := err.(exitStatus); ok {
+		os.Exit(int(status))
+	}
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
-func runScript(filename string) error {
+// exitStatus is returned by runScript when the `main` function of a script returns a non-zero
+// integer, which the process exits with.
+type exitStatus int
+
+func (s exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", s)
+}
+
+// startREPL starts Monkey REPL on the standard input and output with options `opts`.
+func startREPL(opts ...repl.Option) {
+	fmt.Println("This is the Monkey programming language!")
+	fmt.Println("Feel free to type in commands")
+	opts = append([]repl.Option{repl.WithColor(useColor(os.Stdout))}, opts...)
+	repl.Start(os.Stdin, os.Stdout, opts...)
+}
+
+// replCommand starts Monkey REPL configured by flags.
+func replCommand(args []string) error {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	floatFormat := fs.String("float-format", "",
+		"format `spec` of float results as accepted by the format built-in function, e.g. .2f")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s repl [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *floatFormat != "" {
+		if _, err := object.FormatFloat(0, *floatFormat); err != nil {
+			return fmt.Errorf("invalid float format: %s", err)
+		}
+	}
+
+	startREPL(repl.WithFloatFormat(*floatFormat))
+	return nil
+}
+
+// runCommand runs a Monkey script, reusing the bytecode compiled from the same source before.
+func runCommand(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	noCache := fs.Bool("no-cache", false, "always compile the script without the bytecode cache")
+	cacheDir := fs.String("cache-dir", "",
+		"directory to cache bytecode in (default: user cache directory)")
+	printResult := fs.Bool("print-result", false,
+		"print the value of the last top-level expression after the script has run")
+	allow := fs.String("allow", "",
+		"comma-separated capabilities to grant to the script (supported: exec, fs, net)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s run [flags] <file> [args...]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	caps, err := parseCapabilities(*allow)
+	if err != nil {
+		return err
+	}
+
+	var c *cache.Cache
+	if !*noCache {
+		dir := *cacheDir
+		if dir == "" {
+			if dir, err = cache.DefaultDir(); err != nil {
+				return fmt.Errorf("could not locate cache directory: %v", err)
+			}
+		}
+		c = cache.New(dir)
+	}
+
+	return runScript(fs.Arg(0), fs.Args()[1:], c, *printResult, caps)
+}
+
+// parseCapabilities parses a comma-separated list of capabilities `s`.
+func parseCapabilities(s string) ([]object.Capability, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var caps []object.Capability
+	for _, name := range strings.Split(s, ",") {
+		c := object.Capability(strings.TrimSpace(name))
+		known := false
+		for _, k := range object.Capabilities {
+			known = known || c == k
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown capability: %s", c)
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+// buildCommand compiles a Monkey script and generates a program for another target from it.
+func buildCommand(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	target := fs.String("target", "go", "target to generate a program for (supported: go, js)")
+	output := fs.String("o", "", "file to write the generated program to (default: stdout)")
+	optLevel := fs.Int("O", 0, "optimization level (0: none, 1: inline small functions, "+
+		"2: also evaluate pure calls)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s build [flags] <file>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	filename := fs.Arg(0)
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return fmt.Errorf("could not read %s: %v", filename, err)
 	}
 
-	p := parser.New(lexer.New(string(data)))
+	var buf bytes.Buffer
+	switch *target {
+	case "go":
+		bytecode, warnings, err := compile(string(data),
+			compiler.WithOptimizationLevel(*optLevel))
+		printWarnings(warnings)
+		if err != nil {
+			return err
+		}
+		if err := gobackend.Generate(&buf, bytecode); err != nil {
+			return err
+		}
+
+	case "js":
+		program, err := parse(string(data))
+		if err != nil {
+			return err
+		}
+		if err := js.Generate(&buf, program); err != nil {
+			return fmt.Errorf("Woops! Generating JavaScript failed: %s", err)
+		}
+
+	default:
+		return fmt.Errorf("unsupported target: %s", *target)
+	}
+
+	if *output == "" {
+		_, err = buf.WriteTo(os.Stdout)
+		return err
+	}
+	return ioutil.WriteFile(*output, buf.Bytes(), 0644)
+}
+
+// explainCommand prints each line of a Monkey script followed by the instructions compiled from
+// it, to show how the constructs of the language compile.
+func explainCommand(args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	optLevel := fs.Int("O", 0, "optimization level (0: none, 1: inline small functions, "+
+		"2: also evaluate pure calls)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s explain [flags] <file>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	filename := fs.Arg(0)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", filename, err)
+	}
+
+	bytecode, warnings, err := compile(string(data), compiler.WithOptimizationLevel(*optLevel))
+	printWarnings(warnings)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	explain(&buf, string(data), bytecode)
+	_, err = buf.WriteTo(os.Stdout)
+	return err
+}
+
+// explain writes each line of source code `src` to `w`, followed by the instructions of the main
+// program and of the functions in `bytecode` which are compiled from the line according to their
+// line tables.
+func explain(w io.Writer, src string, bytecode *compiler.Bytecode) {
+	type unit struct {
+		name  string
+		insns code.Instructions
+		lines code.LineTable
+	}
+	units := []unit{{insns: bytecode.Instructions, lines: bytecode.Lines}}
+	for i, c := range bytecode.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			name := fmt.Sprintf("function %d", i)
+			if fn.Name != "" {
+				name = fmt.Sprintf("%s (%s)", name, fn.Name)
+			}
+			units = append(units, unit{name: name, insns: fn.Instructions, lines: fn.Lines})
+		}
+	}
+
+	for i, line := range strings.Split(strings.TrimSuffix(src, "\n"), "\n") {
+		fmt.Fprintln(w, strings.TrimRight(fmt.Sprintf("%4d | %s", i+1, line), " "))
+
+		for _, u := range units {
+			header := u.name != ""
+			for j, e := range u.lines {
+				if e.Line != i+1 {
+					continue
+				}
+				if header {
+					fmt.Fprintf(w, "       %s:\n", u.name)
+					header = false
+				}
+
+				end := len(u.insns)
+				if j+1 < len(u.lines) {
+					end = u.lines[j+1].Pos
+				}
+				for _, insn := range strings.SplitAfter(u.insns.Format(e.Pos, end), "\n") {
+					if insn != "" {
+						fmt.Fprintf(w, "         %s", insn)
+					}
+				}
+			}
+		}
+	}
+}
+
+// astCommand prints the AST of a Monkey script as parsed, before macros are expanded.
+func astCommand(args []string) error {
+	fs := flag.NewFlagSet("ast", flag.ExitOnError)
+	dot := fs.Bool("dot", false, "print a graph in the DOT language of Graphviz "+
+		"instead of an s-expression")
+	trace := fs.Bool("trace", false, "trace the parse functions to stderr")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ast [flags] <file>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	filename := fs.Arg(0)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", filename, err)
+	}
+
+	var opts []parser.Option
+	if *trace {
+		opts = append(opts, parser.WithTrace(os.Stderr))
+	}
+	p := parser.New(lexer.New(string(data)), opts...)
 	program := p.ParseProgram()
 	if len(p.Errors()) != 0 {
 		return errors.New(strings.Join(p.Errors(), "\n"))
 	}
 
+	if *dot {
+		return ast.WriteDOT(os.Stdout, program)
+	}
+	fmt.Println(ast.SExpr(program))
+	return nil
+}
+
+// tokensCommand prints the tokens the lexer reads from a Monkey script with their positions.
+func tokensCommand(args []string) error {
+	fs := flag.NewFlagSet("tokens", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the tokens as a JSON array")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s tokens [flags] <file>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	filename := fs.Arg(0)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", filename, err)
+	}
+
+	// jsonToken is the JSON representation of a token.
+	type jsonToken struct {
+		Type    token.Type `json:"type"`
+		Literal string     `json:"literal"`
+		Line    int        `json:"line"`
+		Column  int        `json:"column"`
+	}
+	var toks []jsonToken
+
+	l := lexer.New(string(data))
+	for {
+		tok := l.NextToken()
+		if *asJSON {
+			toks = append(toks, jsonToken{
+				Type: tok.Type, Literal: tok.Literal, Line: tok.Line, Column: tok.Column,
+			})
+		} else {
+			pos := fmt.Sprintf("%d:%d", tok.Line, tok.Column)
+			fmt.Printf("%-8s %-10s %q\n", pos, tok.Type, tok.Literal)
+		}
+		if tok.Type == token.EOF {
+			break
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(toks)
+	}
+	return nil
+}
+
+// testCommand runs tests defined in Monkey test files and reports their results.
+func testCommand(args []string) error {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	verbose := fs.Bool("v", false, "report passed tests as well as failed ones")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s test [flags] [dir]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Runs tests in files named *%s under dir (default: .)\n\n",
+			testrunner.Suffix)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	dir := "."
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		dir = fs.Arg(0)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	files, err := testrunner.Find(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		fmt.Printf("no test files in %s\n", dir)
+		return nil
+	}
+
+	failed := false
+	for _, file := range files {
+		results, err := testrunner.RunFile(file, os.Stdout)
+		if err != nil {
+			fmt.Printf("FAIL\t%s\n    %s\n", file, err)
+			failed = true
+			continue
+		}
+
+		numFailed := 0
+		for _, r := range results {
+			if !r.Passed() {
+				fmt.Printf("--- FAIL: %s (%s)\n    %s\n", r.Name, r.File, r.Err)
+				numFailed++
+			} else if *verbose {
+				fmt.Printf("--- PASS: %s (%s)\n", r.Name, r.File)
+			}
+		}
+
+		if numFailed != 0 {
+			fmt.Printf("FAIL\t%s\t%d of %d tests failed\n", file, numFailed, len(results))
+			failed = true
+		} else {
+			fmt.Printf("ok\t%s\t%d tests\n", file, len(results))
+		}
+	}
+
+	if failed {
+		return errors.New("some tests failed")
+	}
+	return nil
+}
+
+// runScript runs a Monkey script. If `c` is not nil, it is used to look up and store the
+// bytecode compiled from the script. If `printResult` is true, the value of the script, i.e. the
+// value of its last top-level statement if it is an expression, is printed after the top-level
+// statements have run. The script is granted capabilities `caps`.
+//
+// If the script defines a function `main` at the top level, it is called with `args` after the
+// top-level statements have run. If it returns a non-zero integer, runScript returns it as an
+// exitStatus, or an error if it is not in [0, 255]. Functions scheduled with timers are called
+// at last.
+func runScript(
+	filename string, args []string, c *cache.Cache, printResult bool, caps []object.Capability,
+) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", filename, err)
+	}
+
+	var (
+		bytecode *compiler.Bytecode
+		warnings []string
+		cached   bool
+	)
+	if c != nil {
+		bytecode, warnings, cached = c.Get(data)
+	}
+
+	if !cached {
+		bytecode, warnings, err = compile(string(data))
+		if err != nil {
+			printWarnings(warnings)
+			return err
+		}
+
+		if c != nil {
+			if err := c.Put(data, bytecode, warnings); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: could not cache bytecode: %v\n", err)
+			}
+		}
+	}
+	printWarnings(warnings)
+
+	// Run bytecode instructions
+	globals := make([]object.Object, vm.GlobalSize)
+	machine := vm.NewWithGlobalStore(bytecode, globals, vm.WithCapabilities(caps...))
+	stopSignals := handleSignals(machine)
+	defer stopSignals()
+	if err := machine.Run(); err != nil {
+		return executionError(err)
+	}
+
+	if result := machine.Result(); printResult && result != nil {
+		fmt.Println(result.Inspect())
+	}
+
+	idx, ok := bytecode.Globals["main"]
+	if !ok {
+		return runEventLoop(machine)
+	}
+	mainFn, ok := globals[idx].(*object.Closure)
+	if !ok {
+		return runEventLoop(machine)
+	}
+
+	result, err := callMain(machine, mainFn, args)
+	if err != nil {
+		return executionError(err)
+	}
+	if err := runEventLoop(machine); err != nil {
+		return err
+	}
+	return mainStatus(result)
+}
+
+// mainStatus returns the error runScript returns when the `main` function of a script returns
+// `result`: an exitStatus for a non-zero integer, an error for an integer out of the range of
+// exit statuses, which os.Exit would truncate, or nil otherwise.
+func mainStatus(result object.Object) error {
+	switch result := result.(type) {
+	case *object.Integer:
+		if result.Value < 0 || result.Value > 255 {
+			return fmt.Errorf("main returned %d, which is not an exit status in [0, 255]",
+				result.Value)
+		}
+		if result.Value != 0 {
+			return exitStatus(result.Value)
+		}
+	case *object.BigInt:
+		return fmt.Errorf("main returned %s, which is not an exit status in [0, 255]",
+			result.Inspect())
+	}
+	return nil
+}
+
+// runEventLoop calls the functions the script has scheduled with timers until none are left.
+func runEventLoop(machine *vm.VM) error {
+	if err := machine.RunEventLoop(); err != nil {
+		return executionError(err)
+	}
+	return nil
+}
+
+// interruptStatus is the exit status of a script interrupted by a signal, which is set by
+// handleSignals. By convention, it is 128 plus the number of the signal.
+var interruptStatus exitStatus
+
+// handleSignals makes SIGINT and SIGTERM interrupt `machine`, so that the script stops between
+// instructions rather than being killed in the middle of one, and the process exits with a
+// conventional status. A second signal kills the process, e.g. in case the script is blocked in
+// a built-in function running a command. It returns a function to stop handling signals.
+func handleSignals(machine *vm.VM) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			signal.Stop(sigs)
+			if s, ok := sig.(syscall.Signal); ok {
+				interruptStatus = exitStatus(128 + int(s))
+			}
+			machine.Interrupt()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// executionError returns an error to report that executing a script failed with `err`, or the
+// exit status if it was interrupted by a signal.
+func executionError(err error) error {
+	if errors.Is(err, vm.ErrInterrupted) {
+		return interruptStatus
+	}
+	return fmt.Errorf("Woops! Executing bytecode failed: %s", err)
+}
+
+// callMain calls the `main` function of a script. It is passed an array of command line
+// arguments `args` only if it has a parameter, so that it can be defined without one.
+func callMain(machine *vm.VM, mainFn *object.Closure, args []string) (object.Object, error) {
+	if mainFn.Fn.NumParameters == 0 {
+		return machine.Call(mainFn)
+	}
+
+	elems := make([]object.Object, len(args))
+	for i, arg := range args {
+		elems[i] = &object.String{Value: arg}
+	}
+	return machine.Call(mainFn, &object.Array{Elements: elems})
+}
+
+// parse parses source code `src` and expands macros in it.
+func parse(src string) (*ast.Program, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, errors.New(strings.Join(p.Errors(), "\n"))
+	}
+
 	// Process macros
 	macroEnv := object.NewEnvironment()
 	eval.DefineMacros(program, macroEnv)
-	expanded := eval.ExpandMacros(program, macroEnv)
+	expanded, err := eval.ExpandMacros(program, macroEnv)
+	if err != nil {
+		return nil, err
+	}
+	return expanded.(*ast.Program), nil
+}
+
+// compile parses and compiles source code `src` to bytecode with compiler options `opts`.
+// It also returns the warnings about the source code found by compiler.Check and
+// compiler.CheckComments, even if compilation fails.
+func compile(src string, opts ...compiler.Option) (*compiler.Bytecode, []string, error) {
+	expanded, err := parse(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var warnings []string
+	for _, w := range append(compiler.Check(expanded), compiler.CheckComments(src)...) {
+		warnings = append(warnings, w.String())
+	}
 
 	// Compile the AST to bytecode
-	c := compiler.New()
+	c := compiler.New(opts...)
 	if err := c.Compile(expanded); err != nil {
-		return fmt.Errorf("Woops! Compilation failed: %s", err)
+		return nil, warnings, fmt.Errorf("Woops! Compilation failed: %s", err)
 	}
 
-	// Run bytecode instructions
-	machine := vm.New(c.Bytecode())
-	if err := machine.Run(); err != nil {
-		return fmt.Errorf("Woops! Executing bytecode failed: %s", err)
+	return c.Bytecode(), warnings, nil
+}
+
+// printWarnings prints warnings about source code to stderr.
+func printWarnings(warnings []string) {
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
 	}
+}
 
-	return nil
+// useColor reports whether output to `f` should be colored, i.e. `f` is a terminal and colors
+// are not disabled by the NO_COLOR environment variable.
+func useColor(f *os.File) bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+func TestMainStatus(t *testing.T) {
+	tests := []struct {
+		result object.Object
+		want   string
+	}{
+		{&object.Integer{Value: 0}, ""},
+		{&object.Integer{Value: 1}, "exit status 1"},
+		{&object.Integer{Value: 255}, "exit status 255"},
+		{&object.Integer{Value: 256}, "main returned 256, which is not an exit status in [0, 255]"},
+		{&object.Integer{Value: -1}, "main returned -1, which is not an exit status in [0, 255]"},
+		{
+			&object.BigInt{Value: new(big.Int).Lsh(big.NewInt(1), 64)},
+			"main returned 18446744073709551616, which is not an exit status in [0, 255]",
+		},
+		{&object.String{Value: "1"}, ""},
+		{nil, ""},
+	}
+
+	for _, tt := range tests {
+		err := mainStatus(tt.result)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("wrong error for %v. want=%q, got=%q", tt.result, tt.want, got)
+		}
+	}
+}
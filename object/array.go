@@ -0,0 +1,63 @@
+package object
+
+// arrayBuffer describes a backing array shared by the elements of arrays created by Push and
+// Slice.
+type arrayBuffer struct {
+	// capacity is the capacity of the backing array, and used is the number of elements in it
+	// in use by some array, i.e. the end of the elements of the array pushed to most recently
+	capacity, used int
+	// shared reports whether more than one array has used the backing array, in which case
+	// writing an element must copy the elements first
+	shared bool
+}
+
+// Push returns a new array of the elements of `a` followed by `el`, leaving `a` unchanged.
+//
+// The new array grows its backing array by doubling it as needed, and shares it with `a` if `a`
+// has room for `el` after its last element, so that building an array by pushing elements one
+// by one to the last array takes amortized constant time per element.
+func (a *Array) Push(el Object) *Array {
+	l := len(a.Elements)
+
+	if buf := a.buf; buf != nil && l < cap(a.Elements) && buf.used == a.end() {
+		buf.used++
+		buf.shared = true
+		return &Array{Elements: append(a.Elements, el), buf: buf}
+	}
+
+	elems := make([]Object, l+1, 2*l+1)
+	copy(elems, a.Elements)
+	elems[l] = el
+	return &Array{Elements: elems, buf: &arrayBuffer{capacity: cap(elems), used: l + 1}}
+}
+
+// Slice returns a new array of the elements of `a` from index `start` up to but not including
+// `end`, which shares the elements with `a` until either of them is modified by Set. The indices
+// must be within the bounds of `a`.
+func (a *Array) Slice(start, end int) *Array {
+	if a.buf == nil {
+		a.buf = &arrayBuffer{capacity: cap(a.Elements), used: len(a.Elements)}
+	}
+	a.buf.shared = true
+
+	return &Array{Elements: a.Elements[start:end:cap(a.Elements)], buf: a.buf}
+}
+
+// Set sets the element at index `i` of `a` to `el`. If `a` shares its elements with other
+// arrays, it copies them first so that the others are not affected. The index must be within
+// the bounds of `a`.
+func (a *Array) Set(i int, el Object) {
+	if a.buf != nil && a.buf.shared {
+		elems := make([]Object, len(a.Elements))
+		copy(elems, a.Elements)
+		a.Elements = elems
+		a.buf = nil
+	}
+
+	a.Elements[i] = el
+}
+
+// end returns the index of the end of the elements of `a` in its backing array.
+func (a *Array) end() int {
+	return a.buf.capacity - cap(a.Elements) + len(a.Elements)
+}
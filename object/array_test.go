@@ -0,0 +1,69 @@
+package object
+
+import "testing"
+
+func TestArrayPush(t *testing.T) {
+	empty := &Array{}
+	a1 := empty.Push(&Integer{Value: 1})
+	a2 := a1.Push(&Integer{Value: 2})
+	a3 := a2.Push(&Integer{Value: 3})
+
+	// Pushing to the last array reuses its backing array
+	if &a2.Elements[0] != &a3.Elements[0] {
+		t.Errorf("array pushed to the last array does not share the elements")
+	}
+
+	// Pushing to an earlier array must not overwrite elements of later ones
+	b3 := a2.Push(&Integer{Value: 4})
+	if &a2.Elements[0] == &b3.Elements[0] {
+		t.Errorf("array pushed to an earlier array shares the elements")
+	}
+
+	testArray(t, empty, "[]")
+	testArray(t, a1, "[1]")
+	testArray(t, a2, "[1, 2]")
+	testArray(t, a3, "[1, 2, 3]")
+	testArray(t, b3, "[1, 2, 4]")
+}
+
+func TestArraySlice(t *testing.T) {
+	a := &Array{Elements: []Object{&Integer{Value: 1}, &Integer{Value: 2}, &Integer{Value: 3}}}
+	s := a.Slice(1, 2)
+	testArray(t, s, "[2]")
+
+	if &a.Elements[1] != &s.Elements[0] {
+		t.Errorf("slice does not share the elements")
+	}
+
+	// Pushing to the slice must not overwrite the rest of the original
+	p := s.Push(&Integer{Value: 4})
+	testArray(t, p, "[2, 4]")
+	testArray(t, a, "[1, 2, 3]")
+}
+
+func TestArraySet(t *testing.T) {
+	a := &Array{Elements: []Object{&Integer{Value: 1}, &Integer{Value: 2}}}
+	a.Set(0, &Integer{Value: 5})
+	testArray(t, a, "[5, 2]")
+
+	// Setting an element of an array sharing the elements copies them first
+	b := a.Push(&Integer{Value: 3})
+	c := b.Push(&Integer{Value: 4})
+	b.Set(1, &Integer{Value: 6})
+	c.Set(0, &Integer{Value: 7})
+	s := c.Slice(2, 4)
+	s.Set(0, &Integer{Value: 8})
+
+	testArray(t, a, "[5, 2]")
+	testArray(t, b, "[5, 6, 3]")
+	testArray(t, c, "[7, 2, 3, 4]")
+	testArray(t, s, "[8, 4]")
+}
+
+func testArray(t *testing.T, arr *Array, want string) {
+	t.Helper()
+
+	if got := arr.Inspect(); got != want {
+		t.Errorf("wrong array. want=%s, got=%s", want, got)
+	}
+}
@@ -1,7 +1,22 @@
 package object
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 // Builtins is a list of built-in functions.
@@ -12,16 +27,19 @@ var Builtins = []struct {
 	{
 		Name: "len",
 		Builtin: &Builtin{
-			Fn: func(args ...Object) Object {
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
 				if l := len(args); l != 1 {
 					return newError("wrong number of arguments. want=1, got=%d", l)
 				}
 
 				switch arg := args[0].(type) {
 				case *String:
+					return &Integer{Value: int64(arg.Len())}
+				case *Bytes:
 					return &Integer{Value: int64(len(arg.Value))}
-				case *Array:
-					return &Integer{Value: int64(len(arg.Elements))}
+				case ArrayObject:
+					return &Integer{Value: int64(arg.Len())}
 				default:
 					return newError("argument to `len` not supported, got %s", arg.Type())
 				}
@@ -31,9 +49,9 @@ var Builtins = []struct {
 	{
 		Name: "puts",
 		Builtin: &Builtin{
-			Fn: func(args ...Object) Object {
+			Fn: func(host Host, args ...Object) Object {
 				for _, arg := range args {
-					fmt.Println(arg.Inspect())
+					fmt.Fprintln(host.Stdout(), arg.Inspect())
 				}
 				return nil
 			},
@@ -42,7 +60,8 @@ var Builtins = []struct {
 	{
 		Name: "first",
 		Builtin: &Builtin{
-			Fn: func(args ...Object) Object {
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
 				if l := len(args); l != 1 {
 					return newError("wrong number of arguments. want=1, got=%d", l)
 				}
@@ -51,9 +70,9 @@ var Builtins = []struct {
 					return newError("argument to `first` must be Array, got %s", typ)
 				}
 
-				arr := args[0].(*Array)
-				if len(arr.Elements) > 0 {
-					return arr.Elements[0]
+				arr := args[0].(ArrayObject)
+				if arr.Len() > 0 {
+					return arr.Get(0)
 				}
 				return nil
 			},
@@ -62,7 +81,8 @@ var Builtins = []struct {
 	{
 		Name: "last",
 		Builtin: &Builtin{
-			Fn: func(args ...Object) Object {
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
 				if l := len(args); l != 1 {
 					return newError("wrong number of arguments. want=1, got=%d", l)
 				}
@@ -71,9 +91,9 @@ var Builtins = []struct {
 					return newError("argument to `last` must be Array, got %s", typ)
 				}
 
-				arr := args[0].(*Array)
-				if l := len(arr.Elements); l > 0 {
-					return arr.Elements[l-1]
+				arr := args[0].(ArrayObject)
+				if l := arr.Len(); l > 0 {
+					return arr.Get(l - 1)
 				}
 				return nil
 			},
@@ -82,7 +102,8 @@ var Builtins = []struct {
 	{
 		Name: "rest",
 		Builtin: &Builtin{
-			Fn: func(args ...Object) Object {
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
 				if l := len(args); l != 1 {
 					return newError("wrong number of arguments. want=1, got=%d", l)
 				}
@@ -91,22 +112,25 @@ var Builtins = []struct {
 					return newError("argument to `last` must be Array, got %s", typ)
 				}
 
-				arr := args[0].(*Array)
-				l := len(arr.Elements)
-				if l == 0 {
-					return nil
+				switch arr := args[0].(type) {
+				case *Array:
+					if l := len(arr.Elements); l > 0 {
+						return arr.Slice(1, l)
+					}
+				case *PersistentArray:
+					if l := arr.Len(); l > 0 {
+						return arr.Slice(1, l)
+					}
 				}
-
-				newElems := make([]Object, l-1)
-				copy(newElems, arr.Elements[1:l])
-				return &Array{Elements: newElems}
+				return nil
 			},
 		},
 	},
 	{
 		Name: "push",
 		Builtin: &Builtin{
-			Fn: func(args ...Object) Object {
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
 				if l := len(args); l != 2 {
 					return newError("wrong number of arguments. want=%d, got=%d", 2, l)
 				}
@@ -115,28 +139,1762 @@ var Builtins = []struct {
 					return newError("first argument to `push` must be Array, got %s", typ)
 				}
 
-				arr := args[0].(*Array)
-				l := len(arr.Elements)
+				if arr, ok := args[0].(*PersistentArray); ok {
+					return arr.Push(args[1])
+				}
+				return args[0].(*Array).Push(args[1])
+			},
+		},
+	},
+	{
+		Name: "freeze",
+		Builtin: &Builtin{
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
 
-				newElems := make([]Object, l+1)
-				copy(newElems, arr.Elements)
-				newElems[l] = args[1]
-				return &Array{Elements: newElems}
+				return Freeze(args[0])
 			},
 		},
 	},
-}
+	{
+		Name: "clone",
+		Builtin: &Builtin{
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
 
-// GetBuiltinByName returns a built-in function matching a given name.
-// If no function is found with the name, it returns nil.
-func GetBuiltinByName(name string) *Builtin {
-	for _, def := range Builtins {
-		if def.Name == name {
-			return def.Builtin
-		}
-	}
+				return Clone(args[0])
+			},
+		},
+	},
+	{
+		Name: "bytes",
+		Builtin: &Builtin{
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
 
-	return nil
+				switch arg := args[0].(type) {
+				case *String:
+					return &Bytes{Value: []byte(arg.Value)}
+				case *Bytes:
+					return arg
+				case ArrayObject:
+					b := make([]byte, arg.Len())
+					for i := range b {
+						el := arg.Get(i)
+						n, ok := el.(*Integer)
+						if !ok || n.Value < 0 || n.Value > 255 {
+							return newError("element %d of argument to `bytes` is not a byte: %s",
+								i, el.Inspect())
+						}
+						b[i] = byte(n.Value)
+					}
+					return &Bytes{Value: b}
+				default:
+					return newError("argument to `bytes` not supported, got %s", arg.Type())
+				}
+			},
+		},
+	},
+	{
+		Name: "slice",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 3 {
+					return newError("wrong number of arguments. want=3, got=%d", l)
+				}
+
+				switch arg := args[0].(type) {
+				case *Bytes:
+					start, end, err := sliceBounds(args[1], args[2], len(arg.Value))
+					if err != nil {
+						return err
+					}
+
+					newVal := make([]byte, end-start)
+					copy(newVal, arg.Value[start:end])
+					return &Bytes{Value: newVal}
+
+				case *Array:
+					start, end, err := sliceBounds(args[1], args[2], len(arg.Elements))
+					if err != nil {
+						return err
+					}
+					return arg.Slice(start, end)
+
+				case *PersistentArray:
+					start, end, err := sliceBounds(args[1], args[2], arg.Len())
+					if err != nil {
+						return err
+					}
+					return arg.Slice(start, end)
+
+				default:
+					return newError("first argument to `slice` must be Bytes or Array, got %s",
+						args[0].Type())
+				}
+			},
+		},
+	},
+	{
+		Name: "to_str",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				switch arg := args[0].(type) {
+				case *String:
+					return arg
+				case *Bytes:
+					return &String{Value: string(arg.Value)}
+				default:
+					return &String{Value: arg.Inspect()}
+				}
+			},
+		},
+	},
+	{
+		Name: "big",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				switch arg := args[0].(type) {
+				case *Integer:
+					return &BigInt{Value: big.NewInt(arg.Value)}
+				case *BigInt:
+					return arg
+				case *String:
+					n, ok := new(big.Int).SetString(arg.Value, 10)
+					if !ok {
+						return newError("could not parse %q as integer", arg.Value)
+					}
+					return &BigInt{Value: n}
+				default:
+					return newError("argument to `big` not supported, got %s", arg.Type())
+				}
+			},
+		},
+	},
+	{
+		Name: "test",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if l := len(args); l != 2 {
+					return newError("wrong number of arguments. want=2, got=%d", l)
+				}
+
+				name, ok := args[0].(*String)
+				if !ok {
+					return newError("first argument to `test` must be String, got %s",
+						args[0].Type())
+				}
+
+				switch typ := args[1].Type(); typ {
+				case ClosureType, FunctionType:
+				default:
+					return newError("second argument to `test` must be a function, got %s", typ)
+				}
+
+				th, ok := host.(TestHost)
+				if !ok {
+					return newError("tests can only be defined when running tests")
+				}
+				th.AddTest(name.Value, args[1])
+				return nil
+			},
+		},
+	},
+	{
+		Name: "assert_eq",
+		Builtin: &Builtin{
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 2 {
+					return newError("wrong number of arguments. want=2, got=%d", l)
+				}
+
+				if got, want := args[0], args[1]; !Equal(got, want) {
+					return &Abort{Message: fmt.Sprintf("assertion failed: got %s, want %s",
+						got.Inspect(), want.Inspect())}
+				}
+				return nil
+			},
+		},
+	},
+	{
+		Name: "assert",
+		Builtin: &Builtin{
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 && l != 2 {
+					return newError("wrong number of arguments. want=1 or 2, got=%d", l)
+				}
+
+				if isTruthy(args[0]) {
+					return nil
+				}
+				if len(args) == 1 {
+					return &Abort{Message: "assertion failed"}
+				}
+				return &Abort{Message: "assertion failed: " + message(args[1])}
+			},
+		},
+	},
+	{
+		Name: "panic",
+		Builtin: &Builtin{
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				return &Abort{Message: message(args[0]), Panic: true}
+			},
+		},
+	},
+	{
+		Name: "set",
+		Builtin: &Builtin{
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 3 {
+					return newError("wrong number of arguments. want=3, got=%d", l)
+				}
+
+				switch coll := args[0].(type) {
+				case ArrayObject:
+					idx, ok := args[1].(*Integer)
+					if !ok {
+						return newError("index to `set` an array must be Integer, got %s",
+							args[1].Type())
+					}
+					if idx.Value < 0 || idx.Value >= int64(coll.Len()) {
+						return newError("array index %d out of range", idx.Value)
+					}
+					return setElement(coll, int(idx.Value), args[2])
+
+				case HashObject:
+					key, ok := args[1].(Hashable)
+					if !ok {
+						return newError("unusable as hash key: %s", args[1].Type())
+					}
+					return setPair(coll, key.HashKey(), HashPair{Key: args[1], Value: args[2]})
+
+				default:
+					return newError("first argument to `set` must be Array or Hash, got %s",
+						args[0].Type())
+				}
+			},
+		},
+	},
+	{
+		Name: "print",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				for _, arg := range args {
+					io.WriteString(host.Stdout(), arg.Inspect())
+				}
+				return nil
+			},
+		},
+	},
+	{
+		Name: "format",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 2 {
+					return newError("wrong number of arguments. want=2, got=%d", l)
+				}
+
+				spec, ok := args[1].(*String)
+				if !ok {
+					return newError("second argument to `format` must be String, got %s",
+						args[1].Type())
+				}
+
+				var v float64
+				switch arg := args[0].(type) {
+				case *Float:
+					v = arg.Value
+				case *Integer:
+					v = float64(arg.Value)
+				default:
+					return newError("first argument to `format` must be Float or Integer, got %s",
+						arg.Type())
+				}
+
+				s, err := FormatFloat(v, spec.Value)
+				if err != nil {
+					return newError("%s", err)
+				}
+				return &String{Value: s}
+			},
+		},
+	},
+	{
+		Name: "chr",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				code, ok := args[0].(*Integer)
+				if !ok {
+					return newError("argument to `chr` must be Integer, got %s", args[0].Type())
+				}
+				if code.Value < 0 || code.Value > utf8.MaxRune || !utf8.ValidRune(rune(code.Value)) {
+					return newError("invalid code point %d", code.Value)
+				}
+				return &String{Value: string(rune(code.Value))}
+			},
+		},
+	},
+	{
+		Name: "ord",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				s, ok := args[0].(*String)
+				if !ok {
+					return newError("argument to `ord` must be String, got %s", args[0].Type())
+				}
+				r, size := utf8.DecodeRuneInString(s.Value)
+				if len(s.Value) == 0 || size != len(s.Value) {
+					return newError("argument to `ord` must be a single character, got %q", s.Value)
+				}
+				return &Integer{Value: int64(r)}
+			},
+		},
+	},
+	{
+		Name: "delay",
+		Builtin: &Builtin{
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				if !isFunction(args[0]) {
+					return newError("argument to `delay` must be a function, got %s",
+						args[0].Type())
+				}
+				return &Thunk{Fn: args[0]}
+			},
+		},
+	},
+	{
+		Name: "force",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				// Forcing a value which is not a thunk yields the value itself
+				t, ok := args[0].(*Thunk)
+				if !ok {
+					return args[0]
+				}
+				if t.Forced {
+					return t.Value
+				}
+
+				val := callFunction(host, t.Fn)
+				switch val.(type) {
+				case *Abort:
+					return val
+				case nil:
+					val = NilValue
+				}
+
+				// Release the function, which is no longer needed, along with its free variables
+				t.Fn, t.Value, t.Forced = nil, val, true
+				return val
+			},
+		},
+	},
+	{
+		Name: "apply",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if l := len(args); l != 2 {
+					return newError("wrong number of arguments. want=2, got=%d", l)
+				}
+
+				if !isFunction(args[0]) {
+					return newError("first argument to `apply` must be a function, got %s",
+						args[0].Type())
+				}
+				arr, ok := args[1].(ArrayObject)
+				if !ok {
+					return newError("second argument to `apply` must be Array, got %s",
+						args[1].Type())
+				}
+
+				fnArgs := make([]Object, arr.Len())
+				for i := range fnArgs {
+					fnArgs[i] = arr.Get(i)
+				}
+				return callFunction(host, args[0], fnArgs...)
+			},
+		},
+	},
+	{
+		Name: "arity",
+		Builtin: &Builtin{
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				switch fn := args[0].(type) {
+				case *Closure:
+					return &Integer{Value: int64(fn.Fn.NumParameters)}
+				case *CompiledFunction:
+					return &Integer{Value: int64(fn.NumParameters)}
+				case *Function:
+					return &Integer{Value: int64(len(fn.Parameters))}
+				case *Builtin:
+					return newError("arity of built-in functions is not fixed")
+				default:
+					return newError("argument to `arity` must be a function, got %s", fn.Type())
+				}
+			},
+		},
+	},
+	{
+		Name: "compose",
+		Builtin: &Builtin{
+			Fn: func(_ Host, args ...Object) Object {
+				if len(args) == 0 {
+					return newError("wrong number of arguments. want at least 1, got=0")
+				}
+				for i, arg := range args {
+					if !isFunction(arg) {
+						return newError("argument %d to `compose` must be a function, got %s",
+							i+1, arg.Type())
+					}
+				}
+
+				fns := make([]Object, len(args))
+				copy(fns, args)
+				// The last function takes the arguments, and each of the others takes the result
+				// of the one following it
+				return &Builtin{Fn: func(host Host, args ...Object) Object {
+					result := callFunction(host, fns[len(fns)-1], args...)
+					for i := len(fns) - 2; i >= 0; i-- {
+						if _, ok := result.(*Abort); ok {
+							return result
+						}
+						if result == nil {
+							result = NilValue
+						}
+						result = callFunction(host, fns[i], result)
+					}
+					return result
+				}}
+			},
+		},
+	},
+	{
+		Name: "partial",
+		Builtin: &Builtin{
+			Fn: func(_ Host, args ...Object) Object {
+				if len(args) == 0 {
+					return newError("wrong number of arguments. want at least 1, got=0")
+				}
+				if !isFunction(args[0]) {
+					return newError("first argument to `partial` must be a function, got %s",
+						args[0].Type())
+				}
+
+				fn := args[0]
+				bound := make([]Object, len(args)-1)
+				copy(bound, args[1:])
+				return &Builtin{Fn: func(host Host, args ...Object) Object {
+					fnArgs := make([]Object, 0, len(bound)+len(args))
+					fnArgs = append(fnArgs, bound...)
+					fnArgs = append(fnArgs, args...)
+					return callFunction(host, fn, fnArgs...)
+				}}
+			},
+		},
+	},
+	{
+		Name: "parse_int",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 && l != 2 {
+					return newError("wrong number of arguments. want=1 or 2, got=%d", l)
+				}
+
+				s, ok := args[0].(*String)
+				if !ok {
+					return newError("first argument to `parse_int` must be String, got %s",
+						args[0].Type())
+				}
+
+				base := int64(10)
+				if len(args) == 2 {
+					b, ok := args[1].(*Integer)
+					if !ok {
+						return newError("second argument to `parse_int` must be Integer, got %s",
+							args[1].Type())
+					}
+					// Base 0 infers the base from the prefix of the string, e.g. 0x for 16
+					if b.Value != 0 && (b.Value < 2 || b.Value > 36) {
+						return newError("invalid base %d", b.Value)
+					}
+					base = b.Value
+				}
+
+				n, err := strconv.ParseInt(s.Value, int(base), 64)
+				if errors.Is(err, strconv.ErrRange) {
+					return newError("integer %q out of range", s.Value)
+				}
+				if err != nil {
+					return newError("could not parse %q as integer", s.Value)
+				}
+				return &Integer{Value: n}
+			},
+		},
+	},
+	{
+		Name: "parse_float",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				s, ok := args[0].(*String)
+				if !ok {
+					return newError("argument to `parse_float` must be String, got %s",
+						args[0].Type())
+				}
+
+				// Monkey has no literals of infinities and NaN, so neither do strings to parse
+				f, err := strconv.ParseFloat(s.Value, 64)
+				if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+					return newError("could not parse %q as float", s.Value)
+				}
+				return &Float{Value: f}
+			},
+		},
+	},
+	{
+		Name: "concat",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if len(args) == 0 {
+					return newError("wrong number of arguments. want at least 1, got=0")
+				}
+
+				n := 0
+				for i, arg := range args {
+					arr, ok := arg.(ArrayObject)
+					if !ok {
+						return newError("argument %d to `concat` must be Array, got %s",
+							i+1, arg.Type())
+					}
+					n += arr.Len()
+				}
+
+				elems := make([]Object, 0, n)
+				for _, arg := range args {
+					elems = appendElements(elems, arg.(ArrayObject))
+				}
+				return newArrayLike(args[0], elems)
+			},
+		},
+	},
+	{
+		Name: "index_of",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 2 {
+					return newError("wrong number of arguments. want=2, got=%d", l)
+				}
+
+				arr, ok := args[0].(ArrayObject)
+				if !ok {
+					return newError("first argument to `index_of` must be Array, got %s",
+						args[0].Type())
+				}
+
+				for i := 0; i < arr.Len(); i++ {
+					if Equal(arr.Get(i), args[1]) {
+						return &Integer{Value: int64(i)}
+					}
+				}
+				return &Integer{Value: -1}
+			},
+		},
+	},
+	{
+		Name: "flatten",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				arr, ok := args[0].(ArrayObject)
+				if !ok {
+					return newError("argument to `flatten` must be Array, got %s", args[0].Type())
+				}
+
+				n := 0
+				for i := 0; i < arr.Len(); i++ {
+					if inner, ok := arr.Get(i).(ArrayObject); ok {
+						n += inner.Len()
+					} else {
+						n++
+					}
+				}
+
+				elems := make([]Object, 0, n)
+				for i := 0; i < arr.Len(); i++ {
+					if inner, ok := arr.Get(i).(ArrayObject); ok {
+						elems = appendElements(elems, inner)
+					} else {
+						elems = append(elems, arr.Get(i))
+					}
+				}
+				return newArrayLike(arr, elems)
+			},
+		},
+	},
+	{
+		Name: "zip",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if len(args) == 0 {
+					return newError("wrong number of arguments. want at least 1, got=0")
+				}
+
+				arrs := make([]ArrayObject, len(args))
+				n := -1
+				for i, arg := range args {
+					arr, ok := arg.(ArrayObject)
+					if !ok {
+						return newError("argument %d to `zip` must be Array, got %s",
+							i+1, arg.Type())
+					}
+					if l := arr.Len(); n < 0 || l < n {
+						n = l
+					}
+					arrs[i] = arr
+				}
+
+				tuples := make([]Object, n)
+				for i := range tuples {
+					tuple := make([]Object, len(arrs))
+					for j, arr := range arrs {
+						tuple[j] = arr.Get(i)
+					}
+					tuples[i] = newArrayLike(args[0], tuple)
+				}
+				return newArrayLike(args[0], tuples)
+			},
+		},
+	},
+	{
+		Name: "take",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				arr, n, err := arrayAndCount("take", args)
+				if err != nil {
+					return err
+				}
+				return sliceArray(arr, 0, n)
+			},
+		},
+	},
+	{
+		Name: "drop",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				arr, n, err := arrayAndCount("drop", args)
+				if err != nil {
+					return err
+				}
+				return sliceArray(arr, n, arr.Len())
+			},
+		},
+	},
+	{
+		Name: "round",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 && l != 2 {
+					return newError("wrong number of arguments. want=1 or 2, got=%d", l)
+				}
+
+				digits := 0
+				if len(args) == 2 {
+					d, ok := args[1].(*Integer)
+					if !ok {
+						return newError("second argument to `round` must be Integer, got %s",
+							args[1].Type())
+					}
+					digits = clampDigits(d.Value)
+				}
+
+				switch arg := args[0].(type) {
+				case *Float:
+					return &Float{Value: RoundFloat(arg.Value, digits)}
+				case *Integer:
+					r, ok := RoundInt(arg.Value, digits)
+					if !ok {
+						return newError("integer overflow: round(%d, %d)", arg.Value, digits)
+					}
+					return &Integer{Value: r}
+				default:
+					return newError("first argument to `round` must be Float or Integer, got %s",
+						arg.Type())
+				}
+			},
+		},
+	},
+	{
+		Name: "trunc",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				switch arg := args[0].(type) {
+				case *Float:
+					// -2^63 is exactly representable, while 2^63 is the smallest float too large
+					f := math.Trunc(arg.Value)
+					if !(f >= math.MinInt64 && f < math.MaxInt64) {
+						return newError("%s is out of range of Integer", arg.Inspect())
+					}
+					return &Integer{Value: int64(f)}
+				case *Integer:
+					return arg
+				default:
+					return newError("argument to `trunc` must be Float or Integer, got %s",
+						arg.Type())
+				}
+			},
+		},
+	},
+	{
+		Name: "to_fixed",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 2 {
+					return newError("wrong number of arguments. want=2, got=%d", l)
+				}
+
+				var v float64
+				switch arg := args[0].(type) {
+				case *Float:
+					v = arg.Value
+				case *Integer:
+					v = float64(arg.Value)
+				default:
+					return newError("first argument to `to_fixed` must be Float or Integer, got %s",
+						arg.Type())
+				}
+				digits, ok := args[1].(*Integer)
+				if !ok {
+					return newError("second argument to `to_fixed` must be Integer, got %s",
+						args[1].Type())
+				}
+
+				if d := digits.Value; d < 0 || d > maxFormatNum {
+					return newError("number of digits %d is out of range [0, %d]", d, maxFormatNum)
+				}
+				s, err := FormatFixed(v, int(digits.Value))
+				if err != nil {
+					return newError("%s", err)
+				}
+				return &String{Value: s}
+			},
+		},
+	},
+	{
+		Name: "b64_encode",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				data, err := encodingInput("b64_encode", args)
+				if err != nil {
+					return err
+				}
+				return &String{Value: base64.StdEncoding.EncodeToString(data)}
+			},
+		},
+	},
+	{
+		Name: "b64_decode",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				data, err := encodingInput("b64_decode", args)
+				if err != nil {
+					return err
+				}
+				decoded, decodeErr := base64.StdEncoding.DecodeString(string(data))
+				if decodeErr != nil {
+					return newError("invalid base64: %s", decodeErr)
+				}
+				return &String{Value: string(decoded)}
+			},
+		},
+	},
+	{
+		Name: "hex_encode",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				data, err := encodingInput("hex_encode", args)
+				if err != nil {
+					return err
+				}
+				return &String{Value: hex.EncodeToString(data)}
+			},
+		},
+	},
+	{
+		Name: "hex_decode",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				data, err := encodingInput("hex_decode", args)
+				if err != nil {
+					return err
+				}
+				decoded, decodeErr := hex.DecodeString(string(data))
+				if decodeErr != nil {
+					return newError("invalid hex: %s", decodeErr)
+				}
+				return &String{Value: string(decoded)}
+			},
+		},
+	},
+	{
+		Name: "csv_parse",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 && l != 2 {
+					return newError("wrong number of arguments. want=1 or 2, got=%d", l)
+				}
+
+				s, ok := args[0].(*String)
+				if !ok {
+					return newError("first argument to `csv_parse` must be String, got %s",
+						args[0].Type())
+				}
+				header := false
+				if len(args) == 2 {
+					b, ok := args[1].(*Boolean)
+					if !ok {
+						return newError("second argument to `csv_parse` must be Boolean, got %s",
+							args[1].Type())
+					}
+					header = b.Value
+				}
+
+				r := csv.NewReader(strings.NewReader(s.Value))
+				// Rows of arrays may have different numbers of fields, while those of hashes
+				// must have as many as the header
+				if !header {
+					r.FieldsPerRecord = -1
+				}
+				records, err := r.ReadAll()
+				if err != nil {
+					return newError("invalid CSV: %s", err)
+				}
+				if !header {
+					return csvArrays(records)
+				}
+				if len(records) == 0 {
+					return &Array{Elements: []Object{}}
+				}
+				return csvHashes(records[0], records[1:])
+			},
+		},
+	},
+	{
+		Name: "csv_format",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				rows, ok := args[0].(ArrayObject)
+				if !ok {
+					return newError("argument to `csv_format` must be Array, got %s",
+						args[0].Type())
+				}
+
+				records := make([][]string, rows.Len())
+				for i := range records {
+					row, ok := rows.Get(i).(ArrayObject)
+					if !ok {
+						return newError("row %d given to `csv_format` must be Array, got %s",
+							i, rows.Get(i).Type())
+					}
+					records[i] = make([]string, row.Len())
+					for j := range records[i] {
+						records[i][j] = csvField(row.Get(j))
+					}
+				}
+
+				var out strings.Builder
+				w := csv.NewWriter(&out)
+				// Writing to a strings.Builder never fails
+				_ = w.WriteAll(records)
+				return &String{Value: out.String()}
+			},
+		},
+	},
+	{
+		Name: "exec",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if err := checkCapability(host, "exec", CapExec); err != nil {
+					return err
+				}
+				if len(args) == 0 {
+					return newError("wrong number of arguments. want at least 1, got=0")
+				}
+
+				argv := make([]string, len(args))
+				for i, arg := range args {
+					s, ok := arg.(*String)
+					if !ok {
+						return newError("argument %d to `exec` must be String, got %s",
+							i+1, arg.Type())
+					}
+					argv[i] = s.Value
+				}
+
+				var stdout, stderr bytes.Buffer
+				cmd := exec.Command(argv[0], argv[1:]...)
+				cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+				code := 0
+				if err := cmd.Run(); err != nil {
+					exitErr, ok := err.(*exec.ExitError)
+					if !ok {
+						return newError("could not run %q: %s", argv[0], err)
+					}
+					// The exit code is -1 if the command was terminated by a signal
+					code = exitErr.ExitCode()
+				}
+
+				result := &Hash{Pairs: make(map[HashKey]HashPair, 3)}
+				setField(result, "stdout", &String{Value: stdout.String()})
+				setField(result, "stderr", &String{Value: stderr.String()})
+				setField(result, "code", &Integer{Value: int64(code)})
+				return result
+			},
+		},
+	},
+	{
+		Name: "path_join",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if len(args) == 0 {
+					return newError("wrong number of arguments. want at least 1, got=0")
+				}
+
+				elems := make([]string, len(args))
+				for i, arg := range args {
+					s, ok := arg.(*String)
+					if !ok {
+						return newError("argument %d to `path_join` must be String, got %s",
+							i+1, arg.Type())
+					}
+					elems[i] = s.Value
+				}
+				return &String{Value: filepath.Join(elems...)}
+			},
+		},
+	},
+	{
+		Name: "basename",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				path, err := stringArgument("basename", args)
+				if err != nil {
+					return err
+				}
+				return &String{Value: filepath.Base(path)}
+			},
+		},
+	},
+	{
+		Name: "dirname",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				path, err := stringArgument("dirname", args)
+				if err != nil {
+					return err
+				}
+				return &String{Value: filepath.Dir(path)}
+			},
+		},
+	},
+	{
+		Name: "glob",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if err := checkCapability(host, "glob", CapFS); err != nil {
+					return err
+				}
+				pattern, err := stringArgument("glob", args)
+				if err != nil {
+					return err
+				}
+
+				// Matches are sorted, and I/O errors other than a malformed pattern are ignored
+				matches, globErr := filepath.Glob(pattern)
+				if globErr != nil {
+					return newError("invalid pattern %q", pattern)
+				}
+				paths := make([]Object, len(matches))
+				for i, m := range matches {
+					paths[i] = &String{Value: m}
+				}
+				return &Array{Elements: paths}
+			},
+		},
+	},
+	{
+		Name: "tcp_listen",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if err := checkCapability(host, "tcp_listen", CapNet); err != nil {
+					return err
+				}
+				addr, err := stringArgument("tcp_listen", args)
+				if err != nil {
+					return err
+				}
+
+				l, listenErr := net.Listen("tcp", addr)
+				if listenErr != nil {
+					return newError("could not listen on %s: %s", addr, listenErr)
+				}
+				return &Handle{Kind: tcpListenerKind, Value: l}
+			},
+		},
+	},
+	{
+		Name: "tcp_accept",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if err := checkCapability(host, "tcp_accept", CapNet); err != nil {
+					return err
+				}
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+				l, ok := handleValue(args[0], tcpListenerKind).(net.Listener)
+				if !ok {
+					return newError("argument to `tcp_accept` must be a %s, got %s",
+						tcpListenerKind, describe(args[0]))
+				}
+
+				// The listener is closed to stop waiting if the host is interrupted
+				done := onInterrupt(host, func() { l.Close() })
+				conn, acceptErr := l.Accept()
+				done()
+				if acceptErr != nil {
+					return newError("could not accept connection: %s", acceptErr)
+				}
+				return &Handle{Kind: tcpConnKind, Value: conn}
+			},
+		},
+	},
+	{
+		Name: "tcp_connect",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if err := checkCapability(host, "tcp_connect", CapNet); err != nil {
+					return err
+				}
+				addr, err := stringArgument("tcp_connect", args)
+				if err != nil {
+					return err
+				}
+
+				conn, dialErr := net.Dial("tcp", addr)
+				if dialErr != nil {
+					return newError("could not connect to %s: %s", addr, dialErr)
+				}
+				return &Handle{Kind: tcpConnKind, Value: conn}
+			},
+		},
+	},
+	{
+		Name: "tcp_send",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if err := checkCapability(host, "tcp_send", CapNet); err != nil {
+					return err
+				}
+				if l := len(args); l != 2 {
+					return newError("wrong number of arguments. want=2, got=%d", l)
+				}
+				conn, ok := handleValue(args[0], tcpConnKind).(net.Conn)
+				if !ok {
+					return newError("first argument to `tcp_send` must be a %s, got %s",
+						tcpConnKind, describe(args[0]))
+				}
+
+				var data []byte
+				switch arg := args[1].(type) {
+				case *String:
+					data = []byte(arg.Value)
+				case *Bytes:
+					data = arg.Value
+				default:
+					return newError("second argument to `tcp_send` must be String or Bytes, got %s",
+						arg.Type())
+				}
+
+				n, writeErr := conn.Write(data)
+				if writeErr != nil {
+					return newError("could not send: %s", writeErr)
+				}
+				return &Integer{Value: int64(n)}
+			},
+		},
+	},
+	{
+		Name: "tcp_recv",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if err := checkCapability(host, "tcp_recv", CapNet); err != nil {
+					return err
+				}
+				if l := len(args); l != 1 && l != 2 {
+					return newError("wrong number of arguments. want=1 or 2, got=%d", l)
+				}
+				conn, ok := handleValue(args[0], tcpConnKind).(net.Conn)
+				if !ok {
+					return newError("first argument to `tcp_recv` must be a %s, got %s",
+						tcpConnKind, describe(args[0]))
+				}
+
+				size := int64(defaultRecvSize)
+				if len(args) == 2 {
+					n, ok := args[1].(*Integer)
+					if !ok {
+						return newError("second argument to `tcp_recv` must be Integer, got %s",
+							args[1].Type())
+					}
+					if n.Value <= 0 || n.Value > maxRecvSize {
+						return newError("size %d is out of range [1, %d]", n.Value, maxRecvSize)
+					}
+					size = n.Value
+				}
+
+				// Reading times out at once to stop waiting if the host is interrupted, and the
+				// connection is left usable, e.g. after the VM is reset
+				done := onInterrupt(host, func() { conn.SetReadDeadline(time.Unix(1, 0)) })
+				buf := make([]byte, size)
+				n, readErr := conn.Read(buf)
+				done()
+				conn.SetReadDeadline(time.Time{})
+				// Data read along with an error is returned first, and the error on the next call
+				if n > 0 {
+					return &String{Value: string(buf[:n])}
+				}
+				if readErr == io.EOF {
+					return &Nil{}
+				}
+				if readErr != nil {
+					return newError("could not receive: %s", readErr)
+				}
+				return &String{}
+			},
+		},
+	},
+	{
+		Name: "tcp_close",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				var c io.Closer
+				switch v := handleValue(args[0], "").(type) {
+				case net.Listener:
+					c = v
+				case net.Conn:
+					c = v
+				default:
+					return newError("argument to `tcp_close` must be a %s or %s, got %s",
+						tcpListenerKind, tcpConnKind, describe(args[0]))
+				}
+				if err := c.Close(); err != nil {
+					return newError("could not close %s: %s", describe(args[0]), err)
+				}
+				return nil
+			},
+		},
+	},
+	{
+		Name:    "serve",
+		Builtin: &Builtin{Fn: serve},
+	},
+	{
+		Name: "set_timeout",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				return scheduleTimer(host, "set_timeout", args, false)
+			},
+		},
+	},
+	{
+		Name: "set_interval",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				return scheduleTimer(host, "set_interval", args, true)
+			},
+		},
+	},
+	{
+		Name: "clear_timer",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+				id, ok := args[0].(*Integer)
+				if !ok {
+					return newError("argument to `clear_timer` must be Integer, got %s",
+						args[0].Type())
+				}
+
+				sched, ok := host.(Scheduler)
+				if !ok {
+					return newError("timers are not supported here")
+				}
+				if sched.Cancel(id.Value) {
+					return True
+				}
+				return False
+			},
+		},
+	},
+	{
+		Name: "async",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if len(args) == 0 {
+					return newError("wrong number of arguments. want at least 1, got=0")
+				}
+				if !isFunction(args[0]) {
+					return newError("first argument to `async` must be a function, got %s",
+						args[0].Type())
+				}
+				sched, ok := host.(Scheduler)
+				if !ok {
+					return newError("timers are not supported here")
+				}
+
+				fn := args[0]
+				fnArgs := make([]Object, len(args)-1)
+				copy(fnArgs, args[1:])
+				f := &Future{}
+				sched.Schedule(0, &Builtin{Fn: func(host Host, _ ...Object) Object {
+					result := callFunction(host, fn, fnArgs...)
+					if _, ok := result.(*Abort); ok {
+						return result
+					}
+					f.resolve(result)
+					return nil
+				}}, false)
+				return f
+			},
+		},
+	},
+	{
+		Name: "sleep",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+				ms, ok := args[0].(*Integer)
+				if !ok {
+					return newError("argument to `sleep` must be Integer, got %s", args[0].Type())
+				}
+				if ms.Value < 0 || ms.Value > maxSleepDelay {
+					return newError("delay %d ms given to `sleep` is out of range", ms.Value)
+				}
+				sched, ok := host.(Scheduler)
+				if !ok {
+					return newError("timers are not supported here")
+				}
+
+				f := &Future{}
+				delay := time.Duration(ms.Value) * time.Millisecond
+				sched.Schedule(delay, &Builtin{Fn: func(Host, ...Object) Object {
+					f.resolve(nil)
+					return nil
+				}}, false)
+				return f
+			},
+		},
+	},
+	{
+		Name: "await",
+		Builtin: &Builtin{
+			Fn: func(host Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+
+				// Awaiting a value which is not a future yields the value itself
+				f, ok := args[0].(*Future)
+				if !ok {
+					return args[0]
+				}
+				if f.Done {
+					return f.Value
+				}
+
+				sched, ok := host.(Scheduler)
+				if !ok {
+					return newError("timers are not supported here")
+				}
+				done, err := sched.RunUntil(func() bool { return f.Done })
+				if err != nil {
+					return &Abort{Message: err.Error(), Err: err}
+				}
+				if !done {
+					return newError("future is never resolved")
+				}
+				return f.Value
+			},
+		},
+	},
+	{
+		Name: "is_error",
+		Builtin: &Builtin{
+			Pure: true,
+			Fn: func(_ Host, args ...Object) Object {
+				if l := len(args); l != 1 {
+					return newError("wrong number of arguments. want=1, got=%d", l)
+				}
+				if _, ok := args[0].(*Error); ok {
+					return True
+				}
+				return False
+			},
+		},
+	},
+}
+
+// GetBuiltinByName returns a built-in function matching a given name.
+// If no function is found with the name, it returns nil.
+func GetBuiltinByName(name string) *Builtin {
+	for _, def := range Builtins {
+		if def.Name == name {
+			return def.Builtin
+		}
+	}
+
+	return nil
+}
+
+// GetBuiltinName returns the name of a built-in function `b`. If `b` is not in Builtins, it
+// returns an empty string.
+func GetBuiltinName(b *Builtin) string {
+	for _, def := range Builtins {
+		if def.Builtin == b {
+			return def.Name
+		}
+	}
+
+	return ""
+}
+
+// isFunction reports whether `obj` can be called as a function.
+func isFunction(obj Object) bool {
+	switch obj.Type() {
+	case ClosureType, FunctionType, BuiltinType:
+		return true
+	}
+	return false
+}
+
+// callFunction calls a function `fn` of the program with arguments `args` through `host`, so
+// that built-in functions can call back functions given as arguments. A failure of the call
+// aborts the program.
+func callFunction(host Host, fn Object, args ...Object) Object {
+	caller, ok := host.(Caller)
+	if !ok {
+		return newError("functions cannot be called back from built-in functions here")
+	}
+
+	result, err := caller.Call(fn, args...)
+	if err != nil {
+		return &Abort{Message: err.Error(), Err: err}
+	}
+	return result
+}
+
+// sliceBounds validates `start` and `end` arguments of the `slice` built-in function against
+// the `length` of a sequence and returns them as native integers.
+func sliceBounds(start, end Object, length int) (int, int, *Error) {
+	s, ok := start.(*Integer)
+	if !ok {
+		return 0, 0, newError("second argument to `slice` must be Integer, got %s", start.Type())
+	}
+
+	e, ok := end.(*Integer)
+	if !ok {
+		return 0, 0, newError("third argument to `slice` must be Integer, got %s", end.Type())
+	}
+
+	if s.Value < 0 || s.Value > e.Value || e.Value > int64(length) {
+		return 0, 0, newError("slice bounds out of range [%d:%d] with length %d",
+			s.Value, e.Value, length)
+	}
+
+	return int(s.Value), int(e.Value), nil
+}
+
+// encodingInput returns the data given to a built-in function `name` encoding or decoding it as
+// `args`, which must be a string or a byte array.
+func encodingInput(name string, args []Object) ([]byte, *Error) {
+	if l := len(args); l != 1 {
+		return nil, newError("wrong number of arguments. want=1, got=%d", l)
+	}
+
+	switch arg := args[0].(type) {
+	case *String:
+		return []byte(arg.Value), nil
+	case *Bytes:
+		return arg.Value, nil
+	default:
+		return nil, newError("argument to `%s` must be String or Bytes, got %s", name, arg.Type())
+	}
+}
+
+// csvArrays returns CSV `records` as an array of arrays of strings.
+func csvArrays(records [][]string) *Array {
+	rows := make([]Object, len(records))
+	for i, rec := range records {
+		fields := make([]Object, len(rec))
+		for j, f := range rec {
+			fields[j] = &String{Value: f}
+		}
+		rows[i] = &Array{Elements: fields}
+	}
+	return &Array{Elements: rows}
+}
+
+// csvHashes returns CSV `records` as an array of hashes from the names in `header` to the fields
+// in the same columns.
+func csvHashes(header []string, records [][]string) *Array {
+	keys := make([]*String, len(header))
+	for i, name := range header {
+		keys[i] = &String{Value: name}
+	}
+
+	rows := make([]Object, len(records))
+	for i, rec := range records {
+		hash := &Hash{Pairs: make(map[HashKey]HashPair, len(rec))}
+		for j, f := range rec {
+			hash.Set(keys[j].HashKey(), HashPair{Key: keys[j], Value: &String{Value: f}})
+		}
+		rows[i] = hash
+	}
+	return &Array{Elements: rows}
+}
+
+// csvField returns a field of CSV for `obj`. Strings are used as they are, nil is an empty field
+// and other values are represented by their string representations.
+func csvField(obj Object) string {
+	if _, ok := obj.(*Nil); ok {
+		return ""
+	}
+	return message(obj)
+}
+
+// checkCapability returns an error unless `host` grants a capability `c` to a built-in function
+// `name`.
+func checkCapability(host Host, name string, c Capability) *Error {
+	if sb, ok := host.(Sandbox); ok && sb.Allows(c) {
+		return nil
+	}
+	return newError("`%s` is not allowed: the %s capability is not granted", name, c)
+}
+
+// onInterrupt calls `stop` in another goroutine if `host` is interrupted before the returned
+// function is called, e.g. to close a listener a built-in function is blocked accepting
+// connections on. Once the returned function returns, `stop` is no longer called.
+func onInterrupt(host Host, stop func()) (done func()) {
+	ih, ok := host.(Interruptible)
+	if !ok {
+		return func() {}
+	}
+
+	finish, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ih.Interrupted():
+			stop()
+		case <-finish:
+		}
+	}()
+	return func() {
+		close(finish)
+		<-finished
+	}
+}
+
+// setField sets the value of a pair in `hash` whose key is a string `name` to `value`.
+func setField(hash *Hash, name string, value Object) {
+	key := &String{Value: name}
+	hash.Set(key.HashKey(), HashPair{Key: key, Value: value})
+}
+
+// stringArgument returns the string given to a built-in function `name` taking it as the only
+// argument in `args`, e.g. a path.
+func stringArgument(name string, args []Object) (string, *Error) {
+	if l := len(args); l != 1 {
+		return "", newError("wrong number of arguments. want=1, got=%d", l)
+	}
+
+	s, ok := args[0].(*String)
+	if !ok {
+		return "", newError("argument to `%s` must be String, got %s", name, args[0].Type())
+	}
+	return s.Value, nil
+}
+
+const (
+	// tcpListenerKind is the kind of handles of TCP listeners.
+	tcpListenerKind = "TCP listener"
+	// tcpConnKind is the kind of handles of TCP connections.
+	tcpConnKind = "TCP connection"
+
+	// defaultRecvSize is the maximum number of bytes `tcp_recv` receives by default.
+	defaultRecvSize = 4096
+	// maxRecvSize is the limit of the maximum number of bytes given to `tcp_recv`.
+	maxRecvSize = 1 << 24
+
+	// maxTimerDelay is the maximum delay in milliseconds of timers, which is about 290 years so
+	// that it fits in a time.Duration.
+	maxTimerDelay = int64(math.MaxInt64 / time.Millisecond)
+	// maxSleepDelay is the maximum delay in milliseconds given to `sleep`, which is an hour. A
+	// function awaiting a future blocks its caller, so a longer sleep would hang the program.
+	maxSleepDelay = int64(time.Hour / time.Millisecond)
+)
+
+// handleValue returns the resource of `obj` if it is a handle of `kind`, or of any kind if
+// `kind` is empty. Otherwise it returns nil.
+func handleValue(obj Object, kind string) interface{} {
+	h, ok := obj.(*Handle)
+	if !ok || (kind != "" && h.Kind != kind) {
+		return nil
+	}
+	return h.Value
+}
+
+// describe returns what `obj` is for error messages, which is the kind of a handle or the type
+// of any other object.
+func describe(obj Object) string {
+	if h, ok := obj.(*Handle); ok {
+		return h.Kind
+	}
+	return string(obj.Type())
+}
+
+// scheduleTimer schedules a function to be called after a number of milliseconds through `host`
+// for a built-in function `name` taking them as `args`, repeatedly if `repeat` is true, and
+// returns the ID of the timer.
+func scheduleTimer(host Host, name string, args []Object, repeat bool) Object {
+	if l := len(args); l != 2 {
+		return newError("wrong number of arguments. want=2, got=%d", l)
+	}
+	ms, ok := args[0].(*Integer)
+	if !ok {
+		return newError("first argument to `%s` must be Integer, got %s", name, args[0].Type())
+	}
+	// A timer repeating without delay would keep the program from ever finishing
+	if ms.Value < 0 || (repeat && ms.Value == 0) || ms.Value > maxTimerDelay {
+		return newError("delay %d ms given to `%s` is out of range", ms.Value, name)
+	}
+	if !isFunction(args[1]) {
+		return newError("second argument to `%s` must be a function, got %s", name,
+			args[1].Type())
+	}
+
+	sched, ok := host.(Scheduler)
+	if !ok {
+		return newError("timers are not supported here")
+	}
+	id := sched.Schedule(time.Duration(ms.Value)*time.Millisecond, args[1], repeat)
+	return &Integer{Value: id}
+}
+
+// clampDigits converts a number of digits `d` given to a built-in function to an int, clamping
+// it to a range wide enough for any float.
+func clampDigits(d int64) int {
+	const limit = 1 << 16
+	if d < -limit {
+		return -limit
+	}
+	if d > limit {
+		return limit
+	}
+	return int(d)
+}
+
+// arrayAndCount returns the array and the number of elements given to a built-in function
+// `name` taking them as `args`, e.g. `take`. The number is capped at the length of the array.
+func arrayAndCount(name string, args []Object) (ArrayObject, int, *Error) {
+	if l := len(args); l != 2 {
+		return nil, 0, newError("wrong number of arguments. want=2, got=%d", l)
+	}
+
+	arr, ok := args[0].(ArrayObject)
+	if !ok {
+		return nil, 0, newError("first argument to `%s` must be Array, got %s", name,
+			args[0].Type())
+	}
+	n, ok := args[1].(*Integer)
+	if !ok {
+		return nil, 0, newError("second argument to `%s` must be Integer, got %s", name,
+			args[1].Type())
+	}
+	if n.Value < 0 {
+		return nil, 0, newError("second argument to `%s` must not be negative, got %d", name,
+			n.Value)
+	}
+
+	if n.Value > int64(arr.Len()) {
+		return arr, arr.Len(), nil
+	}
+	return arr, int(n.Value), nil
+}
+
+// sliceArray returns a new array of the elements of `arr` from index `start` up to but not
+// including `end`, sharing them with `arr` as `slice` does.
+func sliceArray(arr ArrayObject, start, end int) ArrayObject {
+	if arr, ok := arr.(*PersistentArray); ok {
+		return arr.Slice(start, end)
+	}
+	return arr.(*Array).Slice(start, end)
+}
+
+// appendElements appends the elements of `arr` to `elems`.
+func appendElements(elems []Object, arr ArrayObject) []Object {
+	if arr, ok := arr.(*Array); ok {
+		return append(elems, arr.Elements...)
+	}
+	for i := 0; i < arr.Len(); i++ {
+		elems = append(elems, arr.Get(i))
+	}
+	return elems
+}
+
+// newArrayLike returns a new array of `elems`, which is persistent if `like` is, so that arrays
+// derived from persistent ones are persistent as well.
+func newArrayLike(like Object, elems []Object) ArrayObject {
+	if _, ok := like.(*PersistentArray); ok {
+		return NewPersistentArray(elems)
+	}
+	return &Array{Elements: elems}
+}
+
+// setElement returns a new array of the elements of `arr` with the element at index `i` replaced
+// with `el`. A PersistentArray shares all the other elements with `arr`, while an Array copies
+// them.
+func setElement(arr ArrayObject, i int, el Object) Object {
+	if arr, ok := arr.(*PersistentArray); ok {
+		return arr.Put(i, el)
+	}
+
+	elems := make([]Object, arr.Len())
+	copy(elems, arr.(*Array).Elements)
+	elems[i] = el
+	return &Array{Elements: elems}
+}
+
+// setPair returns a new hash of the pairs of `hash` with the pair for `key` set to `pair`. A
+// PersistentHash shares all the other pairs with `hash`, while a Hash copies them.
+func setPair(hash HashObject, key HashKey, pair HashPair) Object {
+	if hash, ok := hash.(*PersistentHash); ok {
+		return hash.Put(key, pair)
+	}
+
+	c := &Hash{Pairs: make(map[HashKey]HashPair, hash.Len()+1)}
+	hash.Range(c.Set)
+	c.Set(key, pair)
+	return c
+}
+
+// isTruthy reports whether `obj` is regarded as true in conditions.
+func isTruthy(obj Object) bool {
+	switch obj := obj.(type) {
+	case *Boolean:
+		return obj.Value
+	case *Nil:
+		return false
+	default:
+		return true
+	}
+}
+
+// message returns a message given to built-in functions as `obj`. Strings are used as they are
+// and other values are represented by their string representations.
+func message(obj Object) string {
+	if s, ok := obj.(*String); ok {
+		return s.Value
+	}
+	return obj.Inspect()
 }
 
 func newError(format string, a ...interface{}) *Error {
@@ -0,0 +1,99 @@
+package object
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// FromGo converts a Go value `v` to an object, so that hosts can pass their data to Monkey
+// code. Booleans, integers, floats and strings become the corresponding objects, nil and nil
+// pointers become nil, slices and arrays become arrays, and maps with string keys become hashes
+// whose pairs are set in the order of the keys. Pointers are dereferenced, and objects are
+// returned as they are.
+func FromGo(v interface{}) (Object, error) {
+	switch v := v.(type) {
+	case nil:
+		return NilValue, nil
+	case Object:
+		return v, nil
+	case bool:
+		if v {
+			return True, nil
+		}
+		return False, nil
+	case int:
+		return &Integer{Value: int64(v)}, nil
+	case int64:
+		return &Integer{Value: v}, nil
+	case float64:
+		return &Float{Value: v}, nil
+	case string:
+		return &String{Value: v}, nil
+	}
+
+	return fromValue(reflect.ValueOf(v))
+}
+
+func fromValue(v reflect.Value) (Object, error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		return FromGo(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Integer{Value: v.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("integer %d overflows Integer", v.Uint())
+		}
+		return &Integer{Value: int64(v.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Float{Value: v.Float()}, nil
+	case reflect.String:
+		return &String{Value: v.String()}, nil
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			return NilValue, nil
+		}
+		return FromGo(v.Elem().Interface())
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return NilValue, nil
+		}
+		elems := make([]Object, v.Len())
+		for i := range elems {
+			el, err := FromGo(v.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = el
+		}
+		return &Array{Elements: elems}, nil
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("cannot convert %s to Hash: keys must be strings", v.Type())
+		}
+		if v.IsNil() {
+			return NilValue, nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+		hash := &Hash{Pairs: make(map[HashKey]HashPair, len(keys))}
+		for _, k := range keys {
+			val, err := FromGo(v.MapIndex(k).Interface())
+			if err != nil {
+				return nil, err
+			}
+			key := NewHashedString(k.String())
+			hash.Set(key.HashKey(), HashPair{Key: key, Value: val})
+		}
+		return hash, nil
+	}
+
+	return nil, fmt.Errorf("cannot convert %s to an object", v.Type())
+}
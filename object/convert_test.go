@@ -0,0 +1,73 @@
+package object
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFromGo(t *testing.T) {
+	type status string
+	one := 1
+	var nilPtr *int
+
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{nil, "nil"},
+		{true, "true"},
+		{42, "42"},
+		{int8(-8), "-8"},
+		{uint32(7), "7"},
+		{float32(0.5), "0.5"},
+		{"monkey", "monkey"},
+		{status("ok"), "ok"},
+		{&one, "1"},
+		{nilPtr, "nil"},
+		{[]int(nil), "nil"},
+		{[]interface{}{1, "a", nil, []string{"b"}}, "[1, a, nil, [b]]"},
+		{[2]bool{true, false}, "[true, false]"},
+		{map[string]interface{}{"b": 2, "a": map[string]int{"c": 3}}, "{a: {c: 3}, b: 2}"},
+		{&String{Value: "object"}, "object"},
+	}
+
+	for _, tt := range tests {
+		got, err := FromGo(tt.v)
+		if err != nil {
+			t.Errorf("FromGo(%#v) returned error: %s", tt.v, err)
+			continue
+		}
+		if got.Inspect() != tt.want {
+			t.Errorf("FromGo(%#v) = %s, want %s", tt.v, got.Inspect(), tt.want)
+		}
+	}
+
+	// Strings used as keys are hashed in advance
+	h, _ := FromGo(map[string]int{"a": 1})
+	for _, pair := range h.(*Hash).Pairs {
+		if !pair.Key.(*String).Hashed() {
+			t.Errorf("key %s is not hashed", pair.Key.Inspect())
+		}
+	}
+
+	errTests := []struct {
+		v    interface{}
+		want string
+	}{
+		{uint64(math.MaxUint64), "integer 18446744073709551615 overflows Integer"},
+		{map[int]int{}, "cannot convert map[int]int to Hash: keys must be strings"},
+		{[]interface{}{1, make(chan int)}, "cannot convert chan int to an object"},
+		{struct{}{}, "cannot convert struct {} to an object"},
+	}
+
+	for _, tt := range errTests {
+		_, err := FromGo(tt.v)
+		if err == nil {
+			t.Errorf("FromGo(%#v) returned no error", tt.v)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("FromGo(%#v) returned wrong error. want=%q, got=%q", tt.v, tt.want, err)
+		}
+	}
+}
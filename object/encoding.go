@@ -0,0 +1,307 @@
+package object
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/skatsuta/monkey-compiler/code"
+)
+
+// maxEncodingDepth limits nesting of objects to encode, which also rejects cyclic objects.
+const maxEncodingDepth = 1000
+
+// encodedObject is the serialized form of an object. Only the fields for its type are set.
+type encodedObject struct {
+	// Type is empty for a nil slot
+	Type    Type
+	Integer int64
+	Float   float64
+	// String holds the value of a string, the bytes of a byte array, the decimal digits of a
+	// big integer or the name of a built-in function
+	String   string
+	Boolean  bool
+	Elements []encodedObject
+	// Keys holds the keys of a hash, whose values are in Elements
+	Keys   []encodedObject
+	Frozen bool
+	// Function holds a compiled function
+	Function *encodedFunction
+	// Index is the index of the compiled function of a closure in the encoded objects
+	Index int
+}
+
+// encodedFunction is the serialized form of a compiled function.
+type encodedFunction struct {
+	Name          string
+	Instructions  []byte
+	NumLocals     int
+	NumParameters int
+	MaxStackDepth int
+	Lines         code.LineTable
+}
+
+// Encode writes `objs` to `w` in a binary format which Decode reads. Integers, big integers,
+// floating-point numbers, strings, byte arrays, booleans, nil, arrays, hashes, compiled
+// functions and built-in functions are supported. Closures are encoded by reference to their
+// compiled functions, which must be in `objs` themselves. Elements of `objs` may be nil, e.g.
+// to encode unset global bindings.
+//
+// Objects shared by several others are encoded as separate copies, and cyclic ones are
+// rejected.
+func Encode(w io.Writer, objs []Object) error {
+	funcs := make(map[*CompiledFunction]int)
+	for i, obj := range objs {
+		if fn, ok := obj.(*CompiledFunction); ok {
+			funcs[fn] = i
+		}
+	}
+
+	encoded := make([]encodedObject, len(objs))
+	for i, obj := range objs {
+		if obj == nil {
+			continue
+		}
+
+		e, err := encodeObject(obj, funcs, 0)
+		if err != nil {
+			return fmt.Errorf("object %d: %s", i, err)
+		}
+		encoded[i] = e
+	}
+
+	return gob.NewEncoder(w).Encode(encoded)
+}
+
+func encodeObject(obj Object, funcs map[*CompiledFunction]int, depth int) (encodedObject, error) {
+	if depth > maxEncodingDepth {
+		return encodedObject{}, errors.New("object is too deeply nested or cyclic")
+	}
+
+	e := encodedObject{Type: obj.Type()}
+
+	switch obj := obj.(type) {
+	case *Integer:
+		e.Integer = obj.Value
+	case *BigInt:
+		e.String = obj.Value.String()
+	case *Float:
+		e.Float = obj.Value
+	case *String:
+		e.String = obj.Value
+	case *Bytes:
+		e.String = string(obj.Value)
+	case *Boolean:
+		e.Boolean = obj.Value
+	case *Nil:
+
+	case *Array:
+		e.Frozen = obj.Frozen
+		e.Elements = make([]encodedObject, len(obj.Elements))
+		for i, el := range obj.Elements {
+			ee, err := encodeObject(el, funcs, depth+1)
+			if err != nil {
+				return encodedObject{}, err
+			}
+			e.Elements[i] = ee
+		}
+
+	case *Hash:
+		e.Frozen = obj.Frozen
+		var err error
+		obj.Range(func(_ HashKey, pair HashPair) {
+			if err != nil {
+				return
+			}
+			var ke, ve encodedObject
+			if ke, err = encodeObject(pair.Key, funcs, depth+1); err != nil {
+				return
+			}
+			if ve, err = encodeObject(pair.Value, funcs, depth+1); err != nil {
+				return
+			}
+			e.Keys = append(e.Keys, ke)
+			e.Elements = append(e.Elements, ve)
+		})
+		if err != nil {
+			return encodedObject{}, err
+		}
+
+	case *CompiledFunction:
+		e.Function = &encodedFunction{
+			Name:          obj.Name,
+			Instructions:  obj.Instructions,
+			NumLocals:     obj.NumLocals,
+			NumParameters: obj.NumParameters,
+			MaxStackDepth: obj.MaxStackDepth,
+			Lines:         obj.Lines,
+		}
+
+	case *Closure:
+		idx, ok := funcs[obj.Fn]
+		if !ok {
+			return encodedObject{}, errors.New("closure refers to a function not being encoded")
+		}
+		e.Index = idx
+		e.Elements = make([]encodedObject, len(obj.Free))
+		for i, free := range obj.Free {
+			fe, err := encodeObject(free, funcs, depth+1)
+			if err != nil {
+				return encodedObject{}, err
+			}
+			e.Elements[i] = fe
+		}
+
+	case *Builtin:
+		for _, def := range Builtins {
+			if def.Builtin == obj {
+				e.String = def.Name
+			}
+		}
+		if e.String == "" {
+			return encodedObject{}, errors.New("unknown built-in function")
+		}
+
+	default:
+		return encodedObject{}, fmt.Errorf("cannot encode object of type %s", obj.Type())
+	}
+
+	return e, nil
+}
+
+// Decode reads objects written by Encode from `r`. Booleans and nil are decoded into True,
+// False and NilValue.
+func Decode(r io.Reader) ([]Object, error) {
+	var encoded []encodedObject
+	if err := gob.NewDecoder(r).Decode(&encoded); err != nil {
+		return nil, err
+	}
+
+	// Decode compiled functions first so that closures can refer to any of them
+	objs := make([]Object, len(encoded))
+	for i, e := range encoded {
+		if e.Type == CompiledFunctionType {
+			obj, err := decodeObject(e, nil)
+			if err != nil {
+				return nil, fmt.Errorf("object %d: %s", i, err)
+			}
+			objs[i] = obj
+		}
+	}
+
+	for i, e := range encoded {
+		if e.Type == "" || e.Type == CompiledFunctionType {
+			continue
+		}
+
+		obj, err := decodeObject(e, objs)
+		if err != nil {
+			return nil, fmt.Errorf("object %d: %s", i, err)
+		}
+		objs[i] = obj
+	}
+
+	return objs, nil
+}
+
+func decodeObject(e encodedObject, objs []Object) (Object, error) {
+	switch e.Type {
+	case IntegerType:
+		return &Integer{Value: e.Integer}, nil
+	case BigIntType:
+		n, ok := new(big.Int).SetString(e.String, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid big integer: %q", e.String)
+		}
+		return &BigInt{Value: n}, nil
+	case FloatType:
+		return &Float{Value: e.Float}, nil
+	case StringType:
+		return NewHashedString(e.String), nil
+	case BytesType:
+		return &Bytes{Value: []byte(e.String)}, nil
+	case BooleanType:
+		if e.Boolean {
+			return True, nil
+		}
+		return False, nil
+	case NilType:
+		return NilValue, nil
+
+	case ArrayType:
+		arr := &Array{Elements: make([]Object, len(e.Elements)), Frozen: e.Frozen}
+		for i, ee := range e.Elements {
+			el, err := decodeObject(ee, objs)
+			if err != nil {
+				return nil, err
+			}
+			arr.Elements[i] = el
+		}
+		return arr, nil
+
+	case HashType:
+		if len(e.Keys) != len(e.Elements) {
+			return nil, errors.New("hash has mismatched keys and values")
+		}
+		hash := &Hash{Pairs: make(map[HashKey]HashPair, len(e.Keys)), Frozen: e.Frozen}
+		for i, ke := range e.Keys {
+			key, err := decodeObject(ke, objs)
+			if err != nil {
+				return nil, err
+			}
+			hashable, ok := key.(Hashable)
+			if !ok {
+				return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
+			}
+			val, err := decodeObject(e.Elements[i], objs)
+			if err != nil {
+				return nil, err
+			}
+			hash.Set(hashable.HashKey(), HashPair{Key: key, Value: val})
+		}
+		return hash, nil
+
+	case CompiledFunctionType:
+		if e.Function == nil {
+			return nil, errors.New("missing function body")
+		}
+		return &CompiledFunction{
+			Name:          e.Function.Name,
+			Instructions:  e.Function.Instructions,
+			NumLocals:     e.Function.NumLocals,
+			NumParameters: e.Function.NumParameters,
+			MaxStackDepth: e.Function.MaxStackDepth,
+			Lines:         e.Function.Lines,
+		}, nil
+
+	case ClosureType:
+		var fn *CompiledFunction
+		if e.Index >= 0 && e.Index < len(objs) {
+			fn, _ = objs[e.Index].(*CompiledFunction)
+		}
+		if fn == nil {
+			return nil, fmt.Errorf("closure refers to object %d which is not a function", e.Index)
+		}
+		cl := &Closure{Fn: fn, Free: make([]Object, len(e.Elements))}
+		for i, fe := range e.Elements {
+			free, err := decodeObject(fe, objs)
+			if err != nil {
+				return nil, err
+			}
+			cl.Free[i] = free
+		}
+		return cl, nil
+
+	case BuiltinType:
+		b := GetBuiltinByName(e.String)
+		if b == nil {
+			return nil, fmt.Errorf("unknown built-in function: %s", e.String)
+		}
+		return b, nil
+
+	default:
+		return nil, fmt.Errorf("cannot decode object of type %s", e.Type)
+	}
+}
@@ -0,0 +1,115 @@
+package object
+
+import (
+	"bytes"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/code"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	key := &String{Value: "key"}
+	fn := &CompiledFunction{
+		Name:          "f",
+		Instructions:  code.Make(code.OpGetFree, 0),
+		NumLocals:     1,
+		NumParameters: 1,
+		MaxStackDepth: 1,
+	}
+
+	objs := []Object{
+		&Integer{Value: -1},
+		&BigInt{Value: new(big.Int).Lsh(big.NewInt(1), 100)},
+		&Float{Value: 1.5},
+		// Decoded strings have their hash keys computed in advance
+		NewHashedString("héllo"),
+		&Bytes{Value: []byte{0, 255}},
+		True,
+		False,
+		NilValue,
+		&Array{Elements: []Object{&Integer{Value: 1}, &Array{Elements: []Object{}}}, Frozen: true},
+		&Hash{Pairs: map[HashKey]HashPair{key.HashKey(): {Key: key, Value: &Integer{Value: 2}}}},
+		&Closure{Fn: fn, Free: []Object{&Integer{Value: 3}}},
+		fn,
+		GetBuiltinByName("len"),
+		nil,
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, objs); err != nil {
+		t.Fatalf("Encode failed: %s", err)
+	}
+
+	got, err := Decode(&buf)
+	if err != nil {
+		t.Fatalf("Decode failed: %s", err)
+	}
+
+	if len(got) != len(objs) {
+		t.Fatalf("wrong number of objects. want=%d, got=%d", len(objs), len(got))
+	}
+
+	for i, want := range objs {
+		switch want.(type) {
+		case *Closure, *CompiledFunction:
+			// Compared below
+		case *Array, *Hash:
+			if !Equal(got[i], want) {
+				t.Errorf("object %d: want=%s, got=%s", i, want.Inspect(), got[i].Inspect())
+			}
+		default:
+			if !reflect.DeepEqual(got[i], want) {
+				t.Errorf("object %d: want=%#v, got=%#v", i, want, got[i])
+			}
+		}
+	}
+
+	if got[5] != True || got[6] != False || got[7] != NilValue {
+		t.Errorf("booleans and nil are not decoded into the shared values")
+	}
+	if !got[8].(*Array).Frozen {
+		t.Errorf("frozen array is decoded as mutable")
+	}
+
+	gotFn, ok := got[11].(*CompiledFunction)
+	if !ok || !reflect.DeepEqual(gotFn, fn) {
+		t.Fatalf("wrong function. want=%#v, got=%#v", fn, got[11])
+	}
+	cl, ok := got[10].(*Closure)
+	if !ok {
+		t.Fatalf("object 10 is not Closure. got=%T", got[10])
+	}
+	if cl.Fn != gotFn {
+		t.Errorf("closure does not refer to the decoded function")
+	}
+	if len(cl.Free) != 1 || !Equal(cl.Free[0], &Integer{Value: 3}) {
+		t.Errorf("wrong free variables: %v", cl.Free)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	cyclic := &Array{}
+	cyclic.Elements = []Object{cyclic}
+
+	tests := [][]Object{
+		{&Closure{Fn: &CompiledFunction{}}},
+		{cyclic},
+		{&Error{Message: "error"}},
+		{&Builtin{}},
+	}
+
+	for _, objs := range tests {
+		var buf bytes.Buffer
+		if err := Encode(&buf, objs); err == nil {
+			t.Errorf("expected error for %#v but resulted in none", objs[0])
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	if _, err := Decode(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Errorf("expected error for corrupted data but resulted in none")
+	}
+}
@@ -0,0 +1,249 @@
+package object
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultFloatFormat is the format spec Float.Inspect is equivalent to.
+const DefaultFloatFormat = "g"
+
+// FormatFloat formats `v` according to a format `spec` of the form `[width][.precision][verb]`,
+// e.g. ".2f" or "10e", and returns the result.
+//
+// The verb is one of `f` (decimal point, no exponent), `e` (exponent) and `g` (exponent only for
+// large or small magnitudes), and defaults to `g`. If the precision is omitted, the smallest
+// number of digits necessary to represent `v` exactly is used. The result is padded with spaces
+// on the left to the width. With the default spec "g", the result reads back as the same Float.
+func FormatFloat(v float64, spec string) (string, error) {
+	width, prec, verb, err := parseFloatFormat(spec)
+	if err != nil {
+		return "", err
+	}
+
+	var s string
+	switch {
+	case verb == 'g' && prec < 0:
+		s = formatShortest(v)
+	case verb == 'g':
+		// The precision is the number of significant digits, as with "%.3g" in Go
+		s = strconv.FormatFloat(v, 'g', prec, 64)
+	default:
+		s = strconv.FormatFloat(v, verb, prec, 64)
+	}
+
+	if pad := width - len(s); pad > 0 {
+		s = strings.Repeat(" ", pad) + s
+	}
+	return s, nil
+}
+
+// maxFormatNum is the largest width or precision a format spec for FormatFloat can specify.
+const maxFormatNum = 1000
+
+// parseFloatFormat parses a format spec for FormatFloat. The precision is -1 if it is omitted.
+func parseFloatFormat(spec string) (width, prec int, verb byte, err error) {
+	digits, rest := leadingDigits(spec)
+	if width, err = parseFormatNum(spec, digits); err != nil {
+		return 0, 0, 0, err
+	}
+
+	prec = -1
+	if strings.HasPrefix(rest, ".") {
+		digits, rest = leadingDigits(rest[1:])
+		if digits == "" {
+			return 0, 0, 0, fmt.Errorf("invalid format %q: missing precision after '.'", spec)
+		}
+		if prec, err = parseFormatNum(spec, digits); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	verb = 'g'
+	if len(rest) > 0 {
+		verb = rest[0]
+		rest = rest[1:]
+	}
+	if verb != 'f' && verb != 'e' && verb != 'g' {
+		return 0, 0, 0, fmt.Errorf("invalid format %q: unknown verb %q", spec, verb)
+	}
+	if len(rest) > 0 {
+		return 0, 0, 0, fmt.Errorf("invalid format %q: unexpected %q after verb", spec, rest)
+	}
+
+	return width, prec, verb, nil
+}
+
+// leadingDigits splits `s` into the leading decimal digits and the rest.
+func leadingDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// parseFormatNum parses `digits` as a width or precision in a format `spec`. Empty `digits` is 0.
+func parseFormatNum(spec, digits string) (int, error) {
+	if digits == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n > maxFormatNum {
+		return 0, fmt.Errorf("invalid format %q: %s is larger than %d", spec, digits, maxFormatNum)
+	}
+	return n, nil
+}
+
+// formatShortest formats `v` with the fewest digits which read back as `v`. It uses decimal
+// notation unless the magnitude is less than 1e-4 or at least 1e21, and always includes a decimal
+// point or an exponent so that the result is not taken for an integer.
+func formatShortest(v float64) string {
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+
+	var s string
+	if abs := math.Abs(v); abs != 0 && (abs < 1e-4 || abs >= 1e21) {
+		s = strconv.FormatFloat(v, 'e', -1, 64)
+	} else {
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+// FormatFixed formats `v` in decimal notation with exactly `digits` digits after the decimal
+// point, rounding the exact value of `v` half away from zero, e.g. "2.50" for 2.5 with 2 digits
+// and "3" with 0 digits. Unlike FormatFloat with an "f" verb, which rounds ties to even, it
+// rounds as people do by hand. `digits` must be between 0 and the maximum a format spec can
+// specify.
+func FormatFixed(v float64, digits int) (string, error) {
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return "", fmt.Errorf("cannot format %s in fixed notation", formatShortest(v))
+	}
+	if digits < 0 || digits > maxFormatNum {
+		return "", fmt.Errorf("number of digits %d is out of range [0, %d]", digits, maxFormatNum)
+	}
+
+	s := roundDecimal(exactDecimal(math.Abs(v)), digits)
+	if v < 0 && strings.Trim(s, "0.") != "" {
+		s = "-" + s
+	}
+	return s, nil
+}
+
+// RoundFloat rounds `v` to `digits` digits after the decimal point, or to the tens, hundreds and
+// so on if `digits` is negative, rounding the exact value of `v` half away from zero. The result
+// is the float closest to the rounded decimal number, e.g. 0.13 for 0.125 and 1.0 for 1.005 with
+// 2 digits, as the exact value of the latter is slightly less than 1.005.
+func RoundFloat(v float64, digits int) float64 {
+	if math.IsInf(v, 0) || math.IsNaN(v) || v == 0 {
+		return v
+	}
+	// A float has no more than 1074 digits after the decimal point, and less than 309 before it
+	if digits > 1074 {
+		return v
+	}
+	if digits < -309 {
+		return 0
+	}
+
+	r, _ := strconv.ParseFloat(roundDecimal(exactDecimal(math.Abs(v)), digits), 64)
+	if v < 0 {
+		return -r
+	}
+	return r
+}
+
+// RoundInt rounds `v` to `-digits` digits before the decimal point if `digits` is negative,
+// rounding half away from zero, e.g. 1300 for 1250 with -2 digits. Otherwise it returns `v`. It
+// reports false if the result overflows.
+func RoundInt(v int64, digits int) (int64, bool) {
+	if digits >= 0 {
+		return v, true
+	}
+	if digits < -20 {
+		return 0, true
+	}
+
+	abs := uint64(v)
+	if v < 0 {
+		abs = -abs
+	}
+	r, err := strconv.ParseUint(roundDecimal(strconv.FormatUint(abs, 10), digits), 10, 64)
+	if err != nil || r > math.MaxInt64+1 || (v > 0 && r > math.MaxInt64) {
+		return 0, false
+	}
+	if v < 0 {
+		return -int64(r), true
+	}
+	return int64(r), true
+}
+
+// exactDecimal returns the exact value of a finite `v` in decimal notation, without trailing
+// zeros after the decimal point.
+func exactDecimal(v float64) string {
+	// The fraction of a float64 has at most 1074 digits, so this does not round
+	s := strconv.FormatFloat(v, 'f', 1074, 64)
+	return strings.TrimRight(strings.TrimRight(s, "0"), ".")
+}
+
+// roundDecimal rounds a non-negative decimal number `s`, e.g. "12.345", to `digits` digits after
+// the decimal point, or to the tens, hundreds and so on if `digits` is negative, rounding half
+// away from zero. The result has exactly `digits` digits after the decimal point if `digits` is
+// positive, and none otherwise.
+func roundDecimal(s string, digits int) string {
+	intPart, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, frac = s[:i], s[i+1:]
+	}
+	if len(frac) < digits {
+		frac += strings.Repeat("0", digits-len(frac))
+	}
+
+	// Keep the digits up to the position to round at, which may be before the first digit
+	all := intPart + frac
+	keep := len(intPart) + digits
+	var kept []byte
+	roundUp := false
+	switch {
+	case keep < 0:
+	case keep < len(all):
+		kept = []byte(all[:keep])
+		roundUp = all[keep] >= '5'
+	default:
+		kept = []byte(all)
+	}
+
+	if roundUp {
+		i := len(kept) - 1
+		for ; i >= 0 && kept[i] == '9'; i-- {
+			kept[i] = '0'
+		}
+		if i >= 0 {
+			kept[i]++
+		} else {
+			kept = append([]byte{'1'}, kept...)
+		}
+	}
+
+	if digits <= 0 {
+		n := strings.TrimLeft(string(kept), "0")
+		if n == "" {
+			return "0"
+		}
+		return n + strings.Repeat("0", -digits)
+	}
+
+	intDigits := strings.TrimLeft(string(kept[:len(kept)-digits]), "0")
+	if intDigits == "" {
+		intDigits = "0"
+	}
+	return intDigits + "." + string(kept[len(kept)-digits:])
+}
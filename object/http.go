@@ -0,0 +1,227 @@
+package object
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxRequestBodySize is the maximum size of the body of a request `serve` passes to a handler.
+const maxRequestBodySize = 1 << 20
+
+// serve listens on an address and serves HTTP requests by calling a handler function of the
+// program with a hash of each request and writing the response the function returns, until the
+// handler fails or the host is interrupted. It implements the `serve` built-in function.
+//
+// Requests are handled one at a time, as the host can run only one function of the program at a
+// time.
+func serve(host Host, args ...Object) Object {
+	if err := checkCapability(host, "serve", CapNet); err != nil {
+		return err
+	}
+	if l := len(args); l != 2 {
+		return newError("wrong number of arguments. want=2, got=%d", l)
+	}
+	addr, ok := args[0].(*String)
+	if !ok {
+		return newError("first argument to `serve` must be String, got %s", args[0].Type())
+	}
+	if !isFunction(args[1]) {
+		return newError("second argument to `serve` must be a function, got %s", args[1].Type())
+	}
+	caller, ok := host.(Caller)
+	if !ok {
+		return newError("functions cannot be called back from built-in functions here")
+	}
+
+	l, err := net.Listen("tcp", addr.Value)
+	if err != nil {
+		return newError("could not listen on %s: %s", addr.Value, err)
+	}
+
+	h := &httpHandler{caller: caller, fn: args[1], done: make(chan Object, 1)}
+	srv := &http.Server{Handler: h}
+	go func() {
+		h.stop(newError("could not serve: %s", srv.Serve(l)))
+	}()
+
+	// Closing the server closes the listener as well
+	var result Object
+	select {
+	case result = <-h.done:
+	case <-interrupted(host):
+		result = newError("`serve` was interrupted")
+	}
+	srv.Close()
+	// Wait for the handler being called if any, so that the program is not used concurrently
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return result
+}
+
+// interrupted returns a channel which is closed once `host` is interrupted, or nil if it cannot
+// be interrupted, which blocks forever.
+func interrupted(host Host) <-chan struct{} {
+	if ih, ok := host.(Interruptible); ok {
+		return ih.Interrupted()
+	}
+	return nil
+}
+
+// httpHandler handles HTTP requests by calling a function `fn` of the program through `caller`.
+type httpHandler struct {
+	caller Caller
+	fn     Object
+
+	// mu serializes calls of the function
+	mu sync.Mutex
+	// stopped reports whether the server has stopped
+	stopped bool
+	// done receives what `serve` returns when the server stops
+	done chan Object
+}
+
+// stop stops the server to make `serve` return `result`, unless it has stopped already.
+func (h *httpHandler) stop(result Object) {
+	select {
+	case h.done <- result:
+	default:
+	}
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable),
+			http.StatusServiceUnavailable)
+		return
+	}
+
+	result, err := h.caller.Call(h.fn, requestHash(r, body))
+	if err == nil {
+		err = writeResponse(w, result)
+	}
+	if err != nil {
+		h.stopped = true
+		h.stop(&Abort{Message: fmt.Sprintf("handler of `serve` failed: %s", err), Err: err})
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+	}
+}
+
+// requestHash returns a hash representing an HTTP request `r` with a body `body`, which has the
+// method, the path, the query parameters, the headers and the body of the request.
+func requestHash(r *http.Request, body []byte) *Hash {
+	query := r.URL.Query()
+	queryHash := &Hash{Pairs: make(map[HashKey]HashPair, len(query))}
+	for _, name := range sortedKeys(query) {
+		setField(queryHash, name, &String{Value: query.Get(name)})
+	}
+
+	headers := &Hash{Pairs: make(map[HashKey]HashPair, len(r.Header))}
+	for _, name := range sortedKeys(r.Header) {
+		setField(headers, strings.ToLower(name),
+			&String{Value: strings.Join(r.Header[name], ", ")})
+	}
+
+	req := &Hash{Pairs: make(map[HashKey]HashPair, 5)}
+	setField(req, "method", &String{Value: r.Method})
+	setField(req, "path", &String{Value: r.URL.Path})
+	setField(req, "query", queryHash)
+	setField(req, "headers", headers)
+	setField(req, "body", &String{Value: string(body)})
+	return req
+}
+
+// sortedKeys returns the keys of `m` in ascending order.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeResponse writes a response a handler returned as `result` to `w`. It is either a string,
+// which is the body of a response with status 200, or a hash which may have the status, the
+// headers and the body of the response. It reports an error if the response is invalid, in which
+// case nothing is written. Errors writing to the client are ignored, as the client may have gone.
+func writeResponse(w http.ResponseWriter, result Object) error {
+	var resp HashObject
+	switch result := result.(type) {
+	case *String:
+		w.Write([]byte(result.Value))
+		return nil
+	case HashObject:
+		resp = result
+	default:
+		return fmt.Errorf("response must be String or Hash, got %s", result.Type())
+	}
+
+	status := int64(http.StatusOK)
+	if v, ok := field(resp, "status"); ok {
+		s, ok := v.(*Integer)
+		if !ok || s.Value < 100 || s.Value > 999 {
+			return fmt.Errorf("status of response must be Integer in [100, 999], got %s",
+				v.Inspect())
+		}
+		status = s.Value
+	}
+
+	header := make(http.Header)
+	if v, ok := field(resp, "headers"); ok {
+		headers, ok := v.(HashObject)
+		if !ok {
+			return fmt.Errorf("headers of response must be Hash, got %s", v.Type())
+		}
+		var err error
+		headers.Range(func(_ HashKey, pair HashPair) {
+			if name, ok := pair.Key.(*String); ok {
+				header.Set(name.Value, message(pair.Value))
+			} else if err == nil {
+				err = fmt.Errorf("header name must be String, got %s", pair.Key.Type())
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var body []byte
+	if v, ok := field(resp, "body"); ok {
+		switch v := v.(type) {
+		case *String:
+			body = []byte(v.Value)
+		case *Bytes:
+			body = v.Value
+		case *Nil:
+		default:
+			return fmt.Errorf("body of response must be String or Bytes, got %s", v.Type())
+		}
+	}
+
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(int(status))
+	w.Write(body)
+	return nil
+}
+
+// field returns the value of a pair in `hash` whose key is a string `name`, if any.
+func field(hash HashObject, name string) (Object, bool) {
+	pair, ok := hash.Get((&String{Value: name}).HashKey())
+	return pair.Value, ok
+}
@@ -4,8 +4,14 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"io"
+	"math"
+	"math/big"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/skatsuta/monkey-compiler/ast"
 	"github.com/skatsuta/monkey-compiler/code"
@@ -45,6 +51,28 @@ const (
 	CompiledFunctionType = "CompiledFunction"
 	// ClosureType represents a type of closures.
 	ClosureType = "Closure"
+	// BytesType represents a type of byte arrays.
+	BytesType = "Bytes"
+	// BigIntType represents a type of arbitrary-precision integers.
+	BigIntType = "BigInt"
+	// AbortType represents a type of aborts requested by built-in functions.
+	AbortType = "Abort"
+	// ThunkType represents a type of thunks, i.e. delayed computations.
+	ThunkType = "Thunk"
+	// HandleType represents a type of handles of resources of the host.
+	HandleType = "Handle"
+	// FutureType represents a type of futures, i.e. values which become available later.
+	FutureType = "Future"
+)
+
+var (
+	// True is the boolean `true` value. Engines compare booleans by identity, so they share it
+	// and its counterparts below.
+	True = &Boolean{Value: true}
+	// False is the boolean `false` value.
+	False = &Boolean{Value: false}
+	// NilValue is the nil value.
+	NilValue = &Nil{}
 )
 
 // Object represents an object of Monkey language.
@@ -53,10 +81,29 @@ type Object interface {
 	Inspect() string
 }
 
+// TypeName returns the name of the type of `obj` as users see it in Monkey, which hides the
+// differences between the engines, e.g. both Function and Closure are named "Function".
+func TypeName(obj Object) string {
+	switch obj.Type() {
+	case IntegerType:
+		return "Int"
+	case BooleanType:
+		return "Bool"
+	case FunctionType, ClosureType, CompiledFunctionType, BuiltinType:
+		return "Function"
+	default:
+		return string(obj.Type())
+	}
+}
+
 // HashKey represents a key of a hash.
 type HashKey struct {
 	Type  Type
 	Value uint64
+
+	// exact holds the exact value of a key whose Value is only a hash of it, so that different
+	// keys never compare equal even if their hashes collide
+	exact string
 }
 
 // Hashable is the interface that is able to become a hash key.
@@ -87,6 +134,37 @@ func (i *Integer) HashKey() HashKey {
 	}
 }
 
+// BigInt represents an arbitrary-precision integer.
+type BigInt struct {
+	Value *big.Int
+}
+
+// Type returns the type of `bi`.
+func (bi *BigInt) Type() Type {
+	return BigIntType
+}
+
+// Inspect returns a string representation of `bi`.
+func (bi *BigInt) Inspect() string {
+	return bi.Value.String()
+}
+
+// HashKey returns a hash key object for `bi`. A BigInt that fits in int64 has the same hash
+// key as the Integer with the same value, so that both can be used interchangeably as keys.
+func (bi *BigInt) HashKey() HashKey {
+	if bi.Value.IsInt64() {
+		return (&Integer{Value: bi.Value.Int64()}).HashKey()
+	}
+
+	h := fnv.New64a()
+	h.Write(bi.Value.Bytes())
+	key := HashKey{Type: bi.Type(), Value: h.Sum64(), exact: bi.Value.String()}
+	if bi.Value.Sign() < 0 {
+		key.Value = ^key.Value
+	}
+	return key
+}
+
 // Float represents an integer.
 type Float struct {
 	Value float64
@@ -97,13 +175,24 @@ func (f *Float) Type() Type {
 	return FloatType
 }
 
-// Inspect returns a string representation of f.
+// Inspect returns a string representation of f. It has the fewest digits that read back as the
+// same value, and always has a decimal point or an exponent, e.g. `2.0` or `1e+21`.
 func (f *Float) Inspect() string {
-	return strconv.FormatFloat(f.Value, 'f', -1, 64)
+	return formatShortest(f.Value)
 }
 
-// HashKey returns a hash key object for f.
+// HashKey returns a hash key object for f. A Float with an integral value has the same hash key
+// as the Integer or BigInt with that value, as they are equal, so that `1.0` finds the pair of a
+// key `1` and vice versa. All NaNs have the same hash key, so that a hash has at most one of them.
 func (f *Float) HashKey() HashKey {
+	if v := f.Value; v == math.Trunc(v) && !math.IsInf(v, 0) {
+		if v >= math.MinInt64 && v < math.MaxInt64 {
+			return (&Integer{Value: int64(v)}).HashKey()
+		}
+		n, _ := big.NewFloat(v).Int(nil)
+		return (&BigInt{Value: n}).HashKey()
+	}
+
 	s := strconv.FormatFloat(f.Value, 'f', -1, 64)
 	h := fnv.New64a()
 	h.Write([]byte(s))
@@ -111,6 +200,7 @@ func (f *Float) HashKey() HashKey {
 	return HashKey{
 		Type:  f.Type(),
 		Value: h.Sum64(),
+		exact: s,
 	}
 }
 
@@ -186,6 +276,28 @@ func (e *Error) Inspect() string {
 	return "Error: " + e.Message
 }
 
+// Abort represents a request from a built-in function to abort execution of the program, e.g.
+// on a failed assertion. Unlike an Error, which a built-in function returns as an ordinary
+// value, it stops the engine with a runtime error carrying the message.
+type Abort struct {
+	Message string
+	// Panic reports whether the abort is a panic, which engines report with a stack trace.
+	Panic bool
+	// Err is the error which caused the abort if any, e.g. the error of a function called back
+	// by the built-in function, so that engines can report it as it is.
+	Err error
+}
+
+// Type returns the type of `a`.
+func (a *Abort) Type() Type {
+	return AbortType
+}
+
+// Inspect returns a string representation of `a`.
+func (a *Abort) Inspect() string {
+	return "Abort: " + a.Message
+}
+
 // Function represents a function.
 type Function struct {
 	Parameters []*ast.Ident
@@ -219,6 +331,23 @@ func (f *Function) Inspect() string {
 // String represents a string.
 type String struct {
 	Value string
+	// key is the hash key computed in advance by NewHashedString, if any
+	key *HashKey
+}
+
+// NewHashedString returns a new String of value `s` whose hash key is computed in advance, so
+// that using it as a hash key repeatedly costs nothing. It suits strings which are likely to be
+// used as hash keys many times, e.g. string literals in a program.
+func NewHashedString(s string) *String {
+	str := &String{Value: s}
+	key := str.HashKey()
+	str.key = &key
+	return str
+}
+
+// Hashed reports whether the hash key of `s` has been computed in advance by NewHashedString.
+func (s *String) Hashed() bool {
+	return s.key != nil
 }
 
 // Type returns the type of the String.
@@ -231,23 +360,138 @@ func (s *String) Inspect() string {
 	return s.Value
 }
 
+// Len returns the number of characters, i.e. Unicode code points, in `s`.
+func (s *String) Len() int {
+	return utf8.RuneCountInString(s.Value)
+}
+
+// CharAt returns the character, i.e. the Unicode code point, at the index `i` of `s` as a new
+// string. If `i` is out of range, it returns nil and false.
+func (s *String) CharAt(i int64) (*String, bool) {
+	if i < 0 {
+		return nil, false
+	}
+
+	var n int64
+	for _, r := range s.Value {
+		if n == i {
+			return &String{Value: string(r)}, true
+		}
+		n++
+	}
+
+	return nil, false
+}
+
 // HashKey returns a hash key object for s.
 func (s *String) HashKey() HashKey {
+	if s.key != nil {
+		return *s.key
+	}
+
 	h := fnv.New64a()
 	h.Write([]byte(s.Value))
 
 	return HashKey{
 		Type:  s.Type(),
 		Value: h.Sum64(),
+		exact: s.Value,
 	}
 }
 
+// Bytes represents an immutable sequence of bytes, i.e. binary data.
+type Bytes struct {
+	Value []byte
+}
+
+// Type returns the type of `b`.
+func (b *Bytes) Type() Type {
+	return BytesType
+}
+
+// Inspect returns a string representation of `b`.
+func (b *Bytes) Inspect() string {
+	return "b" + strconv.Quote(string(b.Value))
+}
+
+// Host represents an environment in which built-in functions are executed. It is provided by
+// the engine calling them.
+type Host interface {
+	// Stdout returns a writer to which built-in functions print output.
+	Stdout() io.Writer
+}
+
+// TestHost is a Host which collects tests defined by the `test` built-in function.
+type TestHost interface {
+	Host
+	// AddTest registers a test function `fn` named `name` to run later.
+	AddTest(name string, fn Object)
+}
+
+// Caller is a Host which can call functions of the program, so that built-in functions can take
+// functions as arguments and call them back.
+type Caller interface {
+	Host
+	// Call calls a function `fn` with arguments `args` and returns its result.
+	Call(fn Object, args ...Object) (Object, error)
+}
+
+// Scheduler is a Host which can call functions of the program later, after the main program has
+// run, so that built-in functions such as `set_timeout` can schedule callbacks.
+type Scheduler interface {
+	Host
+	// Schedule schedules a function `fn` to be called after `delay`, and then every `delay` if
+	// `repeat` is true. It returns an ID of the timer, which is positive.
+	Schedule(delay time.Duration, fn Object, repeat bool) int64
+	// Cancel cancels the timer of `id` and reports whether it was scheduled.
+	Cancel(id int64) bool
+	// RunUntil calls scheduled functions when they are due until `done` returns true, and
+	// reports whether it does before no timers are left.
+	RunUntil(done func() bool) (bool, error)
+}
+
+// Interruptible is a Host which can be interrupted while it runs the program, so that built-in
+// functions blocked waiting for the outside world, such as `tcp_accept`, can stop waiting.
+type Interruptible interface {
+	Host
+	// Interrupted returns a channel which is closed once the host is interrupted.
+	Interrupted() <-chan struct{}
+}
+
+// Capability is a kind of access to the system outside the program, which built-in functions
+// such as `exec` need to be granted by their host.
+type Capability string
+
+const (
+	// CapExec allows running external commands.
+	CapExec Capability = "exec"
+	// CapFS allows reading the file system.
+	CapFS Capability = "fs"
+	// CapNet allows listening for and making network connections.
+	CapNet Capability = "net"
+)
+
+// Capabilities is a list of all capabilities.
+var Capabilities = []Capability{CapExec, CapFS, CapNet}
+
+// Sandbox is a Host which decides what access to the system outside the program it grants to
+// built-in functions. Built-in functions needing a capability fail with hosts which are not
+// sandboxes, so that programs cannot access the system unless it is explicitly allowed.
+type Sandbox interface {
+	Host
+	// Allows reports whether built-in functions may use a capability `c`.
+	Allows(c Capability) bool
+}
+
 // BuiltinFunction represents a function signature of builtin functions.
-type BuiltinFunction func(args ...Object) Object
+type BuiltinFunction func(host Host, args ...Object) Object
 
 // Builtin represents a builtin function.
 type Builtin struct {
 	Fn BuiltinFunction
+	// Pure tells that Fn neither uses the host nor has side effects, and returns a result which
+	// depends only on its arguments, so that the compiler can call it with constant arguments
+	Pure bool
 }
 
 // Type returns the type of the Builtin.
@@ -263,6 +507,11 @@ func (b *Builtin) Inspect() string {
 // Array represents an array.
 type Array struct {
 	Elements []Object
+	// Frozen reports whether the array is immutable.
+	Frozen bool
+
+	// buf describes the backing array of Elements if it may be shared with other arrays
+	buf *arrayBuffer
 }
 
 // Type returns the type of the Array.
@@ -275,10 +524,47 @@ func (a *Array) Inspect() string {
 	if a == nil {
 		return ""
 	}
+	return inspectArray(a)
+}
 
-	elements := make([]string, 0, len(a.Elements))
-	for _, e := range a.Elements {
-		elements = append(elements, e.Inspect())
+// Len returns the number of elements.
+func (a *Array) Len() int {
+	return len(a.Elements)
+}
+
+// Get returns the element at index `i`, which must be within the bounds.
+func (a *Array) Get(i int) Object {
+	return a.Elements[i]
+}
+
+// IsFrozen reports whether `a` is immutable.
+func (a *Array) IsFrozen() bool {
+	return a.Frozen
+}
+
+func (a *Array) freeze() {
+	a.Frozen = true
+}
+
+// ArrayObject is an array, which is either an Array or a PersistentArray.
+type ArrayObject interface {
+	Object
+	// Len returns the number of elements.
+	Len() int
+	// Get returns the element at index `i`, which must be within the bounds.
+	Get(i int) Object
+	// Set sets the element at index `i`, which must be within the bounds, to `el`.
+	Set(i int, el Object)
+	// IsFrozen reports whether the array is immutable.
+	IsFrozen() bool
+
+	freeze()
+}
+
+func inspectArray(a ArrayObject) string {
+	elements := make([]string, 0, a.Len())
+	for i := 0; i < a.Len(); i++ {
+		elements = append(elements, a.Get(i).Inspect())
 	}
 
 	var out bytes.Buffer
@@ -294,9 +580,14 @@ type HashPair struct {
 	Value Object
 }
 
-// Hash represents a hash.
+// Hash represents a hash, which enumerates its pairs in the order their keys are first set.
 type Hash struct {
 	Pairs map[HashKey]HashPair
+	// Frozen reports whether the hash is immutable.
+	Frozen bool
+
+	// keys holds the keys set by Set in the order they are first set
+	keys []HashKey
 }
 
 // Type returns the type of the Hash.
@@ -309,11 +600,97 @@ func (h *Hash) Inspect() string {
 	if h == nil {
 		return ""
 	}
+	return inspectHash(h)
+}
 
-	pairs := make([]string, 0, len(h.Pairs))
-	for _, pair := range h.Pairs {
-		pairs = append(pairs, pair.Key.Inspect()+": "+pair.Value.Inspect())
+// Len returns the number of pairs.
+func (h *Hash) Len() int {
+	return len(h.Pairs)
+}
+
+// Get returns the pair for `key` and true if any, otherwise false.
+func (h *Hash) Get(key HashKey) (HashPair, bool) {
+	pair, ok := h.Pairs[key]
+	return pair, ok
+}
+
+// Set sets the pair for `key` to `pair`.
+func (h *Hash) Set(key HashKey, pair HashPair) {
+	if _, ok := h.Pairs[key]; !ok {
+		h.keys = append(h.keys, key)
+	}
+	h.Pairs[key] = pair
+}
+
+// Range calls `f` with each pair in `h` and its key in the order the keys are first set. Pairs
+// put into Pairs directly rather than by Set follow them in the order of their keys.
+func (h *Hash) Range(f func(key HashKey, pair HashPair)) {
+	n := 0
+	for _, k := range h.keys {
+		if pair, ok := h.Pairs[k]; ok {
+			f(k, pair)
+			n++
+		}
+	}
+	if n == len(h.Pairs) {
+		return
+	}
+
+	known := make(map[HashKey]bool, len(h.keys))
+	for _, k := range h.keys {
+		known[k] = true
+	}
+	rest := make([]HashKey, 0, len(h.Pairs)-n)
+	for k := range h.Pairs {
+		if !known[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		if rest[i].Type != rest[j].Type {
+			return rest[i].Type < rest[j].Type
+		}
+		if rest[i].Value != rest[j].Value {
+			return rest[i].Value < rest[j].Value
+		}
+		return rest[i].exact < rest[j].exact
+	})
+	for _, k := range rest {
+		f(k, h.Pairs[k])
 	}
+}
+
+// IsFrozen reports whether `h` is immutable.
+func (h *Hash) IsFrozen() bool {
+	return h.Frozen
+}
+
+func (h *Hash) freeze() {
+	h.Frozen = true
+}
+
+// HashObject is a hash, which is either a Hash or a PersistentHash.
+type HashObject interface {
+	Object
+	// Len returns the number of pairs.
+	Len() int
+	// Get returns the pair for `key` and true if any, otherwise false.
+	Get(key HashKey) (HashPair, bool)
+	// Set sets the pair for `key` to `pair`.
+	Set(key HashKey, pair HashPair)
+	// Range calls `f` with each pair and its key in an unspecified order.
+	Range(f func(key HashKey, pair HashPair))
+	// IsFrozen reports whether the hash is immutable.
+	IsFrozen() bool
+
+	freeze()
+}
+
+func inspectHash(h HashObject) string {
+	pairs := make([]string, 0, h.Len())
+	h.Range(func(_ HashKey, pair HashPair) {
+		pairs = append(pairs, pair.Key.Inspect()+": "+pair.Value.Inspect())
+	})
 
 	var out bytes.Buffer
 	out.WriteString("{")
@@ -322,6 +699,217 @@ func (h *Hash) Inspect() string {
 	return out.String()
 }
 
+// Freeze makes `obj` immutable. Arrays and hashes are frozen recursively, so nested arrays and
+// hashes reachable from `obj` become immutable as well. Other objects are immutable by nature
+// and are left as they are. It returns `obj` itself.
+func Freeze(obj Object) Object {
+	switch obj := obj.(type) {
+	case ArrayObject:
+		if obj.IsFrozen() {
+			return obj
+		}
+		obj.freeze()
+		for i := 0; i < obj.Len(); i++ {
+			Freeze(obj.Get(i))
+		}
+	case HashObject:
+		if obj.IsFrozen() {
+			return obj
+		}
+		obj.freeze()
+		obj.Range(func(_ HashKey, pair HashPair) {
+			Freeze(pair.Value)
+		})
+	}
+
+	return obj
+}
+
+// Clone returns a deep copy of `obj`. Arrays and hashes are copied recursively and the copies
+// are always mutable even if the originals are frozen. Other objects, including closures, are
+// immutable or shared by reference, so they are returned as they are.
+func Clone(obj Object) Object {
+	return clone(obj, make(map[Object]Object))
+}
+
+// clone copies `obj` recursively. `seen` maps already copied arrays and hashes to their copies
+// so that shared and self-referencing structures are preserved in the copy.
+func clone(obj Object, seen map[Object]Object) Object {
+	if c, ok := seen[obj]; ok {
+		return c
+	}
+
+	switch obj := obj.(type) {
+	case *Array:
+		c := &Array{Elements: make([]Object, len(obj.Elements))}
+		seen[obj] = c
+		for i, el := range obj.Elements {
+			c.Elements[i] = clone(el, seen)
+		}
+		return c
+
+	case *Hash:
+		c := &Hash{Pairs: make(map[HashKey]HashPair, len(obj.Pairs))}
+		seen[obj] = c
+		obj.Range(func(k HashKey, pair HashPair) {
+			c.Set(k, HashPair{Key: pair.Key, Value: clone(pair.Value, seen)})
+		})
+		return c
+
+	case *PersistentArray:
+		c := &PersistentArray{}
+		seen[obj] = c
+		for i := 0; i < obj.Len(); i++ {
+			c.appendInPlace(clone(obj.Get(i), seen))
+		}
+		return c
+
+	case *PersistentHash:
+		c := &PersistentHash{}
+		seen[obj] = c
+		obj.Range(func(k HashKey, pair HashPair) {
+			c.Set(k, HashPair{Key: pair.Key, Value: clone(pair.Value, seen)})
+		})
+		return c
+
+	default:
+		return obj
+	}
+}
+
+// Equal reports whether `a` and `b` are equal. Arrays and hashes are compared recursively by
+// their elements, and other values which can be hash keys are compared by their values. Numbers
+// of different types are compared numerically as the == operator does, e.g. 1 equals 1.0. The
+// rest, e.g. functions, are equal only if they are identical.
+func Equal(a, b Object) bool {
+	if a == b {
+		return true
+	}
+	if a == nil || b == nil {
+		return false
+	}
+	if a.Type() != b.Type() {
+		return equalNumbers(a, b)
+	}
+
+	switch a := a.(type) {
+	case ArrayObject:
+		b := b.(ArrayObject)
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !Equal(a.Get(i), b.Get(i)) {
+				return false
+			}
+		}
+		return true
+
+	case HashObject:
+		b := b.(HashObject)
+		if a.Len() != b.Len() {
+			return false
+		}
+		equal := true
+		a.Range(func(k HashKey, pair HashPair) {
+			other, ok := b.Get(k)
+			if !ok || !Equal(pair.Value, other.Value) {
+				equal = false
+			}
+		})
+		return equal
+
+	case *Bytes:
+		return bytes.Equal(a.Value, b.(*Bytes).Value)
+
+	case *BigInt:
+		return a.Value.Cmp(b.(*BigInt).Value) == 0
+
+	case Hashable:
+		return a.HashKey() == b.(Hashable).HashKey()
+
+	default:
+		return false
+	}
+}
+
+// equalNumbers reports whether `a` and `b` are numbers with the same value, comparing them as
+// floats if either of them is a float.
+func equalNumbers(a, b Object) bool {
+	_, aFloat := a.(*Float)
+	_, bFloat := b.(*Float)
+	if aFloat || bFloat {
+		x, xok := toFloat(a)
+		y, yok := toFloat(b)
+		return xok && yok && x == y
+	}
+
+	x, xok := toBigInt(a)
+	y, yok := toBigInt(b)
+	return xok && yok && x.Cmp(y) == 0
+}
+
+// toFloat converts a number `obj` to float64. It reports false if `obj` is not a number.
+func toFloat(obj Object) (float64, bool) {
+	switch obj := obj.(type) {
+	case *Integer:
+		return float64(obj.Value), true
+	case *Float:
+		return obj.Value, true
+	case *BigInt:
+		f, _ := new(big.Float).SetInt(obj.Value).Float64()
+		return f, true
+	default:
+		return 0, false
+	}
+}
+
+// toBigInt converts an integer `obj` to *big.Int. It reports false if `obj` is not an integer.
+func toBigInt(obj Object) (*big.Int, bool) {
+	switch obj := obj.(type) {
+	case *Integer:
+		return big.NewInt(obj.Value), true
+	case *BigInt:
+		return obj.Value, true
+	default:
+		return nil, false
+	}
+}
+
+// Contains reports whether a collection `coll` contains `el`, i.e. whether an array has an
+// element equal to `el`, a hash has a key `el`, or a string has a substring `el`. It returns an
+// error if `coll` is not a collection or `el` cannot be in it.
+func Contains(coll, el Object) (bool, error) {
+	switch coll := coll.(type) {
+	case ArrayObject:
+		for i := 0; i < coll.Len(); i++ {
+			if Equal(coll.Get(i), el) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case HashObject:
+		key, ok := el.(Hashable)
+		if !ok {
+			return false, fmt.Errorf("unusable as hash key: %s", el.Type())
+		}
+		_, ok = coll.Get(key.HashKey())
+		return ok, nil
+
+	case *String:
+		sub, ok := el.(*String)
+		if !ok {
+			return false, fmt.Errorf("left operand of `in` a string must be String, got %s", el.Type())
+		}
+		return strings.Contains(coll.Value, sub.Value), nil
+
+	default:
+		return false, fmt.Errorf("right operand of `in` must be Array, Hash or String, got %s",
+			coll.Type())
+	}
+}
+
 // Quote represents a quote, i.e. an unevaluated expression.
 type Quote struct {
 	ast.Node
@@ -369,10 +957,21 @@ func (m *Macro) Inspect() string {
 
 // CompiledFunction represents a function compiled to bytecode instructions.
 type CompiledFunction struct {
+	// Name is the name the function is bound to by a let statement, or empty if it is anonymous
+	Name         string
 	Instructions code.Instructions
 	// NumLocals is used for reserving slots to store local bindings on the stack
 	NumLocals     int
 	NumParameters int
+	// MaxStackDepth is the maximum number of elements the function can push on to the stack
+	// above its local bindings, which is computed at compile time
+	MaxStackDepth int
+	// Constants is the constant pool of a function compiled on its own, e.g. by
+	// compiler.CompileExpr. It is nil for functions compiled as part of a program, which use the
+	// constant pool of the program.
+	Constants []Object
+	// Lines maps the instructions to the lines of the source code they are compiled from
+	Lines code.LineTable
 }
 
 // Type returns the type of `cf`.
@@ -401,3 +1000,75 @@ func (c *Closure) Type() Type {
 func (c *Closure) Inspect() string {
 	return fmt.Sprintf("Closure[%p]", c)
 }
+
+// Thunk represents a delayed computation created by the `delay` built-in function. The function
+// `Fn` is called the first time the thunk is forced, and its result is kept in `Value` so that
+// forcing the thunk again returns the same value without calling the function.
+type Thunk struct {
+	Fn    Object
+	Value Object
+	// Forced reports whether the thunk has been forced, i.e. `Value` holds the result of `Fn`.
+	Forced bool
+}
+
+// Type returns the type of `t`.
+func (t *Thunk) Type() Type {
+	return ThunkType
+}
+
+// Inspect returns a string representation of `t`.
+func (t *Thunk) Inspect() string {
+	if t.Forced {
+		return fmt.Sprintf("Thunk(%s)", t.Value.Inspect())
+	}
+	return "Thunk(...)"
+}
+
+// Handle represents an opaque reference to a resource of the host, e.g. a network connection,
+// which programs get from built-in functions and can only pass to other built-in functions.
+type Handle struct {
+	// Kind describes what the resource is, e.g. "tcp connection"
+	Kind string
+	// Value is the resource
+	Value interface{}
+}
+
+// Type returns the type of `h`.
+func (h *Handle) Type() Type {
+	return HandleType
+}
+
+// Inspect returns a string representation of `h`.
+func (h *Handle) Inspect() string {
+	return fmt.Sprintf("Handle(%s)", h.Kind)
+}
+
+// Future represents a value which becomes available later, e.g. the result of a function called
+// asynchronously by the `async` built-in function. It is resolved with the value once, and the
+// `await` built-in function waits for it.
+type Future struct {
+	// Done reports whether the future has been resolved, i.e. `Value` holds the value.
+	Done  bool
+	Value Object
+}
+
+// Type returns the type of `f`.
+func (f *Future) Type() Type {
+	return FutureType
+}
+
+// Inspect returns a string representation of `f`.
+func (f *Future) Inspect() string {
+	if f.Done {
+		return fmt.Sprintf("Future(%s)", f.Value.Inspect())
+	}
+	return "Future(...)"
+}
+
+// resolve resolves `f` with `value`.
+func (f *Future) resolve(value Object) {
+	if value == nil {
+		value = &Nil{}
+	}
+	f.Done, f.Value = true, value
+}
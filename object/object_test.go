@@ -1,6 +1,11 @@
 package object
 
-import "testing"
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "Hello World"}
@@ -24,6 +29,59 @@ func TestStringHashKey(t *testing.T) {
 	}
 }
 
+func TestHashKeyCollisions(t *testing.T) {
+	// Keys whose hash values collide but whose values differ
+	k1 := HashKey{Type: StringType, Value: 42, exact: "a"}
+	k2 := HashKey{Type: StringType, Value: 42, exact: "b"}
+
+	hashes := []HashObject{&Hash{Pairs: make(map[HashKey]HashPair)}, NewPersistentHash()}
+	for _, h := range hashes {
+		h.Set(k1, HashPair{Key: &String{Value: "a"}, Value: &Integer{Value: 1}})
+		h.Set(k2, HashPair{Key: &String{Value: "b"}, Value: &Integer{Value: 2}})
+
+		if h.Len() != 2 {
+			t.Errorf("%T: colliding keys overwrite each other. got=%s", h, h.Inspect())
+		}
+		for i, k := range []HashKey{k1, k2} {
+			pair, ok := h.Get(k)
+			if !ok || pair.Value.Inspect() != fmt.Sprint(i+1) {
+				t.Errorf("%T: wrong pair for key %q", h, k.exact)
+			}
+		}
+	}
+}
+
+func TestStringCharAt(t *testing.T) {
+	s := &String{Value: "aé世"}
+
+	tests := []struct {
+		index int64
+		want  string
+		ok    bool
+	}{
+		{0, "a", true},
+		{1, "é", true},
+		{2, "世", true},
+		{3, "", false},
+		{-1, "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := s.CharAt(tt.index)
+		if ok != tt.ok {
+			t.Errorf("CharAt(%d) returned wrong ok. want=%t, got=%t", tt.index, tt.ok, ok)
+			continue
+		}
+		if ok && got.Value != tt.want {
+			t.Errorf("CharAt(%d) returned wrong char. want=%q, got=%q", tt.index, tt.want, got.Value)
+		}
+	}
+
+	if l := s.Len(); l != 3 {
+		t.Errorf("Len returned wrong length. want=3, got=%d", l)
+	}
+}
+
 func TestBooleanHashKey(t *testing.T) {
 	true1 := &Boolean{Value: true}
 	true2 := &Boolean{Value: true}
@@ -68,6 +126,57 @@ func TestIntegerHashKey(t *testing.T) {
 	}
 }
 
+func TestBigIntHashKey(t *testing.T) {
+	one := &BigInt{Value: big.NewInt(1)}
+	huge1 := &BigInt{Value: new(big.Int).Lsh(big.NewInt(1), 100)}
+	huge2 := &BigInt{Value: new(big.Int).Lsh(big.NewInt(1), 100)}
+	negHuge := &BigInt{Value: new(big.Int).Neg(huge1.Value)}
+
+	if one.HashKey() != (&Integer{Value: 1}).HashKey() {
+		t.Errorf("BigInt fitting in int64 has different hash key from Integer: %#v != %#v",
+			one.HashKey(), (&Integer{Value: 1}).HashKey())
+	}
+
+	if huge1.HashKey() != huge2.HashKey() {
+		t.Errorf("big integers with same value have different hash keys: %#v != %#v",
+			huge1.HashKey(), huge2.HashKey())
+	}
+
+	if huge1.HashKey() == negHuge.HashKey() {
+		t.Errorf("big integers with different signs have same hash keys: %#v",
+			huge1.HashKey())
+	}
+}
+
+func TestFloatHashKey(t *testing.T) {
+	huge := new(big.Int).Lsh(big.NewInt(1), 100)
+	tests := []struct {
+		f    float64
+		key  Hashable
+		same bool
+	}{
+		{1.0, &Integer{Value: 1}, true},
+		{-3.0, &Integer{Value: -3}, true},
+		{math.Copysign(0, -1), &Integer{Value: 0}, true},
+		{math.Ldexp(1, 100), &BigInt{Value: huge}, true},
+		{-math.Ldexp(1, 63), &Integer{Value: math.MinInt64}, true},
+		{math.Ldexp(1, 63), &BigInt{Value: new(big.Int).Lsh(big.NewInt(1), 63)}, true},
+		{1.5, &Float{Value: 1.5}, true},
+		{math.NaN(), &Float{Value: math.NaN()}, true},
+		{math.Inf(1), &Float{Value: math.Inf(1)}, true},
+		{1.5, &Integer{Value: 1}, false},
+		{1.0, &String{Value: "1"}, false},
+		{math.Inf(1), &Float{Value: math.Inf(-1)}, false},
+	}
+
+	for _, tt := range tests {
+		f := &Float{Value: tt.f}
+		if same := f.HashKey() == tt.key.HashKey(); same != tt.same {
+			t.Errorf("hash keys of %v and %#v: same=%t, want=%t", tt.f, tt.key, same, tt.same)
+		}
+	}
+}
+
 func TestNilHashKey(t *testing.T) {
 	n1 := &Nil{}
 	n2 := &Nil{}
@@ -76,3 +185,364 @@ func TestNilHashKey(t *testing.T) {
 		t.Errorf("nils have different hash keys: %#v != %#v", n1.HashKey(), n2.HashKey())
 	}
 }
+
+func TestFreeze(t *testing.T) {
+	inner := &Array{Elements: []Object{&Integer{Value: 1}}}
+	key := &String{Value: "inner"}
+	hash := &Hash{Pairs: map[HashKey]HashPair{
+		key.HashKey(): {Key: key, Value: inner},
+	}}
+	outer := &Array{Elements: []Object{hash}}
+
+	if got := Freeze(outer); got != outer {
+		t.Errorf("Freeze returned a different object: %#v", got)
+	}
+
+	if !outer.Frozen {
+		t.Errorf("outer array is not frozen")
+	}
+	if !hash.Frozen {
+		t.Errorf("nested hash is not frozen")
+	}
+	if !inner.Frozen {
+		t.Errorf("array nested in hash is not frozen")
+	}
+}
+
+func TestClone(t *testing.T) {
+	inner := &Array{Elements: []Object{&Integer{Value: 1}}}
+	key := &String{Value: "inner"}
+	hash := &Hash{Pairs: map[HashKey]HashPair{
+		key.HashKey(): {Key: key, Value: inner},
+	}}
+	outer := &Array{Elements: []Object{hash, hash}, Frozen: true}
+
+	cloned, ok := Clone(outer).(*Array)
+	if !ok {
+		t.Fatalf("Clone did not return Array. got=%T", cloned)
+	}
+
+	if cloned == outer || cloned.Frozen {
+		t.Errorf("cloned array is not a mutable copy: %#v", cloned)
+	}
+
+	h0, ok := cloned.Elements[0].(*Hash)
+	if !ok {
+		t.Fatalf("cloned element is not Hash. got=%T", cloned.Elements[0])
+	}
+	if h0 == hash {
+		t.Errorf("nested hash was not copied")
+	}
+	if cloned.Elements[1] != h0 {
+		t.Errorf("shared nested hash was copied twice")
+	}
+
+	if h0.Pairs[key.HashKey()].Value == inner {
+		t.Errorf("array nested in hash was not copied")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	hash := func(k string, v Object) *Hash {
+		key := &String{Value: k}
+		return &Hash{Pairs: map[HashKey]HashPair{key.HashKey(): {Key: key, Value: v}}}
+	}
+	fn := &Closure{Fn: &CompiledFunction{}}
+
+	tests := []struct {
+		a, b Object
+		want bool
+	}{
+		{&Integer{Value: 1}, &Integer{Value: 1}, true},
+		{&Integer{Value: 1}, &Integer{Value: 2}, false},
+		{&Integer{Value: 1}, &Float{Value: 1}, true},
+		{&Integer{Value: 1}, &Float{Value: 1.5}, false},
+		{&Float{Value: 2}, &BigInt{Value: big.NewInt(2)}, true},
+		{&BigInt{Value: big.NewInt(1)}, &Integer{Value: 1}, true},
+		{&Integer{Value: 1}, &String{Value: "1"}, false},
+		{
+			&Array{Elements: []Object{&Integer{Value: 1}}},
+			&Array{Elements: []Object{&Float{Value: 1}}},
+			true,
+		},
+		{&String{Value: "a"}, &String{Value: "a"}, true},
+		{&Boolean{Value: true}, &Boolean{Value: true}, true},
+		{&Nil{}, &Nil{}, true},
+		{&BigInt{Value: big.NewInt(1)}, &BigInt{Value: big.NewInt(1)}, true},
+		{&Bytes{Value: []byte("a")}, &Bytes{Value: []byte("a")}, true},
+		{&Bytes{Value: []byte("a")}, &Bytes{Value: []byte("b")}, false},
+		{
+			&Array{Elements: []Object{&Integer{Value: 1}, &Array{}}},
+			&Array{Elements: []Object{&Integer{Value: 1}, &Array{}}},
+			true,
+		},
+		{
+			&Array{Elements: []Object{&Integer{Value: 1}}},
+			&Array{Elements: []Object{&Integer{Value: 1}, &Integer{Value: 2}}},
+			false,
+		},
+		{hash("a", &Integer{Value: 1}), hash("a", &Integer{Value: 1}), true},
+		{hash("a", &Integer{Value: 1}), hash("a", &Integer{Value: 2}), false},
+		{hash("a", &Integer{Value: 1}), hash("b", &Integer{Value: 1}), false},
+		{fn, fn, true},
+		{fn, &Closure{Fn: fn.Fn}, false},
+		{nil, &Nil{}, false},
+	}
+
+	for _, tt := range tests {
+		if got := Equal(tt.a, tt.b); got != tt.want {
+			t.Errorf("Equal(%v, %v) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestTypeName(t *testing.T) {
+	tests := []struct {
+		obj  Object
+		want string
+	}{
+		{&Integer{Value: 1}, "Int"},
+		{&BigInt{Value: big.NewInt(1)}, "BigInt"},
+		{&Float{Value: 1}, "Float"},
+		{&Boolean{Value: true}, "Bool"},
+		{&Nil{}, "Nil"},
+		{&String{Value: "a"}, "String"},
+		{&Bytes{}, "Bytes"},
+		{&Array{}, "Array"},
+		{&Hash{}, "Hash"},
+		{&Function{}, "Function"},
+		{&Closure{}, "Function"},
+		{&Builtin{}, "Function"},
+		{&Error{}, "Error"},
+	}
+
+	for _, tt := range tests {
+		if got := TypeName(tt.obj); got != tt.want {
+			t.Errorf("TypeName(%T) = %q, want %q", tt.obj, got, tt.want)
+		}
+	}
+}
+
+func TestHashOrder(t *testing.T) {
+	h := &Hash{Pairs: make(map[HashKey]HashPair)}
+	for _, k := range []int64{3, 1, 2, 1} {
+		key := &Integer{Value: k}
+		h.Set(key.HashKey(), HashPair{Key: key, Value: &Integer{Value: k * 10}})
+	}
+
+	if got, want := h.Inspect(), "{3: 30, 1: 10, 2: 20}"; got != want {
+		t.Errorf("wrong Inspect result. want=%q, got=%q", want, got)
+	}
+	if got, want := Clone(h).Inspect(), "{3: 30, 1: 10, 2: 20}"; got != want {
+		t.Errorf("wrong Inspect result of clone. want=%q, got=%q", want, got)
+	}
+
+	// Pairs put into the map directly follow the others in the order of their keys
+	for _, k := range []int64{5, 4} {
+		key := &Integer{Value: k}
+		h.Pairs[key.HashKey()] = HashPair{Key: key, Value: key}
+	}
+	if got, want := h.Inspect(), "{3: 30, 1: 10, 2: 20, 4: 4, 5: 5}"; got != want {
+		t.Errorf("wrong Inspect result. want=%q, got=%q", want, got)
+	}
+}
+
+func TestPersistentHashOrder(t *testing.T) {
+	h := NewPersistentHash()
+	for _, k := range []int64{3, 1, 2, 1} {
+		key := &Integer{Value: k}
+		h.Set(key.HashKey(), HashPair{Key: key, Value: &Integer{Value: k * 10}})
+	}
+	// Keys of different types with the same hash value are stored below the last level
+	r := h.Put(True.HashKey(), HashPair{Key: True, Value: True})
+
+	if got, want := h.Inspect(), "{3: 30, 1: 10, 2: 20}"; got != want {
+		t.Errorf("wrong Inspect result. want=%q, got=%q", want, got)
+	}
+	if got, want := r.Inspect(), "{3: 30, 1: 10, 2: 20, true: true}"; got != want {
+		t.Errorf("wrong Inspect result of new version. want=%q, got=%q", want, got)
+	}
+	if got, want := Clone(r).Inspect(), "{3: 30, 1: 10, 2: 20, true: true}"; got != want {
+		t.Errorf("wrong Inspect result of clone. want=%q, got=%q", want, got)
+	}
+}
+
+func TestBytesInspect(t *testing.T) {
+	b := &Bytes{Value: []byte("hi\x00")}
+
+	if got, want := b.Inspect(), `b"hi\x00"`; got != want {
+		t.Errorf("wrong Inspect result. want=%q, got=%q", want, got)
+	}
+}
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		input float64
+		want  string
+	}{
+		{0, "0.0"},
+		{2, "2.0"},
+		{-2.5, "-2.5"},
+		{0.1, "0.1"},
+		{1e6, "1000000.0"},
+		{1e21, "1e+21"},
+		{0.0001, "0.0001"},
+		{0.00001, "1e-05"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+
+	for _, tt := range tests {
+		if got := (&Float{Value: tt.input}).Inspect(); got != tt.want {
+			t.Errorf("wrong Inspect result of %v. want=%q, got=%q", tt.input, tt.want, got)
+		}
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	tests := []struct {
+		input float64
+		spec  string
+		want  string
+	}{
+		{2, "", "2.0"},
+		{2, "g", "2.0"},
+		{3.14159, ".2f", "3.14"},
+		{3.14159, ".3g", "3.14"},
+		{1234.5, "e", "1.2345e+03"},
+		{1234.5, ".1e", "1.2e+03"},
+		{2.5, "f", "2.5"},
+		{2.5, "6.2f", "  2.50"},
+		{-2.5, "3", "-2.5"},
+		{1e6, ".0f", "1000000"},
+	}
+
+	for _, tt := range tests {
+		got, err := FormatFloat(tt.input, tt.spec)
+		if err != nil {
+			t.Errorf("FormatFloat(%v, %q) returned error: %s", tt.input, tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("FormatFloat(%v, %q) = %q, want %q", tt.input, tt.spec, got, tt.want)
+		}
+	}
+
+	errTests := []struct {
+		spec string
+		want string
+	}{
+		{"x", `invalid format "x": unknown verb 'x'`},
+		{"2.f", `invalid format "2.f": missing precision after '.'`},
+		{".2fx", `invalid format ".2fx": unexpected "x" after verb`},
+		{"9999f", `invalid format "9999f": 9999 is larger than 1000`},
+	}
+
+	for _, tt := range errTests {
+		_, err := FormatFloat(1, tt.spec)
+		if err == nil {
+			t.Errorf("FormatFloat(1, %q) returned no error", tt.spec)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.spec, tt.want, err)
+		}
+	}
+}
+
+func TestFormatFixed(t *testing.T) {
+	tests := []struct {
+		input  float64
+		digits int
+		want   string
+	}{
+		{2.5, 0, "3"},
+		{-2.5, 0, "-3"},
+		{3.5, 0, "4"},
+		{2.5, 2, "2.50"},
+		{0.125, 2, "0.13"},
+		// The exact values are slightly less than the ones in the source
+		{1.005, 2, "1.00"},
+		{0.285, 2, "0.28"},
+		{9.995, 2, "9.99"},
+		{9.9951, 2, "10.00"},
+		{99.5, 0, "100"},
+		{-0.001, 2, "0.00"},
+		{1e21, 1, "1000000000000000000000.0"},
+		{5e-324, 3, "0.000"},
+		{0.1, 20, "0.10000000000000000555"},
+	}
+
+	for _, tt := range tests {
+		got, err := FormatFixed(tt.input, tt.digits)
+		if err != nil {
+			t.Errorf("FormatFixed(%v, %d) returned error: %s", tt.input, tt.digits, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("FormatFixed(%v, %d) = %q, want %q", tt.input, tt.digits, got, tt.want)
+		}
+	}
+
+	if _, err := FormatFixed(math.Inf(1), 1); err == nil {
+		t.Errorf("FormatFixed(+Inf, 1) returned no error")
+	}
+	if _, err := FormatFixed(1, -1); err == nil {
+		t.Errorf("FormatFixed(1, -1) returned no error")
+	}
+}
+
+func TestRound(t *testing.T) {
+	floatTests := []struct {
+		input  float64
+		digits int
+		want   float64
+	}{
+		{2.5, 0, 3},
+		{-2.5, 0, -3},
+		{2.4999, 0, 2},
+		{0.125, 2, 0.13},
+		{1.005, 2, 1},
+		{1234.5678, 2, 1234.57},
+		{1250, -2, 1300},
+		{-1249.9, -2, -1200},
+		{499, -3, 0},
+		{500, -3, 1000},
+		{0.1, 20, 0.1},
+		{1.5, 2000, 1.5},
+		{1.5, -2000, 0},
+	}
+
+	for _, tt := range floatTests {
+		if got := RoundFloat(tt.input, tt.digits); got != tt.want {
+			t.Errorf("RoundFloat(%v, %d) = %v, want %v", tt.input, tt.digits, got, tt.want)
+		}
+	}
+
+	intTests := []struct {
+		input  int64
+		digits int
+		want   int64
+		ok     bool
+	}{
+		{1234, 2, 1234, true},
+		{1250, -2, 1300, true},
+		{-1250, -2, -1300, true},
+		{1249, -2, 1200, true},
+		{5, -1, 10, true},
+		{4, -1, 0, true},
+		{9223372036854775807, -1, 0, false},
+		{-9223372036854775808, -1, 0, false},
+		{-9223372036854775808, -19, 0, false},
+		{-9223372036854775808, -2, -9223372036854775800, true},
+		{9223372036854775807, -25, 0, true},
+	}
+
+	for _, tt := range intTests {
+		got, ok := RoundInt(tt.input, tt.digits)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("RoundInt(%d, %d) = (%d, %t), want (%d, %t)",
+				tt.input, tt.digits, got, ok, tt.want, tt.ok)
+		}
+	}
+}
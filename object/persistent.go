@@ -0,0 +1,366 @@
+package object
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// Persistent arrays and hashes are tries whose nodes are never modified once they are shared.
+// Updating one copies the nodes on the path to the updated element, so a new version shares
+// all the other nodes with the old one, which stays intact.
+
+const (
+	// trieBits is the number of bits of an index or a hash key consumed at each level of a trie
+	trieBits  = 5
+	trieWidth = 1 << trieBits
+	trieMask  = trieWidth - 1
+)
+
+// PersistentArray is an array backed by a persistent vector trie, which takes O(log n) time to
+// push, set or get an element, and constant time to slice, without copying the elements. It
+// behaves just like Array otherwise.
+type PersistentArray struct {
+	root *vectorNode
+	// shift is the number of bits of an index below the root
+	shift uint
+	// start and end are the bounds of the elements in the trie
+	start, end int
+	// Frozen reports whether the array is immutable.
+	Frozen bool
+}
+
+// vectorNode is a node of a vector trie. Leaves hold elements and the others hold children.
+type vectorNode struct {
+	elems    []Object
+	children []*vectorNode
+}
+
+// NewPersistentArray creates a new PersistentArray of elements `elems`.
+func NewPersistentArray(elems []Object) *PersistentArray {
+	a := &PersistentArray{}
+	for _, el := range elems {
+		a.appendInPlace(el)
+	}
+	return a
+}
+
+// Type returns the type of the PersistentArray, which is the same as Array.
+func (*PersistentArray) Type() Type {
+	return ArrayType
+}
+
+// Inspect returns a string representation of the PersistentArray.
+func (a *PersistentArray) Inspect() string {
+	return inspectArray(a)
+}
+
+// Len returns the number of elements.
+func (a *PersistentArray) Len() int {
+	return a.end - a.start
+}
+
+// Get returns the element at index `i`, which must be within the bounds.
+func (a *PersistentArray) Get(i int) Object {
+	idx := a.start + i
+	node := a.root
+	for level := a.shift; level > 0; level -= trieBits {
+		node = node.children[(idx>>level)&trieMask]
+	}
+	return node.elems[idx&trieMask]
+}
+
+// Set sets the element at index `i`, which must be within the bounds, to `el`. Other arrays
+// sharing elements with `a` are not affected.
+func (a *PersistentArray) Set(i int, el Object) {
+	a.root = assocVector(a.root, a.shift, a.start+i, el)
+}
+
+// Put returns a new array of the elements of `a` with the element at index `i`, which must be
+// within the bounds, replaced with `el`, leaving `a` unchanged.
+func (a *PersistentArray) Put(i int, el Object) *PersistentArray {
+	return &PersistentArray{
+		root:  assocVector(a.root, a.shift, a.start+i, el),
+		shift: a.shift,
+		start: a.start,
+		end:   a.end,
+	}
+}
+
+// Push returns a new array of the elements of `a` followed by `el`, leaving `a` unchanged.
+func (a *PersistentArray) Push(el Object) *PersistentArray {
+	root, shift := a.root, a.shift
+	for a.end >= trieWidth<<shift {
+		// Add a level above the root to make room for the element
+		newRoot := newVectorNode(shift + trieBits)
+		newRoot.children[0] = root
+		root, shift = newRoot, shift+trieBits
+	}
+
+	return &PersistentArray{
+		root:  assocVector(root, shift, a.end, el),
+		shift: shift,
+		start: a.start,
+		end:   a.end + 1,
+	}
+}
+
+// Slice returns a new array of the elements of `a` from index `start` up to but not including
+// `end`, which must be within the bounds.
+func (a *PersistentArray) Slice(start, end int) *PersistentArray {
+	return &PersistentArray{root: a.root, shift: a.shift, start: a.start + start, end: a.start + end}
+}
+
+// Elements returns a slice of the elements of `a`.
+func (a *PersistentArray) Elements() []Object {
+	elems := make([]Object, a.Len())
+	for i := range elems {
+		elems[i] = a.Get(i)
+	}
+	return elems
+}
+
+// IsFrozen reports whether `a` is immutable.
+func (a *PersistentArray) IsFrozen() bool {
+	return a.Frozen
+}
+
+func (a *PersistentArray) freeze() {
+	a.Frozen = true
+}
+
+// appendInPlace appends `el` to `a` by modifying the nodes of `a`. It must be used only while
+// building a new array, whose nodes are not shared yet.
+func (a *PersistentArray) appendInPlace(el Object) {
+	if a.root == nil {
+		a.root = newVectorNode(0)
+	}
+	for a.end >= trieWidth<<a.shift {
+		newRoot := newVectorNode(a.shift + trieBits)
+		newRoot.children[0] = a.root
+		a.root, a.shift = newRoot, a.shift+trieBits
+	}
+
+	node := a.root
+	for level := a.shift; level > 0; level -= trieBits {
+		i := (a.end >> level) & trieMask
+		if node.children[i] == nil {
+			node.children[i] = newVectorNode(level - trieBits)
+		}
+		node = node.children[i]
+	}
+	node.elems[a.end&trieMask] = el
+	a.end++
+}
+
+// newVectorNode creates an empty node at `level`, which is a leaf if `level` is 0.
+func newVectorNode(level uint) *vectorNode {
+	if level == 0 {
+		return &vectorNode{elems: make([]Object, trieWidth)}
+	}
+	return &vectorNode{children: make([]*vectorNode, trieWidth)}
+}
+
+// assocVector returns a copy of `node` at `level`, or a new node if it is nil, with the element
+// at index `idx` set to `el`.
+func assocVector(node *vectorNode, level uint, idx int, el Object) *vectorNode {
+	n := newVectorNode(level)
+	if node != nil {
+		copy(n.elems, node.elems)
+		copy(n.children, node.children)
+	}
+
+	if level == 0 {
+		n.elems[idx&trieMask] = el
+		return n
+	}
+
+	i := (idx >> level) & trieMask
+	n.children[i] = assocVector(n.children[i], level-trieBits, idx, el)
+	return n
+}
+
+// PersistentHash is a hash backed by a persistent hash array mapped trie, which takes O(log n)
+// time to set or get a pair without copying the others. It behaves just like Hash otherwise,
+// including enumerating its pairs in the order their keys are first set.
+type PersistentHash struct {
+	root *hashNode
+	size int
+	// seq is the sequence number given to the next key added, which orders the pairs
+	seq int
+	// Frozen reports whether the hash is immutable.
+	Frozen bool
+}
+
+// hashNode is a node of a hash array mapped trie. Its entries are either pairs or children,
+// and `bitmap` has the bits set for the parts of hash keys at its level which have entries.
+// Nodes below the last level hold all pairs whose hash keys have the same value in entries.
+type hashNode struct {
+	bitmap  uint32
+	entries []hashEntry
+}
+
+type hashEntry struct {
+	key  HashKey
+	pair HashPair
+	// seq is the sequence number of the key, which is kept when the pair is replaced
+	seq int
+	// child is set if the entry is a child node rather than a pair
+	child *hashNode
+}
+
+// NewPersistentHash creates a new empty PersistentHash.
+func NewPersistentHash() *PersistentHash {
+	return &PersistentHash{}
+}
+
+// Type returns the type of the PersistentHash, which is the same as Hash.
+func (*PersistentHash) Type() Type {
+	return HashType
+}
+
+// Inspect returns a string representation of the PersistentHash.
+func (h *PersistentHash) Inspect() string {
+	return inspectHash(h)
+}
+
+// Len returns the number of pairs.
+func (h *PersistentHash) Len() int {
+	return h.size
+}
+
+// Get returns the pair for `key` and true if any, otherwise false.
+func (h *PersistentHash) Get(key HashKey) (HashPair, bool) {
+	node := h.root
+	for shift := uint(0); node != nil; shift += trieBits {
+		if shift >= 64 {
+			for _, e := range node.entries {
+				if e.key == key {
+					return e.pair, true
+				}
+			}
+			return HashPair{}, false
+		}
+
+		bit := uint32(1) << ((key.Value >> shift) & trieMask)
+		if node.bitmap&bit == 0 {
+			return HashPair{}, false
+		}
+
+		e := node.entries[bits.OnesCount32(node.bitmap&(bit-1))]
+		if e.child == nil {
+			return e.pair, e.key == key
+		}
+		node = e.child
+	}
+	return HashPair{}, false
+}
+
+// Set sets the pair for `key` to `pair`. Other hashes sharing pairs with `h` are not affected.
+func (h *PersistentHash) Set(key HashKey, pair HashPair) {
+	root, added := assocHash(h.root, 0, key, pair, h.seq)
+	h.root = root
+	if added {
+		h.size++
+		h.seq++
+	}
+}
+
+// Put returns a new hash of the pairs of `h` with the pair for `key` set to `pair`, leaving `h`
+// unchanged.
+func (h *PersistentHash) Put(key HashKey, pair HashPair) *PersistentHash {
+	c := &PersistentHash{root: h.root, size: h.size, seq: h.seq}
+	c.Set(key, pair)
+	return c
+}
+
+// Range calls `f` with each pair in `h` and its key in the order the keys are first set.
+func (h *PersistentHash) Range(f func(key HashKey, pair HashPair)) {
+	entries := make([]hashEntry, 0, h.size)
+	var walk func(node *hashNode)
+	walk = func(node *hashNode) {
+		for _, e := range node.entries {
+			if e.child != nil {
+				walk(e.child)
+			} else {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	if h.root != nil {
+		walk(h.root)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	for _, e := range entries {
+		f(e.key, e.pair)
+	}
+}
+
+// IsFrozen reports whether `h` is immutable.
+func (h *PersistentHash) IsFrozen() bool {
+	return h.Frozen
+}
+
+func (h *PersistentHash) freeze() {
+	h.Frozen = true
+}
+
+// assocHash returns a copy of `node` at the level of `shift`, or a new node if it is nil, with
+// the pair for `key` set to `pair`. It also reports whether the key has been added, in which
+// case it is given the sequence number `seq`.
+func assocHash(node *hashNode, shift uint, key HashKey, pair HashPair, seq int) (*hashNode, bool) {
+	if node == nil {
+		node = &hashNode{}
+	}
+
+	// All the bits of hash keys are consumed, so look for the key linearly
+	if shift >= 64 {
+		n := &hashNode{entries: make([]hashEntry, len(node.entries), len(node.entries)+1)}
+		copy(n.entries, node.entries)
+		for i, e := range n.entries {
+			if e.key == key {
+				n.entries[i].pair = pair
+				return n, false
+			}
+		}
+		n.entries = append(n.entries, hashEntry{key: key, pair: pair, seq: seq})
+		return n, true
+	}
+
+	bit := uint32(1) << ((key.Value >> shift) & trieMask)
+	pos := bits.OnesCount32(node.bitmap & (bit - 1))
+
+	if node.bitmap&bit == 0 {
+		n := &hashNode{
+			bitmap:  node.bitmap | bit,
+			entries: make([]hashEntry, len(node.entries)+1),
+		}
+		copy(n.entries, node.entries[:pos])
+		n.entries[pos] = hashEntry{key: key, pair: pair, seq: seq}
+		copy(n.entries[pos+1:], node.entries[pos:])
+		return n, true
+	}
+
+	n := &hashNode{bitmap: node.bitmap, entries: make([]hashEntry, len(node.entries))}
+	copy(n.entries, node.entries)
+
+	e := node.entries[pos]
+	switch {
+	case e.child != nil:
+		child, added := assocHash(e.child, shift+trieBits, key, pair, seq)
+		n.entries[pos].child = child
+		return n, added
+
+	case e.key == key:
+		n.entries[pos].pair = pair
+		return n, false
+
+	default:
+		// Move the existing pair down to a new child along with the new one
+		child, _ := assocHash(nil, shift+trieBits, e.key, e.pair, e.seq)
+		child, _ = assocHash(child, shift+trieBits, key, pair, seq)
+		n.entries[pos] = hashEntry{child: child}
+		return n, true
+	}
+}
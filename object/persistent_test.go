@@ -0,0 +1,157 @@
+package object
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPersistentArray(t *testing.T) {
+	var elems []Object
+	for i := 0; i < 1100; i++ {
+		elems = append(elems, &Integer{Value: int64(i)})
+	}
+
+	a := NewPersistentArray(elems)
+	if got := a.Len(); got != len(elems) {
+		t.Fatalf("wrong length. want=%d, got=%d", len(elems), got)
+	}
+	for i := range elems {
+		if got := a.Get(i); got != elems[i] {
+			t.Fatalf("wrong element at %d. want=%s, got=%s", i, elems[i].Inspect(), got.Inspect())
+		}
+	}
+
+	// Pushing past the capacity of the trie adds a level
+	pushed := NewPersistentArray(nil)
+	for i := range elems {
+		pushed = pushed.Push(elems[i])
+	}
+	if !Equal(a, pushed) {
+		t.Errorf("pushed array differs from array built at once")
+	}
+
+	// Put leaves the original intact
+	b := a.Put(1000, &Integer{Value: -1})
+	if got := a.Get(1000).Inspect(); got != "1000" {
+		t.Errorf("original array modified by Put. got=%s", got)
+	}
+	if got := b.Get(1000).Inspect(); got != "-1" {
+		t.Errorf("wrong element set by Put. got=%s", got)
+	}
+
+	// Set does not affect arrays sharing the nodes
+	c := b.Slice(998, 1002)
+	c.Set(0, &Integer{Value: -2})
+	testPersistentArray(t, c, "[-2, 999, -1, 1001]")
+	testPersistentArray(t, b.Slice(998, 1002), "[998, 999, -1, 1001]")
+
+	// Pushing to a slice does not overwrite elements after it
+	d := c.Slice(1, 2).Push(&Integer{Value: -3})
+	testPersistentArray(t, d, "[999, -3]")
+	testPersistentArray(t, c, "[-2, 999, -1, 1001]")
+
+	testPersistentArray(t, NewPersistentArray(nil), "[]")
+	testPersistentArray(t, NewPersistentArray(nil).Push(True), "[true]")
+}
+
+func TestPersistentHash(t *testing.T) {
+	h := NewPersistentHash()
+	versions := []*PersistentHash{h}
+	for i := 0; i < 1000; i++ {
+		key := &String{Value: fmt.Sprintf("key%d", i)}
+		h = h.Put(key.HashKey(), HashPair{Key: key, Value: &Integer{Value: int64(i)}})
+		versions = append(versions, h)
+	}
+
+	for n, v := range versions {
+		if got := v.Len(); got != n {
+			t.Fatalf("wrong length of version %d. got=%d", n, got)
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := &String{Value: fmt.Sprintf("key%d", i)}
+		pair, ok := h.Get(key.HashKey())
+		if !ok {
+			t.Fatalf("no pair for %s", key.Value)
+		}
+		if got := pair.Value.Inspect(); got != fmt.Sprint(i) {
+			t.Fatalf("wrong value for %s. got=%s", key.Value, got)
+		}
+
+		// Earlier versions only have the pairs put before them
+		if _, ok := versions[i].Get(key.HashKey()); ok {
+			t.Fatalf("version %d has a pair for %s", i, key.Value)
+		}
+	}
+
+	// Replacing a value keeps the length and the original
+	key := &String{Value: "key1"}
+	r := h.Put(key.HashKey(), HashPair{Key: key, Value: NilValue})
+	if r.Len() != h.Len() {
+		t.Errorf("wrong length after replacing. want=%d, got=%d", h.Len(), r.Len())
+	}
+	if pair, _ := h.Get(key.HashKey()); pair.Value.Inspect() != "1" {
+		t.Errorf("original hash modified by Put. got=%s", pair.Value.Inspect())
+	}
+
+	count := 0
+	r.Range(func(HashKey, HashPair) { count++ })
+	if count != r.Len() {
+		t.Errorf("wrong number of pairs in Range. want=%d, got=%d", r.Len(), count)
+	}
+
+	if _, ok := h.Get((&String{Value: "missing"}).HashKey()); ok {
+		t.Errorf("pair found for missing key")
+	}
+}
+
+func TestPersistentHashCollisions(t *testing.T) {
+	// Keys with the same hash values of different types are stored below the last level
+	h := NewPersistentHash()
+	keys := []Object{&Integer{Value: 1}, True}
+	for _, k := range keys {
+		h.Set(k.(Hashable).HashKey(), HashPair{Key: k, Value: &String{Value: k.Inspect()}})
+	}
+
+	if h.Len() != len(keys) {
+		t.Fatalf("wrong length. want=%d, got=%d", len(keys), h.Len())
+	}
+	for _, k := range keys {
+		pair, ok := h.Get(k.(Hashable).HashKey())
+		if !ok || pair.Value.Inspect() != k.Inspect() {
+			t.Errorf("wrong pair for %s", k.Inspect())
+		}
+	}
+}
+
+func TestPersistentCollectionsEqual(t *testing.T) {
+	elems := []Object{&Integer{Value: 1}, &String{Value: "a"}}
+	if !Equal(NewPersistentArray(elems), &Array{Elements: elems}) {
+		t.Errorf("persistent array differs from array with the same elements")
+	}
+
+	h := NewPersistentHash()
+	m := &Hash{Pairs: make(map[HashKey]HashPair)}
+	for _, el := range elems {
+		k := el.(Hashable).HashKey()
+		h.Set(k, HashPair{Key: el, Value: el})
+		m.Set(k, HashPair{Key: el, Value: el})
+	}
+	if !Equal(h, m) {
+		t.Errorf("persistent hash differs from hash with the same pairs")
+	}
+
+	c := Clone(Freeze(h)).(*PersistentHash)
+	if !h.Frozen || c.Frozen || !Equal(h, c) {
+		t.Errorf("wrong clone of frozen persistent hash")
+	}
+}
+
+func testPersistentArray(t *testing.T, arr *PersistentArray, want string) {
+	t.Helper()
+
+	if got := arr.Inspect(); got != want {
+		t.Errorf("wrong array. want=%s, got=%s", want, got)
+	}
+}
@@ -0,0 +1,55 @@
+package parser
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/ast"
+	"github.com/skatsuta/monkey-compiler/lexer"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// TestGolden parses each testdata/*.monkey file and compares the AST with the golden file next
+// to it. Run `go test -update` to regenerate the golden files after changing the parser, and
+// review the diff.
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.monkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := New(lexer.New(string(src)))
+		program := p.ParseProgram()
+		if errs := p.Errors(); len(errs) != 0 {
+			t.Errorf("%s: parser errors: %v", file, errs)
+			continue
+		}
+		got := ast.SExpr(program) + "\n"
+
+		golden := strings.TrimSuffix(file, ".monkey") + ".golden"
+		if *update {
+			if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%s: AST does not match %s.\nwant=\n%s\ngot=\n%s", file, golden, want, got)
+		}
+	}
+}
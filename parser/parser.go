@@ -2,7 +2,9 @@ package parser
 
 import (
 	"fmt"
+	"io"
 	"strconv"
+	"unicode/utf8"
 
 	"github.com/skatsuta/monkey-compiler/ast"
 	"github.com/skatsuta/monkey-compiler/lexer"
@@ -42,12 +44,15 @@ var precedences = map[token.Type]int{
 	token.GT:       LESSGREATER,
 	token.LE:       LESSGREATER,
 	token.GE:       LESSGREATER,
+	token.IN:       LESSGREATER,
+	token.NOT:      LESSGREATER,
 	token.PLUS:     SUM,
 	token.MINUS:    SUM,
 	token.SLASH:    PRODUCT,
 	token.ASTARISK: PRODUCT,
 	token.LPAREN:   CALL,
 	token.LBRACKET: INDEX,
+	token.DOT:      INDEX,
 }
 
 type (
@@ -65,14 +70,33 @@ type Parser struct {
 
 	prefixParseFns map[token.Type]prefixParseFn
 	infixParseFns  map[token.Type]infixParseFn
+
+	// tracer receives a trace of the parse functions if it is not nil, and traceDepth is the
+	// number of parse functions being traced
+	tracer     io.Writer
+	traceDepth int
+}
+
+// Option is a functional option to configure a Parser.
+type Option func(*Parser)
+
+// WithTrace makes the parser write a line to `w` when it enters and leaves each of its parse
+// functions, indented by the nesting of the calls, e.g. to debug the precedence of operators.
+func WithTrace(w io.Writer) Option {
+	return func(p *Parser) {
+		p.tracer = w
+	}
 }
 
 // New returns a new Parser.
-func New(l lexer.Lexer) *Parser {
+func New(l lexer.Lexer, opts ...Option) *Parser {
 	p := &Parser{
 		l:      l,
 		errors: []string{},
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
 
 	p.prefixParseFns = map[token.Type]prefixParseFn{
 		token.IDENT:    p.parseIdent,
@@ -87,9 +111,11 @@ func New(l lexer.Lexer) *Parser {
 		token.IF:       p.parseIfExpression,
 		token.FUNCTION: p.parseFunctionLiteral,
 		token.STRING:   p.parseStringLiteral,
+		token.CHAR:     p.parseCharLiteral,
 		token.LBRACKET: p.parseArrayLiteral,
 		token.LBRACE:   p.parseHashLiteral,
 		token.MACRO:    p.parseMacroLiteral,
+		token.MATCH:    p.parseMatchExpression,
 	}
 
 	p.infixParseFns = map[token.Type]infixParseFn{
@@ -105,8 +131,11 @@ func New(l lexer.Lexer) *Parser {
 		token.GE:       p.parseInfixExpression,
 		token.AND:      p.parseInfixExpression,
 		token.OR:       p.parseInfixExpression,
+		token.IN:       p.parseInfixExpression,
+		token.NOT:      p.parseNotInExpression,
 		token.LPAREN:   p.parseCallExpression,
 		token.LBRACKET: p.parseIndexExpression,
+		token.DOT:      p.parseFieldExpression,
 	}
 
 	// Read two tokens, so curToken and peekToken are both set
@@ -167,11 +196,17 @@ func (p *Parser) ParseProgram() *ast.Program {
 }
 
 func (p *Parser) parseStatement() ast.Statement {
+	defer p.untrace(p.trace("parseStatement"))
+
 	switch p.curToken.Type {
 	case token.LET:
-		return p.parseLetStatement()
-	case token.IDENT, token.INT, token.FLOAT, token.STRING, token.FUNCTION, token.LPAREN,
-		token.LBRACKET, token.MINUS, token.BANG:
+		// Avoid returning a nil *ast.LetStatement as a non-nil ast.Statement
+		if stmt := p.parseLetStatement(); stmt != nil {
+			return stmt
+		}
+		return nil
+	case token.IDENT, token.INT, token.FLOAT, token.STRING, token.CHAR, token.FUNCTION,
+		token.LPAREN, token.LBRACKET, token.MINUS, token.BANG:
 		return p.parseSimpleStatement()
 	case token.RETURN:
 		return p.parseReturnStatement()
@@ -181,6 +216,8 @@ func (p *Parser) parseStatement() ast.Statement {
 }
 
 func (p *Parser) parseLetStatement() *ast.LetStatement {
+	defer p.untrace(p.trace("parseLetStatement"))
+
 	stmt := &ast.LetStatement{Token: p.curToken}
 
 	if !p.expectPeek(token.IDENT) {
@@ -212,6 +249,9 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 }
 
 func (p *Parser) parseSimpleStatement() (stmt ast.Statement) {
+	defer p.untrace(p.trace("parseSimpleStatement"))
+
+	first := p.curToken
 	lhs := p.parseExpression(LOWEST)
 
 	switch p.peekToken.Type {
@@ -233,9 +273,13 @@ func (p *Parser) parseSimpleStatement() (stmt ast.Statement) {
 
 		stmt = &ast.AssignStatement{Token: tok, LHS: lhs, RHS: rhs}
 
+	case token.INC, token.DEC:
+		p.nextToken()
+		stmt = &ast.IncDecStatement{Token: p.curToken, Operand: lhs}
+
 	default:
 		// Expression
-		stmt = &ast.ExpressionStatement{Token: p.curToken, Expression: lhs}
+		stmt = &ast.ExpressionStatement{Token: first, Expression: lhs}
 	}
 
 	for p.peekTokenIs(token.SEMICOLON) {
@@ -246,6 +290,8 @@ func (p *Parser) parseSimpleStatement() (stmt ast.Statement) {
 }
 
 func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
+	defer p.untrace(p.trace("parseReturnStatement"))
+
 	stmt := &ast.ReturnStatement{
 		Token: p.curToken,
 	}
@@ -262,8 +308,12 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 }
 
 func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
+	defer p.untrace(p.trace("parseExpressionStatement"))
+
+	// The statement takes its first token, which parsing the expression moves past
+	tok := p.curToken
 	stmt := &ast.ExpressionStatement{
-		Token:      p.curToken,
+		Token:      tok,
 		Expression: p.parseExpression(LOWEST),
 	}
 
@@ -275,6 +325,8 @@ func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 }
 
 func (p *Parser) parseExpression(precedence int) ast.Expression {
+	defer p.untrace(p.trace("parseExpression"))
+
 	prefix := p.prefixParseFns[p.curToken.Type]
 	if prefix == nil {
 		msg := fmt.Sprintf("no prefix parse function for %s found", p.curToken.Type)
@@ -299,6 +351,8 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 }
 
 func (p *Parser) parseIdent() ast.Expression {
+	defer p.untrace(p.trace("parseIdent"))
+
 	return &ast.Ident{
 		Token: p.curToken,
 		Value: p.curToken.Literal,
@@ -306,6 +360,8 @@ func (p *Parser) parseIdent() ast.Expression {
 }
 
 func (p *Parser) parseIntegerLiteral() ast.Expression {
+	defer p.untrace(p.trace("parseIntegerLiteral"))
+
 	tok := p.curToken
 
 	val, err := strconv.ParseInt(tok.Literal, 0, 64)
@@ -318,7 +374,28 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	return &ast.IntegerLiteral{Token: tok, Value: val}
 }
 
+// parseCharLiteral parses a character literal such as 'a' into an integer literal of its code
+// point.
+func (p *Parser) parseCharLiteral() ast.Expression {
+	defer p.untrace(p.trace("parseCharLiteral"))
+
+	tok := p.curToken
+
+	r, size := utf8.DecodeRuneInString(tok.Literal)
+	if len(tok.Literal) == 0 || size != len(tok.Literal) || r == utf8.RuneError && size == 1 {
+		msg := fmt.Sprintf("could not parse '%s' as character", tok.Literal)
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	// Keep the quotes in the literal so that the node is printed as written
+	tok.Literal = "'" + tok.Literal + "'"
+	return &ast.IntegerLiteral{Token: tok, Value: int64(r)}
+}
+
 func (p *Parser) parseFloatLiteral() ast.Expression {
+	defer p.untrace(p.trace("parseFloatLiteral"))
+
 	tok := p.curToken
 
 	val, err := strconv.ParseFloat(tok.Literal, 64)
@@ -332,6 +409,8 @@ func (p *Parser) parseFloatLiteral() ast.Expression {
 }
 
 func (p *Parser) parsePrefixExpression() ast.Expression {
+	defer p.untrace(p.trace("parsePrefixExpression"))
+
 	tok := p.curToken
 
 	p.nextToken()
@@ -359,6 +438,8 @@ func (p *Parser) curPrecedence() int {
 }
 
 func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
+	defer p.untrace(p.trace("parseInfixExpression"))
+
 	tok := p.curToken
 	prec := p.curPrecedence()
 
@@ -372,7 +453,29 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	}
 }
 
+// parseNotInExpression parses a non-membership expression such as `x not in arr`.
+func (p *Parser) parseNotInExpression(left ast.Expression) ast.Expression {
+	defer p.untrace(p.trace("parseNotInExpression"))
+
+	tok := p.curToken
+	prec := p.curPrecedence()
+
+	if !p.expectPeek(token.IN) {
+		return nil
+	}
+	p.nextToken()
+
+	return &ast.InfixExpression{
+		Token:    tok,
+		Operator: "not in",
+		Left:     left,
+		Right:    p.parseExpression(prec),
+	}
+}
+
 func (p *Parser) parseBoolean() ast.Expression {
+	defer p.untrace(p.trace("parseBoolean"))
+
 	return &ast.Boolean{
 		Token: p.curToken,
 		Value: p.curTokenIs(token.TRUE),
@@ -380,10 +483,14 @@ func (p *Parser) parseBoolean() ast.Expression {
 }
 
 func (p *Parser) parseNil() ast.Expression {
+	defer p.untrace(p.trace("parseNil"))
+
 	return &ast.Nil{Token: p.curToken}
 }
 
 func (p *Parser) parseGroupedExpression() ast.Expression {
+	defer p.untrace(p.trace("parseGroupedExpression"))
+
 	p.nextToken()
 
 	expr := p.parseExpression(LOWEST)
@@ -396,6 +503,8 @@ func (p *Parser) parseGroupedExpression() ast.Expression {
 }
 
 func (p *Parser) parseIfExpression() ast.Expression {
+	defer p.untrace(p.trace("parseIfExpression"))
+
 	expr := &ast.IfExpression{Token: p.curToken}
 
 	if !p.expectPeek(token.LPAREN) {
@@ -429,7 +538,95 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	return expr
 }
 
+// parseMatchExpression parses a match expression such as `match x { [a, b] => a + b, _ => 0 }`.
+func (p *Parser) parseMatchExpression() ast.Expression {
+	defer p.untrace(p.trace("parseMatchExpression"))
+
+	expr := &ast.MatchExpression{Token: p.curToken}
+
+	p.nextToken()
+	expr.Subject = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	for !p.peekTokenIs(token.RBRACE) {
+		p.nextToken()
+		arm := &ast.MatchArm{Pattern: p.parseExpression(LOWEST)}
+		if arm.Pattern != nil {
+			p.checkPattern(arm.Pattern, make(map[string]bool))
+		}
+
+		if !p.expectPeek(token.ARROW) {
+			return nil
+		}
+
+		p.nextToken()
+		arm.Value = p.parseExpression(LOWEST)
+		expr.Arms = append(expr.Arms, arm)
+
+		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.RBRACE) {
+		return nil
+	}
+
+	return expr
+}
+
+// checkPattern reports an error if `pattern` of a match arm is not a valid pattern or binds the
+// same name more than once, recording the names it binds in `bound`.
+func (p *Parser) checkPattern(pattern ast.Expression, bound map[string]bool) {
+	switch pattern := pattern.(type) {
+	case *ast.Ident:
+		if pattern.Value == "_" {
+			return
+		}
+		if bound[pattern.Value] {
+			p.errors = append(p.errors,
+				fmt.Sprintf("%s is bound more than once in a pattern", pattern.Value))
+		}
+		bound[pattern.Value] = true
+
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral, *ast.Boolean, *ast.Nil:
+
+	case *ast.PrefixExpression:
+		switch pattern.Right.(type) {
+		case *ast.IntegerLiteral, *ast.FloatLiteral:
+			if pattern.Operator == "-" {
+				return
+			}
+		}
+		p.errors = append(p.errors, fmt.Sprintf("invalid pattern: %s", pattern))
+
+	case *ast.ArrayLiteral:
+		for _, el := range pattern.Elements {
+			p.checkPattern(el, bound)
+		}
+
+	case *ast.HashLiteral:
+		for _, pair := range pattern.Pairs {
+			switch pair.Key.(type) {
+			case *ast.StringLiteral, *ast.IntegerLiteral, *ast.Boolean:
+			default:
+				p.errors = append(p.errors,
+					fmt.Sprintf("key of hash pattern must be a literal, got %s", pair.Key))
+			}
+			p.checkPattern(pair.Value, bound)
+		}
+
+	default:
+		p.errors = append(p.errors, fmt.Sprintf("invalid pattern: %s", pattern))
+	}
+}
+
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
+	defer p.untrace(p.trace("parseBlockStatement"))
+
 	block := &ast.BlockStatement{
 		Token:      p.curToken,
 		Statements: []ast.Statement{},
@@ -449,6 +646,8 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 }
 
 func (p *Parser) parseFunctionLiteral() ast.Expression {
+	defer p.untrace(p.trace("parseFunctionLiteral"))
+
 	lit := &ast.FunctionLiteral{Token: p.curToken}
 
 	if !p.expectPeek(token.LPAREN) {
@@ -467,6 +666,8 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 }
 
 func (p *Parser) parseFunctionParameters() []*ast.Ident {
+	defer p.untrace(p.trace("parseFunctionParameters"))
+
 	idents := []*ast.Ident{}
 
 	if p.peekTokenIs(token.RPAREN) {
@@ -500,6 +701,8 @@ func (p *Parser) parseFunctionParameters() []*ast.Ident {
 }
 
 func (p *Parser) parseExpressionList(end token.Type) []ast.Expression {
+	defer p.untrace(p.trace("parseExpressionList"))
+
 	list := make([]ast.Expression, 0)
 
 	if p.peekTokenIs(end) {
@@ -524,6 +727,8 @@ func (p *Parser) parseExpressionList(end token.Type) []ast.Expression {
 }
 
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
+	defer p.untrace(p.trace("parseCallExpression"))
+
 	return &ast.CallExpression{
 		Token:     p.curToken,
 		Function:  function,
@@ -532,6 +737,8 @@ func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 }
 
 func (p *Parser) parseStringLiteral() ast.Expression {
+	defer p.untrace(p.trace("parseStringLiteral"))
+
 	return &ast.StringLiteral{
 		Token: p.curToken,
 		Value: p.curToken.Literal,
@@ -539,6 +746,8 @@ func (p *Parser) parseStringLiteral() ast.Expression {
 }
 
 func (p *Parser) parseArrayLiteral() ast.Expression {
+	defer p.untrace(p.trace("parseArrayLiteral"))
+
 	return &ast.ArrayLiteral{
 		Token:    p.curToken,
 		Elements: p.parseExpressionList(token.RBRACKET),
@@ -546,6 +755,8 @@ func (p *Parser) parseArrayLiteral() ast.Expression {
 }
 
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
+	defer p.untrace(p.trace("parseIndexExpression"))
+
 	expr := &ast.IndexExpression{
 		Token: p.curToken,
 		Left:  left,
@@ -561,12 +772,31 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	return expr
 }
 
-func (p *Parser) parseHashLiteral() ast.Expression {
-	hash := &ast.HashLiteral{
+func (p *Parser) parseFieldExpression(left ast.Expression) ast.Expression {
+	defer p.untrace(p.trace("parseFieldExpression"))
+
+	expr := &ast.FieldExpression{
+		Token: p.curToken,
+		Left:  left,
+	}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+
+	expr.Field = &ast.Ident{
 		Token: p.curToken,
-		Pairs: make(map[ast.Expression]ast.Expression),
+		Value: p.curToken.Literal,
 	}
 
+	return expr
+}
+
+func (p *Parser) parseHashLiteral() ast.Expression {
+	defer p.untrace(p.trace("parseHashLiteral"))
+
+	hash := &ast.HashLiteral{Token: p.curToken}
+
 	for !p.peekTokenIs(token.RBRACE) {
 		p.nextToken()
 		key := p.parseExpression(LOWEST)
@@ -577,7 +807,7 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 
 		p.nextToken()
 		value := p.parseExpression(LOWEST)
-		hash.Pairs[key] = value
+		hash.Pairs = append(hash.Pairs, ast.HashPair{Key: key, Value: value})
 
 		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
 			return nil
@@ -592,6 +822,8 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 }
 
 func (p *Parser) parseMacroLiteral() ast.Expression {
+	defer p.untrace(p.trace("parseMacroLiteral"))
+
 	tok := p.curToken
 
 	if !p.expectPeek(token.LPAREN) {
@@ -60,6 +60,12 @@ func TestLetStatementErrors(t *testing.T) {
 		if len(p.Errors()) == 0 {
 			t.Errorf("parser has no errors despite invalid statements.")
 		}
+
+		for i, stmt := range program.Statements {
+			if stmt, ok := stmt.(*ast.LetStatement); ok && stmt == nil {
+				t.Errorf("program.Statements[%d] is a nil *ast.LetStatement", i)
+			}
+		}
 	}
 }
 
@@ -119,6 +125,32 @@ func TestAssignmentStatements(t *testing.T) {
 	}
 }
 
+func TestIncDecStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"i++;", "i++;"},
+		{"i--", "i--;"},
+		{"a[0]++; b.c--;", "(a[0])++;(b.c)--;"},
+		{"i++; i = 1 - -1", "i++;i = (1 - (-1));"},
+		{"if (x) { i-- } i++ # done", "ifx i--;i++;"},
+		// -- followed by more of the expression is two minus signs
+		{"a--b", "(a - (-b))"},
+		{"--5", "(-(-5))"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if got := program.String(); got != tt.expected {
+			t.Errorf("wrong program. want=%q, got=%q", tt.expected, got)
+		}
+	}
+}
+
 func testAssignmentStatement(t *testing.T, s ast.Statement, name string) {
 	stmt, ok := s.(*ast.AssignStatement)
 	if !ok {
@@ -236,6 +268,10 @@ func TestFloatExpression(t *testing.T) {
 		{"12.34", 12.34},
 		{"0.56", 0.56},
 		{"78.00", 78.00},
+		// Exponents, as floats are printed with them
+		{"1e+21", 1e21},
+		{"2.5e-3", 0.0025},
+		{"1E5", 1e5},
 	}
 
 	for _, tt := range tests {
@@ -397,6 +433,8 @@ func TestParsingInfixExpressions(t *testing.T) {
 		{"5.9 <= 5;", 5.9, "<=", 5},
 		{"5 == 5.0;", 5, "==", 5.0},
 		{"5.1 != 5.1;", 5.1, "!=", 5.1},
+		{"1 in a", 1, "in", "a"},
+		{"1 not in a", 1, "not in", "a"},
 	}
 
 	for _, tt := range tests {
@@ -462,6 +500,8 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 		{"3 < 5 && true", "((3 < 5) && true)"},
 		{"3 + 5 || false", "((3 + 5) || false)"},
 		{"3 * 5 || true", "((3 * 5) || true)"},
+		{"a + 1 in b == true", "(((a + 1) in b) == true)"},
+		{"!a not in b", "((!a) not in b)"},
 		{"1 + (2 + 3) + 4", "((1 + (2 + 3)) + 4)"},
 		{"(5 + 5) * 2", "((5 + 5) * 2)"},
 		{"2 / (5 + 5)", "(2 / (5 + 5))"},
@@ -476,6 +516,12 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 		{"add(a + b + c * d / f + g)", "add((((a + b) + ((c * d) / f)) + g))"},
 		{"a * [1, 2, 3, 4][b * c] * d", "((a * ([1, 2, 3, 4][(b * c)])) * d)"},
 		{"add(a * b[2], b[1], 2 * [1, 2][1])", "add((a * (b[2])), (b[1]), (2 * ([1, 2][1])))"},
+		{"a.b.c", "((a.b).c)"},
+		{"-a.b * c", "((-(a.b)) * c)"},
+		{"a.b[1].c", "(((a.b)[1]).c)"},
+		{"a.b + c.d", "((a.b) + (c.d))"},
+		{"{c: 1, a: 2 * 3, b: d}", "{c: 1, a: (2 * 3), b: d}"},
+		{"{}", "{}"},
 	}
 
 	for _, tt := range tests {
@@ -805,6 +851,58 @@ func TestStringLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestCharLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"'a'", 97},
+		{"'0'", 48},
+		{"' '", 32},
+		{"'é'", 233},
+		{"'🐵'", 128053},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if l := len(program.Statements); l != 1 {
+			t.Errorf("program has not 1 statement. got=%d", l)
+			continue
+		}
+
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Errorf("program.Statements[0] is not *ast.ExpressionStatement. got=%T",
+				program.Statements[0])
+			continue
+		}
+
+		il, ok := stmt.Expression.(*ast.IntegerLiteral)
+		if !ok {
+			t.Errorf("stmt.Expression is not *ast.IntegerLiteral. got=%T", stmt.Expression)
+			continue
+		}
+		if il.Value != tt.expected {
+			t.Errorf("il.Value not %d. got=%d", tt.expected, il.Value)
+		}
+		// The literal is printed as written
+		if got := il.String(); got != tt.input {
+			t.Errorf("wrong String result. want=%q, got=%q", tt.input, got)
+		}
+	}
+
+	for _, input := range []string{"''", "'ab'"} {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 {
+			t.Errorf("%s: expected a parser error", input)
+		}
+	}
+}
+
 func TestParsingArrayLiterals(t *testing.T) {
 	input := "[1, 2 * 2, 3 + 3]"
 
@@ -862,6 +960,65 @@ func TestParsingIndexExpressions(t *testing.T) {
 	testInfixExpression(t, idxExpr.Index, 1, "+", 1)
 }
 
+func TestParsingFieldExpressions(t *testing.T) {
+	input := "person.name"
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if l := len(program.Statements); l != 1 {
+		t.Fatalf("program has not %d statement. got=%d", 1, l)
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not *ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+
+	fieldExpr, ok := stmt.Expression.(*ast.FieldExpression)
+	if !ok {
+		t.Fatalf("fieldExpr not *ast.FieldExpression. got=%T", stmt.Expression)
+	}
+
+	testIdent(t, fieldExpr.Left, "person")
+	testIdent(t, fieldExpr.Field, "name")
+}
+
+func TestParsingFieldAssignments(t *testing.T) {
+	input := "person.name = 1"
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt, ok := program.Statements[0].(*ast.AssignStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not *ast.AssignStatement. got=%T",
+			program.Statements[0])
+	}
+
+	fieldExpr, ok := stmt.LHS.(*ast.FieldExpression)
+	if !ok {
+		t.Fatalf("stmt.LHS not *ast.FieldExpression. got=%T", stmt.LHS)
+	}
+
+	testIdent(t, fieldExpr.Left, "person")
+	testIdent(t, fieldExpr.Field, "name")
+	testLiteralExpression(t, stmt.RHS, 1)
+}
+
+func TestParsingFieldExpressionErrors(t *testing.T) {
+	p := New(lexer.New("person.1"))
+	p.ParseProgram()
+
+	want := "expected next token to be IDENT, got INT instead"
+	if errs := p.Errors(); len(errs) == 0 || errs[0] != want {
+		t.Errorf("wrong parser errors. want=%q, got=%q", want, errs)
+	}
+}
+
 func TestParsingHashLiterals(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -930,8 +1087,9 @@ func TestParsingHashLiterals(t *testing.T) {
 			t.Fatalf("hash not *ast.HashLiteral. got=%T", stmt.Expression)
 		}
 
-		for key, value := range hash.Pairs {
-			switch key := key.(type) {
+		for _, pair := range hash.Pairs {
+			value := pair.Value
+			switch key := pair.Key.(type) {
 			case *ast.StringLiteral:
 				switch expected := tt.expected.(type) {
 				case map[string]int64:
@@ -972,6 +1130,25 @@ func TestParsingHashLiterals(t *testing.T) {
 	}
 }
 
+func TestHashLiteralPairOrder(t *testing.T) {
+	// Pairs are kept in the source order, including duplicate keys
+	p := New(lexer.New(`{"b": 1, "a": 2, 3: 3, "b": 4}`))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	hash := stmt.Expression.(*ast.HashLiteral)
+
+	var got []string
+	for _, pair := range hash.Pairs {
+		got = append(got, pair.Key.String()+": "+pair.Value.String())
+	}
+	want := []string{"b: 1", "a: 2", "3: 3", "b: 4"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("wrong pairs. want=%q, got=%q", want, got)
+	}
+}
+
 func TestMacroLiteralParsing(t *testing.T) {
 	input := `macro(x, y) { x + y; }`
 
@@ -1016,6 +1193,63 @@ func TestMacroLiteralParsing(t *testing.T) {
 	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
 }
 
+func TestMatchExpressionParsing(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"match x { 1 => 2 }", "match x { 1 => 2 }"},
+		{"match x { -1 => a, _ => b, }", "match x { (-1) => a, _ => b }"},
+		{
+			"match p { [x, y] => x + y, [] => 0 }",
+			"match p { [x, y] => (x + y), [] => 0 }",
+		},
+		{
+			`match s { {"type": "circle", "r": r} => r * r, nil => 0 }`,
+			`match s { {type: circle, r: r} => (r * r), nil => 0 }`,
+		},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("statement is not *ast.ExpressionStatement; got %T", program.Statements[0])
+		}
+		if _, ok := stmt.Expression.(*ast.MatchExpression); !ok {
+			t.Fatalf("stmt.Expression is not *ast.MatchExpression; got %T", stmt.Expression)
+		}
+		if got := stmt.Expression.String(); got != tt.want {
+			t.Errorf("wrong match expression. want=%q, got=%q", tt.want, got)
+		}
+	}
+}
+
+func TestMatchExpressionErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"match x { [a, a] => a }", "a is bound more than once in a pattern"},
+		{"match x { a + 1 => a }", "invalid pattern: (a + 1)"},
+		{"match x { !true => 1 }", "invalid pattern: (!true)"},
+		{"match x { {k: v} => v }", "key of hash pattern must be a literal, got k"},
+		{"match x { 1 2 }", "expected next token to be =>, got INT instead"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		if errs := p.Errors(); len(errs) == 0 || errs[0] != tt.want {
+			t.Errorf("wrong parser errors for %q. want=%q, got=%q", tt.input, tt.want, errs)
+		}
+	}
+}
+
 func checkParserErrors(t *testing.T, p *Parser) {
 	errors := p.Errors()
 	length := len(errors)
@@ -0,0 +1,31 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// trace writes a line telling that the parser enters a parse function `fn` at the current token
+// if tracing is enabled, and returns `fn` to be passed to untrace when the function returns, e.g.
+// `defer p.untrace(p.trace("parseExpression"))`.
+func (p *Parser) trace(fn string) string {
+	if p.tracer == nil {
+		return fn
+	}
+
+	fmt.Fprintf(p.tracer, "%sBEGIN %s %q at %d:%d\n", strings.Repeat("\t", p.traceDepth), fn,
+		p.curToken.Literal, p.curToken.Line, p.curToken.Column)
+	p.traceDepth++
+	return fn
+}
+
+// untrace writes a line telling that the parser leaves a parse function `fn` if tracing is
+// enabled.
+func (p *Parser) untrace(fn string) {
+	if p.tracer == nil {
+		return
+	}
+
+	p.traceDepth--
+	fmt.Fprintf(p.tracer, "%sEND %s\n", strings.Repeat("\t", p.traceDepth), fn)
+}
@@ -0,0 +1,46 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/lexer"
+)
+
+func TestTrace(t *testing.T) {
+	var out strings.Builder
+	p := New(lexer.New("-1 * 2"), WithTrace(&out))
+	p.ParseProgram()
+	checkParserErrors(t, p)
+
+	// The prefix expression binds tighter than the infix one
+	want := `BEGIN parseStatement "-" at 1:1
+	BEGIN parseSimpleStatement "-" at 1:1
+		BEGIN parseExpression "-" at 1:1
+			BEGIN parsePrefixExpression "-" at 1:1
+				BEGIN parseExpression "1" at 1:2
+					BEGIN parseIntegerLiteral "1" at 1:2
+					END parseIntegerLiteral
+				END parseExpression
+			END parsePrefixExpression
+			BEGIN parseInfixExpression "*" at 1:4
+				BEGIN parseExpression "2" at 1:6
+					BEGIN parseIntegerLiteral "2" at 1:6
+					END parseIntegerLiteral
+				END parseExpression
+			END parseInfixExpression
+		END parseExpression
+	END parseSimpleStatement
+END parseStatement
+`
+	if got := out.String(); got != want {
+		t.Errorf("wrong trace.\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	// Nothing is traced by default
+	out.Reset()
+	New(lexer.New("-1 * 2")).ParseProgram()
+	if out.Len() != 0 {
+		t.Errorf("traced without the option: %s", out.String())
+	}
+}
@@ -0,0 +1,198 @@
+// Package playground provides an HTTP handler which compiles and runs Monkey programs sent by
+// clients under strict limits, and returns their output, disassembled bytecode and errors as
+// JSON. It is meant to be a showcase of the compiler and the VM.
+//
+// Programs run with limited fuel, i.e. the number of instructions they can execute, limited
+// memory and limited time, which also bounds waiting in the `await` built-in function, and
+// their output is captured into the response with a size limit, so that they have no access to
+// I/O of the server.
+package playground
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/lexer"
+	"github.com/skatsuta/monkey-compiler/object"
+	"github.com/skatsuta/monkey-compiler/parser"
+	"github.com/skatsuta/monkey-compiler/vm"
+)
+
+const (
+	// DefaultFuel is the default number of instructions a program can execute.
+	DefaultFuel = 10000000
+	// DefaultMaxSourceSize is the default maximum size of source code in bytes.
+	DefaultMaxSourceSize = 64 << 10
+	// DefaultMaxOutputSize is the default maximum size of output in bytes.
+	DefaultMaxOutputSize = 64 << 10
+	// DefaultMaxMemory is the default maximum memory a program can use in bytes.
+	DefaultMaxMemory = 64 << 20
+	// DefaultTimeout is the default maximum time a program can run.
+	DefaultTimeout = 5 * time.Second
+)
+
+// Request is a request to run a program.
+type Request struct {
+	Source string `json:"source"`
+}
+
+// Response is the result of running a program.
+type Response struct {
+	Output      string   `json:"output"`
+	Disassembly string   `json:"disassembly"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+// Handler is an HTTP handler which runs programs. It accepts a POST request whose body is a
+// JSON-encoded Request and responds with a JSON-encoded Response.
+type Handler struct {
+	// Fuel is the number of instructions a program can execute.
+	Fuel int64
+	// MaxSourceSize is the maximum size of source code in bytes.
+	MaxSourceSize int64
+	// MaxOutputSize is the maximum size of output in bytes.
+	MaxOutputSize int
+	// MaxMemory is the approximate maximum memory a program can use in bytes.
+	MaxMemory int64
+	// Timeout is the maximum time a program can run, or zero for no limit.
+	Timeout time.Duration
+}
+
+// NewHandler creates a new Handler with the default limits.
+func NewHandler() *Handler {
+	return &Handler{
+		Fuel:          DefaultFuel,
+		MaxSourceSize: DefaultMaxSourceSize,
+		MaxOutputSize: DefaultMaxOutputSize,
+		MaxMemory:     DefaultMaxMemory,
+		Timeout:       DefaultTimeout,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Allow some room for JSON encoding of the source code
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 2*h.MaxSourceSize))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var req Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(req.Source)) > h.MaxSourceSize {
+		http.Error(w, "source code too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Run(req.Source))
+}
+
+// Run compiles and runs source code `src` under the limits of the handler.
+func (h *Handler) Run(src string) *Response {
+	res := &Response{}
+
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		res.Errors = p.Errors()
+		return res
+	}
+
+	// Macros are not expanded because the evaluator running them has no limits
+	c := compiler.New()
+	if err := c.Compile(program); err != nil {
+		res.Errors = []string{fmt.Sprintf("compilation failed: %s", err)}
+		return res
+	}
+
+	bytecode := c.Bytecode()
+	res.Disassembly = disassemble(bytecode)
+
+	out := &limitedWriter{max: h.MaxOutputSize}
+	machine := vm.New(bytecode,
+		vm.WithFuel(h.Fuel),
+		vm.WithMaxMemory(h.MaxMemory),
+		vm.WithStdout(out),
+		vm.WithArena(),
+	)
+	ctx := context.Background()
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+	if err := machine.RunContext(ctx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = errTimeLimit
+		}
+		res.Errors = []string{fmt.Sprintf("execution failed: %s", err)}
+	} else if n := machine.PendingTimers(); n > 0 {
+		// The event loop is not run, so the functions scheduled with timers are never called
+		res.Errors = []string{fmt.Sprintf("%d timers left pending: %s", n, errEventLoop)}
+	}
+	if out.exceeded {
+		res.Errors = append(res.Errors, errOutputLimit.Error())
+	}
+
+	res.Output = out.buf.String()
+	return res
+}
+
+// disassemble returns a human-readable listing of the instructions of the main program and
+// the compiled functions in `bytecode`.
+func disassemble(bytecode *compiler.Bytecode) string {
+	var out strings.Builder
+
+	out.WriteString("main:\n")
+	out.WriteString(bytecode.Instructions.String())
+
+	for i, c := range bytecode.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			fmt.Fprintf(&out, "\nconstant %d: %s(params=%d, locals=%d)\n",
+				i, fn.Type(), fn.NumParameters, fn.NumLocals)
+			out.WriteString(fn.Instructions.String())
+		}
+	}
+
+	return out.String()
+}
+
+var (
+	errOutputLimit = errors.New("output limit exceeded")
+	errTimeLimit   = errors.New("time limit exceeded")
+	errEventLoop   = errors.New("timers are not run after the program")
+)
+
+// limitedWriter is a writer which keeps up to `max` bytes written and discards the rest.
+type limitedWriter struct {
+	buf      bytes.Buffer
+	max      int
+	exceeded bool
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if rest := w.max - w.buf.Len(); len(p) > rest {
+		w.buf.Write(p[:rest])
+		w.exceeded = true
+		return rest, errOutputLimit
+	}
+	return w.buf.Write(p)
+}
@@ -0,0 +1,133 @@
+package playground
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		source     string
+		wantOutput string
+		wantErrors []string
+	}{
+		{
+			source:     `puts("Hello, world!")`,
+			wantOutput: "Hello, world!\n",
+		},
+		{
+			source:     `let x = ;`,
+			wantErrors: []string{"no prefix parse function for ; found"},
+		},
+		{
+			source:     `puts(y)`,
+			wantErrors: []string{`compilation failed: undefined variable "y"`},
+		},
+		{
+			source:     `puts(1); let f = fn() { f() }; f()`,
+			wantOutput: "1\n",
+			wantErrors: []string{"execution failed: stack overflow"},
+		},
+		{
+			source:     `let f = fn(n) { if (n < 2) { n } else { f(n - 1) + f(n - 2) } }; f(25)`,
+			wantErrors: []string{"execution failed: out of fuel: too many instructions executed"},
+		},
+		{
+			source:     `let d = fn(s, n) { if (n == 0) { s } else { d(s + s, n - 1) } }; d("a", 17)`,
+			wantErrors: []string{"execution failed: out of memory: memory limit exceeded"},
+		},
+		{
+			source:     `puts("0123456789"); puts("abc")`,
+			wantOutput: "0123456789\nabc",
+			wantErrors: []string{"output limit exceeded"},
+		},
+		{
+			source:     `puts(1); await(sleep(60000))`,
+			wantOutput: "1\n",
+			wantErrors: []string{"execution failed: time limit exceeded"},
+		},
+		{
+			source:     `set_timeout(0, fn() { puts(1) }); await(sleep(0)); set_interval(10, puts)`,
+			wantOutput: "1\n",
+			wantErrors: []string{"1 timers left pending: timers are not run after the program"},
+		},
+	}
+
+	h := &Handler{
+		Fuel:          10000,
+		MaxSourceSize: 1024,
+		MaxOutputSize: 14,
+		MaxMemory:     64 << 10,
+		Timeout:       100 * time.Millisecond,
+	}
+
+	for _, tt := range tests {
+		body, _ := json.Marshal(Request{Source: tt.source})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(string(body))))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("wrong status code. want=%d, got=%d", http.StatusOK, rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("wrong content type. want=%q, got=%q", "application/json", ct)
+		}
+
+		var res Response
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("invalid response: %s", err)
+		}
+
+		if res.Output != tt.wantOutput {
+			t.Errorf("wrong output for %q. want=%q, got=%q", tt.source, tt.wantOutput, res.Output)
+		}
+		if !reflect.DeepEqual(res.Errors, tt.wantErrors) {
+			t.Errorf("wrong errors for %q. want=%q, got=%q", tt.source, tt.wantErrors, res.Errors)
+		}
+	}
+}
+
+func TestHandlerDisassembly(t *testing.T) {
+	res := NewHandler().Run("let add = fn(a, b) { a + b }; add(1, 2)")
+
+	wants := []string{
+		"main:\n0000 OpClosure 0x0 0x0\n",
+		"constant 0: CompiledFunction(params=2, locals=2)\n0000 OpGetLocal 0x0\n",
+	}
+	for _, want := range wants {
+		if !strings.Contains(res.Disassembly, want) {
+			t.Errorf("disassembly does not contain %q:\n%s", want, res.Disassembly)
+		}
+	}
+}
+
+func TestHandlerBadRequests(t *testing.T) {
+	h := &Handler{Fuel: 100, MaxSourceSize: 8, MaxOutputSize: 100}
+
+	tests := []struct {
+		method string
+		body   string
+		want   int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "not json", http.StatusBadRequest},
+		{http.MethodPost, `{"source": "1 + 2 + 3 + 4"}`, http.StatusRequestEntityTooLarge},
+		{http.MethodPost, `{"source": "` + strings.Repeat("1", 100) + `"}`,
+			http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tt.method, "/run", strings.NewReader(tt.body)))
+
+		if rec.Code != tt.want {
+			t.Errorf("wrong status code for %s %q. want=%d, got=%d",
+				tt.method, tt.body, tt.want, rec.Code)
+		}
+	}
+}
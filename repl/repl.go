@@ -4,6 +4,9 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/skatsuta/monkey-compiler/compiler"
 	"github.com/skatsuta/monkey-compiler/eval"
@@ -15,29 +18,76 @@ import (
 
 const prompt = ">> "
 
-// Start starts Monkey REPL.
-func Start(in io.Reader, out io.Writer) {
-	scanner := bufio.NewScanner(in)
+// ANSI escape sequences to color output
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorBlue   = "\x1b[34m"
+	colorCyan   = "\x1b[36m"
+	colorGray   = "\x1b[90m"
+)
 
-	macroEnv := object.NewEnvironment()
+// config is a configuration of the REPL.
+type config struct {
+	color       bool
+	floatFormat string
+}
+
+// Option is a functional option to configure the REPL.
+type Option func(*config)
+
+// WithColor enables or disables coloring results with ANSI escape sequences.
+func WithColor(enabled bool) Option {
+	return func(c *config) {
+		c.color = enabled
+	}
+}
 
-	symbolTable := compiler.NewSymbolTable()
+// WithFloatFormat sets a format spec of Float results, e.g. ".2f", as accepted by the `format`
+// built-in function. Results are shown in full if the spec is empty or invalid.
+func WithFloatFormat(spec string) Option {
+	return func(c *config) {
+		c.floatFormat = spec
+	}
+}
 
-	// Define built-in functions
-	for i, builtin := range object.Builtins {
-		symbolTable.DefineBuiltin(i, builtin.Name)
+// Start starts Monkey REPL.
+func Start(in io.Reader, out io.Writer, opts ...Option) {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
 	}
 
-	constants := make([]object.Object, 0)
-	globals := make([]object.Object, vm.GlobalSize)
+	scanner := bufio.NewScanner(in)
+
+	macroEnv := object.NewEnvironment()
+	sess := newSession()
+	defer flush(out)
+
+	// The VM is reused for all the inputs of a session, so that timers scheduled by an input
+	// stay pending while later ones run
+	var machine *vm.VM
 
 	for {
-		fmt.Print(prompt)
+		io.WriteString(out, prompt)
+		// Show the prompt and the output of the previous line before waiting for input
+		flush(out)
 		if !scanner.Scan() {
 			return
 		}
 
 		line := scanner.Text()
+		if strings.HasPrefix(line, ":") {
+			if s, err := runCommand(line, sess); err != nil {
+				fmt.Fprintf(out, "Woops! %s\n", err)
+			} else if s != sess {
+				sess, machine = s, nil
+			}
+			continue
+		}
+
 		l := lexer.New(line)
 		p := parser.New(l)
 
@@ -49,10 +99,20 @@ func Start(in io.Reader, out io.Writer) {
 
 		// Process macros
 		eval.DefineMacros(program, macroEnv)
-		expanded := eval.ExpandMacros(program, macroEnv)
+		expanded, err := eval.ExpandMacros(program, macroEnv)
+		if err != nil {
+			fmt.Fprintf(out, "Woops! Macro expansion failed: %s\n", err)
+			continue
+		}
+
+		warnings := append(compiler.Check(expanded), compiler.CheckComments(line)...)
+		for _, w := range warnings {
+			fmt.Fprintf(out, "warning: %s\n", w)
+		}
 
 		// Compile the AST to bytecode
-		complr := compiler.NewWithState(symbolTable, constants)
+		complr := compiler.NewWithState(sess.symbolTable, sess.constants,
+			compiler.WithKeepLastValue())
 		if err := complr.Compile(expanded); err != nil {
 			fmt.Fprintf(out, "Woops! Compilation failed: %s\n", err)
 			continue
@@ -60,23 +120,116 @@ func Start(in io.Reader, out io.Writer) {
 
 		// Update constant pool
 		code := complr.Bytecode()
-		constants = code.Constants
+		sess.constants = code.Constants
 
 		// Run bytecode instructions
-		machine := vm.NewWithGlobalStore(code, globals)
+		if machine == nil {
+			machine = vm.NewWithGlobalStore(code, sess.globals, vm.WithStdout(out))
+		} else {
+			machine.Reset(code)
+		}
 		if err := machine.Run(); err != nil {
 			fmt.Fprintf(out, "Woops! Executing bytecode failed: %s\n", err)
 			continue
 		}
 
-		lastPopped := machine.LastPoppedStackElem()
-		if lastPopped == nil {
-			io.WriteString(out, "no object at top of stack\n")
-			continue
+		// Input ending with a statement other than an expression, e.g. `let`, has no value
+		if result := machine.ReturnValue(); result != nil {
+			io.WriteString(out, render(result, cfg))
+			io.WriteString(out, "\n")
 		}
 
-		io.WriteString(out, lastPopped.Inspect())
-		io.WriteString(out, "\n")
+		// Functions scheduled with timers are called once they are due, between inputs, so that
+		// the prompt comes back even while repeating timers are pending
+		if err := machine.RunDueTimers(); err != nil {
+			fmt.Fprintf(out, "Woops! Executing bytecode failed: %s\n", err)
+		}
+
+		// The main program never runs again, so the constants only it used can be dropped
+		sess.constants = compiler.CompactConstants(sess.constants)
+	}
+}
+
+// flush flushes output buffered in `out`, if any.
+func flush(out io.Writer) {
+	if f, ok := out.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+}
+
+// render returns a representation of a result `obj` annotated with its type, e.g.
+// `=> "hi" : String`, according to `cfg`.
+func render(obj object.Object, cfg config) string {
+	val := obj.Inspect()
+	switch obj := obj.(type) {
+	case *object.String:
+		val = strconv.Quote(obj.Value)
+	case *object.Float:
+		if cfg.floatFormat != "" {
+			if s, err := object.FormatFloat(obj.Value, cfg.floatFormat); err == nil {
+				val = s
+			}
+		}
+	}
+	typ := object.TypeName(obj)
+
+	if !cfg.color {
+		return "=> " + val + " : " + typ
+	}
+	return "=> " + valueColor(obj) + val + colorReset + " : " + colorGray + typ + colorReset
+}
+
+// valueColor returns a color of values of the type of `obj`.
+func valueColor(obj object.Object) string {
+	switch obj.Type() {
+	case object.IntegerType, object.BigIntType, object.FloatType:
+		return colorYellow
+	case object.StringType, object.BytesType:
+		return colorGreen
+	case object.BooleanType, object.NilType:
+		return colorBlue
+	case object.ErrorType:
+		return colorRed
+	default:
+		return colorCyan
+	}
+}
+
+// runCommand runs a REPL command `line` such as `:session save <file>` against the current
+// session `sess`, and returns the session to continue with.
+func runCommand(line string, sess *session) (*session, error) {
+	args := strings.Fields(line)
+	if len(args) != 3 || args[0] != ":session" {
+		return nil, fmt.Errorf("unknown command: %s (usage: :session save|load <file>)", line)
+	}
+
+	switch filename := args[2]; args[1] {
+	case "save":
+		f, err := os.Create(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := sess.save(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not save session: %s", err)
+		}
+		return sess, f.Close()
+
+	case "load":
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		loaded, err := loadSession(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not load session: %s", err)
+		}
+		return loaded, nil
+
+	default:
+		return nil, fmt.Errorf("unknown session command: %s", args[1])
 	}
 }
 
@@ -0,0 +1,234 @@
+package repl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		obj  object.Object
+		cfg  config
+		want string
+	}{
+		{&object.Integer{Value: 42}, config{}, "=> 42 : Int"},
+		{&object.String{Value: "hi"}, config{}, `=> "hi" : String`},
+		{&object.Boolean{Value: true}, config{}, "=> true : Bool"},
+		{&object.Array{Elements: []object.Object{&object.String{Value: "a"}}}, config{},
+			"=> [a] : Array"},
+		{&object.Float{Value: 2}, config{}, "=> 2.0 : Float"},
+		{&object.Float{Value: 3.14159}, config{floatFormat: ".2f"}, "=> 3.14 : Float"},
+		{&object.Float{Value: 3.14159}, config{floatFormat: "x"}, "=> 3.14159 : Float"},
+		{&object.Integer{Value: 42}, config{color: true},
+			"=> \x1b[33m42\x1b[0m : \x1b[90mInt\x1b[0m"},
+		{&object.String{Value: "hi"}, config{color: true},
+			"=> \x1b[32m\"hi\"\x1b[0m : \x1b[90mString\x1b[0m"},
+	}
+
+	for _, tt := range tests {
+		if got := render(tt.obj, tt.cfg); got != tt.want {
+			t.Errorf("render(%s, %+v) = %q, want %q", tt.obj.Inspect(), tt.cfg, got, tt.want)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	in := strings.NewReader("let a = 1;\na + 1\n\"x\" + \"y\"\n1 +\n")
+
+	var out bytes.Buffer
+	Start(in, &out)
+
+	// `let` has no value to print
+	want := ">> >> => 2 : Int\n>> => \"xy\" : String\n"
+	if got := out.String(); !strings.Contains(got, want) {
+		t.Errorf("wrong output. want to contain %q, got=%q", want, got)
+	}
+}
+
+func TestStartOutput(t *testing.T) {
+	in := strings.NewReader("puts(1, \"a\")\nprint(2, \"b\")\n")
+
+	// Output of built-in functions goes to the same writer as results and is flushed
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	Start(in, out)
+
+	want := ">> 1\na\n=> nil : Nil\n>> 2b=> nil : Nil\n>> "
+	if got := buf.String(); got != want {
+		t.Errorf("wrong output. want=%q, got=%q", want, got)
+	}
+}
+
+func TestStartTimers(t *testing.T) {
+	// Due timers are called between inputs, while the others stay pending for later inputs
+	in := strings.NewReader("set_timeout(0, fn() { puts(1) }); set_interval(3600000, puts)\n" +
+		"clear_timer(2)\n")
+
+	var out bytes.Buffer
+	Start(in, &out)
+
+	want := ">> => 2 : Int\n1\n>> => true : Bool\n>> "
+	if got := out.String(); got != want {
+		t.Errorf("wrong output. want=%q, got=%q", want, got)
+	}
+}
+
+func TestStartWarnings(t *testing.T) {
+	in := strings.NewReader("if (false) { -\"a\" }\n")
+
+	var out bytes.Buffer
+	Start(in, &out)
+
+	want := "warning: unsupported type for negation: String: (-a)\n=> nil : Nil\n"
+	if got := out.String(); !strings.Contains(got, want) {
+		t.Errorf("wrong output. want to contain %q, got=%q", want, got)
+	}
+}
+
+func TestStartCompactsConstants(t *testing.T) {
+	// Functions keep working after the constants of earlier inputs are dropped, including one
+	// only a built-in function refers to
+	in := strings.NewReader(strings.Join([]string{
+		`puts("a"); let f = fn(x) { x + "!" };`,
+		`puts("b"); let g = partial(fn(a, b) { a * b + 100 }, 2);`,
+		`[1, 2, 3]`,
+		`f("hi")`,
+		`g(3)`,
+	}, "\n"))
+
+	var out bytes.Buffer
+	Start(in, &out)
+
+	want := `>> => "hi!" : String` + "\n>> => 106 : Int\n"
+	if got := out.String(); !strings.Contains(got, want) {
+		t.Errorf("wrong output. want to contain %q, got=%q", want, got)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "session")
+
+	first := strings.Join([]string{
+		`let x = [1, {"a": 2}];`,
+		`let add = fn(a) { fn(b) { a + b } };`,
+		`let inc = add(1);`,
+		`let l = len;`,
+		`let s = "monkey";`,
+		":session save " + filename,
+	}, "\n")
+
+	var out bytes.Buffer
+	Start(strings.NewReader(first), &out)
+	if strings.Contains(out.String(), "Woops!") {
+		t.Fatalf("saving session failed: %s", out.String())
+	}
+
+	second := strings.Join([]string{
+		":session load " + filename,
+		`inc(x[1]["a"])`,
+		`l(s)`,
+		`let y = 5; y + x[0]`,
+	}, "\n")
+
+	out.Reset()
+	Start(strings.NewReader(second), &out)
+
+	want := "=> 3 : Int\n>> => 6 : Int\n>> => 6 : Int\n"
+	if got := out.String(); !strings.Contains(got, want) {
+		t.Errorf("wrong output. want to contain %q, got=%q", want, got)
+	}
+}
+
+func TestSessionRelinksBuiltins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "session")
+
+	// A session saved when `len` was the last built-in function, with `let f = fn() { len(s) }`
+	var names []string
+	for _, name := range compiler.BuiltinNames() {
+		if name != "len" {
+			names = append(names, name)
+		}
+	}
+	names = append(names, "len")
+
+	var insns code.Instructions
+	for _, ins := range []code.Instructions{
+		code.Make(code.OpGetBuiltin, len(names)-1),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpCall, 1),
+		code.Make(code.OpReturnValue),
+	} {
+		insns = append(insns, ins...)
+	}
+	fn := &object.CompiledFunction{Name: "f", Instructions: insns, MaxStackDepth: 2}
+	objs := []object.Object{&object.String{Value: "monkey"}, fn, &object.Closure{Fn: fn}}
+
+	var buf bytes.Buffer
+	if err := object.Encode(&buf, objs); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gob.NewEncoder(f).Encode(savedSession{
+		Version:      compiler.Version,
+		Symbols:      []compiler.Symbol{{Name: "f", Scope: compiler.GlobalScope, Index: 0}},
+		Objects:      buf.Bytes(),
+		NumConstants: 2,
+		Builtins:     names,
+	})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	Start(strings.NewReader(":session load "+filename+"\nf()"), &out)
+	if want := "=> 6 : Int\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("wrong output. want to contain %q, got=%q", want, out.String())
+	}
+}
+
+func TestSessionErrors(t *testing.T) {
+	// Cyclic values cannot be saved
+	sess := newSession()
+	arr := &object.Array{}
+	arr.Elements = []object.Object{arr}
+	sess.globals[0] = arr
+	sess.symbolTable.Define("a")
+
+	if err := sess.save(ioutil.Discard); err == nil {
+		t.Errorf("expected error for cyclic value but resulted in none")
+	}
+
+	if _, err := loadSession(strings.NewReader("garbage")); err == nil {
+		t.Errorf("expected error for corrupted session but resulted in none")
+	}
+
+	var out bytes.Buffer
+	Start(strings.NewReader(":session load /nonexistent\n:unknown\n"), &out)
+	if got := strings.Count(out.String(), "Woops!"); got != 2 {
+		t.Errorf("wrong number of errors. want=2, got=%d in %q", got, out.String())
+	}
+}
@@ -0,0 +1,116 @@
+package repl
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/object"
+	"github.com/skatsuta/monkey-compiler/vm"
+)
+
+// session is the state of the REPL carried over from one input to the next.
+type session struct {
+	symbolTable *compiler.SymbolTable
+	constants   []object.Object
+	globals     []object.Object
+}
+
+func newSession() *session {
+	symbolTable := compiler.NewSymbolTable()
+
+	// Define built-in functions
+	for i, builtin := range object.Builtins {
+		symbolTable.DefineBuiltin(i, builtin.Name)
+	}
+
+	return &session{
+		symbolTable: symbolTable,
+		constants:   make([]object.Object, 0),
+		globals:     make([]object.Object, vm.GlobalSize),
+	}
+}
+
+// savedSession is the serialized form of a session.
+type savedSession struct {
+	Version string
+	Symbols []compiler.Symbol
+	// Objects holds the constant pool followed by the global bindings up to the last one set,
+	// encoded by object.Encode, so that closures in globals can refer to functions in the pool
+	Objects      []byte
+	NumConstants int
+	// Builtins holds the names of the built-in functions which OpGetBuiltin instructions of the
+	// compiled functions refer to by their indexes, so that they are linked by name when loaded
+	Builtins []string
+}
+
+// save writes the session to `w`.
+func (s *session) save(w io.Writer) error {
+	last := len(s.globals) - 1
+	for last >= 0 && s.globals[last] == nil {
+		last--
+	}
+
+	objs := make([]object.Object, 0, len(s.constants)+last+1)
+	objs = append(objs, s.constants...)
+	objs = append(objs, s.globals[:last+1]...)
+
+	var buf bytes.Buffer
+	if err := object.Encode(&buf, objs); err != nil {
+		return err
+	}
+
+	return gob.NewEncoder(w).Encode(savedSession{
+		Version:      compiler.Version,
+		Symbols:      s.symbolTable.Symbols(),
+		Objects:      buf.Bytes(),
+		NumConstants: len(s.constants),
+		Builtins:     compiler.BuiltinNames(),
+	})
+}
+
+// loadSession reads a session written by save from `r`.
+func loadSession(r io.Reader) (*session, error) {
+	var saved savedSession
+	if err := gob.NewDecoder(r).Decode(&saved); err != nil {
+		return nil, err
+	}
+
+	if saved.Version != compiler.Version {
+		return nil, fmt.Errorf("session version mismatch: want=%s, got=%s",
+			compiler.Version, saved.Version)
+	}
+
+	objs, err := object.Decode(bytes.NewReader(saved.Objects))
+	if err != nil {
+		return nil, err
+	}
+
+	numGlobals := len(objs) - saved.NumConstants
+	if saved.NumConstants < 0 || numGlobals < 0 || numGlobals > vm.GlobalSize {
+		return nil, fmt.Errorf("invalid number of constants: %d", saved.NumConstants)
+	}
+
+	// Closures in the global bindings share the functions in the constant pool, which are
+	// linked along with them
+	consts := objs[:saved.NumConstants:saved.NumConstants]
+	linked := &compiler.Bytecode{Constants: consts, Builtins: saved.Builtins}
+	if err := linked.LinkBuiltins(); err != nil {
+		return nil, err
+	}
+
+	s := newSession()
+	for _, sym := range saved.Symbols {
+		if sym.Scope != compiler.GlobalScope || sym.Index < 0 || sym.Index >= vm.GlobalSize {
+			return nil, fmt.Errorf("invalid symbol: %+v", sym)
+		}
+		s.symbolTable.DefineAt(sym.Name, sym.Index)
+	}
+
+	s.constants = consts
+	copy(s.globals, objs[saved.NumConstants:])
+
+	return s, nil
+}
@@ -0,0 +1,110 @@
+// Package testrunner runs tests written in Monkey. Test files are Monkey scripts whose names end
+// with `_test.mk`, and they define tests with the `test` built-in function:
+//
+//	let add = fn(a, b) { a + b };
+//	test("add", fn() { assert_eq(add(1, 2), 3); });
+//
+// Each file is run on the VM first, and then the tests it has defined are called one by one.
+package testrunner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/eval"
+	"github.com/skatsuta/monkey-compiler/lexer"
+	"github.com/skatsuta/monkey-compiler/object"
+	"github.com/skatsuta/monkey-compiler/parser"
+	"github.com/skatsuta/monkey-compiler/vm"
+)
+
+// Suffix is the suffix of names of test files.
+const Suffix = "_test.mk"
+
+// Result is the result of a test.
+type Result struct {
+	// File is the name of the file defining the test.
+	File string
+	// Name is the name of the test.
+	Name string
+	// Err is the error which made the test fail, or nil if the test passed.
+	Err error
+}
+
+// Passed reports whether the test passed.
+func (r Result) Passed() bool {
+	return r.Err == nil
+}
+
+// Find returns the names of test files in directory `dir` and its subdirectories in lexical
+// order.
+func Find(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(info.Name(), Suffix) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// RunFile runs the tests defined in file `filename`. Output printed by the file is written to
+// `w`. It returns an error if the file itself fails to run, in which case no test is run.
+func RunFile(filename string, w io.Writer) ([]Result, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return run(filename, string(data), w)
+}
+
+func run(filename, src string, w io.Writer) ([]Result, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, errors.New(strings.Join(p.Errors(), "\n"))
+	}
+
+	macroEnv := object.NewEnvironment()
+	eval.DefineMacros(program, macroEnv)
+	expanded, err := eval.ExpandMacros(program, macroEnv)
+	if err != nil {
+		return nil, fmt.Errorf("macro expansion failed: %s", err)
+	}
+
+	c := compiler.New()
+	if err := c.Compile(expanded); err != nil {
+		return nil, fmt.Errorf("compilation failed: %s", err)
+	}
+
+	machine := vm.New(c.Bytecode(), vm.WithStdout(w))
+	if err := machine.Run(); err != nil {
+		return nil, fmt.Errorf("execution failed: %s", err)
+	}
+
+	tests := machine.Tests()
+	results := make([]Result, len(tests))
+	for i, t := range tests {
+		_, err := machine.Call(t.Fn)
+		results[i] = Result{File: filename, Name: t.Name, Err: err}
+	}
+
+	return results, nil
+}
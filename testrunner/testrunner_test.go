@@ -0,0 +1,115 @@
+package testrunner
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	src := `
+	let add = fn(a, b) { a + b };
+	puts("loaded");
+	test("add", fn() { assert_eq(add(1, 2), 3); });
+	test("add arrays", fn() { assert_eq([add(1, 1), "a"], [2, "a"]); });
+	test("wrong result", fn() { assert_eq(add(1, 2), 4); puts("unreachable"); });
+	test("runtime error", fn() { add(1, "a") });
+	test("parameters", fn(x) { x });
+	`
+
+	var out bytes.Buffer
+	results, err := run("add_test.mk", src, &out)
+	if err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+
+	if got, want := out.String(), "loaded\n"; got != want {
+		t.Errorf("wrong output. want=%q, got=%q", want, got)
+	}
+
+	want := []struct {
+		name   string
+		errMsg string
+	}{
+		{"add", ""},
+		{"add arrays", ""},
+		{"wrong result", "assertion failed: got 3, want 4"},
+		{"runtime error", "unsupported types for binary operation 2: Integer and String"},
+		{"parameters", "wrong number of arguments: want=1, got=0"},
+	}
+
+	if len(results) != len(want) {
+		t.Fatalf("wrong number of results. want=%d, got=%d", len(want), len(results))
+	}
+
+	for i, r := range results {
+		if r.File != "add_test.mk" || r.Name != want[i].name {
+			t.Errorf("results[%d] has wrong test. want=%q, got=%q in %q",
+				i, want[i].name, r.Name, r.File)
+		}
+
+		var errMsg string
+		if r.Err != nil {
+			errMsg = r.Err.Error()
+		}
+		if errMsg != want[i].errMsg {
+			t.Errorf("results[%d] has wrong error. want=%q, got=%q", i, want[i].errMsg, errMsg)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	inputs := []string{
+		`test("syntax error", fn() { 1 + });`,
+		`test("undefined", fn() { foo() });`,
+		`assert_eq(1, 2); test("never defined", fn() { });`,
+	}
+
+	for _, input := range inputs {
+		if _, err := run("error_test.mk", input, ioutil.Discard); err == nil {
+			t.Errorf("expected error for %q but resulted in none", input)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testrunner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"b_test.mk",
+		"a_test.mk",
+		"lib.mk",
+		"test.mk",
+		filepath.Join("sub", "c_test.mk"),
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := Find(dir)
+	if err != nil {
+		t.Fatalf("Find failed: %s", err)
+	}
+
+	want := []string{
+		filepath.Join(dir, "a_test.mk"),
+		filepath.Join(dir, "b_test.mk"),
+		filepath.Join(dir, "sub", "c_test.mk"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong files. want=%q, got=%q", want, got)
+	}
+}
@@ -17,6 +17,8 @@ const (
 	FLOAT = "FLOAT"
 	// STRING is a token type for strings.
 	STRING = "STRING"
+	// CHAR is a token type for characters.
+	CHAR = "CHAR"
 
 	// BANG is a token type for NOT operator.
 	BANG = "!"
@@ -26,6 +28,10 @@ const (
 	PLUS = "+"
 	// MINUS is a token type for subtraction.
 	MINUS = "-"
+	// INC is a token type for increment.
+	INC = "++"
+	// DEC is a token type for decrement.
+	DEC = "--"
 	// ASTARISK is a token type for multiplication.
 	ASTARISK = "*"
 	// SLASH is a token type for division.
@@ -46,6 +52,10 @@ const (
 	AND = "&&"
 	// OR is a token type for binary OR logical operator.
 	OR = "||"
+	// IN is a token type for membership operator.
+	IN = "IN"
+	// NOT is a token type for the 'not' of non-membership operator 'not in'.
+	NOT = "NOT"
 
 	// COMMA is a token type for commas.
 	COMMA = ","
@@ -53,6 +63,10 @@ const (
 	SEMICOLON = ";"
 	// COLON is a token type for colons.
 	COLON = ":"
+	// DOT is a token type for dots.
+	DOT = "."
+	// ARROW is a token type for arrows separating patterns and values in match expressions.
+	ARROW = "=>"
 
 	// LPAREN is a token type for left parentheses.
 	LPAREN = "("
@@ -85,12 +99,19 @@ const (
 	RETURN = "RETURN"
 	// MACRO is a token type for macros.
 	MACRO = "MACRO"
+	// MATCH is a token type for match.
+	MATCH = "MATCH"
 )
 
 // Token represents a token which has a token type and literal.
 type Token struct {
 	Type    Type
 	Literal string
+	// Line and Column are the position in the source code the token starts at, counting from 1.
+	// The column counts bytes. They are 0 for tokens which are not read from source code, e.g.
+	// those of nodes made by macros.
+	Line   int
+	Column int
 }
 
 // Language keywords
@@ -104,6 +125,9 @@ var keywords = map[string]Type{
 	"else":   ELSE,
 	"return": RETURN,
 	"macro":  MACRO,
+	"in":     IN,
+	"not":    NOT,
+	"match":  MATCH,
 }
 
 // LookupIdent checks the language keywords to see whether the given identifier is a keyword.
@@ -0,0 +1,644 @@
+// Package js generates readable JavaScript programs from Monkey programs, so that scripts can
+// be shared with web projects.
+//
+// It supports the subset of Monkey which maps naturally onto JavaScript: bindings, functions
+// and closures, if expressions, arithmetic, strings, arrays, hashes (as Maps) and most built-in
+// functions. Integers are JavaScript numbers, so they neither overflow into big integers nor
+// differ from floats, and calling a function with the wrong number of arguments is not an
+// error. Macros must be expanded before generating JavaScript.
+package js
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/skatsuta/monkey-compiler/ast"
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+// indentUnit is the string indenting each level of generated code.
+const indentUnit = "  "
+
+// Generate writes a JavaScript program equivalent to `program` to `w`.
+func Generate(w io.Writer, program *ast.Program) error {
+	g := &generator{
+		declared: make(map[string]bool),
+		used:     make(map[string]bool),
+	}
+	ast.Inspect(program, g.collectDeclarations)
+
+	body, err := g.statements(program.Statements, false)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by monkey-compiler build; DO NOT EDIT.\n\n")
+	buf.WriteString("\"use strict\";\n\n")
+	buf.WriteString(g.runtime())
+	buf.WriteString(body)
+
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// generator generates JavaScript code from AST nodes.
+type generator struct {
+	// declared is the set of names bound by the program, which shadow built-in functions
+	declared map[string]bool
+	// used is the set of runtime helpers the generated code refers to
+	used map[string]bool
+
+	indent int
+	// fnDepth is the number of functions enclosing the code being generated, and iifeDepth is
+	// the number of if expressions generated as immediately invoked functions among them
+	fnDepth, iifeDepth int
+}
+
+func (g *generator) collectDeclarations(node ast.Node) bool {
+	switch node := node.(type) {
+	case *ast.LetStatement:
+		g.declared[node.Name.Value] = true
+	case *ast.FunctionLiteral:
+		for _, param := range node.Parameters {
+			g.declared[param.Value] = true
+		}
+	}
+	return true
+}
+
+// statements generates lines of code for `stmts` at the current indentation. If `tail` is
+// true, they are the body of a function, whose value is returned.
+func (g *generator) statements(stmts []ast.Statement, tail bool) (string, error) {
+	var out strings.Builder
+	for i, stmt := range stmts {
+		code, err := g.statement(stmt, tail && i == len(stmts)-1)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(code)
+	}
+
+	if tail && !returnsValue(stmts) {
+		// Functions ending with statements which have no value return nil
+		out.WriteString(g.line("return null;"))
+	}
+
+	return out.String(), nil
+}
+
+// returnsValue reports whether the last of `stmts` gives the value of a function body.
+func returnsValue(stmts []ast.Statement) bool {
+	if len(stmts) == 0 {
+		return false
+	}
+	switch stmts[len(stmts)-1].(type) {
+	case *ast.ExpressionStatement, *ast.ReturnStatement:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *generator) statement(stmt ast.Statement, tail bool) (string, error) {
+	switch stmt := stmt.(type) {
+	case *ast.LetStatement:
+		val, err := g.expression(stmt.Value)
+		if err != nil {
+			return "", err
+		}
+		// `var` is scoped to functions like bindings in Monkey, and allows them to be rebound
+		return g.line(fmt.Sprintf("var %s = %s;", g.name(stmt.Name.Value), unwrap(val))), nil
+
+	case *ast.AssignStatement:
+		return g.assignment(stmt)
+
+	case *ast.IncDecStatement:
+		return g.assignment(stmt.Assignment())
+
+	case *ast.ReturnStatement:
+		switch {
+		case g.fnDepth == 0:
+			return "", fmt.Errorf("return outside of functions is not supported: %s", stmt)
+		case g.iifeDepth != 0:
+			return "", fmt.Errorf(
+				"return in if expressions used as values is not supported: %s", stmt)
+		}
+
+		val, err := g.expression(stmt.ReturnValue)
+		if err != nil {
+			return "", err
+		}
+		return g.line(fmt.Sprintf("return %s;", unwrap(val))), nil
+
+	case *ast.ExpressionStatement:
+		if ie, ok := stmt.Expression.(*ast.IfExpression); ok {
+			return g.ifStatement(ie, tail)
+		}
+
+		expr, err := g.expression(stmt.Expression)
+		if err != nil {
+			return "", err
+		}
+		if tail {
+			return g.line(fmt.Sprintf("return %s;", unwrap(expr))), nil
+		}
+		return g.line(unwrap(expr) + ";"), nil
+
+	default:
+		return "", fmt.Errorf("unsupported statement: %s", stmt)
+	}
+}
+
+func (g *generator) assignment(stmt *ast.AssignStatement) (string, error) {
+	rhs, err := g.expression(stmt.RHS)
+	if err != nil {
+		return "", err
+	}
+
+	var coll, idx string
+	switch lhs := stmt.LHS.(type) {
+	case *ast.Ident:
+		return g.line(fmt.Sprintf("%s = %s;", g.name(lhs.Value), unwrap(rhs))), nil
+	case *ast.IndexExpression:
+		if coll, err = g.expression(lhs.Left); err != nil {
+			return "", err
+		}
+		if idx, err = g.expression(lhs.Index); err != nil {
+			return "", err
+		}
+	case *ast.FieldExpression:
+		if coll, err = g.expression(lhs.Left); err != nil {
+			return "", err
+		}
+		idx = quote(lhs.Field.Value)
+	default:
+		return "", fmt.Errorf("unsupported assignment: %s", stmt)
+	}
+
+	return g.line(fmt.Sprintf("%s(%s, %s, %s);", g.helper("setIndex"), coll, unwrap(idx), unwrap(rhs))), nil
+}
+
+// ifStatement generates an if statement from an if expression whose value is unused, or is
+// returned from a function if `tail` is true.
+func (g *generator) ifStatement(ie *ast.IfExpression, tail bool) (string, error) {
+	var out strings.Builder
+	if err := g.ifClauses(&out, ie, tail, "if"); err != nil {
+		return "", err
+	}
+	out.WriteString(g.line("}"))
+	return out.String(), nil
+}
+
+// ifClauses writes the clauses of an if statement to `out` up to its closing brace, starting
+// with `keyword`. An alternative consisting of another if expression is chained with `else if`.
+func (g *generator) ifClauses(
+	out *strings.Builder, ie *ast.IfExpression, tail bool, keyword string,
+) error {
+	cond, err := g.condition(ie.Condition)
+	if err != nil {
+		return err
+	}
+
+	out.WriteString(g.line(fmt.Sprintf("%s (%s) {", keyword, unwrap(cond))))
+	if err := g.block(out, ie.Consequence.Statements, tail); err != nil {
+		return err
+	}
+
+	switch {
+	case ie.Alternative != nil:
+		if next, ok := soleIfExpression(ie.Alternative); ok {
+			return g.ifClauses(out, next, tail, "} else if")
+		}
+		out.WriteString(g.line("} else {"))
+		return g.block(out, ie.Alternative.Statements, tail)
+	case tail:
+		// The value of an if expression without an alternative is nil if the condition is false
+		out.WriteString(g.line("} else {"))
+		return g.block(out, nil, tail)
+	default:
+		return nil
+	}
+}
+
+// soleIfExpression returns the if expression `block` consists of, if any.
+func soleIfExpression(block *ast.BlockStatement) (*ast.IfExpression, bool) {
+	if len(block.Statements) != 1 {
+		return nil, false
+	}
+	es, ok := block.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		return nil, false
+	}
+	ie, ok := es.Expression.(*ast.IfExpression)
+	return ie, ok
+}
+
+// soleExpression returns the expression `block` consists of, if any.
+func soleExpression(block *ast.BlockStatement) (ast.Expression, bool) {
+	if block == nil || len(block.Statements) != 1 {
+		return nil, false
+	}
+	es, ok := block.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		return nil, false
+	}
+	return es.Expression, true
+}
+
+// block writes `stmts` in a block to `out`, indented one level deeper.
+func (g *generator) block(out *strings.Builder, stmts []ast.Statement, tail bool) error {
+	g.indent++
+	defer func() { g.indent-- }()
+
+	code, err := g.statements(stmts, tail)
+	if err != nil {
+		return err
+	}
+	out.WriteString(code)
+	return nil
+}
+
+func (g *generator) expression(expr ast.Expression) (string, error) {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return g.identifier(expr.Value)
+	case *ast.IntegerLiteral:
+		return strconv.FormatInt(expr.Value, 10), nil
+	case *ast.FloatLiteral:
+		return strconv.FormatFloat(expr.Value, 'g', -1, 64), nil
+	case *ast.StringLiteral:
+		return quote(expr.Value), nil
+	case *ast.Boolean:
+		return strconv.FormatBool(expr.Value), nil
+	case *ast.Nil:
+		return "null", nil
+
+	case *ast.PrefixExpression:
+		switch expr.Operator {
+		case "!":
+			operand, err := g.condition(expr.Right)
+			if err != nil {
+				return "", err
+			}
+			return "!" + wrap(operand), nil
+		case "-":
+			operand, err := g.expression(expr.Right)
+			if err != nil {
+				return "", err
+			}
+			return "(-" + operand + ")", nil
+		}
+
+	case *ast.InfixExpression:
+		return g.infix(expr)
+
+	case *ast.IfExpression:
+		return g.ifExpression(expr)
+
+	case *ast.FunctionLiteral:
+		return g.function(expr)
+
+	case *ast.CallExpression:
+		return g.call(expr)
+
+	case *ast.ArrayLiteral:
+		elems, err := g.expressions(expr.Elements)
+		if err != nil {
+			return "", err
+		}
+		return "[" + strings.Join(elems, ", ") + "]", nil
+
+	case *ast.HashLiteral:
+		pairs := make([]string, 0, len(expr.Pairs))
+		for _, pair := range expr.Pairs {
+			k, err := g.expression(pair.Key)
+			if err != nil {
+				return "", err
+			}
+			v, err := g.expression(pair.Value)
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, "["+unwrap(k)+", "+unwrap(v)+"]")
+		}
+		if len(pairs) == 0 {
+			return "new Map()", nil
+		}
+		return "new Map([" + strings.Join(pairs, ", ") + "])", nil
+
+	case *ast.IndexExpression:
+		left, err := g.expression(expr.Left)
+		if err != nil {
+			return "", err
+		}
+		idx, err := g.expression(expr.Index)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s(%s, %s)", g.helper("index"), left, unwrap(idx)), nil
+
+	case *ast.FieldExpression:
+		left, err := g.expression(expr.Left)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s(%s, %s)", g.helper("index"), left, quote(expr.Field.Value)), nil
+	}
+
+	return "", fmt.Errorf("unsupported expression: %s", expr)
+}
+
+// expressions generates expressions separated by commas, e.g. arguments, from `exprs`.
+func (g *generator) expressions(exprs []ast.Expression) ([]string, error) {
+	codes := make([]string, 0, len(exprs))
+	for _, expr := range exprs {
+		code, err := g.expression(expr)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, unwrap(code))
+	}
+	return codes, nil
+}
+
+// condition generates an expression which is true if `expr` is truthy in Monkey, where only
+// false and nil are falsy, unlike in JavaScript.
+func (g *generator) condition(expr ast.Expression) (string, error) {
+	code, err := g.expression(expr)
+	if err != nil {
+		return "", err
+	}
+	if isBoolean(expr) {
+		return code, nil
+	}
+	return fmt.Sprintf("%s(%s)", g.helper("truthy"), code), nil
+}
+
+// isBoolean reports whether `expr` always evaluates to a boolean, so that its truthiness is
+// the same in Monkey and JavaScript.
+func isBoolean(expr ast.Expression) bool {
+	switch expr := expr.(type) {
+	case *ast.Boolean:
+		return true
+	case *ast.PrefixExpression:
+		return expr.Operator == "!"
+	case *ast.InfixExpression:
+		switch expr.Operator {
+		case "<", ">", "<=", ">=", "==", "!=", "in", "not in":
+			return true
+		case "&&", "||":
+			return isBoolean(expr.Left) && isBoolean(expr.Right)
+		}
+	}
+	return false
+}
+
+// jsOperators maps infix operators in Monkey to those in JavaScript which differ.
+var jsOperators = map[string]string{
+	"==": "===",
+	"!=": "!==",
+}
+
+func (g *generator) infix(expr *ast.InfixExpression) (string, error) {
+	left, err := g.expression(expr.Left)
+	if err != nil {
+		return "", err
+	}
+	right, err := g.expression(expr.Right)
+	if err != nil {
+		return "", err
+	}
+
+	switch expr.Operator {
+	case "&&", "||":
+		if isBoolean(expr) {
+			return fmt.Sprintf("(%s %s %s)", left, expr.Operator, right), nil
+		}
+		// Logical operators evaluate to one of the operands depending on their truthiness in
+		// Monkey, and the right operand is evaluated lazily
+		helper := g.helper("and")
+		if expr.Operator == "||" {
+			helper = g.helper("or")
+		}
+		return fmt.Sprintf("%s(%s, () => %s)", helper, left, right), nil
+
+	case "+", "-", "*", "/", "<", ">", "<=", ">=", "==", "!=":
+		op := expr.Operator
+		if jsOp, ok := jsOperators[op]; ok {
+			op = jsOp
+		}
+		return fmt.Sprintf("(%s %s %s)", left, op, right), nil
+
+	case "in":
+		return fmt.Sprintf("%s(%s, %s)", g.helper("contains"), unwrap(right), unwrap(left)), nil
+	case "not in":
+		return fmt.Sprintf("!%s(%s, %s)", g.helper("contains"), unwrap(right), unwrap(left)), nil
+
+	default:
+		return "", fmt.Errorf("unsupported operator: %s", expr.Operator)
+	}
+}
+
+// ifExpression generates an expression from an if expression whose value is used. It is a
+// conditional operator if the branches are single expressions, or otherwise an immediately
+// invoked function.
+func (g *generator) ifExpression(ie *ast.IfExpression) (string, error) {
+	cons, consOK := soleExpression(ie.Consequence)
+	alt, altOK := soleExpression(ie.Alternative)
+	if consOK && (altOK || ie.Alternative == nil) {
+		cond, err := g.condition(ie.Condition)
+		if err != nil {
+			return "", err
+		}
+		consCode, err := g.expression(cons)
+		if err != nil {
+			return "", err
+		}
+		altCode := "null"
+		if altOK {
+			if altCode, err = g.expression(alt); err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("(%s ? %s : %s)", cond, consCode, altCode), nil
+	}
+
+	g.iifeDepth++
+	defer func() { g.iifeDepth-- }()
+
+	var out strings.Builder
+	out.WriteString("(() => {\n")
+	g.indent++
+	code, err := g.ifStatement(ie, true)
+	g.indent--
+	if err != nil {
+		return "", err
+	}
+	out.WriteString(code)
+	out.WriteString(g.indentation() + "})()")
+	return out.String(), nil
+}
+
+func (g *generator) function(fl *ast.FunctionLiteral) (string, error) {
+	params := make([]string, 0, len(fl.Parameters))
+	for _, param := range fl.Parameters {
+		params = append(params, g.name(param.Value))
+	}
+
+	// A return statement in the function returns from the function itself even if it is in an
+	// if expression generated as an immediately invoked function outside
+	savedIIFEDepth := g.iifeDepth
+	g.fnDepth++
+	g.iifeDepth = 0
+	defer func() {
+		g.fnDepth--
+		g.iifeDepth = savedIIFEDepth
+	}()
+
+	var out strings.Builder
+	out.WriteString("function ")
+	if fl.Name != "" {
+		out.WriteString(g.name(fl.Name))
+	}
+	out.WriteString("(" + strings.Join(params, ", ") + ") {\n")
+	if err := g.block(&out, fl.Body.Statements, true); err != nil {
+		return "", err
+	}
+	out.WriteString(g.indentation() + "}")
+	return out.String(), nil
+}
+
+func (g *generator) call(ce *ast.CallExpression) (string, error) {
+	args, err := g.expressions(ce.Arguments)
+	if err != nil {
+		return "", err
+	}
+
+	switch fn := ce.Function.(type) {
+	case *ast.FieldExpression:
+		// A method is called with its receiver as the first argument
+		recv, err := g.expression(fn.Left)
+		if err != nil {
+			return "", err
+		}
+		args = append([]string{recv, quote(fn.Field.Value)}, args...)
+		return fmt.Sprintf("%s(%s)", g.helper("method"), strings.Join(args, ", ")), nil
+	}
+
+	callee, err := g.expression(ce.Function)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := ce.Function.(*ast.FunctionLiteral); ok {
+		callee = "(" + callee + ")"
+	}
+	return fmt.Sprintf("%s(%s)", callee, strings.Join(args, ", ")), nil
+}
+
+// identifier generates a reference to a binding or a built-in function named `name`.
+func (g *generator) identifier(name string) (string, error) {
+	if g.declared[name] || object.GetBuiltinByName(name) == nil {
+		return g.name(name), nil
+	}
+	if !builtins[name] {
+		return "", fmt.Errorf("built-in function %s is not supported", name)
+	}
+	return g.helper(name), nil
+}
+
+// name returns the name of a binding in JavaScript, which is suffixed with `$` if it is a
+// reserved word. Monkey identifiers never contain `$`, so it never clashes with other names.
+func (g *generator) name(name string) string {
+	if reserved[name] {
+		return name + "$"
+	}
+	return name
+}
+
+// helper returns the name of a runtime helper `name`, marking it as used.
+func (g *generator) helper(name string) string {
+	g.used[name] = true
+	return "$" + name
+}
+
+func (g *generator) indentation() string {
+	return strings.Repeat(indentUnit, g.indent)
+}
+
+// line returns a line of `code` at the current indentation.
+func (g *generator) line(code string) string {
+	return g.indentation() + code + "\n"
+}
+
+// quote returns a JavaScript string literal of `s`.
+func quote(s string) string {
+	// JSON strings are valid JavaScript string literals
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// wrap parenthesizes `code` unless it is a simple operand.
+func wrap(code string) string {
+	if strings.HasPrefix(code, "(") && strings.HasSuffix(code, ")") ||
+		strings.HasPrefix(code, "$") && strings.HasSuffix(code, ")") {
+		return code
+	}
+	for _, r := range code {
+		if !(r == '_' || r == '$' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			r >= '0' && r <= '9') {
+			return "(" + code + ")"
+		}
+	}
+	return code
+}
+
+// unwrap removes the parentheses enclosing the whole of `code`, if any, where they are
+// redundant, e.g. in arguments or conditions of if statements.
+func unwrap(code string) string {
+	if !strings.HasPrefix(code, "(") || !strings.HasSuffix(code, ")") {
+		return code
+	}
+
+	depth := 0
+	inString := false
+	for i := 0; i < len(code); i++ {
+		switch c := code[i]; {
+		case inString && c == '\\':
+			// Skip an escaped character
+			i++
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 && i != len(code)-1 {
+				// The first parenthesis is closed before the end, e.g. `(a)(b)`
+				return code
+			}
+		}
+	}
+	return code[1 : len(code)-1]
+}
+
+// reserved is the set of reserved words and global names in JavaScript which may be
+// identifiers in Monkey.
+var reserved = map[string]bool{
+	"arguments": true, "await": true, "break": true, "case": true, "catch": true,
+	"class": true, "const": true, "continue": true, "debugger": true, "default": true,
+	"delete": true, "do": true, "else": true, "enum": true, "eval": true, "export": true,
+	"extends": true, "false": true, "finally": true, "for": true, "function": true,
+	"if": true, "implements": true, "import": true, "in": true, "instanceof": true,
+	"interface": true, "let": true, "new": true, "null": true, "package": true,
+	"private": true, "protected": true, "public": true, "return": true, "static": true,
+	"super": true, "switch": true, "this": true, "throw": true, "true": true, "try": true,
+	"typeof": true, "var": true, "void": true, "while": true, "with": true, "yield": true,
+	"undefined": true, "NaN": true, "Infinity": true, "Map": true, "Array": true,
+	"Number": true, "String": true, "Error": true, "console": true, "process": true,
+}
@@ -0,0 +1,170 @@
+package js
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/ast"
+	"github.com/skatsuta/monkey-compiler/lexer"
+	"github.com/skatsuta/monkey-compiler/parser"
+)
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`let a = 1; a = a + 2.5`, "var a = 1;\na = a + 2.5;\n"},
+		{`let s = "C:\monkey"; s`, "var s = \"C:\\\\monkey\";\ns;\n"},
+		{`[1, nil, true][0] == 1`, "$index([1, null, true], 0) === 1;\n"},
+		{`let h = {"a": 1}; h.a = 2; h["b"]`,
+			"var h = new Map([[\"a\", 1]]);\n$setIndex(h, \"a\", 2);\n$index(h, \"b\");\n"},
+		{`let h = {}; h.f(1)`, "var h = new Map();\n$method(h, \"f\", 1);\n"},
+		{`let add = fn(a, b) { a + b }`, "var add = function add(a, b) {\n  return a + b;\n};\n"},
+		{`let f = fn() { let x = 1; }`,
+			"var f = function f() {\n  var x = 1;\n  return null;\n};\n"},
+		{
+			`let f = fn(x) { if (x) { 1 } else { if (x == 0) { 2 } } }`,
+			"var f = function f(x) {\n" +
+				"  if ($truthy(x)) {\n" +
+				"    return 1;\n" +
+				"  } else if (x === 0) {\n" +
+				"    return 2;\n" +
+				"  } else {\n" +
+				"    return null;\n" +
+				"  }\n" +
+				"};\n",
+		},
+		{`let x = if (1 < 2) { "a" }`, "var x = (1 < 2) ? \"a\" : null;\n"},
+		{`!(1 < 2) && !nil || 0`, "$or((!(1 < 2) && !$truthy(null)), () => 0);\n"},
+		// Names which are reserved in JavaScript and those shadowing built-in functions
+		{`let new = fn(len) { len(new) }`,
+			"var new$ = function new$(len) {\n  return len(new$);\n};\n"},
+		{`len("a")`, "$len(\"a\");\n"},
+		{`'a' + 1`, "97 + 1;\n"},
+		{`1 not in [1]`, "!$contains([1], 1);\n"},
+		{`let i = 0; i++`, "var i = 0;\ni = i + 1;\n"},
+	}
+
+	for _, tt := range tests {
+		got := generate(t, tt.input)
+		if i := strings.Index(got, "\"use strict\";\n\n"); i >= 0 {
+			got = got[i+len("\"use strict\";\n\n"):]
+		}
+		// Skip the definitions of runtime helpers
+		if i := strings.LastIndex(got, "}\n\n"); i >= 0 {
+			got = got[i+len("}\n\n"):]
+		}
+
+		if got != tt.want {
+			t.Errorf("wrong code for %q.\nwant=%q\ngot=%q", tt.input, tt.want, got)
+		}
+	}
+}
+
+func TestGenerateRuntime(t *testing.T) {
+	got := generate(t, `len([1]); 1 || 2`)
+
+	// Only the helpers used and their dependencies are defined
+	for _, name := range []string{"len", "or", "truthy", "inspect"} {
+		if !strings.Contains(got, "function $"+name+"(") {
+			t.Errorf("helper %s is not defined:\n%s", name, got)
+		}
+	}
+	for _, name := range []string{"index", "puts"} {
+		if strings.Contains(got, "function $"+name+"(") {
+			t.Errorf("unused helper %s is defined:\n%s", name, got)
+		}
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`return 1`, "return outside of functions is not supported: return 1;"},
+		{
+			`fn() { let x = if (true) { return 1; 2 } }`,
+			"return in if expressions used as values is not supported: return 1;",
+		},
+		{`freeze([])`, "built-in function freeze is not supported"},
+		{`let f = big`, "built-in function big is not supported"},
+	}
+
+	for _, tt := range tests {
+		program := parse(t, tt.input)
+
+		err := Generate(&bytes.Buffer{}, program)
+		if err == nil {
+			t.Errorf("expected error for %q but got none", tt.input)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.want, err)
+		}
+	}
+}
+
+func TestRunWithNode(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+
+	input := `
+	let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+	let sign = fn(n) { if (n < 0) { "-" } else { if (n == 0) { "0" } else { "+" } } };
+	let h = {"name": "monkey", "greet": fn(self, x) { "hi " + x + " from " + self.name }};
+	h["age"] = 3;
+	let f = fn() { let x = if (true) { let y = 1; y + 1 } else { 0 }; x };
+	let or = fn(x) { x || "default" };
+	puts(fib(15), sign(-1), sign(0), sign(1), h.greet("you"), h);
+	puts([1, 2.5, "x", nil], len("héllo"), "abc"[1], [1][5], f(), fn() {}());
+	puts(or(nil), or(0), !nil, 1 / 2, rest([1, 2, 3]), set([1, 2], 0, 9), push([1], 2));
+	puts(chr('a' + 1), ord("é"), [1] in [[1]], "b" in h, "ell" not in "hello");
+	print("a", 1);
+	assert_eq([1, {"a": 2}], [1, {"a": 2}]);
+	`
+
+	cmd := exec.Command(node)
+	cmd.Stdin = strings.NewReader(generate(t, input))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("node failed: %s\n%s", err, out)
+	}
+
+	want := strings.Join([]string{
+		"610", "-", "0", "+", "hi you from monkey", "{name: monkey, greet: fn, age: 3}",
+		"[1, 2.5, x, nil]", "5", "b", "nil", "2", "nil",
+		"default", "0", "true", "0.5", "[2, 3]", "[9, 2]", "[1, 2]",
+		"b", "233", "true", "false", "false",
+		"a1",
+	}, "\n")
+	if got := string(out); got != want {
+		t.Errorf("wrong output.\nwant=%q\ngot=%q", want, got)
+	}
+}
+
+func generate(t *testing.T, input string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := Generate(&buf, parse(t, input)); err != nil {
+		t.Fatalf("failed to generate JavaScript: %s", err)
+	}
+	return buf.String()
+}
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) != 0 {
+		t.Fatalf("parser errors: %v", errs)
+	}
+	return program
+}
@@ -0,0 +1,214 @@
+package js
+
+import "strings"
+
+// helper is a function generated JavaScript programs use to emulate the semantics of Monkey.
+type helper struct {
+	name string
+	// deps are the names of other helpers the helper calls
+	deps []string
+	code string
+}
+
+// helpers are defined in generated programs in this order if they are used.
+var helpers = []helper{
+	{"truthy", nil, `function $truthy(v) {
+  return v !== false && v !== null && v !== undefined;
+}`},
+	{"inspect", nil, `function $inspect(v) {
+  if (v === null || v === undefined) {
+    return "nil";
+  }
+  if (Array.isArray(v)) {
+    return "[" + v.map($inspect).join(", ") + "]";
+  }
+  if (v instanceof Map) {
+    return "{" + Array.from(v, ([key, val]) => $inspect(key) + ": " + $inspect(val)).join(", ") + "}";
+  }
+  if (typeof v === "function") {
+    return "fn";
+  }
+  return String(v);
+}`},
+	{"equal", nil, `function $equal(a, b) {
+  if (Array.isArray(a) && Array.isArray(b)) {
+    return a.length === b.length && a.every((el, i) => $equal(el, b[i]));
+  }
+  if (a instanceof Map && b instanceof Map) {
+    return a.size === b.size && Array.from(a).every(([key, val]) => b.has(key) && $equal(val, b.get(key)));
+  }
+  return a === b;
+}`},
+	{"contains", []string{"equal", "inspect"}, `function $contains(coll, el) {
+  if (Array.isArray(coll)) {
+    return coll.some((v) => $equal(v, el));
+  }
+  if (coll instanceof Map) {
+    return coll.has(el);
+  }
+  if (typeof coll === "string" && typeof el === "string") {
+    return coll.includes(el);
+  }
+  throw new TypeError("in operator not supported: " + $inspect(coll));
+}`},
+	{"index", []string{"inspect"}, `function $index(coll, i) {
+  if (coll instanceof Map) {
+    return coll.has(i) ? coll.get(i) : null;
+  }
+  if (Array.isArray(coll) && Number.isInteger(i)) {
+    return i >= 0 && i < coll.length ? coll[i] : null;
+  }
+  if (typeof coll === "string" && Number.isInteger(i)) {
+    const chars = Array.from(coll);
+    return i >= 0 && i < chars.length ? chars[i] : null;
+  }
+  throw new TypeError("index operator not supported: " + $inspect(coll));
+}`},
+	{"setIndex", []string{"inspect"}, `function $setIndex(coll, i, val) {
+  if (coll instanceof Map) {
+    coll.set(i, val);
+    return;
+  }
+  if (Array.isArray(coll) && Number.isInteger(i)) {
+    if (i < 0 || i >= coll.length) {
+      throw new RangeError("array index " + i + " out of range");
+    }
+    coll[i] = val;
+    return;
+  }
+  throw new TypeError("index operator not supported: " + $inspect(coll));
+}`},
+	{"method", []string{"index"}, `function $method(recv, name, ...args) {
+  return $index(recv, name)(recv, ...args);
+}`},
+	{"and", []string{"truthy"}, `function $and(left, right) {
+  return $truthy(left) ? right() : left;
+}`},
+	{"or", []string{"truthy"}, `function $or(left, right) {
+  return $truthy(left) ? left : right();
+}`},
+
+	// Built-in functions
+	{"len", []string{"inspect"}, `function $len(v) {
+  if (typeof v === "string") {
+    return Array.from(v).length;
+  }
+  if (Array.isArray(v)) {
+    return v.length;
+  }
+  throw new TypeError("argument to len not supported, got " + $inspect(v));
+}`},
+	{"puts", []string{"inspect"}, `function $puts(...args) {
+  args.forEach((arg) => console.log($inspect(arg)));
+  return null;
+}`},
+	{"print", []string{"inspect"}, `function $print(...args) {
+  const s = args.map($inspect).join("");
+  if (typeof process !== "undefined" && process.stdout) {
+    process.stdout.write(s);
+  } else {
+    console.log(s);
+  }
+  return null;
+}`},
+	{"first", nil, `function $first(arr) {
+  return arr.length > 0 ? arr[0] : null;
+}`},
+	{"last", nil, `function $last(arr) {
+  return arr.length > 0 ? arr[arr.length - 1] : null;
+}`},
+	{"rest", nil, `function $rest(arr) {
+  return arr.length > 0 ? arr.slice(1) : null;
+}`},
+	{"push", nil, `function $push(arr, el) {
+  return [...arr, el];
+}`},
+	{"clone", nil, `function $clone(v) {
+  if (Array.isArray(v)) {
+    return v.map($clone);
+  }
+  if (v instanceof Map) {
+    return new Map(Array.from(v, ([key, val]) => [key, $clone(val)]));
+  }
+  return v;
+}`},
+	{"slice", nil, `function $slice(arr, start, end) {
+  if (start < 0 || start > end || end > arr.length) {
+    throw new RangeError("slice bounds out of range [" + start + ":" + end + "] with length " + arr.length);
+  }
+  return arr.slice(start, end);
+}`},
+	{"to_str", []string{"inspect"}, `function $to_str(v) {
+  return $inspect(v);
+}`},
+	{"assert_eq", []string{"equal", "inspect"}, `function $assert_eq(got, want) {
+  if (!$equal(got, want)) {
+    throw new Error("assertion failed: got " + $inspect(got) + ", want " + $inspect(want));
+  }
+  return null;
+}`},
+	{"assert", []string{"truthy", "inspect"}, `function $assert(cond, message) {
+  if ($truthy(cond)) {
+    return null;
+  }
+  throw new Error(message === undefined ? "assertion failed" : "assertion failed: " + $inspect(message));
+}`},
+	{"panic", []string{"inspect"}, `function $panic(message) {
+  throw new Error("panic: " + $inspect(message));
+}`},
+	{"chr", nil, `function $chr(code) {
+  return String.fromCodePoint(code);
+}`},
+	{"ord", nil, `function $ord(s) {
+  const chars = Array.from(s);
+  if (chars.length !== 1) {
+    throw new TypeError("argument to ord must be a single character, got " + JSON.stringify(s));
+  }
+  return chars[0].codePointAt(0);
+}`},
+	{"set", []string{"setIndex"}, `function $set(coll, i, val) {
+  const copy = coll instanceof Map ? new Map(coll) : Array.from(coll);
+  $setIndex(copy, i, val);
+  return copy;
+}`},
+}
+
+// builtins is the set of built-in functions generated programs support. The others, such as
+// `freeze` and `big`, have no counterpart in JavaScript.
+var builtins = map[string]bool{
+	"len": true, "puts": true, "print": true, "first": true, "last": true, "rest": true,
+	"push": true, "clone": true, "slice": true, "to_str": true, "assert_eq": true,
+	"assert": true, "panic": true, "set": true, "chr": true, "ord": true,
+}
+
+// runtime returns the definitions of the helpers the generated code uses, including the ones
+// they depend on.
+func (g *generator) runtime() string {
+	var mark func(name string)
+	mark = func(name string) {
+		g.used[name] = true
+		for _, h := range helpers {
+			if h.name == name {
+				for _, dep := range h.deps {
+					mark(dep)
+				}
+			}
+		}
+	}
+	var names []string
+	for name := range g.used {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		mark(name)
+	}
+
+	var out strings.Builder
+	for _, h := range helpers {
+		if g.used[h.name] {
+			out.WriteString(h.code)
+			out.WriteString("\n\n")
+		}
+	}
+	return out.String()
+}
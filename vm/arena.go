@@ -0,0 +1,40 @@
+package vm
+
+import "github.com/skatsuta/monkey-compiler/object"
+
+// arenaChunkSize is the number of objects of each type an arena allocates at once.
+const arenaChunkSize = 256
+
+// arena allocates integers and strings in chunks rather than one by one, which reduces the
+// number of allocations the garbage collector has to track.
+//
+// An object keeps the whole chunk it is allocated in alive as long as it is referenced, so an
+// arena suits short-lived programs which produce many temporary values.
+type arena struct {
+	ints    []object.Integer
+	strings []object.String
+}
+
+func (a *arena) newInteger(v int64) *object.Integer {
+	// Appending within the capacity never moves objects allocated before
+	if len(a.ints) == cap(a.ints) {
+		a.ints = make([]object.Integer, 0, arenaChunkSize)
+	}
+	a.ints = append(a.ints, object.Integer{Value: v})
+	return &a.ints[len(a.ints)-1]
+}
+
+func (a *arena) newString(s string) *object.String {
+	if len(a.strings) == cap(a.strings) {
+		a.strings = make([]object.String, 0, arenaChunkSize)
+	}
+	a.strings = append(a.strings, object.String{Value: s})
+	return &a.strings[len(a.strings)-1]
+}
+
+// release drops the chunks being allocated from, so that they can be collected once the
+// objects in them are no longer referenced.
+func (a *arena) release() {
+	a.ints = nil
+	a.strings = nil
+}
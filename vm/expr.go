@@ -0,0 +1,54 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+// Expr is an expression compiled with variables whose values the host binds on each
+// evaluation, e.g. a rule evaluated against many records. It is compiled once and never
+// modified, so it can be shared by VMs on different goroutines.
+type Expr struct {
+	fn   *object.CompiledFunction
+	vars []string
+}
+
+// CompileExpr compiles source code `src` of a single expression which can refer to variables
+// named `vars` as well as built-in functions.
+func CompileExpr(src string, vars ...string) (*Expr, error) {
+	fn, err := compiler.CompileExpr(src, vars...)
+	if err != nil {
+		return nil, err
+	}
+	return &Expr{fn: fn, vars: vars}, nil
+}
+
+// Vars returns the names of the variables the expression can refer to.
+func (e *Expr) Vars() []string {
+	return e.vars
+}
+
+// Eval evaluates `expr` with its variables bound to the values in `vars`, which are converted
+// by object.FromGo; passing objects avoids the conversion when the same values are bound
+// repeatedly. Every variable must be bound, while values for other names are ignored.
+//
+// The variables are stored in the first slots of the globals store of `vm`, so a VM evaluating
+// expressions should not run programs, e.g. one created by `New(&compiler.Bytecode{})`.
+func (vm *VM) Eval(expr *Expr, vars map[string]interface{}) (object.Object, error) {
+	for i, name := range expr.vars {
+		v, ok := vars[name]
+		if !ok {
+			return nil, fmt.Errorf("variable %q is not bound", name)
+		}
+
+		obj, err := object.FromGo(v)
+		if err != nil {
+			return nil, fmt.Errorf("variable %q: %s", name, err)
+		}
+		vm.globals[i] = obj
+	}
+
+	return vm.CallFunction(expr.fn)
+}
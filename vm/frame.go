@@ -15,7 +15,7 @@ type Frame struct {
 	bp int
 }
 
-// NewFrame creates a new stack frame for a given compiled function.
+// NewFrame creates a new stack frame for a closure `cl` with a base pointer `bp`.
 func NewFrame(cl *object.Closure, bp int) *Frame {
 	return &Frame{cl: cl, ip: -1, bp: bp}
 }
@@ -24,3 +24,27 @@ func NewFrame(cl *object.Closure, bp int) *Frame {
 func (f *Frame) Instructions() code.Instructions {
 	return f.cl.Fn.Instructions
 }
+
+// Closure returns the closure the stack frame is created for, which holds the free variables
+// OpGetFree retrieves.
+func (f *Frame) Closure() *object.Closure {
+	return f.cl
+}
+
+// Fn returns the compiled function of the closure the stack frame is created for.
+func (f *Frame) Fn() *object.CompiledFunction {
+	return f.cl.Fn
+}
+
+// IP returns the instruction pointer, which is the offset of the last byte of the instruction
+// being executed, or -1 if execution of the frame has not started yet. For a frame calling
+// another function, it is the offset of the operand of the OpCall instruction.
+func (f *Frame) IP() int {
+	return f.ip
+}
+
+// BasePointer returns the index of the bottom of the stack frame on the stack, where its local
+// bindings start.
+func (f *Frame) BasePointer() int {
+	return f.bp
+}
@@ -0,0 +1,154 @@
+package vm
+
+import "github.com/skatsuta/monkey-compiler/object"
+
+// Approximate sizes in bytes used to account for memory allocated by the VM.
+const (
+	// objectSize is the size of an object apart from its elements or characters
+	objectSize = 32
+	// elementSize is the size of an element of an array or a free variable of a closure
+	elementSize = 16
+	// pairSize is the size of a key-value pair in a hash, including the overhead of the map
+	pairSize = 64
+)
+
+// sizeOf returns the approximate number of bytes `obj` itself occupies, not counting the objects
+// it refers to. Objects of a fixed size other than closures, e.g. integers, are not counted, as
+// a program cannot accumulate them without storing them into arrays, hashes or closures.
+func sizeOf(obj object.Object) int64 {
+	switch obj := obj.(type) {
+	case *object.String:
+		return objectSize + int64(len(obj.Value))
+	case *object.Bytes:
+		return objectSize + int64(len(obj.Value))
+	case object.ArrayObject:
+		return objectSize + elementSize*int64(obj.Len())
+	case object.HashObject:
+		return objectSize + pairSize*int64(obj.Len())
+	case *object.Closure:
+		return objectSize + elementSize*int64(len(obj.Free))
+	default:
+		return 0
+	}
+}
+
+// newObjectsSize returns the approximate number of bytes occupied by objects reachable from
+// `result` but not from `args`, i.e. the objects a built-in function called with `args` has
+// allocated for its result.
+//
+// The arguments are only walked if `result` is a new array, hash or closure, so that calling a
+// built-in function returning e.g. an integer or one of its arguments takes constant time
+// however large the arguments are. A new string or byte array is counted without walking them;
+// if it was in fact taken from one of the arguments it is counted twice until the memory is
+// recounted by allocate.
+func newObjectsSize(result object.Object, args []object.Object) int64 {
+	for _, arg := range args {
+		if result == arg {
+			return 0
+		}
+	}
+
+	switch result.(type) {
+	case *object.String, *object.Bytes:
+		return sizeOf(result)
+	case object.ArrayObject, object.HashObject, *object.Closure:
+	default:
+		// Other objects are not counted
+		return 0
+	}
+
+	seen := make(map[object.Object]bool)
+	for _, arg := range args {
+		walkObjects(arg, seen, func(object.Object) {})
+	}
+
+	var size int64
+	walkObjects(result, seen, func(obj object.Object) {
+		size += sizeOf(obj)
+	})
+	return size
+}
+
+// walkObjects calls `f` with `obj` and the objects reachable from it which are not in `seen`,
+// adding them to `seen`.
+func walkObjects(obj object.Object, seen map[object.Object]bool, f func(object.Object)) {
+	switch obj.(type) {
+	case *object.String, *object.Bytes, object.ArrayObject, object.HashObject, *object.Closure:
+	default:
+		// Other objects neither refer to others nor are counted
+		return
+	}
+
+	if seen[obj] {
+		return
+	}
+	seen[obj] = true
+	f(obj)
+
+	switch obj := obj.(type) {
+	case object.ArrayObject:
+		for i := 0; i < obj.Len(); i++ {
+			walkObjects(obj.Get(i), seen, f)
+		}
+	case object.HashObject:
+		obj.Range(func(_ object.HashKey, pair object.HashPair) {
+			walkObjects(pair.Key, seen, f)
+			walkObjects(pair.Value, seen, f)
+		})
+	case *object.Closure:
+		for _, free := range obj.Free {
+			walkObjects(free, seen, f)
+		}
+	}
+}
+
+// allocate accounts for `size` bytes allocated by the VM if memory is limited by WithMaxMemory.
+// It must be called after the allocated objects are made reachable, e.g. pushed on to the stack.
+//
+// Once the bytes allocated exceed the limit, they are recounted from the objects still reachable
+// by the program, and ErrOutOfMemory is returned if the limit is still exceeded.
+func (vm *VM) allocate(size int64) error {
+	if !vm.memoryLimited {
+		return nil
+	}
+
+	vm.memory += size
+	if vm.memory <= vm.maxMemory {
+		return nil
+	}
+
+	vm.memory = vm.liveMemory()
+	if vm.memory > vm.maxMemory {
+		return ErrOutOfMemory
+	}
+	return nil
+}
+
+// liveMemory returns the approximate number of bytes occupied by the objects reachable from
+// the stack, the global bindings, the closures being executed and the tests defined so far, and
+// by the strings the VM has interned.
+func (vm *VM) liveMemory() int64 {
+	seen := make(map[object.Object]bool)
+
+	size := vm.internedBytes
+	count := func(obj object.Object) {
+		size += sizeOf(obj)
+	}
+
+	for _, obj := range vm.stack[:vm.sp] {
+		walkObjects(obj, seen, count)
+	}
+	for _, obj := range vm.globals {
+		if obj != nil {
+			walkObjects(obj, seen, count)
+		}
+	}
+	for _, f := range vm.frames[:vm.framesIdx] {
+		walkObjects(f.cl, seen, count)
+	}
+	for _, t := range vm.tests {
+		walkObjects(t.Fn, seen, count)
+	}
+
+	return size
+}
@@ -0,0 +1,137 @@
+package vm
+
+import (
+	"os"
+	"sync"
+
+	"github.com/skatsuta/monkey-compiler/compiler"
+)
+
+// Pool keeps VMs which have finished running programs, so that they can be reused to run the
+// same programs again without allocating their stacks, frames and globals stores, e.g. in a
+// server running a script for each request. Programs are identified by their bytecode. A Pool
+// is safe for concurrent use.
+//
+// The pool keeps the bytecode given to Get and its idle VMs until Forget is called with it, so
+// a program which stops running some bytecode, e.g. because the script is edited and compiled
+// again, should call Forget with it for them to be garbage collected.
+type Pool struct {
+	opts []Option
+
+	mu       sync.Mutex
+	programs map[*compiler.Bytecode]*pooledProgram
+}
+
+// pooledProgram is the set of idle VMs for a program.
+type pooledProgram struct {
+	vms sync.Pool
+	// numGlobals is the number of slots of the globals store the program can use
+	numGlobals int
+	// forgotten reports whether the program has been removed from the pool by Forget, after
+	// which VMs running it are no longer kept. It is guarded by the mutex of the pool.
+	forgotten bool
+}
+
+// NewPool creates a new Pool which configures the VMs with `opts`.
+func NewPool(opts ...Option) *Pool {
+	return &Pool{
+		opts:     opts,
+		programs: make(map[*compiler.Bytecode]*pooledProgram),
+	}
+}
+
+// Get returns a VM which runs `bytecode` from the start with empty global bindings. It is
+// configured with the options of the pool followed by `opts`, e.g. WithStdout to capture the
+// output of each run.
+func (p *Pool) Get(bytecode *compiler.Bytecode, opts ...Option) *VM {
+	prog := p.program(bytecode)
+
+	vm, ok := prog.vms.Get().(*VM)
+	if !ok {
+		vm = New(bytecode)
+		vm.pooled = prog
+	} else {
+		vm.Reset(bytecode)
+		vm.resetPooled(prog.numGlobals)
+	}
+
+	for _, opt := range p.opts {
+		opt(vm)
+	}
+	for _, opt := range opts {
+		opt(vm)
+	}
+	return vm
+}
+
+// Put returns `vm` taken by Get to the pool. The caller must not use the VM afterwards, while
+// objects it has returned stay valid. VMs not taken from a pool, or running bytecode the pool
+// has forgotten, are ignored.
+func (p *Pool) Put(vm *VM) {
+	if vm.pooled == nil {
+		return
+	}
+
+	p.mu.Lock()
+	forgotten := vm.pooled.forgotten
+	p.mu.Unlock()
+	if !forgotten {
+		vm.pooled.vms.Put(vm)
+	}
+}
+
+// Forget removes `bytecode` and the idle VMs running it from the pool. VMs taken for it before
+// are not returned to the pool by Put. Calling Get with it again adds it to the pool afresh.
+func (p *Pool) Forget(bytecode *compiler.Bytecode) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if prog, ok := p.programs[bytecode]; ok {
+		prog.forgotten = true
+		delete(p.programs, bytecode)
+	}
+}
+
+func (p *Pool) program(bytecode *compiler.Bytecode) *pooledProgram {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if prog, ok := p.programs[bytecode]; ok {
+		return prog
+	}
+
+	// Programs whose global bindings are unknown, e.g. made by hand, may use all of the slots
+	numGlobals := GlobalSize
+	if bytecode.Globals != nil {
+		numGlobals = 0
+		for _, idx := range bytecode.Globals {
+			if idx >= numGlobals {
+				numGlobals = idx + 1
+			}
+		}
+	}
+
+	prog := &pooledProgram{numGlobals: numGlobals}
+	p.programs[bytecode] = prog
+	return prog
+}
+
+// resetPooled clears the first `numGlobals` global bindings of the VM, drops its pending timers
+// and restores the default configuration, all of which Reset keeps.
+func (vm *VM) resetPooled(numGlobals int) {
+	globals := vm.globals[:numGlobals]
+	for i := range globals {
+		globals[i] = nil
+	}
+	vm.timers = nil
+
+	vm.overflowMode = OverflowWrap
+	vm.stdout = os.Stdout
+	vm.fuel, vm.fuelLimited = 0, false
+	vm.maxMemory, vm.memoryLimited = 0, false
+	vm.arena = nil
+	vm.persistent = false
+	vm.logger = nil
+	// Capabilities granted to a run must not leak to the next one, which may run another script
+	vm.allowed = nil
+}
@@ -0,0 +1,142 @@
+package vm
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+// timer is a function of the program scheduled to be called by RunEventLoop.
+type timer struct {
+	id int64
+	// due is when the function is called next
+	due time.Time
+	// interval is the period of the calls, or zero if the function is called only once
+	interval time.Duration
+	fn       object.Object
+}
+
+// timerQueue is a priority queue of timers ordered by when they are due, where timers due at the
+// same time are ordered by when they were scheduled. It implements heap.Interface.
+type timerQueue []*timer
+
+func (q timerQueue) Len() int { return len(q) }
+
+func (q timerQueue) Less(i, j int) bool {
+	if !q[i].due.Equal(q[j].due) {
+		return q[i].due.Before(q[j].due)
+	}
+	return q[i].id < q[j].id
+}
+
+func (q timerQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *timerQueue) Push(x interface{}) { *q = append(*q, x.(*timer)) }
+
+func (q *timerQueue) Pop() interface{} {
+	old := *q
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return t
+}
+
+// Schedule schedules a function `fn` to be called by RunEventLoop after `delay`, and then every
+// `delay` if `repeat` is true. It returns an ID of the timer. It makes VM satisfy
+// object.Scheduler interface.
+func (vm *VM) Schedule(delay time.Duration, fn object.Object, repeat bool) int64 {
+	vm.lastTimerID++
+	t := &timer{id: vm.lastTimerID, due: time.Now().Add(delay), fn: fn}
+	if repeat {
+		t.interval = delay
+	}
+	heap.Push(&vm.timers, t)
+	return t.id
+}
+
+// Cancel cancels the timer of `id` and reports whether it was scheduled. It makes VM satisfy
+// object.Scheduler interface.
+func (vm *VM) Cancel(id int64) bool {
+	for i, t := range vm.timers {
+		if t.id == id {
+			heap.Remove(&vm.timers, i)
+			return true
+		}
+	}
+	return false
+}
+
+// RunEventLoop calls the functions scheduled by the `set_timeout` and `set_interval` built-in
+// functions when they are due, waiting for them in between, until no timers are left. It is
+// meant to be called after Run, so that the program can do things asynchronously after its main
+// part has run. It stops at the first error a function fails with.
+func (vm *VM) RunEventLoop() error {
+	_, err := vm.RunUntil(func() bool { return false })
+	return err
+}
+
+// RunUntil calls scheduled functions as RunEventLoop does until `done` returns true, and reports
+// whether it does before no timers are left. It makes VM satisfy object.Scheduler interface, so
+// that the `await` built-in function can run the event loop while it waits for a future.
+func (vm *VM) RunUntil(done func() bool) (bool, error) {
+	for !done() {
+		if len(vm.timers) == 0 {
+			return false, nil
+		}
+
+		if wait := time.Until(vm.timers[0].due); wait > 0 {
+			sleep := time.NewTimer(wait)
+			select {
+			case <-sleep.C:
+			case <-vm.interruptCh:
+				sleep.Stop()
+				return false, ErrInterrupted
+			}
+		}
+
+		if err := vm.callNextTimer(); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// RunDueTimers calls the scheduled functions which are already due as RunEventLoop does, but
+// returns without waiting for the others, which stay scheduled. It lets a host go on with its
+// own work while timers are pending, e.g. the REPL calls the functions due between inputs.
+func (vm *VM) RunDueTimers() error {
+	now := time.Now()
+	for len(vm.timers) > 0 && !vm.timers[0].due.After(now) {
+		if err := vm.callNextTimer(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PendingTimers returns the number of timers scheduled but not yet called, including repeating
+// ones.
+func (vm *VM) PendingTimers() int {
+	return len(vm.timers)
+}
+
+// callNextTimer calls the function of the timer due first.
+func (vm *VM) callNextTimer() error {
+	t := vm.timers[0]
+
+	// A repeating timer is scheduled again before the call, so that the function can cancel it.
+	// Calls missed while other functions ran late are skipped rather than made at once.
+	if t.interval > 0 {
+		t.due = t.due.Add(t.interval)
+		if now := time.Now(); t.due.Before(now) {
+			t.due = now.Add(t.interval)
+		}
+		heap.Fix(&vm.timers, 0)
+	} else {
+		heap.Pop(&vm.timers)
+	}
+
+	_, err := vm.Call(t.fn)
+	return err
+}
@@ -0,0 +1,191 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+// Verify checks that `bytecode` is well-formed, so that the VM can run it without failing with
+// an InternalError. It reports an error for undefined opcodes, truncated instructions, jumps
+// which do not land on an instruction of the same function, operands referring to constants,
+// global or local bindings, free variables or built-in functions which do not exist, functions
+// whose instructions run past their end, and paths through instructions which underflow the
+// stack or reach the same instruction with different stack depths.
+//
+// The compiler always produces bytecode which passes it, so it is meant for bytecode from other
+// sources, e.g. files which may be corrupted.
+func Verify(bytecode *compiler.Bytecode) error {
+	v := &verifier{
+		consts:  bytecode.Constants,
+		numFree: make(map[*object.CompiledFunction]int),
+	}
+
+	main := &object.CompiledFunction{
+		Instructions:  bytecode.Instructions,
+		MaxStackDepth: bytecode.MaxStackDepth,
+	}
+	if err := v.verifyFunction(main, true); err != nil {
+		return fmt.Errorf("main program: %s", err)
+	}
+	return nil
+}
+
+// verifier verifies functions in the constant pool `consts` of a program.
+type verifier struct {
+	consts []object.Object
+	// numFree maps the functions verified so far to the numbers of free variables they use
+	numFree map[*object.CompiledFunction]int
+}
+
+// verifyFunction verifies the instructions of a function `fn`, and then those of the functions
+// it creates closures of. `isMain` tells that it is the main program, which has no local
+// bindings and ends by running past its last instruction instead of returning.
+func (v *verifier) verifyFunction(fn *object.CompiledFunction, isMain bool) error {
+	insns := fn.Instructions
+	if !isMain && len(insns) == 0 {
+		return fmt.Errorf("function has no instructions")
+	}
+	if fn.NumParameters < 0 || fn.MaxStackDepth < 0 || fn.MaxStackDepth > StackSize {
+		return fmt.Errorf("function declares invalid sizes: %d parameters, stack depth %d",
+			fn.NumParameters, fn.MaxStackDepth)
+	}
+	if fn.NumParameters > fn.NumLocals {
+		return fmt.Errorf("function has %d parameters but %d local bindings",
+			fn.NumParameters, fn.NumLocals)
+	}
+
+	// The first pass decodes instructions and checks their operands except for the functions
+	// of closures, which are checked once the number of free variables used by this function is
+	// known, in case it creates a closure of itself
+	starts := make([]bool, len(insns)+1)
+	var jumps, closures []int
+	numFree, last := 0, 0
+
+	for ip := 0; ip < len(insns); {
+		def, err := code.Lookup(insns[ip])
+		if err != nil {
+			return fmt.Errorf("%04d: %s", ip, err)
+		}
+
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if ip+1+width > len(insns) {
+			return fmt.Errorf("%04d: %s is truncated", ip, def.Name)
+		}
+		operands, _ := code.ReadOperands(def, insns[ip+1:])
+
+		op := code.Opcode(insns[ip])
+		if err := v.checkOperands(fn, isMain, op, def, operands); err != nil {
+			return fmt.Errorf("%04d: %s", ip, err)
+		}
+
+		switch op {
+		case code.OpJump, code.OpJumpNotTruthy, code.OpJumpTruthy:
+			jumps = append(jumps, ip)
+		case code.OpClosure:
+			closures = append(closures, ip)
+		case code.OpGetFree:
+			if operands[0]+1 > numFree {
+				numFree = operands[0] + 1
+			}
+		}
+
+		starts[ip], last = true, ip
+		ip += 1 + width
+	}
+
+	// Only the main program can end by running past its last instruction or jumping to its end
+	starts[len(insns)] = isMain
+	for _, ip := range jumps {
+		target := int(code.ReadUint16(insns[ip+1:]))
+		if target > len(insns) || !starts[target] {
+			return fmt.Errorf("%04d: jump to %04d does not land on an instruction", ip, target)
+		}
+	}
+	// Jumps cannot land on the end of a function, so only its last instruction can run past it
+	if !isMain {
+		switch code.Opcode(insns[last]) {
+		case code.OpReturn, code.OpReturnValue, code.OpJump:
+		default:
+			return fmt.Errorf("%04d: control runs past the end of the function", last)
+		}
+	}
+
+	depth, err := compiler.MaxStackDepth(insns)
+	if err != nil {
+		return err
+	}
+	if depth > fn.MaxStackDepth {
+		return fmt.Errorf("stack depth %d exceeds the maximum %d", depth, fn.MaxStackDepth)
+	}
+
+	v.numFree[fn] = numFree
+	for _, ip := range closures {
+		constIdx := int(code.ReadUint16(insns[ip+1:]))
+		closureFree := int(code.ReadUint8(insns[ip+3:]))
+
+		cf := v.consts[constIdx].(*object.CompiledFunction)
+		if _, ok := v.numFree[cf]; !ok {
+			if err := v.verifyFunction(cf, false); err != nil {
+				return fmt.Errorf("function %d: %s", constIdx, err)
+			}
+		}
+		if v.numFree[cf] > closureFree {
+			return fmt.Errorf("%04d: function %d uses %d free variables but is given %d",
+				ip, constIdx, v.numFree[cf], closureFree)
+		}
+	}
+
+	return nil
+}
+
+// checkOperands checks that `operands` of an instruction `op` of a function `fn` refer to what
+// exists.
+func (v *verifier) checkOperands(
+	fn *object.CompiledFunction, isMain bool, op code.Opcode, def *code.Definition,
+	operands []int,
+) error {
+	switch op {
+	case code.OpConstant:
+		if operands[0] >= len(v.consts) {
+			return fmt.Errorf("constant %d does not exist", operands[0])
+		}
+	case code.OpGetMethod:
+		if operands[0] >= len(v.consts) {
+			return fmt.Errorf("constant %d does not exist", operands[0])
+		}
+		if _, ok := v.consts[operands[0]].(*object.String); !ok {
+			return fmt.Errorf("constant %d is not a method name", operands[0])
+		}
+	case code.OpClosure:
+		if operands[0] >= len(v.consts) {
+			return fmt.Errorf("constant %d does not exist", operands[0])
+		}
+		if _, ok := v.consts[operands[0]].(*object.CompiledFunction); !ok {
+			return fmt.Errorf("constant %d is not a function", operands[0])
+		}
+	case code.OpGetGlobal, code.OpSetGlobal:
+		if operands[0] >= GlobalSize {
+			return fmt.Errorf("global binding %d does not exist", operands[0])
+		}
+	case code.OpGetLocal, code.OpSetLocal, code.OpGetLocalWide, code.OpSetLocalWide:
+		if operands[0] >= fn.NumLocals {
+			return fmt.Errorf("local binding %d does not exist", operands[0])
+		}
+	case code.OpGetBuiltin:
+		if operands[0] >= len(object.Builtins) {
+			return fmt.Errorf("built-in function %d does not exist", operands[0])
+		}
+	case code.OpGetFree, code.OpCurrentClosure, code.OpReturn:
+		// The main program is not a closure, and it returns only a value
+		if isMain {
+			return fmt.Errorf("%s is not allowed in the main program", def.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/skatsuta/monkey-compiler/code"
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/object"
+)
+
+func TestVerify(t *testing.T) {
+	inputs := []string{
+		"",
+		"1 + 2; let x = [1, 2]; x[0]",
+		"let f = fn(a, b) { if (a) { return b; } a }; f(true, 1)",
+		`let newAdder = fn(x) { fn(y) { x + y } }; newAdder(1)(2); puts("x")`,
+		"let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(5)",
+		`let p = {"x": 1, "get": fn(self) { self.x }}; p.get()`,
+		"match [1, 2] { [x, y] => x + y, _ => 0 }",
+		"if (true) { return 1; }",
+	}
+
+	for _, input := range inputs {
+		c := compiler.New(compiler.WithKeepLastValue())
+		if err := c.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		if err := Verify(c.Bytecode()); err != nil {
+			t.Errorf("bytecode of %q is rejected: %s", input, err)
+		}
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	fn := func(numLocals int, src string) *object.CompiledFunction {
+		return &object.CompiledFunction{
+			Instructions:  mustAssemble(t, src),
+			NumLocals:     numLocals,
+			MaxStackDepth: 2,
+		}
+	}
+	consts := []object.Object{
+		&object.Integer{Value: 1},
+		fn(1, "OpGetLocal 0\nOpReturnValue"),
+		fn(0, "OpGetFree 1\nOpReturnValue"),
+		fn(0, "OpNil\nOpPop"),
+		fn(0, "OpGetLocal 0\nOpReturnValue"),
+		fn(0, "OpJump 1\nOpReturn"),
+	}
+
+	tests := []struct {
+		insns string
+		want  string
+	}{
+		{"OpConstant 0\nOpPop\n", ""},
+		{"OpConstant 6", "0000: constant 6 does not exist"},
+		{"OpClosure 0 0", "0000: constant 0 is not a function"},
+		{"OpClosure 1 0\nOpPop", ""},
+		{"OpClosure 2 1", "stack underflow at 0000: OpClosure"},
+		{"OpNil\nOpClosure 2 1\nOpPop", "0001: function 2 uses 2 free variables but is given 1"},
+		{"OpClosure 3 0", "function 3: 0001: control runs past the end of the function"},
+		{"OpClosure 4 0", "function 4: 0000: local binding 0 does not exist"},
+		{"OpClosure 5 0", "function 5: 0000: jump to 0001 does not land on an instruction"},
+		{"OpGetLocal 0", "0000: local binding 0 does not exist"},
+		{"OpGetBuiltin 255", "0000: built-in function 255 does not exist"},
+		{"OpReturn", "0000: OpReturn is not allowed in the main program"},
+		{"OpGetFree 0", "0000: OpGetFree is not allowed in the main program"},
+		{"OpAdd", "stack underflow at 0000: OpAdd"},
+		{"OpTrue\nOpJumpNotTruthy end\nOpNil\nend:\nOpPop", "inconsistent stack depth"},
+		{"OpTrue\nOpJump 2", "0001: jump to 0002 does not land on an instruction"},
+		{"OpTrue\nOpJump 100", "0001: jump to 0100 does not land on an instruction"},
+	}
+
+	for _, tt := range tests {
+		bytecode := &compiler.Bytecode{
+			Instructions:  mustAssemble(t, tt.insns),
+			Constants:     consts,
+			MaxStackDepth: 2,
+		}
+		err := Verify(bytecode)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%q is rejected: %s", tt.insns, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("wrong error for %q. want=%q, got=%v", tt.insns, tt.want, err)
+		}
+	}
+
+	// Truncated instructions and undefined opcodes cannot be written in the assembly format
+	malformed := []struct {
+		insns code.Instructions
+		want  string
+	}{
+		{code.Instructions{byte(code.OpConstant), 0}, "main program: 0000: OpConstant is truncated"},
+		{code.Instructions{255}, "main program: 0000: opcode 255 undefined"},
+	}
+	for _, tt := range malformed {
+		err := Verify(&compiler.Bytecode{Instructions: tt.insns, Constants: consts})
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("wrong error for %v. want=%q, got=%v", tt.insns, tt.want, err)
+		}
+	}
+}
+
+// FuzzVM runs arbitrary instructions which pass Verify on the VM with a constant pool of a
+// compiled program, and checks that the VM never fails with an InternalError. Run it with
+// `go test ./vm -fuzz FuzzVM`.
+func FuzzVM(f *testing.F) {
+	c := compiler.New()
+	err := c.Compile(parse(`
+	let add = fn(a, b) { let c = a + b; c };
+	let adder = fn(x) { fn(y) { x + y } };
+	let p = {"x": 1, "get": fn(self) { self.x }};
+	[add(1, 2), adder(1)(2), p.get(), "s" + "t", 1.5 * 2, match [1] { [x] => x }];
+	`))
+	if err != nil {
+		f.Fatalf("compiler error: %s", err)
+	}
+	seed := c.Bytecode()
+
+	f.Add([]byte(seed.Instructions))
+	f.Add([]byte(mustAssemble(f, "OpConstant 0\nOpConstant 1\nOpCall 1\nOpPop")))
+	f.Add([]byte(mustAssemble(f, "OpGetBuiltin 0\nOpArray 0\nOpCall 1\nOpReturnValue")))
+
+	f.Fuzz(func(t *testing.T, insns []byte) {
+		bytecode := &compiler.Bytecode{
+			Instructions:  insns,
+			Constants:     seed.Constants,
+			MaxStackDepth: StackSize,
+		}
+		if Verify(bytecode) != nil {
+			return
+		}
+
+		vm := New(bytecode, WithFuel(10000), WithStdout(&strings.Builder{}))
+		if err, ok := vm.Run().(*InternalError); ok {
+			t.Fatalf("internal error running\n%s: %s", code.Instructions(insns), err)
+		}
+	})
+}
+
+func mustAssemble(tb testing.TB, src string) code.Instructions {
+	tb.Helper()
+
+	insns, err := code.Assemble(src)
+	if err != nil {
+		tb.Fatalf("failed to assemble: %s", err)
+	}
+	return insns
+}
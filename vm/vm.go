@@ -1,8 +1,16 @@
 package vm
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/skatsuta/monkey-compiler/code"
 	"github.com/skatsuta/monkey-compiler/compiler"
@@ -14,7 +22,7 @@ const (
 	StackSize = 2048
 
 	// GlobalSize is an upper limit of the number of global bindings the VM can support.
-	GlobalSize = 1 << 16 // 16 bits
+	GlobalSize = compiler.MaxGlobals
 
 	// MaxFrames is the maximum number of stack frames.
 	MaxFrames = 1024
@@ -22,54 +30,395 @@ const (
 
 var (
 	// True is the boolean `true` value.
-	True = &object.Boolean{Value: true}
+	True = object.True
 	// False is the boolean `false` value.
-	False = &object.Boolean{Value: false}
+	False = object.False
 	// Nil represents the zero value.
-	Nil = &object.Nil{}
+	Nil = object.NilValue
 )
 
 // VM is a virtual machine which interprets and executes bytecode instructions.
 type VM struct {
 	consts []object.Object
+	// closures holds the closures created so far for functions without free variables, indexed
+	// by the constants of the functions
+	closures []*object.Closure
 
 	stack []object.Object
 	// Stack pointer always points to the *next* slot on the stack. Top of stack is stack[sp-1].
 	sp int
+	// stackHigh bounds the part of the stack used so far, which Reset clears
+	stackHigh int
 
 	// globals store
 	globals []object.Object
 
 	frames    []*Frame
 	framesIdx int
+
+	overflowMode OverflowMode
+
+	// stdout is a writer to which built-in functions print output
+	stdout io.Writer
+
+	// fuel is the number of instructions the VM can still execute if fuelLimited is true
+	fuel        int64
+	fuelLimited bool
+
+	// memory is the approximate number of bytes allocated by the VM, which is accounted for only
+	// if memoryLimited is true
+	memory        int64
+	maxMemory     int64
+	memoryLimited bool
+
+	// tests defined by the `test` built-in function
+	tests []Test
+
+	// arena allocates integers and strings produced by the VM if it is not nil
+	arena *arena
+
+	// persistent makes array and hash literals create persistent arrays and hashes
+	persistent bool
+
+	// result is the value of the main program returned by Result
+	result object.Object
+
+	// strings interns strings produced at runtime which are used as hash keys, so that their
+	// hash keys are computed once and share the same underlying strings. internedBytes is the
+	// number of bytes they occupy.
+	strings       map[string]*object.String
+	internedBytes int64
+
+	// pooled is the program the VM belongs to if it is taken from a Pool
+	pooled *pooledProgram
+
+	// logger logs function calls if it is not nil
+	logger compiler.Logger
+
+	// allowed is the set of capabilities granted to built-in functions
+	allowed map[object.Capability]bool
+
+	// timers are the functions scheduled to be called by RunEventLoop
+	timers      timerQueue
+	lastTimerID int64
+
+	// interrupted is set to non-zero by Interrupt from any goroutine, which also closes
+	// interruptCh once to wake the event loop up
+	interrupted   int32
+	interruptCh   chan struct{}
+	interruptOnce *sync.Once
+}
+
+// Test is a test defined by the `test` built-in function.
+type Test struct {
+	Name string
+	Fn   object.Object
+}
+
+// ErrOutOfFuel is returned by Run when the VM has executed as many instructions as the fuel
+// given by WithFuel allows.
+var ErrOutOfFuel = errors.New("out of fuel: too many instructions executed")
+
+// ErrInterrupted is returned by Run and Call when the VM has been stopped by Interrupt.
+var ErrInterrupted = errors.New("interrupted")
+
+// ErrOutOfMemory is returned by Run when the objects the program keeps exceed the memory limit
+// given by WithMaxMemory.
+var ErrOutOfMemory = errors.New("out of memory: memory limit exceeded")
+
+// ErrStackOverflow is returned by Run when the program calls functions too deeply or runs out
+// of room on the stack.
+var ErrStackOverflow = errors.New("stack overflow")
+
+// TypeMismatchError is returned by Run when a binary operator `Op` is applied to operands of
+// types it does not support, e.g. an integer and a string.
+type TypeMismatchError struct {
+	Op          code.Opcode
+	Left, Right object.Type
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("unsupported types for binary operation %d: %s and %s",
+		e.Op, e.Left, e.Right)
+}
+
+// PanicError is returned by Run when the program panics with the `panic` built-in function.
+type PanicError struct {
+	Message string
+	// StackTrace describes the functions being executed when the program panicked, from the
+	// innermost one to the main program.
+	StackTrace []string
+}
+
+func (e *PanicError) Error() string {
+	var out strings.Builder
+	out.WriteString("panic: ")
+	out.WriteString(e.Message)
+	writeStackTrace(&out, e.StackTrace)
+	return out.String()
+}
+
+// writeStackTrace writes a stack trace returned by stackTrace to `out` after an error message.
+func writeStackTrace(out *strings.Builder, trace []string) {
+	out.WriteString("\n\nstack trace:")
+	for _, f := range trace {
+		out.WriteString("\n\t")
+		out.WriteString(f)
+	}
+}
+
+// abortError is returned by Run when a built-in function aborts the program because of an error
+// `err`, e.g. ErrInterrupted in a function it calls back. It wraps `err`, so that the error can
+// still be told with errors.Is and errors.As.
+type abortError struct {
+	message string
+	err     error
+}
+
+func (e *abortError) Error() string {
+	return e.message
+}
+
+func (e *abortError) Unwrap() error {
+	return e.err
+}
+
+// InternalError is returned by Run and Call when the VM panics while executing an instruction,
+// which indicates a bug in the VM or malformed bytecode rather than an error in the program.
+type InternalError struct {
+	// Op is the opcode of the instruction being executed
+	Op code.Opcode
+	// IP is the instruction pointer in the function being executed when the VM panicked
+	IP int
+	// Function is the name of the function being executed, which is empty for the main program
+	// and anonymous functions
+	Function string
+	// Value is the value the VM panicked with
+	Value interface{}
+}
+
+func (e *InternalError) Error() string {
+	name := "unknown opcode"
+	if def, err := code.Lookup(byte(e.Op)); err == nil {
+		name = def.Name
+	}
+
+	fn := e.Function
+	if fn == "" {
+		fn = "<main or anonymous>"
+	}
+	return fmt.Sprintf("internal error: %v (executing %s at %04d in %s)", e.Value, name, e.IP, fn)
+}
+
+// OverflowMode represents how the VM behaves when integer arithmetic overflows.
+type OverflowMode int
+
+const (
+	// OverflowWrap makes integer arithmetic silently wrap around on overflow. This is the default.
+	OverflowWrap OverflowMode = iota
+	// OverflowError makes integer arithmetic return a runtime error on overflow.
+	OverflowError
+	// OverflowPromote makes integer arithmetic promote the result to an arbitrary-precision
+	// integer (BigInt) on overflow.
+	OverflowPromote
+)
+
+// Option is a functional option to configure a VM.
+type Option func(*VM)
+
+// WithOverflowMode sets how the VM handles integer overflow.
+func WithOverflowMode(mode OverflowMode) Option {
+	return func(vm *VM) {
+		vm.overflowMode = mode
+	}
+}
+
+// WithStdout sets a writer to which built-in functions such as `puts` and `print` print output.
+// It defaults to the standard output.
+func WithStdout(w io.Writer) Option {
+	return func(vm *VM) {
+		vm.stdout = w
+	}
+}
+
+// WithFuel limits the number of instructions the VM executes to `fuel`, so that untrusted
+// programs cannot run forever.
+func WithFuel(fuel int64) Option {
+	return func(vm *VM) {
+		vm.fuel = fuel
+		vm.fuelLimited = true
+	}
+}
+
+// WithMaxMemory limits the memory occupied by arrays, hashes, strings, byte arrays and closures
+// the program creates to approximately `bytes` bytes, so that untrusted programs cannot exhaust
+// the memory of the process embedding the VM.
+func WithMaxMemory(bytes int64) Option {
+	return func(vm *VM) {
+		vm.maxMemory = bytes
+		vm.memoryLimited = true
+	}
+}
+
+// WithArena makes the VM allocate integers and strings produced during execution in chunks,
+// which are released when Run finishes. It reduces pressure on the garbage collector when
+// running many short scripts, e.g. in a server, at the cost of keeping a chunk in memory as
+// long as any object in it is referenced.
+func WithArena() Option {
+	return func(vm *VM) {
+		vm.arena = &arena{}
+	}
+}
+
+// WithPersistentCollections makes array and hash literals create arrays and hashes backed by
+// persistent tries rather than slices and maps. Deriving a new array or hash from one with the
+// `push`, `rest`, `slice` and `set` built-in functions then takes O(log n) time and shares most
+// of the elements with the original, which suits programs which build up collections
+// functionally, at the cost of slower indexing.
+func WithPersistentCollections() Option {
+	return func(vm *VM) {
+		vm.persistent = true
+	}
+}
+
+// WithLogger makes the VM log pushing stack frames and calling built-in functions to `logger`,
+// e.g. to diagnose scripts in production. Logging slows down function calls considerably.
+func WithLogger(logger compiler.Logger) Option {
+	return func(vm *VM) {
+		vm.logger = logger
+	}
+}
+
+// WithCapabilities grants capabilities `caps` to built-in functions, e.g. object.CapExec to let
+// `exec` run external commands. No capabilities are granted by default, so programs can access
+// the system only through the standard output.
+func WithCapabilities(caps ...object.Capability) Option {
+	return func(vm *VM) {
+		if vm.allowed == nil {
+			vm.allowed = make(map[object.Capability]bool, len(caps))
+		}
+		for _, c := range caps {
+			vm.allowed[c] = true
+		}
+	}
 }
 
 // New creates a new VM instance which executes the given bytecode.
-func New(bytecode *compiler.Bytecode) *VM {
-	return NewWithGlobalStore(bytecode, make([]object.Object, GlobalSize))
+func New(bytecode *compiler.Bytecode, opts ...Option) *VM {
+	return NewWithGlobalStore(bytecode, make([]object.Object, GlobalSize), opts...)
 }
 
 // NewWithGlobalStore creates a new VM instance which executes the given bytecode with the
 // given globals store.
-func NewWithGlobalStore(bytecode *compiler.Bytecode, globals []object.Object) *VM {
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
+func NewWithGlobalStore(
+	bytecode *compiler.Bytecode, globals []object.Object, opts ...Option,
+) *VM {
+	mainFn := &object.CompiledFunction{
+		Instructions:  bytecode.Instructions,
+		MaxStackDepth: bytecode.MaxStackDepth,
+		Lines:         bytecode.Lines,
+	}
 	mainClosure := &object.Closure{Fn: mainFn}
 	mainFrame := NewFrame(mainClosure, 0) // Base pointer points to zero
 
 	frames := make([]*Frame, MaxFrames)
 	frames[0] = mainFrame
 
-	return &VM{
+	vm := &VM{
 		consts: bytecode.Constants,
 
-		stack: make([]object.Object, StackSize),
-		sp:    0,
+		stack:     make([]object.Object, StackSize),
+		sp:        0,
+		stackHigh: bytecode.MaxStackDepth,
 
 		globals: globals,
 
 		frames:    frames,
 		framesIdx: 1,
+
+		stdout: os.Stdout,
+
+		interruptCh:   make(chan struct{}),
+		interruptOnce: &sync.Once{},
+	}
+
+	for _, opt := range opts {
+		opt(vm)
+	}
+
+	return vm
+}
+
+// Reset rewinds the VM to run `bytecode` from the start, reusing its stack and frames rather
+// than allocating them again, e.g. to run many programs one after another. Only the part of the
+// stack used so far is cleared.
+//
+// Global bindings, pending timers and the configuration given by options are kept, so that
+// programs compiled with a shared symbol table can build on the bindings of those run before,
+// as in a REPL. The fuel used so far is not refilled.
+func (vm *VM) Reset(bytecode *compiler.Bytecode) {
+	used := vm.stack[:vm.stackHigh]
+	for i := range used {
+		used[i] = nil
+	}
+	vm.sp = 0
+	vm.stackHigh = bytecode.MaxStackDepth
+
+	// Frames are pushed one after another, so the ones used so far precede the first nil
+	for i := 1; i < len(vm.frames) && vm.frames[i] != nil; i++ {
+		vm.frames[i] = nil
+	}
+	mainFn := &object.CompiledFunction{
+		Instructions:  bytecode.Instructions,
+		MaxStackDepth: bytecode.MaxStackDepth,
+		Lines:         bytecode.Lines,
 	}
+	vm.frames[0] = NewFrame(&object.Closure{Fn: mainFn}, 0)
+	vm.framesIdx = 1
+
+	// Closures are cached by the indices of their constants, which are valid only for the
+	// constant pool they were created from
+	if !sameObjects(vm.consts, bytecode.Constants) {
+		vm.consts = bytecode.Constants
+		vm.closures = nil
+	}
+
+	vm.memory = vm.internedBytes
+	vm.tests = nil
+	vm.result = nil
+
+	if atomic.LoadInt32(&vm.interrupted) != 0 {
+		atomic.StoreInt32(&vm.interrupted, 0)
+		vm.interruptCh, vm.interruptOnce = make(chan struct{}), &sync.Once{}
+	}
+}
+
+// sameObjects reports whether `a` and `b` are the same slice.
+func sameObjects(a, b []object.Object) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// Stdout returns a writer to which built-in functions print output. It makes VM satisfy
+// object.Host interface.
+func (vm *VM) Stdout() io.Writer {
+	return vm.stdout
+}
+
+// Allows reports whether built-in functions may use a capability `c`. It makes VM satisfy
+// object.Sandbox interface.
+func (vm *VM) Allows(c object.Capability) bool {
+	return vm.allowed[c]
+}
+
+// AddTest registers a test function `fn` named `name`. It makes VM satisfy object.TestHost
+// interface.
+func (vm *VM) AddTest(name string, fn object.Object) {
+	vm.tests = append(vm.tests, Test{Name: name, Fn: fn})
+}
+
+// Tests returns the tests defined by the program so far.
+func (vm *VM) Tests() []Test {
+	return vm.tests
 }
 
 // StackTop returns an object on top of the stack.
@@ -80,22 +429,200 @@ func (vm *VM) StackTop() object.Object {
 	return vm.stack[vm.sp-1]
 }
 
-// LastPoppedStackElem returns an object which was popped off the stack most recently.
+// LastPoppedStackElem returns an object which was popped off the stack most recently. It peeks
+// at the slot just past the top of the stack, so it is meaningful only right after an object
+// is popped.
+//
+// Deprecated: The slot is free to be reused, e.g. by calls after Run. Use Result or ReturnValue
+// to get the value of the program.
 func (vm *VM) LastPoppedStackElem() object.Object {
 	// vm.sp always points to the *next free* slot in vm.stack
 	return vm.stack[vm.sp]
 }
 
+// Result returns the value of the main program after Run has finished: the value of the last
+// statement if it is an expression statement, or the returned value if the program ends with a
+// return statement at the top level. It returns nil if the program ends with another kind of
+// statement, e.g. a let statement, has no statements, or has not finished successfully.
+func (vm *VM) Result() object.Object {
+	return vm.result
+}
+
+// ReturnValue returns the value on top of the stack after Run has finished successfully, which
+// a main program compiled with compiler.WithKeepLastValue leaves there if it ends with an
+// expression statement, or the value returned by a return statement at the top level. For a
+// program compiled without the option, it is the same as Result.
+func (vm *VM) ReturnValue() object.Object {
+	if vm.sp > 0 {
+		return vm.stack[vm.sp-1]
+	}
+	return vm.result
+}
+
+// Frames returns the stack frames of the functions being executed, from the main program to
+// the innermost function. If Run or Call has failed, they are the frames at the point of the
+// failure.
+func (vm *VM) Frames() []*Frame {
+	frames := make([]*Frame, vm.framesIdx)
+	copy(frames, vm.frames[:vm.framesIdx])
+	return frames
+}
+
+// CurrentFrame returns the stack frame of the innermost function being executed.
+func (vm *VM) CurrentFrame() *Frame {
+	return vm.currentFrame()
+}
+
+// Locals returns a copy of the local bindings of a stack frame `f`, including its parameters,
+// which are indexed as by OpGetLocal.
+func (vm *VM) Locals(f *Frame) []object.Object {
+	locals := make([]object.Object, f.Fn().NumLocals)
+	copy(locals, vm.stack[f.bp:])
+	return locals
+}
+
 // Run executes bytecode instructions.
 func (vm *VM) Run() error {
+	if vm.arena != nil {
+		defer vm.arena.release()
+	}
+	return vm.run(0)
+}
+
+// RunContext executes bytecode instructions as Run does, but stops them once `ctx` is done, e.g.
+// cancelled or past its deadline, in which case it returns the error of `ctx`.
+func (vm *VM) RunContext(ctx context.Context) error {
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			vm.Interrupt()
+		case <-stop:
+		}
+	}()
+
+	err := vm.Run()
+	// The VM may be reset once this returns, so Interrupt must not be running
+	close(stop)
+	<-stopped
+	if errors.Is(err, ErrInterrupted) && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Interrupt stops the VM from executing instructions, so that Run, Call and RunEventLoop
+// return ErrInterrupted as soon as possible, e.g. when the user presses Ctrl-C. It may be called
+// from any goroutine. Built-in functions waiting for connections or data, i.e. `serve`,
+// `tcp_accept` and `tcp_recv`, stop waiting, and the VM stops once they return. Other built-in
+// functions being called are not stopped. The VM stays interrupted until Reset.
+func (vm *VM) Interrupt() {
+	atomic.StoreInt32(&vm.interrupted, 1)
+	vm.interruptOnce.Do(func() { close(vm.interruptCh) })
+}
+
+// Interrupted returns a channel which is closed once the VM is interrupted by Interrupt. It makes
+// VM satisfy object.Interruptible interface.
+func (vm *VM) Interrupted() <-chan struct{} {
+	return vm.interruptCh
+}
+
+// Call calls a function `fn` with arguments `args` and returns its result. It is meant to be
+// used to call functions defined by the program after Run has finished, e.g. to run tests, or by
+// built-in functions taking functions as arguments while the program runs. It makes VM satisfy
+// object.Caller interface.
+func (vm *VM) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	sp, framesIdx := vm.sp, vm.framesIdx
+
+	result, err := vm.call(fn, args)
+	if err != nil {
+		// Discard what is left by the failed call
+		vm.sp, vm.framesIdx = sp, framesIdx
+		return nil, err
+	}
+	return result, nil
+}
+
+// CallFunction calls a function `fn` compiled on its own, e.g. by compiler.CompileExpr, with
+// arguments `args` and returns its result. The function is executed with its own constant
+// pool, so the VM can be created with an empty bytecode and reused to call it repeatedly.
+func (vm *VM) CallFunction(
+	fn *object.CompiledFunction, args ...object.Object,
+) (object.Object, error) {
+	if fn.Constants != nil {
+		// Closures cached by the VM are indexed by constants, so they are swapped as well
+		consts, closures := vm.consts, vm.closures
+		vm.consts, vm.closures = fn.Constants, nil
+		defer func() { vm.consts, vm.closures = consts, closures }()
+	}
+	return vm.Call(&object.Closure{Fn: fn}, args...)
+}
+
+func (vm *VM) call(fn object.Object, args []object.Object) (object.Object, error) {
+	framesIdx := vm.framesIdx
+
+	if err := vm.push(fn); err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		if err := vm.push(arg); err != nil {
+			return nil, err
+		}
+	}
+	if vm.sp > vm.stackHigh {
+		vm.stackHigh = vm.sp
+	}
+
+	if err := vm.execCall(len(args)); err != nil {
+		return nil, err
+	}
+	// Calling a closure pushes a new frame, which is executed until it returns
+	if vm.framesIdx > framesIdx {
+		if err := vm.run(framesIdx); err != nil {
+			return nil, err
+		}
+	}
+
+	return vm.pop(), nil
+}
+
+// run executes bytecode instructions until the end of the main program, or until the frame
+// stack shrinks to `depth` frames.
+//
+// The current frame, its instructions and its instruction pointer are kept in local variables,
+// which are updated only when a function is called or returns. The instruction pointer is
+// written back to the frame before calling a function, including before operators and index
+// expressions which may call methods of hashes, and when run returns, so that it is up to date
+// in the frame stack.
+//
+// A panic during execution, which can only be caused by a bug in the VM or malformed bytecode,
+// is recovered and returned as an InternalError, so that it never crashes the host program.
+func (vm *VM) run(depth int) (err error) {
 	frame := vm.currentFrame()
 	insns := frame.Instructions()
+	ip := frame.ip
+	var op code.Opcode
+	defer func() {
+		frame.ip = ip
+		if r := recover(); r != nil {
+			err = &InternalError{Op: op, IP: ip, Function: frame.Fn().Name, Value: r}
+		}
+	}()
 
-	for frame.ip < len(insns)-1 {
-		frame.ip++
+	for ip < len(insns)-1 {
+		if atomic.LoadInt32(&vm.interrupted) != 0 {
+			return ErrInterrupted
+		}
+		if vm.fuelLimited {
+			if vm.fuel == 0 {
+				return ErrOutOfFuel
+			}
+			vm.fuel--
+		}
 
-		ip := frame.ip
-		op := code.Opcode(insns[ip])
+		ip++
+		op = code.Opcode(insns[ip])
 
 		switch op {
 		case code.OpConstant:
@@ -103,7 +630,7 @@ func (vm *VM) Run() error {
 			constIdx := code.ReadUint16(insns[ip+1:])
 			// Because the operand is 2-byte width and we already read it,
 			// increment the pointer by 2 (bytes)
-			frame.ip += 2
+			ip += 2
 
 			if err := vm.push(vm.consts[constIdx]); err != nil {
 				return err
@@ -124,9 +651,18 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+		case code.OpConcatN:
+			numOperands := int(code.ReadUint8(insns[ip+1:]))
+			ip++
+
+			frame.ip = ip
+			if err := vm.execConcatN(numOperands); err != nil {
+				return err
+			}
+
 		case code.OpArray:
 			numElems := int(code.ReadUint16(insns[ip+1:]))
-			frame.ip += 2
+			ip += 2
 
 			startIdx := vm.sp - numElems
 			arr := vm.buildArray(startIdx, vm.sp)
@@ -135,10 +671,13 @@ func (vm *VM) Run() error {
 			if err := vm.push(arr); err != nil {
 				return err
 			}
+			if err := vm.allocate(sizeOf(arr)); err != nil {
+				return err
+			}
 
 		case code.OpHash:
 			numElems := int(code.ReadUint16(insns[ip+1:]))
-			frame.ip += 2
+			ip += 2
 
 			startIdx := vm.sp - numElems
 			hash, err := vm.buildHash(startIdx, vm.sp)
@@ -150,6 +689,48 @@ func (vm *VM) Run() error {
 			if err := vm.push(hash); err != nil {
 				return err
 			}
+			if err := vm.allocate(sizeOf(hash)); err != nil {
+				return err
+			}
+
+		case code.OpArrayAppend:
+			numElems := int(code.ReadUint16(insns[ip+1:]))
+			ip += 2
+
+			startIdx := vm.sp - numElems
+			arr, err := vm.appendElements(vm.stack[startIdx-1], startIdx, vm.sp)
+			if err != nil {
+				return err
+			}
+			vm.sp = startIdx - 1
+
+			if err := vm.push(arr); err != nil {
+				return err
+			}
+			if err := vm.allocate(elementSize * int64(numElems)); err != nil {
+				return err
+			}
+
+		case code.OpHashAppend:
+			numElems := int(code.ReadUint16(insns[ip+1:]))
+			ip += 2
+
+			startIdx := vm.sp - numElems
+			hash, ok := vm.stack[startIdx-1].(object.HashObject)
+			if !ok {
+				return fmt.Errorf("cannot add pairs to %s", vm.stack[startIdx-1].Type())
+			}
+			if hash.IsFrozen() {
+				return fmt.Errorf("cannot modify frozen %s", hash.Type())
+			}
+			if err := vm.setPairs(hash, startIdx, vm.sp); err != nil {
+				return err
+			}
+			vm.sp = startIdx
+
+			if err := vm.allocate(pairSize * int64(numElems/2)); err != nil {
+				return err
+			}
 
 		case code.OpSetIndex:
 			val := vm.pop()
@@ -164,6 +745,7 @@ func (vm *VM) Run() error {
 			idx := vm.pop()
 			left := vm.pop()
 
+			frame.ip = ip
 			if err := vm.execGetIndexExpr(left, idx); err != nil {
 				return err
 			}
@@ -181,12 +763,36 @@ func (vm *VM) Run() error {
 				return err
 			}
 
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		case code.OpAdd:
+			// Fast path for the most common case of adding two integers, which replaces the
+			// left operand on the stack with the sum in place, unless the sum overflows
+			if vm.sp >= 2 {
+				left, lok := vm.stack[vm.sp-2].(*object.Integer)
+				right, rok := vm.stack[vm.sp-1].(*object.Integer)
+				if lok && rok {
+					sum := left.Value + right.Value
+					// The sum overflows iff both operands have a sign different from the sum
+					if (left.Value^sum)&(right.Value^sum) >= 0 {
+						vm.sp--
+						vm.stack[vm.sp-1] = vm.newInteger(sum)
+						continue
+					}
+				}
+			}
+
+			frame.ip = ip
+			if err := vm.execBinaryOp(op); err != nil {
+				return err
+			}
+
+		case code.OpSub, code.OpMul, code.OpDiv:
+			frame.ip = ip
 			if err := vm.execBinaryOp(op); err != nil {
 				return err
 			}
 
 		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanOrEqual:
+			frame.ip = ip
 			if err := vm.execComparison(op); err != nil {
 				return err
 			}
@@ -196,49 +802,102 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+		case code.OpIn:
+			coll := vm.pop()
+			el := vm.pop()
+
+			found, err := object.Contains(coll, el)
+			if err != nil {
+				return err
+			}
+			if err := vm.push(nativeBoolToBooleanObject(found)); err != nil {
+				return err
+			}
+
+		case code.OpMatchArray:
+			length := int(code.ReadUint16(insns[ip+1:]))
+			ip += 2
+
+			arr, ok := vm.pop().(object.ArrayObject)
+			if err := vm.push(nativeBoolToBooleanObject(ok && arr.Len() == length)); err != nil {
+				return err
+			}
+
+		case code.OpMatchHash:
+			_, ok := vm.pop().(object.HashObject)
+			if err := vm.push(nativeBoolToBooleanObject(ok)); err != nil {
+				return err
+			}
+
 		case code.OpJump:
 			pos := int(code.ReadUint16(insns[ip+1:]))
 			// Since we're in a loop that increments `ip` with each iteration, we need to set `ip`
 			// to the offset *right before the one* we want.
-			frame.ip = pos - 1
+			ip = pos - 1
 
 		case code.OpJumpNotTruthy:
 			pos := int(code.ReadUint16(insns[ip+1:]))
-			frame.ip += 2
+			ip += 2
 
 			condition := vm.pop()
 			if !isTruthy(condition) {
-				frame.ip = pos - 1
+				ip = pos - 1
+			}
+
+		case code.OpJumpTruthy:
+			pos := int(code.ReadUint16(insns[ip+1:]))
+			ip += 2
+
+			condition := vm.pop()
+			if isTruthy(condition) {
+				ip = pos - 1
 			}
 
 		case code.OpSetGlobal:
 			globalIdx := code.ReadUint16(insns[ip+1:])
-			frame.ip += 2
+			ip += 2
 
 			vm.globals[globalIdx] = vm.pop()
 
 		case code.OpGetGlobal:
 			globalIdx := code.ReadUint16(insns[ip+1:])
-			frame.ip += 2
+			ip += 2
 
-			if err := vm.push(vm.globals[globalIdx]); err != nil {
+			// A global is unset if it is referred to in its own definition, e.g. `let x = x;`
+			global := vm.globals[globalIdx]
+			if global == nil {
+				return fmt.Errorf("global binding %d used before its definition", globalIdx)
+			}
+			if err := vm.push(global); err != nil {
 				return err
 			}
 
 		case code.OpCall:
 			numArgs := int(code.ReadUint8(insns[ip+1:]))
-			frame.ip++
+			ip++
 
+			frame.ip = ip
 			if err := vm.execCall(numArgs); err != nil {
 				return err
 			}
 
+			// Switch to the called function unless it is a built-in function
+			frame = vm.currentFrame()
+			insns = frame.Instructions()
+			ip = frame.ip
+
 		case code.OpReturnValue:
 			// Pop the return value off the stack before clearing the stack frame
 			retVal := vm.pop()
 
+			// A return statement at the top level ends the main program with the value
+			if vm.framesIdx == 1 {
+				vm.result = retVal
+				return nil
+			}
+
 			// Clear the called function's stack frame
-			frame := vm.popFrame()
+			vm.popFrame()
 			vm.sp = frame.bp - 1 // -1 for the called function object itself on the stack
 
 			// Push the return value on to the stack again
@@ -246,9 +905,16 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+			if vm.framesIdx == depth {
+				return nil
+			}
+			frame = vm.currentFrame()
+			insns = frame.Instructions()
+			ip = frame.ip
+
 		case code.OpReturn:
 			// Clear the called function's stack frame
-			frame := vm.popFrame()
+			vm.popFrame()
 			vm.sp = frame.bp - 1 // -1 for the called function object itself on the stack
 
 			// Push the Nil value on to the stack because we have no return value
@@ -256,23 +922,53 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+			if vm.framesIdx == depth {
+				return nil
+			}
+			frame = vm.currentFrame()
+			insns = frame.Instructions()
+			ip = frame.ip
+
 		case code.OpSetLocal:
 			localIdx := int(code.ReadUint8(insns[ip+1:]))
-			frame.ip++
+			ip++
 
 			vm.stack[frame.bp+localIdx] = vm.pop()
 
 		case code.OpGetLocal:
 			localIdx := int(code.ReadUint8(insns[ip+1:]))
-			frame.ip++
+			ip++
+
+			// A local is unset if its definition has not run, e.g. `if (false) { let x = 1 }; x`
+			local := vm.stack[frame.bp+localIdx]
+			if local == nil {
+				return fmt.Errorf("local binding %d used before its definition", localIdx)
+			}
+			if err := vm.push(local); err != nil {
+				return err
+			}
+
+		case code.OpSetLocalWide:
+			localIdx := int(code.ReadUint16(insns[ip+1:]))
+			ip += 2
 
-			if err := vm.push(vm.stack[frame.bp+localIdx]); err != nil {
+			vm.stack[frame.bp+localIdx] = vm.pop()
+
+		case code.OpGetLocalWide:
+			localIdx := int(code.ReadUint16(insns[ip+1:]))
+			ip += 2
+
+			local := vm.stack[frame.bp+localIdx]
+			if local == nil {
+				return fmt.Errorf("local binding %d used before its definition", localIdx)
+			}
+			if err := vm.push(local); err != nil {
 				return err
 			}
 
 		case code.OpGetBuiltin:
 			builtinIdx := code.ReadUint8(insns[ip+1:])
-			frame.ip++
+			ip++
 
 			def := object.Builtins[builtinIdx]
 
@@ -283,7 +979,7 @@ func (vm *VM) Run() error {
 		case code.OpClosure:
 			constIdx := int(code.ReadUint16(insns[ip+1:]))
 			numFree := int(code.ReadUint8(insns[ip+3:]))
-			frame.ip += 3
+			ip += 3
 
 			if err := vm.pushClosure(constIdx, numFree); err != nil {
 				return err
@@ -291,7 +987,7 @@ func (vm *VM) Run() error {
 
 		case code.OpGetFree:
 			freeIdx := code.ReadUint8(insns[ip+1:])
-			frame.ip++
+			ip++
 
 			currentClosure := frame.cl
 			if err := vm.push(currentClosure.Free[freeIdx]); err != nil {
@@ -303,13 +999,37 @@ func (vm *VM) Run() error {
 			if err := vm.push(currentClosure); err != nil {
 				return err
 			}
-		}
 
-		// Update current frame and instructions for the next interation
-		frame = vm.currentFrame()
-		insns = frame.Instructions()
+		case code.OpGetMethod:
+			constIdx := code.ReadUint16(insns[ip+1:])
+			ip += 2
+
+			if err := vm.execGetMethod(vm.consts[constIdx]); err != nil {
+				return err
+			}
+
+		case code.OpDup:
+			if err := vm.push(vm.stack[vm.sp-1]); err != nil {
+				return err
+			}
+
+		case code.OpSwap:
+			vm.stack[vm.sp-2], vm.stack[vm.sp-1] = vm.stack[vm.sp-1], vm.stack[vm.sp-2]
+
+		case code.OpRot:
+			a, b, c := vm.stack[vm.sp-3], vm.stack[vm.sp-2], vm.stack[vm.sp-1]
+			vm.stack[vm.sp-3], vm.stack[vm.sp-2], vm.stack[vm.sp-1] = b, c, a
+		}
 	}
 
+	// The main program has finished. Only an expression statement ends with OpPop, unless the
+	// program is compiled to keep the value of the last one on the stack.
+	vm.result = nil
+	if op == code.OpPop {
+		vm.result = vm.stack[vm.sp]
+	} else if vm.sp > 0 {
+		vm.result = vm.stack[vm.sp-1]
+	}
 	return nil
 }
 
@@ -329,7 +1049,7 @@ func (vm *VM) popFrame() *Frame {
 
 func (vm *VM) push(obj object.Object) error {
 	if vm.sp >= StackSize {
-		return errors.New("stack overflow")
+		return ErrStackOverflow
 	}
 
 	// Push the object on to the stack
@@ -360,13 +1080,49 @@ func (vm *VM) buildArray(startIdx, endIdx int) object.Object {
 		elems[i-startIdx] = vm.stack[i]
 	}
 
+	if vm.persistent {
+		return object.NewPersistentArray(elems)
+	}
 	return &object.Array{Elements: elems}
 }
 
+// appendElements returns an array of the elements of `arr` followed by the elements on the stack
+// from `startIdx` up to but not including `endIdx`, leaving `arr` unchanged.
+func (vm *VM) appendElements(arr object.Object, startIdx, endIdx int) (object.Object, error) {
+	switch arr := arr.(type) {
+	case *object.Array:
+		for i := startIdx; i < endIdx; i++ {
+			arr = arr.Push(vm.stack[i])
+		}
+		return arr, nil
+	case *object.PersistentArray:
+		for i := startIdx; i < endIdx; i++ {
+			arr = arr.Push(vm.stack[i])
+		}
+		return arr, nil
+	default:
+		return nil, fmt.Errorf("cannot append elements to %s", arr.Type())
+	}
+}
+
 func (vm *VM) buildHash(startIdx, endIdx int) (object.Object, error) {
-	capacity := (endIdx - startIdx) / 2
-	m := make(map[object.HashKey]object.HashPair, capacity)
+	var hash object.HashObject
+	if vm.persistent {
+		hash = object.NewPersistentHash()
+	} else {
+		capacity := (endIdx - startIdx) / 2
+		hash = &object.Hash{Pairs: make(map[object.HashKey]object.HashPair, capacity)}
+	}
 
+	if err := vm.setPairs(hash, startIdx, endIdx); err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
+// setPairs sets pairs of keys and values on the stack from `startIdx` up to but not including
+// `endIdx` into `hash`.
+func (vm *VM) setPairs(hash object.HashObject, startIdx, endIdx int) error {
 	for i := startIdx; i < endIdx; i += 2 {
 		key := vm.stack[i]
 		val := vm.stack[i+1]
@@ -375,13 +1131,13 @@ func (vm *VM) buildHash(startIdx, endIdx int) (object.Object, error) {
 
 		hashKey, ok := key.(object.Hashable)
 		if !ok {
-			return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
+			return fmt.Errorf("unusable as hash key: %s", key.Type())
 		}
 
-		m[hashKey.HashKey()] = pair
+		hash.Set(vm.hashKey(hashKey), pair)
 	}
 
-	return &object.Hash{Pairs: m}, nil
+	return nil
 }
 
 func (vm *VM) execBangOp() error {
@@ -400,7 +1156,17 @@ func (vm *VM) execBangOp() error {
 func (vm *VM) execMinusOp() error {
 	switch operand := vm.pop().(type) {
 	case *object.Integer:
-		return vm.push(&object.Integer{Value: -operand.Value})
+		if operand.Value == math.MinInt64 {
+			switch vm.overflowMode {
+			case OverflowError:
+				return fmt.Errorf("integer overflow: -(%d)", operand.Value)
+			case OverflowPromote:
+				return vm.push(&object.BigInt{Value: new(big.Int).Neg(big.NewInt(operand.Value))})
+			}
+		}
+		return vm.push(vm.newInteger(-operand.Value))
+	case *object.BigInt:
+		return vm.push(&object.BigInt{Value: new(big.Int).Neg(operand.Value)})
 	case *object.Float:
 		return vm.push(&object.Float{Value: -operand.Value})
 	default:
@@ -412,17 +1178,23 @@ func (vm *VM) execBinaryOp(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
+	if isHash(left) || isHash(right) {
+		if ok, err := vm.execOverloadedOp(op, left, right); ok {
+			return err
+		}
+	}
+
 	switch {
 	case isFloatArithmeticRequired(op, left, right):
 		return vm.execBinaryFloatOp(op, left, right)
 	case isBothType(object.IntegerType, left, right):
 		return vm.execBinaryIntOp(op, left, right)
+	case isBigIntArithmeticRequired(left, right):
+		return vm.execBinaryBigIntOp(op, left, right)
 	case isBothType(object.StringType, left, right):
 		return vm.execBinaryStrOp(op, left, right)
 	default:
-		return fmt.Errorf(
-			"unsupported types for binary operation %d: %s and %s", op, left.Type(), right.Type(),
-		)
+		return &TypeMismatchError{Op: op, Left: left.Type(), Right: right.Type()}
 	}
 }
 
@@ -430,33 +1202,72 @@ func (vm *VM) execBinaryIntOp(op code.Opcode, left, right object.Object) error {
 	leftVal := left.(*object.Integer).Value
 	rightVal := right.(*object.Integer).Value
 
-	var result int64
+	var (
+		result   int64
+		overflow bool
+	)
 
 	switch op {
 	case code.OpAdd:
 		result = leftVal + rightVal
+		overflow = (leftVal > 0 && rightVal > 0 && result < 0) ||
+			(leftVal < 0 && rightVal < 0 && result >= 0)
 	case code.OpSub:
 		result = leftVal - rightVal
+		overflow = (leftVal >= 0 && rightVal < 0 && result < 0) ||
+			(leftVal < 0 && rightVal > 0 && result >= 0)
 	case code.OpMul:
 		result = leftVal * rightVal
+		overflow = leftVal != 0 && (result/leftVal != rightVal ||
+			(leftVal == -1 && rightVal == math.MinInt64))
 	case code.OpDiv:
 		result = leftVal / rightVal
+		overflow = leftVal == math.MinInt64 && rightVal == -1
 	default:
 		return fmt.Errorf("unknown integer operator: %d", op)
 	}
 
-	return vm.push(&object.Integer{Value: result})
+	if overflow {
+		switch vm.overflowMode {
+		case OverflowError:
+			return fmt.Errorf("integer overflow: %d %s %d", leftVal, operatorSymbols[op], rightVal)
+		case OverflowPromote:
+			return vm.execBinaryBigIntOp(op, left, right)
+		}
+	}
+
+	return vm.push(vm.newInteger(result))
+}
+
+func (vm *VM) execBinaryBigIntOp(op code.Opcode, left, right object.Object) error {
+	leftVal := castToBigInt(left)
+	rightVal := castToBigInt(right)
+
+	result := new(big.Int)
+
+	switch op {
+	case code.OpAdd:
+		result.Add(leftVal, rightVal)
+	case code.OpSub:
+		result.Sub(leftVal, rightVal)
+	case code.OpMul:
+		result.Mul(leftVal, rightVal)
+	default:
+		return fmt.Errorf("unknown big integer operator: %d", op)
+	}
+
+	return vm.push(&object.BigInt{Value: result})
 }
 
 func (vm *VM) execBinaryFloatOp(op code.Opcode, left, right object.Object) error {
 	leftVal, err := castToFloat(left)
 	if err != nil {
-		return err
+		return &TypeMismatchError{Op: op, Left: left.Type(), Right: right.Type()}
 	}
 
 	rightVal, err := castToFloat(right)
 	if err != nil {
-		return err
+		return &TypeMismatchError{Op: op, Left: left.Type(), Right: right.Type()}
 	}
 
 	var result float64
@@ -485,7 +1296,60 @@ func (vm *VM) execBinaryStrOp(op code.Opcode, left, right object.Object) error {
 	leftVal := left.(*object.String).Value
 	rightVal := right.(*object.String).Value
 
-	return vm.push(&object.String{Value: leftVal + rightVal})
+	s := vm.newString(leftVal + rightVal)
+	if err := vm.push(s); err != nil {
+		return err
+	}
+	return vm.allocate(sizeOf(s))
+}
+
+// execConcatN adds up `n` elements on top of the stack from the bottommost one, and pushes the
+// sum. If they are all strings, it concatenates them into a new string at once. Otherwise they
+// are added one by one just like OpAdd.
+func (vm *VM) execConcatN(n int) error {
+	operands := vm.stack[vm.sp-n : vm.sp]
+
+	size := 0
+	for _, operand := range operands {
+		s, ok := operand.(*object.String)
+		if !ok {
+			return vm.execAddN(n)
+		}
+		size += len(s.Value)
+	}
+
+	var out strings.Builder
+	out.Grow(size)
+	for _, operand := range operands {
+		out.WriteString(operand.(*object.String).Value)
+	}
+	vm.sp -= n
+
+	s := vm.newString(out.String())
+	if err := vm.push(s); err != nil {
+		return err
+	}
+	return vm.allocate(sizeOf(s))
+}
+
+// execAddN adds up `n` elements on top of the stack one by one from the bottommost one.
+func (vm *VM) execAddN(n int) error {
+	operands := make([]object.Object, n)
+	copy(operands, vm.stack[vm.sp-n:vm.sp])
+	vm.sp -= n
+
+	if err := vm.push(operands[0]); err != nil {
+		return err
+	}
+	for _, operand := range operands[1:] {
+		if err := vm.push(operand); err != nil {
+			return err
+		}
+		if err := vm.execBinaryOp(code.OpAdd); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (vm *VM) execSetIndexExpr(left, idx, val object.Object) error {
@@ -501,30 +1365,42 @@ func (vm *VM) execSetIndexExpr(left, idx, val object.Object) error {
 }
 
 func (vm *VM) execArraySetIndex(array, idx, val object.Object) error {
-	arr := array.(*object.Array)
+	arr := array.(object.ArrayObject)
+	if arr.IsFrozen() {
+		return fmt.Errorf("cannot modify frozen %s", arr.Type())
+	}
+
 	i := idx.(*object.Integer).Value
-	max := int64(len(arr.Elements) - 1)
+	max := int64(arr.Len() - 1)
 
 	if i < 0 || i > max {
 		return fmt.Errorf("array index %d out of range", i)
 	}
 
-	arr.Elements[i] = val
+	arr.Set(int(i), val)
 
 	return nil
 }
 
 func (vm *VM) execHashSetIndex(hash, idx, val object.Object) error {
-	h := hash.(*object.Hash)
+	h := hash.(object.HashObject)
+	if h.IsFrozen() {
+		return fmt.Errorf("cannot modify frozen %s", h.Type())
+	}
 
 	key, ok := idx.(object.Hashable)
 	if !ok {
 		return fmt.Errorf("unusable as hash key: %s", idx.Type())
 	}
 
-	h.Pairs[key.HashKey()] = object.HashPair{Key: idx, Value: val}
+	hashKey := vm.hashKey(key)
+	_, exists := h.Get(hashKey)
+	h.Set(hashKey, object.HashPair{Key: idx, Value: val})
 
-	return nil
+	if exists {
+		return nil
+	}
+	return vm.allocate(pairSize)
 }
 
 func (vm *VM) execGetIndexExpr(left, idx object.Object) error {
@@ -532,6 +1408,10 @@ func (vm *VM) execGetIndexExpr(left, idx object.Object) error {
 	switch {
 	case leftType == object.ArrayType && idx.Type() == object.IntegerType:
 		return vm.execArrayGetIndex(left, idx)
+	case leftType == object.StringType && idx.Type() == object.IntegerType:
+		return vm.execStringGetIndex(left, idx)
+	case leftType == object.BytesType && idx.Type() == object.IntegerType:
+		return vm.execBytesGetIndex(left, idx)
 	case leftType == object.HashType:
 		return vm.execHashGetIndex(left, idx)
 	default:
@@ -540,41 +1420,159 @@ func (vm *VM) execGetIndexExpr(left, idx object.Object) error {
 }
 
 func (vm *VM) execArrayGetIndex(array, idx object.Object) error {
-	arr := array.(*object.Array)
+	arr := array.(object.ArrayObject)
 	i := idx.(*object.Integer).Value
-	max := int64(len(arr.Elements) - 1)
+	max := int64(arr.Len() - 1)
 
 	if i < 0 || i > max {
 		return vm.push(Nil)
 	}
 
-	return vm.push(arr.Elements[i])
+	return vm.push(arr.Get(int(i)))
 }
 
-func (vm *VM) execHashGetIndex(hash, idx object.Object) error {
-	h := hash.(*object.Hash)
+func (vm *VM) execStringGetIndex(str, idx object.Object) error {
+	s := str.(*object.String)
+	i := idx.(*object.Integer).Value
 
-	key, ok := idx.(object.Hashable)
+	char, ok := s.CharAt(i)
 	if !ok {
+		return vm.push(Nil)
+	}
+
+	return vm.push(char)
+}
+
+func (vm *VM) execBytesGetIndex(bytes, idx object.Object) error {
+	b := bytes.(*object.Bytes)
+	i := idx.(*object.Integer).Value
+	max := int64(len(b.Value) - 1)
+
+	if i < 0 || i > max {
+		return vm.push(Nil)
+	}
+
+	return vm.push(vm.newInteger(int64(b.Value[i])))
+}
+
+func (vm *VM) execHashGetIndex(hash, idx object.Object) error {
+	h := hash.(object.HashObject)
+
+	key, hashable := idx.(object.Hashable)
+	if hashable {
+		if pair, ok := h.Get(vm.hashKey(key)); ok {
+			return vm.push(pair.Value)
+		}
+	}
+
+	// A hash can handle indices which are not its keys by itself
+	if method, ok := h.Get(indexMethodKey); ok {
+		result, err := vm.call(method.Value, []object.Object{hash, idx})
+		if err != nil {
+			return err
+		}
+		return vm.push(result)
+	}
+
+	if !hashable {
 		return fmt.Errorf("unusable as hash key: %s", idx.Type())
 	}
+	return vm.push(Nil)
+}
+
+// operatorMethodKeys maps opcodes of operators to the hash keys of the methods overloading them.
+// A method is called with both operands, and OpNotEqual negates the result of `__eq__`.
+var operatorMethodKeys = map[code.Opcode]object.HashKey{
+	code.OpAdd:      object.NewHashedString("__add__").HashKey(),
+	code.OpSub:      object.NewHashedString("__sub__").HashKey(),
+	code.OpMul:      object.NewHashedString("__mul__").HashKey(),
+	code.OpDiv:      object.NewHashedString("__div__").HashKey(),
+	code.OpEqual:    object.NewHashedString("__eq__").HashKey(),
+	code.OpNotEqual: object.NewHashedString("__eq__").HashKey(),
+}
+
+// indexMethodKey is the hash key of the method handling indices which are not keys of a hash.
+var indexMethodKey = object.NewHashedString("__index__").HashKey()
+
+// isHash reports whether `obj` is a hash, which may overload operators. It is cheaper than
+// asserting object.HashObject on the hot path of arithmetic.
+func isHash(obj object.Object) bool {
+	switch obj.(type) {
+	case *object.Hash, *object.PersistentHash:
+		return true
+	}
+	return false
+}
+
+// execOverloadedOp applies operator `op` to `left` and `right` by calling the method overloading
+// it if either of them is a hash with one, looking at `left` first. It reports whether the
+// operator is overloaded.
+func (vm *VM) execOverloadedOp(op code.Opcode, left, right object.Object) (bool, error) {
+	var method object.Object
+	for _, operand := range [...]object.Object{left, right} {
+		h, ok := operand.(object.HashObject)
+		if !ok {
+			continue
+		}
+		key, ok := operatorMethodKeys[op]
+		if !ok {
+			return false, nil
+		}
+		if pair, ok := h.Get(key); ok {
+			method = pair.Value
+			break
+		}
+	}
+	if method == nil {
+		return false, nil
+	}
+
+	result, err := vm.call(method, []object.Object{left, right})
+	if err != nil {
+		return true, err
+	}
+	if op == code.OpNotEqual {
+		result = nativeBoolToBooleanObject(!isTruthy(result))
+	}
+	return true, vm.push(result)
+}
+
+func (vm *VM) execGetMethod(name object.Object) error {
+	receiver := vm.stack[vm.sp-1]
 
-	pair, ok := h.Pairs[key.HashKey()]
+	h, ok := receiver.(object.HashObject)
 	if !ok {
-		return vm.push(Nil)
+		return fmt.Errorf("cannot call method %s on %s", name.Inspect(), receiver.Type())
+	}
+
+	pair, ok := h.Get(name.(object.Hashable).HashKey())
+	if !ok {
+		return fmt.Errorf("undefined method %s for %s", name.Inspect(), receiver.Type())
 	}
 
-	return vm.push(pair.Value)
+	// Put the method below the receiver, which becomes the first argument of the call
+	vm.stack[vm.sp-1] = pair.Value
+	return vm.push(receiver)
 }
 
 func (vm *VM) execComparison(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
+	if isHash(left) || isHash(right) {
+		if ok, err := vm.execOverloadedOp(op, left, right); ok {
+			return err
+		}
+	}
+
 	if isEitherType(object.FloatType, left, right) {
 		return vm.execFloatComparison(op, left, right)
 	} else if isBothType(object.IntegerType, left, right) {
 		return vm.execIntComparison(op, left, right)
+	} else if isBigIntArithmeticRequired(left, right) {
+		return vm.execBigIntComparison(op, left, right)
+	} else if isBothType(object.StringType, left, right) {
+		return vm.execStrComparison(op, left, right)
 	}
 
 	var result bool
@@ -585,7 +1583,25 @@ func (vm *VM) execComparison(op code.Opcode) error {
 	case code.OpNotEqual:
 		result = left != right
 	default:
-		return fmt.Errorf("unknown operator %d: %s and %s", op, left.Type(), right.Type())
+		return &TypeMismatchError{Op: op, Left: left.Type(), Right: right.Type()}
+	}
+
+	return vm.push(nativeBoolToBooleanObject(result))
+}
+
+func (vm *VM) execStrComparison(op code.Opcode, left, right object.Object) error {
+	leftVal := left.(*object.String).Value
+	rightVal := right.(*object.String).Value
+
+	var result bool
+
+	switch op {
+	case code.OpEqual:
+		result = leftVal == rightVal
+	case code.OpNotEqual:
+		result = leftVal != rightVal
+	default:
+		return fmt.Errorf("unknown string operator: %d", op)
 	}
 
 	return vm.push(nativeBoolToBooleanObject(result))
@@ -613,15 +1629,36 @@ func (vm *VM) execIntComparison(op code.Opcode, left, right object.Object) error
 	return vm.push(nativeBoolToBooleanObject(result))
 }
 
+func (vm *VM) execBigIntComparison(op code.Opcode, left, right object.Object) error {
+	cmp := castToBigInt(left).Cmp(castToBigInt(right))
+
+	var result bool
+
+	switch op {
+	case code.OpEqual:
+		result = cmp == 0
+	case code.OpNotEqual:
+		result = cmp != 0
+	case code.OpGreaterThan:
+		result = cmp > 0
+	case code.OpGreaterThanOrEqual:
+		result = cmp >= 0
+	default:
+		return fmt.Errorf("unknown operator %d for big integers", op)
+	}
+
+	return vm.push(nativeBoolToBooleanObject(result))
+}
+
 func (vm *VM) execFloatComparison(op code.Opcode, left, right object.Object) error {
 	leftVal, err := castToFloat(left)
 	if err != nil {
-		return err
+		return &TypeMismatchError{Op: op, Left: left.Type(), Right: right.Type()}
 	}
 
 	rightVal, err := castToFloat(right)
 	if err != nil {
-		return err
+		return &TypeMismatchError{Op: op, Left: left.Type(), Right: right.Type()}
 	}
 
 	var result bool
@@ -670,43 +1707,150 @@ func (vm *VM) execCall(numArgs int) error {
 	case *object.Builtin:
 		return vm.callBuiltin(callee, numArgs)
 	default:
-		var typ interface{}
+		var out strings.Builder
+		out.WriteString("calling non-function and non-built-in: ")
 		if callee != nil {
-			typ = callee.Type()
+			fmt.Fprintf(&out, "%s (type %s)", abbreviate(callee.Inspect()), callee.Type())
+		} else {
+			out.WriteString("type <nil>")
 		}
-		return fmt.Errorf("calling non-function and non-built-in: type %v", typ)
+		writeStackTrace(&out, vm.stackTrace())
+		return errors.New(out.String())
 	}
 }
 
+// maxInspectLen is the maximum length of representations of values in error messages.
+const maxInspectLen = 40
+
+// abbreviate shortens a representation `s` of a value to at most maxInspectLen bytes, so that
+// large values do not clutter error messages.
+func abbreviate(s string) string {
+	if len(s) <= maxInspectLen {
+		return s
+	}
+	return s[:maxInspectLen-3] + "..."
+}
+
 func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
 	if numArgs != cl.Fn.NumParameters {
-		return fmt.Errorf(
-			"wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs,
-		)
+		return arityError(cl.Fn, numArgs)
 	}
 
 	// Create a new stack frame
 	basePtr := vm.sp - numArgs
+	// Make sure in advance that the stack has enough room for the whole frame
+	top := basePtr + cl.Fn.NumLocals + cl.Fn.MaxStackDepth
+	if top > StackSize || vm.framesIdx >= MaxFrames {
+		return ErrStackOverflow
+	}
+	if top > vm.stackHigh {
+		vm.stackHigh = top
+	}
+
 	frame := NewFrame(cl, basePtr)
 	vm.pushFrame(frame)
+	if vm.logger != nil {
+		name := cl.Fn.Name
+		if name == "" {
+			name = "<anonymous>"
+		}
+		vm.logger.Debug("push frame", "function", name, "depth", vm.framesIdx)
+	}
 
-	vm.sp = frame.bp + cl.Fn.NumLocals // Reserve slots for local bindings on the stack
+	// Reserve slots for local bindings on the stack, clearing what is left there by other frames
+	// so that the bindings are unset until they are defined
+	vm.sp = frame.bp + cl.Fn.NumLocals
+	for i := basePtr + numArgs; i < vm.sp; i++ {
+		vm.stack[i] = nil
+	}
 
 	return nil
 }
 
+// arityError returns an error for calling `fn` with a wrong number of arguments `numArgs`, which
+// names the function unless it is anonymous.
+func arityError(fn *object.CompiledFunction, numArgs int) error {
+	if fn.Name == "" {
+		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", fn.NumParameters, numArgs)
+	}
+	return fmt.Errorf("wrong number of arguments to %s: want=%d, got=%d",
+		fn.Name, fn.NumParameters, numArgs)
+}
+
 func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
 	args := vm.stack[vm.sp-numArgs : vm.sp]
+	if vm.logger != nil {
+		vm.logger.Debug("call builtin", "name", object.GetBuiltinName(builtin), "args", numArgs)
+	}
 
 	// Execute the built-in function itself
-	result := builtin.Fn(args...)
+	result := builtin.Fn(vm, args...)
 	// Take the arguments and the function we just executed off the stack
 	vm.sp -= (numArgs + 1)
 
-	if result == nil {
+	switch result := result.(type) {
+	case nil:
 		return vm.push(Nil)
+	case *object.Abort:
+		if result.Panic {
+			return &PanicError{Message: result.Message, StackTrace: vm.stackTrace()}
+		}
+		if result.Err != nil {
+			return &abortError{message: result.Message, err: result.Err}
+		}
+		return errors.New(result.Message)
+	default:
+		if err := vm.push(result); err != nil {
+			return err
+		}
+		if !vm.memoryLimited {
+			return nil
+		}
+		return vm.allocate(newObjectsSize(result, args))
+	}
+}
+
+// stackTrace describes the functions in the current stack frames from the innermost one, with
+// the offsets of the instructions being executed in them and the lines of the source code they
+// are compiled from if known.
+func (vm *VM) stackTrace() []string {
+	trace := make([]string, 0, vm.framesIdx)
+	for i := vm.framesIdx - 1; i >= 0; i-- {
+		f := vm.frames[i]
+
+		name := f.Fn().Name
+		switch {
+		case i == 0:
+			name = "main"
+		case name == "":
+			name = "<anonymous>"
+		}
+		pos := instructionStart(f.Instructions(), f.ip)
+		entry := fmt.Sprintf("%s at %04d", name, pos)
+		if line := f.Fn().Lines.Line(pos); line > 0 {
+			entry += fmt.Sprintf(" (line %d)", line)
+		}
+		trace = append(trace, entry)
+	}
+	return trace
+}
+
+// instructionStart returns the offset of the instruction whose last byte is at `ip`, which is
+// an OpCall for a calling frame but can be any instruction calling a method of a hash.
+func instructionStart(insns code.Instructions, ip int) int {
+	start := ip
+	for pos := 0; pos <= ip && pos < len(insns); {
+		def, err := code.Lookup(insns[pos])
+		if err != nil {
+			return ip
+		}
+		start = pos
+		pos++
+		for _, w := range def.OperandWidths {
+			pos += w
+		}
 	}
-	return vm.push(result)
+	return start
 }
 
 func (vm *VM) pushClosure(constIdx int, numFree int) error {
@@ -717,6 +1861,18 @@ func (vm *VM) pushClosure(constIdx int, numFree int) error {
 		return fmt.Errorf("not a function: %+v", c)
 	}
 
+	// A closure without free variables cannot be told apart from another one of the same
+	// function except by identity, so create it only once instead of every time it is evaluated
+	if numFree == 0 {
+		if vm.closures == nil {
+			vm.closures = make([]*object.Closure, len(vm.consts))
+		}
+		if vm.closures[constIdx] == nil {
+			vm.closures[constIdx] = &object.Closure{Fn: fn}
+		}
+		return vm.push(vm.closures[constIdx])
+	}
+
 	// Fetch free variables
 	free := make([]object.Object, numFree)
 	copy(free, vm.stack[vm.sp-numFree:vm.sp])
@@ -724,7 +1880,97 @@ func (vm *VM) pushClosure(constIdx int, numFree int) error {
 
 	// Create a closure and push it on to the stack
 	closure := &object.Closure{Fn: fn, Free: free}
-	return vm.push(closure)
+	if err := vm.push(closure); err != nil {
+		return err
+	}
+	return vm.allocate(sizeOf(closure))
+}
+
+// newInteger returns an integer object of value `v`, which is shared if `v` is small, or
+// otherwise newly allocated in the arena if any.
+func (vm *VM) newInteger(v int64) *object.Integer {
+	if minSmallInteger <= v && v <= maxSmallInteger {
+		return smallIntegers[v-minSmallInteger]
+	}
+	if vm.arena != nil {
+		return vm.arena.newInteger(v)
+	}
+	return &object.Integer{Value: v}
+}
+
+const (
+	minSmallInteger = -128
+	maxSmallInteger = 1023
+)
+
+// smallIntegers caches integer objects of small values, which are shared by all VMs since
+// integer objects are immutable.
+var smallIntegers = func() []*object.Integer {
+	ints := make([]*object.Integer, maxSmallInteger-minSmallInteger+1)
+	for i := range ints {
+		ints[i] = &object.Integer{Value: int64(i + minSmallInteger)}
+	}
+	return ints
+}()
+
+// Limits of the strings a VM interns, which bound the memory the strings kept alive by the intern
+// table take. Longer strings are rarely used as keys repeatedly, and are hashed each time.
+const (
+	// maxInternedStringLen is the maximum length of a string to intern
+	maxInternedStringLen = 64
+	// maxInternedBytes is the maximum number of bytes the interned strings occupy, as sizeOf
+	// counts them
+	maxInternedBytes = 1 << 16
+)
+
+// hashKey returns the hash key of `key`. If `key` is a short string produced at runtime, it is
+// interned so that the hash key of the same string is computed only once. The interned strings
+// count towards the memory limit given by WithMaxMemory for as long as the VM keeps them.
+func (vm *VM) hashKey(key object.Hashable) object.HashKey {
+	s, ok := key.(*object.String)
+	if !ok || s.Hashed() {
+		return key.HashKey()
+	}
+
+	if interned, ok := vm.strings[s.Value]; ok {
+		return interned.HashKey()
+	}
+	size := sizeOf(s)
+	if len(s.Value) > maxInternedStringLen || vm.internedBytes+size > maxInternedBytes {
+		return s.HashKey()
+	}
+	// The string is not interned if it would exceed the memory limit, which is checked when the
+	// VM allocates memory next
+	if vm.memoryLimited && vm.memory+size > vm.maxMemory {
+		return s.HashKey()
+	}
+
+	if vm.strings == nil {
+		vm.strings = make(map[string]*object.String)
+	}
+	interned := object.NewHashedString(s.Value)
+	vm.strings[s.Value] = interned
+	vm.internedBytes += size
+	if vm.memoryLimited {
+		vm.memory += size
+	}
+	return interned.HashKey()
+}
+
+// newString returns a new string object of value `s`, allocated in the arena if any.
+func (vm *VM) newString(s string) *object.String {
+	if vm.arena != nil {
+		return vm.arena.newString(s)
+	}
+	return &object.String{Value: s}
+}
+
+// operatorSymbols maps arithmetic opcodes to their operator symbols in the source code.
+var operatorSymbols = map[code.Opcode]string{
+	code.OpAdd: "+",
+	code.OpSub: "-",
+	code.OpMul: "*",
+	code.OpDiv: "/",
 }
 
 func castToFloat(obj object.Object) (float64, error) {
@@ -733,11 +1979,33 @@ func castToFloat(obj object.Object) (float64, error) {
 		return float64(obj.Value), nil
 	case *object.Float:
 		return obj.Value, nil
+	case *object.BigInt:
+		f, _ := new(big.Float).SetInt(obj.Value).Float64()
+		return f, nil
 	default:
 		return 0.0, fmt.Errorf("could not cast to float: %s", obj.Type())
 	}
 }
 
+// castToBigInt converts an Integer or a BigInt to *big.Int. The caller must ensure `obj` is
+// either of them.
+func castToBigInt(obj object.Object) *big.Int {
+	if i, ok := obj.(*object.Integer); ok {
+		return big.NewInt(i.Value)
+	}
+	return obj.(*object.BigInt).Value
+}
+
+// isBigIntArithmeticRequired returns true if either operand is a BigInt and the other is an
+// Integer or a BigInt.
+func isBigIntArithmeticRequired(left, right object.Object) bool {
+	isInteger := func(obj object.Object) bool {
+		typ := obj.Type()
+		return typ == object.IntegerType || typ == object.BigIntType
+	}
+	return isEitherType(object.BigIntType, left, right) && isInteger(left) && isInteger(right)
+}
+
 func isFloatArithmeticRequired(op code.Opcode, left, right object.Object) bool {
 	// Division always returns a floating-point number
 	return op == code.OpDiv || isEitherType(object.FloatType, left, right)
@@ -1,10 +1,26 @@
 package vm
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/skatsuta/monkey-compiler/ast"
+	"github.com/skatsuta/monkey-compiler/code"
 	"github.com/skatsuta/monkey-compiler/compiler"
 	"github.com/skatsuta/monkey-compiler/lexer"
 	"github.com/skatsuta/monkey-compiler/object"
@@ -38,10 +54,133 @@ func TestIntegerArithmetic(t *testing.T) {
 	runVMTests(t, tests)
 }
 
+func TestIntegerOverflow(t *testing.T) {
+	tests := []struct {
+		input   string
+		wrapped int64
+		wantErr string
+	}{
+		{
+			input:   "9223372036854775807 + 1",
+			wrapped: math.MinInt64,
+			wantErr: "integer overflow: 9223372036854775807 + 1",
+		},
+		{
+			input:   "-9223372036854775807 - 2",
+			wrapped: math.MaxInt64,
+			wantErr: "integer overflow: -9223372036854775807 - 2",
+		},
+		{
+			input:   "4611686018427387904 * 2",
+			wrapped: math.MinInt64,
+			wantErr: "integer overflow: 4611686018427387904 * 2",
+		},
+		{
+			input:   "-(-9223372036854775807 - 1)",
+			wrapped: math.MinInt64,
+			wantErr: "integer overflow: -(-9223372036854775808)",
+		},
+		{
+			input:   "9223372036854775807 + 0",
+			wrapped: math.MaxInt64,
+		},
+		{
+			input:   "-9223372036854775807 - 1",
+			wrapped: math.MinInt64,
+		},
+		{
+			input:   "-3037000499 * 3037000499",
+			wrapped: -9223372030926249001,
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		complr := compiler.New()
+		if err := complr.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		wrapVM := New(complr.Bytecode())
+		if err := wrapVM.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		if err := testIntegerObject(tt.wrapped, wrapVM.Result()); err != nil {
+			t.Errorf("testIntegerObject failed for %q: %s", tt.input, err)
+		}
+
+		checkedVM := New(complr.Bytecode(), WithOverflowMode(OverflowError))
+		err := checkedVM.Run()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("unexpected vm error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.wantErr {
+			t.Errorf("wrong vm error for %q. want=%q, got=%v", tt.input, tt.wantErr, err)
+		}
+	}
+}
+
+func TestBigIntegers(t *testing.T) {
+	bigInt := func(s string) *big.Int {
+		n, _ := new(big.Int).SetString(s, 10)
+		return n
+	}
+
+	tests := []vmTestCase{
+		{"big(1)", big.NewInt(1)},
+		{`big("123456789012345678901234567890")`, bigInt("123456789012345678901234567890")},
+		{"big(1) + 2", big.NewInt(3)},
+		{"2 - big(5)", big.NewInt(-3)},
+		{"big(9223372036854775807) * big(9223372036854775807)",
+			bigInt("85070591730234615847396907784232501249")},
+		{"-big(2)", big.NewInt(-2)},
+		{"big(3) / 2", 1.5},
+		{"big(3) + 0.5", 3.5},
+		{"big(1) == 1", true},
+		{"big(1) != 1", false},
+		{"big(2) > 1", true},
+		{"1 < big(2)", true},
+		{"big(2) >= big(3)", false},
+		{`big("100000000000000000000") > 9223372036854775807`, true},
+		{"{1: 2}[big(1)]", 2},
+		{`big(1.5)`, &object.Error{Message: "argument to `big` not supported, got Float"}},
+		{`big("x")`, &object.Error{Message: `could not parse "x" as integer`}},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestIntegerOverflowPromotion(t *testing.T) {
+	tests := []vmTestCase{
+		{"9223372036854775807 + 1", new(big.Int).Add(big.NewInt(math.MaxInt64), big.NewInt(1))},
+		{"-9223372036854775807 - 2", new(big.Int).Sub(big.NewInt(-math.MaxInt64), big.NewInt(2))},
+		{"4611686018427387904 * 4", new(big.Int).Lsh(big.NewInt(1), 64)},
+		{"-(-9223372036854775807 - 1)", new(big.Int).Neg(big.NewInt(math.MinInt64))},
+		{"9223372036854775807 + 0", math.MaxInt64},
+		{
+			input: `
+			let fact = fn(n) { if (n <= 1) { 1 } else { n * fact(n - 1) } };
+			fact(25) == big("15511210043330985984000000");
+			`,
+			want: true,
+		},
+	}
+
+	runVMTestsWithOptions(t, tests, WithOverflowMode(OverflowPromote))
+}
+
 func TestFloatArithmetic(t *testing.T) {
 	tests := []vmTestCase{
 		{"1.0", 1.0},
 		{"1.1", 1.1},
+		{"1e+21 * 10", 1e22},
+		{"2.5e-3 + 1", 1.0025},
+		// Floats are printed in a form which reads back as the same value
+		{`to_str(1e21) + " " + to_str(0.00001)`, "1e+21 1e-05"},
 		{"2.2", 2.2},
 		{"1.25 + 2.25", 3.5},
 		{"1.5 - 2.25", -0.75},
@@ -160,6 +299,14 @@ func TestLogicalExpressions(t *testing.T) {
 		{"true || 1", true},
 		{"true && false", false},
 		{"false || true", true},
+		{"nil && 1", Nil},
+		{"1 && 2 && 3", 3},
+		{"false || nil || 3", 3},
+		{"if (1 > 2 || 2 > 1) { 10 } else { 20 }", 10},
+		// The right-hand side is not evaluated if the left-hand side decides the result
+		{`let h = {"x": 0}; let f = fn() { h.x = 1; true }; false && f(); h.x`, 0},
+		{`let h = {"x": 0}; let f = fn() { h.x = 1; true }; true || f(); h.x`, 0},
+		{`let h = {"x": 0}; let f = fn() { h.x = 1; true }; true && f(); h.x`, 1},
 	}
 
 	runVMTests(t, tests)
@@ -180,6 +327,47 @@ func TestConditionals(t *testing.T) {
 		{"if (1 >= 2) { 10 } else { 20 }", 20},
 		{"if (1 >= 2) { 10 }", Nil},
 		{"if (false) { 10 }", Nil},
+		{"if (true) { let x = 10; }", Nil},
+		{"if (true) {} else { 20 }", Nil},
+		{"if (false) { 10 } else {}", Nil},
+		{"let f = fn() { if (true) { let x = 10; } }; f()", Nil},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestMatchExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{`match 2 { 1 => 10, 2 => 20, _ => 30 }`, 20},
+		{`match 3 { 1 => 10, 2 => 20 }`, Nil},
+		{`match -1 { -1 => 10, _ => 20 }`, 10},
+		{`match "a" { 1 => 10, "a" => 20 }`, 20},
+		{`match nil { false => 10, nil => 20 }`, 20},
+		{`match 5 { n => n * 2 }`, 10},
+		{`match [1, 2] { [x] => x, [x, y] => x + y, _ => 0 }`, 3},
+		{`match [1, [2, 3]] { [a, [b, c]] => a + b + c }`, 6},
+		{`match [1, 2] { [2, x] => x, [1, x] => x * 10 }`, 20},
+		{`match [] { [] => 1, _ => 2 }`, 1},
+		{`match 1 { [] => 1, _ => 2 }`, 2},
+		{`match {"type": "circle", "r": 2} {
+			{"type": "square", "side": s} => s * s,
+			{"type": "circle", "r": r} => r * r * 3,
+			_ => 0,
+		}`, 12},
+		{`match {"a": 1} { {"b": b} => b, {} => 2 }`, 2},
+		{`match [1, 2] { {} => 1, _ => 2 }`, 2},
+		// Bindings of arms that fail to match are left untouched
+		{`let x = 1; match [2, 3] { [x, 4] => x, _ => x }`, 1},
+		// Bindings of patterns are visible only in their arms
+		{`let x = 1; match [2, 3] { [x, 3] => 0, _ => 0 }; x`, 1},
+		{`let x = 10; match 3 { x => x }`, 3},
+		{`let x = 10; match 3 { x => x }; x`, 10},
+		{`let f = fn() { let x = 10; match 3 { x => fn() { x } } }; f()()`, 3},
+		{`let f = fn() { let x = 10; match 3 { x => x }; x }; f()`, 10},
+		{`match [1, 2] { [len, y] => len + y }; len("ab")`, 2},
+		{`let f = fn(v) { match v { [h, t] => h + f(t), _ => 0 } }; f([1, [2, [3, nil]]])`, 6},
+		{`let f = fn(a) { fn(b) { match [a, b] { [x, y] => x * y } } }; f(3)(4)`, 12},
+		{`match match 1 { 1 => [1, 2] } { [a, b] => match b { 2 => a + b } }`, 3},
 	}
 
 	runVMTests(t, tests)
@@ -190,6 +378,10 @@ func TestGlobalLetStatements(t *testing.T) {
 		{"let one = 1; one", 1},
 		{"let one = 1; let two = 2; one + two", 3},
 		{"let one = 1; let two = one + one; one + two", 3},
+		// Names may contain digits after the first character, but cannot start with one: `2y`
+		// is the number 2 followed by the name y
+		{"let x1 = 1; let _2x = x1 + 1; x1 + _2x", 3},
+		{"let y = 3; 2y", 3},
 	}
 
 	runVMTests(t, tests)
@@ -201,11 +393,36 @@ func TestGlobalAssignmentStatements(t *testing.T) {
 		{`one = 1; two = one; two;`, 1},
 		{`a = 1; a = 2; a`, 2},
 		{`a = 1; b = 2; tmp = a; a = b; b = tmp; b`, 1},
+		{`i = 1; i++; i++; i--; i`, 2},
+		{`let a = [1.5]; a[0]++; a[0]`, 2.5},
+		{`let h = {"n": 1}; h.n--; h["n"]--; h.n`, -1},
+		{`let f = fn(i) { i++; i }; f(1)`, 2},
+		// Global variables are updated from functions
+		{`let c = 0; let inc = fn() { c++; c }; inc(); [inc(), c]`, []int{2, 2}},
 	}
 
 	runVMTests(t, tests)
 }
 
+func TestGlobalsUsedBeforeDefinition(t *testing.T) {
+	tests := []string{
+		"let x = x + 1; x",
+		"let a = [a]",
+	}
+
+	runVMTestErrors(t, tests)
+}
+
+func TestLocalsUsedBeforeDefinition(t *testing.T) {
+	tests := []string{
+		"let f = fn(c) { if (c) { let x = 1; }; x }; f(false)",
+		// Slots of local bindings left by another call are not reused
+		"let g = fn() { let y = 5; y }; let f = fn() { if (false) { let x = 1; }; x }; g(); f()",
+	}
+
+	runVMTestErrors(t, tests)
+}
+
 func TestAssignmentStatementScopes(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -309,9 +526,31 @@ func TestStringExpressions(t *testing.T) {
 		{`"monkey"`, "monkey"},
 		{`"mon" + "key"`, "monkey"},
 		{`"mon" + "key" + "banana"`, "monkeybanana"},
+		{`"monkey" == "mon" + "key"`, true},
+		{`"monkey" == "banana"`, false},
+		{`"monkey" != "mon" + "key"`, false},
+		{`"monkey" != "banana"`, true},
+		{`"abc"[0]`, "a"},
+		{`"abc"[2]`, "c"},
+		{`"abc"[3]`, Nil},
+		{`"abc"[-1]`, Nil},
+		{`""[0]`, Nil},
+		{`"héllo, 世界"[1]`, "é"},
+		{`"héllo, 世界"[8]`, "界"},
+		{`len("héllo, 世界")`, 9},
+		{`let s = "x"; "<" + s + "|" + s + ">"`, "<x|x>"},
+		{`let f = fn(s) { "[" + s + "]" }; f(f("a")) + "!" + f("")`, "[[a]]![]"},
+		{`"a"` + strings.Repeat(` + "a"`, 599) + " == \"" + strings.Repeat("a", 600) + "\"", true},
 	}
 
 	runVMTests(t, tests)
+
+	// Operands other than strings are added one by one, failing on the first invalid addition
+	runVMTestErrors(t, []string{
+		`1 + 2 + "a"`,
+		`"a" + 1 + "b"`,
+		`"a" + "b" + [1]`,
+	})
 }
 
 func TestArrayLiterals(t *testing.T) {
@@ -347,6 +586,33 @@ func TestHashLiterals(t *testing.T) {
 	}
 
 	runVMTests(t, tests)
+
+	// Hashes enumerate pairs in the order their keys are first set, whether they are persistent
+	// or not
+	many := make([]string, 0, 40)
+	for i := 39; i >= 0; i-- {
+		many = append(many, fmt.Sprintf("%d: %d", i, i))
+	}
+	manyHash := "{" + strings.Join(many, ", ") + "}"
+	orderTests := []vmTestCase{
+		{`to_str({"b": 1, "c": 2, "a": 3})`, "{b: 1, c: 2, a: 3}"},
+		{`let h = {2: 1, 1: 2}; h[0] = 3; h[2] = 4; to_str(h)`, "{2: 4, 1: 2, 0: 3}"},
+		{`to_str(set({"b": 1, "a": 2}, "c", 3))`, "{b: 1, a: 2, c: 3}"},
+		{`to_str(set(` + manyHash + `, true, 1))`, manyHash[:len(manyHash)-1] + ", true: 1}"},
+	}
+	runVMTests(t, orderTests)
+	runVMTestsWithOptions(t, orderTests, WithPersistentCollections())
+
+	// Keys and values are evaluated in the source order
+	runVMTests(t, []vmTestCase{
+		{
+			input: `let log = [0];
+			let next = fn(x) { log[0] = log[0] * 10 + x; x };
+			let h = {next(2): next(4), next(1): next(3)};
+			log[0]`,
+			want: 2413,
+		},
+	})
 }
 
 func TestSetIndexExpressions(t *testing.T) {
@@ -385,11 +651,206 @@ func TestSetIndexExpressionErrors(t *testing.T) {
 		"a = []; a[1] = 1",
 		"a = [1, 2, 3]; a[10] = 9",
 		"a = [[1, 1, 1]]; a[1][0] = 2",
+		"a = freeze([1, 2, 3]); a[0] = 9",
+		"h = freeze({1: 1}); h[2] = 2",
+		"a = freeze([[1, 1, 1]]); a[0][0] = 2",
+		"h = freeze({1: [1]}); h[1][0] = 2",
+	}
+
+	runVMTestErrors(t, tests)
+}
+
+func TestFrozenValues(t *testing.T) {
+	tests := []vmTestCase{
+		{"freeze(1)", 1},
+		{`freeze("a")`, "a"},
+		{"a = freeze([1, 2, 3]); a[1]", 2},
+		{"a = [1, 2]; b = freeze(a); push(b, 3)", []int{1, 2, 3}},
+		{"h = freeze({1: 2}); h[1]", 2},
+		{"freeze()", &object.Error{Message: "wrong number of arguments. want=1, got=0"}},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestCloneValues(t *testing.T) {
+	tests := []vmTestCase{
+		{"clone(1)", 1},
+		{`clone("a")`, "a"},
+		{"a = [1, 2, 3]; b = clone(a); b[0] = 9; a", []int{1, 2, 3}},
+		{"a = [1, 2, 3]; b = clone(a); b[0] = 9; b", []int{9, 2, 3}},
+		{"a = [[1, 1]]; b = clone(a); b[0][0] = 2; a[0]", []int{1, 1}},
+		{"a = freeze([1, 2]); b = clone(a); b[0] = 3; b", []int{3, 2}},
+		{
+			input: "h = {1: 1}; g = clone(h); g[1] = 2; h",
+			want: map[object.HashKey]int64{
+				(&object.Integer{Value: 1}).HashKey(): 1,
+			},
+		},
+		{
+			input: "h = {1: [1]}; g = clone(h); g[1][0] = 2; h[1]",
+			want:  []int{1},
+		},
+		{"f = fn() { 1 }; g = clone(f); g()", 1},
+		{"a = [1]; a[0] = a; b = clone(a); b[0][0][0] == b", true},
+		{"clone(1, 2)", &object.Error{Message: "wrong number of arguments. want=1, got=2"}},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestBytes(t *testing.T) {
+	tests := []vmTestCase{
+		{`bytes("abc")`, []byte("abc")},
+		{`bytes([0, 127, 255])`, []byte{0, 127, 255}},
+		{`len(bytes("abc"))`, 3},
+		{`len(bytes("∑"))`, 3},
+		{`bytes("abc")[0]`, 97},
+		{`bytes("abc")[2]`, 99},
+		{`bytes("abc")[3]`, Nil},
+		{`bytes("abc")[-1]`, Nil},
+		{`slice(bytes("hello"), 1, 3)`, []byte("el")},
+		{`slice(bytes("hello"), 0, 0)`, []byte{}},
+		{`to_str(slice(bytes("hello"), 1, 5))`, "ello"},
+		{`to_str(bytes([104, 105]))`, "hi"},
+		{`to_str(1)`, "1"},
+		{`bytes(1)`, &object.Error{Message: "argument to `bytes` not supported, got Integer"}},
+		{
+			`bytes([1, 256])`,
+			&object.Error{Message: "element 1 of argument to `bytes` is not a byte: 256"},
+		},
+		{
+			`slice(bytes("abc"), 2, 4)`,
+			&object.Error{Message: "slice bounds out of range [2:4] with length 3"},
+		},
+		{
+			`slice("abc", 0, 0)`,
+			&object.Error{Message: "first argument to `slice` must be Bytes or Array, got String"},
+		},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestFieldExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{`{"name": "Jimmy"}.name`, "Jimmy"},
+		{`{"name": "Jimmy"}.age`, Nil},
+		{`p = {"pos": {"x": 1, "y": 2}}; p.pos.x + p.pos.y`, 3},
+		{`p = {}; p.x = 1; p.x`, 1},
+		{`p = {"x": 1}; p.x = p.x + 1; p["x"]`, 2},
+		{`p = {"pos": {"x": 1}}; p.pos.x = 5; p.pos.x`, 5},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestFieldExpressionErrors(t *testing.T) {
+	tests := []string{
+		"[1, 2].a",
+		"a = 1; a.b = 2",
+		`p = freeze({"x": 1}); p.x = 2`,
+	}
+
+	runVMTestErrors(t, tests)
+}
+
+func TestMethodCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let counter = {"count": 0, "incr": fn(self, n) { self.count = self.count + n; self }};
+			counter.incr(2).incr(3);
+			counter.count;
+			`,
+			want: 5,
+		},
+		{
+			input: `
+			let newPoint = fn(x, y) {
+				{"x": x, "y": y, "sum": fn(self) { self.x + self.y }}
+			};
+			newPoint(1, 2).sum();
+			`,
+			want: 3,
+		},
+		{
+			input: `
+			let p = {"name": "Jimmy", "greet": fn(self, greeting) { greeting + " " + self.name }};
+			p.greet("Hello");
+			`,
+			want: "Hello Jimmy",
+		},
+		{
+			input: `let h = {"f": fn(x) { x + 1 }}; h["f"](1)`,
+			want:  2,
+		},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestMethodCallErrors(t *testing.T) {
+	tests := []string{
+		"let a = 1; a.f()",
+		`let h = {}; h.f()`,
+		`let h = {"f": fn() { 1 }}; h.f()`,
 	}
 
 	runVMTestErrors(t, tests)
 }
 
+func TestStackManipulation(t *testing.T) {
+	consts := []object.Object{
+		&object.Integer{Value: 1},
+		&object.Integer{Value: 2},
+		&object.Integer{Value: 3},
+	}
+	push123 := []code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpConstant, 2),
+	}
+
+	tests := []struct {
+		insns []code.Instructions
+		want  []int64
+	}{
+		{[]code.Instructions{code.Make(code.OpDup)}, []int64{1, 2, 3, 3}},
+		{[]code.Instructions{code.Make(code.OpSwap)}, []int64{1, 3, 2}},
+		{[]code.Instructions{code.Make(code.OpRot)}, []int64{2, 3, 1}},
+		{
+			[]code.Instructions{code.Make(code.OpRot), code.Make(code.OpRot)},
+			[]int64{3, 1, 2},
+		},
+		{
+			[]code.Instructions{code.Make(code.OpSwap), code.Make(code.OpDup), code.Make(code.OpAdd)},
+			[]int64{1, 3, 4},
+		},
+	}
+
+	for _, tt := range tests {
+		var insns code.Instructions
+		for _, insn := range append(push123, tt.insns...) {
+			insns = append(insns, insn...)
+		}
+
+		vm := New(&compiler.Bytecode{Instructions: insns, Constants: consts})
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if vm.sp != len(tt.want) {
+			t.Fatalf("wrong stack size. want=%d, got=%d", len(tt.want), vm.sp)
+		}
+		for i, want := range tt.want {
+			if err := testIntegerObject(want, vm.stack[i]); err != nil {
+				t.Errorf("stack[%d]: %s", i, err)
+			}
+		}
+	}
+}
+
 func TestGetIndexExpressions(t *testing.T) {
 	tests := []vmTestCase{
 		{"[1, 2, 3][1]", 2},
@@ -407,6 +868,30 @@ func TestGetIndexExpressions(t *testing.T) {
 	runVMTests(t, tests)
 }
 
+func TestInExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"2 in [1, 2, 3]", true},
+		{"4 in [1, 2, 3]", false},
+		{"[1] in [[1], [2]]", true},
+		{"1 in [1.0]", true},
+		{"1.5 in [1]", false},
+		{"2 not in [1, 2, 3]", false},
+		{"4 not in [1, 2, 3]", true},
+		{`"a" in {"a": 1}`, true},
+		{`"b" in {"a": 1}`, false},
+		{`let h = {"a": nil}; "a" in h && h["a"] == nil`, true},
+		{`"ell" in "hello"`, true},
+		{`"" in "hello"`, true},
+		{`"x" not in "hello"`, true},
+		{"1 in [1] == true", true},
+	}
+
+	runVMTests(t, tests)
+	runVMTestsWithOptions(t, tests, WithPersistentCollections())
+
+	runVMTestErrors(t, []string{`[] in {}`, `1 in "1"`, `1 in 1`})
+}
+
 func TestCallingFunctionsWithoutArguments(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -630,6 +1115,97 @@ func TestCallingFunctionsWithArgumentsAndBindings(t *testing.T) {
 	runVMTests(t, tests)
 }
 
+func TestWideLocals(t *testing.T) {
+	// Locals after the first 256 are addressed by wide instructions
+	var input strings.Builder
+	input.WriteString("let f = fn(x) {\n")
+	for i := 1; i < 300; i++ {
+		name := ""
+		for n := i; n > 0; n /= 26 {
+			name += string(rune('a' + n%26))
+		}
+		fmt.Fprintf(&input, "let l_%s = x + %d;\n", name, i)
+	}
+	// l_b is the local at index 1 and l_nl is the one at 299 (13 + 11*26)
+	input.WriteString("l_b + l_nl\n}; f(1)")
+
+	runVMTests(t, []vmTestCase{{input.String(), 2 + 300}})
+}
+
+func TestLargeLiterals(t *testing.T) {
+	// Literals too large to push all their elements on to the stack at once are built in chunks
+	var elems, pairs []string
+	for i := 0; i < 3000; i++ {
+		elems = append(elems, fmt.Sprint(i))
+		if i < 600 {
+			pairs = append(pairs, fmt.Sprintf("%d: %d", i, i))
+		}
+	}
+	array := "[" + strings.Join(elems, ", ") + "]"
+	hash := "{" + strings.Join(pairs, ", ") + "}"
+	// More elements than the constant pool can hold constants
+	var many []string
+	for i := 0; i < 70000; i++ {
+		many = append(many, fmt.Sprint(i%100))
+	}
+	manyArray := "[" + strings.Join(many, ", ") + "]"
+
+	tests := []vmTestCase{
+		{"len(" + array + ")", 3000},
+		{"let a = " + manyArray + "; len(a) * 100 + a[69999]", 70000*100 + 99},
+		{"let a = " + array + "; a[0] + a[256] + a[2999]", 0 + 256 + 2999},
+		{"let h = " + hash + "; h[0] + h[256] + h[599]", 0 + 256 + 599},
+	}
+
+	runVMTests(t, tests)
+	runVMTestsWithOptions(t, tests, WithPersistentCollections())
+}
+
+func TestCallingNonFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `"abc"(1)`,
+			want: "calling non-function and non-built-in: abc (type String)\n\n" +
+				"stack trace:\n\tmain at 0006 (line 1)",
+		},
+		{
+			// Large values are abbreviated
+			input: `let run = fn(f) { f(1) }; let call = fn(x) { run(x) }; call([` +
+				strings.Repeat("1, ", 20) + `1])`,
+			want: "calling non-function and non-built-in: " +
+				"[1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, ... (type Array)\n\n" +
+				"stack trace:\n\trun at 0005 (line 1)\n\tcall at 0005 (line 1)\n\tmain at 0083 (line 1)",
+		},
+		{
+			// Operators and index expressions calling methods of hashes are in stack traces
+			input: `let h = {"__add__": 1}; h + 2`,
+			want: "calling non-function and non-built-in: 1 (type Integer)\n\n" +
+				"stack trace:\n\tmain at 0018 (line 1)",
+		},
+		{
+			input: `let h = {"__index__": 1}; let f = fn() { 1 + h["k"] }; f()`,
+			want: "calling non-function and non-built-in: 1 (type Integer)\n\n" +
+				"stack trace:\n\tf at 0009 (line 1)\n\tmain at 0022 (line 1)",
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		c := compiler.New()
+		if err := c.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(c.Bytecode())
+		if err := vm.Run(); err == nil {
+			t.Fatalf("expected VM error but resulted in none")
+		} else if err.Error() != tt.want {
+			t.Fatalf("wrong VM error: want=%q, got=%q", tt.want, err)
+		}
+	}
+}
+
 func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -644,6 +1220,10 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 			input: "fn(a, b) { a + b; }(1);",
 			want:  "wrong number of arguments: want=2, got=1",
 		},
+		{
+			input: "let add = fn(a, b) { a + b; }; add(1, 2, 3);",
+			want:  "wrong number of arguments to add: want=2, got=3",
+		},
 	}
 
 	for _, tt := range tests {
@@ -681,47 +1261,1662 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`push([], 1)`, []int{1}},
 		{`push(1, 1)`, &object.Error{Message: "first argument to `push` must be Array, got Integer"}},
 		{`first(rest(push([1, 2, 3], 4)))`, 2},
+		{`slice([1, 2, 3, 4], 1, 3)`, []int{2, 3}},
+		{`slice([1, 2, 3, 4], 2, 2)`, []int{}},
+		// Arrays sharing elements are copied on write
+		{`let a = [1, 2, 3]; let b = rest(a); b[0] = 9; to_str([a, b])`, "[[1, 2, 3], [9, 3]]"},
+		{`let a = [1, 2, 3]; let b = slice(a, 0, 2); a[0] = 9; to_str([a, b, push(b, 4), a])`,
+			"[[9, 2, 3], [1, 2], [1, 2, 4], [9, 2, 3]]"},
+		{`let a = push([], 1); let b = push(a, 2); let c = push(a, 3); to_str([a, b, c])`,
+			"[[1], [1, 2], [1, 3]]"},
+		{`let a = push(push([], 1), 2); let b = push(a, 3); a[0] = 5; to_str([a, b])`,
+			"[[5, 2], [1, 2, 3]]"},
+		{`let a = [1, 2, 3]; to_str([set(a, 1, 9), a])`, "[[1, 9, 3], [1, 2, 3]]"},
+		{`let h = {"a": 1}; let g = set(h, "a", 2); [h["a"], g["a"]]`, []int{1, 2}},
+		{`set({}, "a", 1)["a"]`, 1},
+		{`set([1], 1, 2)`, &object.Error{Message: "array index 1 out of range"}},
+		{`set([1], "a", 2)`,
+			&object.Error{Message: "index to `set` an array must be Integer, got String"}},
+		{`set({}, [], 1)`, &object.Error{Message: "unusable as hash key: Array"}},
+		{`set(1, 0, 1)`,
+			&object.Error{Message: "first argument to `set` must be Array or Hash, got Integer"}},
+		{`format(3.14159, ".2f")`, "3.14"},
+		{`format(2, "6.1e")`, "2.0e+00"},
+		{`format(1.0 / 3.0, "")`, "0.3333333333333333"},
+		{`to_str(2.0)`, "2.0"},
+		{`format("a", "f")`,
+			&object.Error{Message: "first argument to `format` must be Float or Integer, got String"}},
+		{`format(1.5, "x")`, &object.Error{Message: `invalid format "x": unknown verb 'x'`}},
+		{`'a'`, 97},
+		{`chr('a' + 1)`, "b"},
+		{`chr(128053) == "🐵"`, true},
+		{`ord("é")`, 233},
+		{`ord(chr(65))`, 65},
+		{`chr(-1)`, &object.Error{Message: "invalid code point -1"}},
+		{`chr(55296)`, &object.Error{Message: "invalid code point 55296"}},
+		{`chr("a")`, &object.Error{Message: "argument to `chr` must be Integer, got String"}},
+		{`ord("ab")`,
+			&object.Error{Message: "argument to `ord` must be a single character, got \"ab\""}},
+		{`ord(1)`, &object.Error{Message: "argument to `ord` must be String, got Integer"}},
+		{`parse_int("42")`, 42},
+		{`parse_int("-ff", 16)`, -255},
+		{`parse_int("0b101", 0)`, 5},
+		{`parse_int("z", 36)`, 35},
+		{`parse_int("4x")`, &object.Error{Message: `could not parse "4x" as integer`}},
+		{`parse_int(" 1")`, &object.Error{Message: `could not parse " 1" as integer`}},
+		{`parse_int("12", 2)`, &object.Error{Message: `could not parse "12" as integer`}},
+		{`parse_int("9223372036854775808")`,
+			&object.Error{Message: `integer "9223372036854775808" out of range`}},
+		{`parse_int("1", 37)`, &object.Error{Message: "invalid base 37"}},
+		{`parse_int(1)`,
+			&object.Error{Message: "first argument to `parse_int` must be String, got Integer"}},
+		{`parse_int("1", "2")`,
+			&object.Error{Message: "second argument to `parse_int` must be Integer, got String"}},
+		{`parse_int()`, &object.Error{Message: "wrong number of arguments. want=1 or 2, got=0"}},
+		{`parse_float("2.5")`, 2.5},
+		{`parse_float("-1e3")`, -1000.0},
+		{`parse_float("3")`, 3.0},
+		{`parse_float("x")`, &object.Error{Message: `could not parse "x" as float`}},
+		{`parse_float("1e400")`, &object.Error{Message: `could not parse "1e400" as float`}},
+		{`parse_float("NaN")`, &object.Error{Message: `could not parse "NaN" as float`}},
+		{`parse_float(1.5)`,
+			&object.Error{Message: "argument to `parse_float` must be String, got Float"}},
+		// Invalid input can be told from valid one by is_error
+		{`let parse = fn(s) { let n = parse_int(s); if (is_error(n)) { -1 } else { n } };
+		  [parse("4x"), parse("42")]`, []int{-1, 42}},
+		{`is_error(parse_float("x")) && !is_error(parse_float("1"))`, true},
+		{`is_error(nil)`, false},
+		{`is_error()`, &object.Error{Message: "wrong number of arguments. want=1, got=0"}},
+		{"round(2.5)", 3.0},
+		{"round(-2.5)", -3.0},
+		{"round(1234.5678, 2)", 1234.57},
+		{"round(1.005, 2)", 1.0},
+		{"round(1250, -2)", 1300},
+		{"round(1250, 2)", 1250},
+		{"round(9223372036854775807, -1)",
+			&object.Error{Message: "integer overflow: round(9223372036854775807, -1)"}},
+		{`round("a")`, &object.Error{
+			Message: "first argument to `round` must be Float or Integer, got String",
+		}},
+		{"round(1.5, 0.5)",
+			&object.Error{Message: "second argument to `round` must be Integer, got Float"}},
+		{"trunc(2.7)", 2},
+		{"trunc(-2.7)", -2},
+		{"trunc(5)", 5},
+		{"trunc(10000000000000000000.0)",
+			&object.Error{Message: "10000000000000000000.0 is out of range of Integer"}},
+		{"trunc(nil)",
+			&object.Error{Message: "argument to `trunc` must be Float or Integer, got Nil"}},
+		{"to_fixed(2.5, 0)", "3"},
+		{"to_fixed(3.14159, 2)", "3.14"},
+		{"to_fixed(1.005, 2)", "1.00"},
+		{"to_fixed(-0.5, 0)", "-1"},
+		{"to_fixed(7, 3)", "7.000"},
+		{"to_fixed(1.5, -1)",
+			&object.Error{Message: "number of digits -1 is out of range [0, 1000]"}},
+		{"to_fixed(1.0 / 0.0, 1)", &object.Error{Message: "cannot format +Inf in fixed notation"}},
+		{"to_fixed(1.5)", &object.Error{Message: "wrong number of arguments. want=2, got=1"}},
+		{`b64_encode("hello?")`, "aGVsbG8/"},
+		{`b64_encode(bytes([0, 255]))`, "AP8="},
+		{`b64_encode("")`, ""},
+		{`b64_decode("aGVsbG8/")`, "hello?"},
+		{`b64_decode(b64_encode("日本"))`, "日本"},
+		{`b64_decode("aGVsbG8")`,
+			&object.Error{Message: "invalid base64: illegal base64 data at input byte 4"}},
+		{`hex_encode("Hi!")`, "486921"},
+		{`hex_encode(bytes([1, 171]))`, "01ab"},
+		{`hex_decode("486921")`, "Hi!"},
+		{`hex_decode("48692")`,
+			&object.Error{Message: "invalid hex: encoding/hex: odd length hex string"}},
+		{`hex_decode("zz")`,
+			&object.Error{Message: "invalid hex: encoding/hex: invalid byte: U+007A 'z'"}},
+		{`b64_encode(1)`, &object.Error{Message: "argument to `b64_encode` " +
+			"must be String or Bytes, got Integer"}},
+		{`hex_decode()`, &object.Error{Message: "wrong number of arguments. want=1, got=0"}},
+		{"to_str(csv_parse(\"a,b\n1,x y\n2\n\"))", "[[a, b], [1, x y], [2]]"},
+		{`let q = chr(34); csv_parse("a," + q + "b" + q + q + ", c" + q)[0][1]`, `b", c`},
+		{`len(csv_parse(""))`, 0},
+		{"let rows = csv_parse(\"name,age\nann,30\nbob,25\", true); " +
+			"rows[1][\"name\"] + rows[1][\"age\"]", "bob25"},
+		{`len(csv_parse("name,age", true))`, 0},
+		{"csv_parse(\"a,b\n1\", true)",
+			&object.Error{Message: "invalid CSV: record on line 2: wrong number of fields"}},
+		{`csv_parse("a," + chr(34) + "b")`, &object.Error{Message: "invalid CSV: " +
+			`parse error on line 1, column 5: extraneous or missing " in quoted-field`}},
+		{`csv_parse("a", 1)`,
+			&object.Error{Message: "second argument to `csv_parse` must be Boolean, got Integer"}},
+		{`csv_format([["a", "b c"], [1, nil, "x," + chr(34) + "y"], []])`,
+			"a,b c\n1,,\"x,\"\"y\"\n\n"},
+		{"csv_format(csv_parse(\"a,b\n1,\"))", "a,b\n1,\n"},
+		{`csv_format([1])`,
+			&object.Error{Message: "row 0 given to `csv_format` must be Array, got Integer"}},
 	}
 
 	runVMTests(t, tests)
 }
 
-func TestClosures(t *testing.T) {
+func TestArrayFunctions(t *testing.T) {
 	tests := []vmTestCase{
-		{
-			input: `
-			let newClosure = fn(a) {
-				fn() { a; };
-			};
-			let closure = newClosure(99);
-			closure();
-			`,
-			want: 99,
-		},
-		{
-			input: `
-			let newAdder = fn(a, b) {
-				fn(c) { a + b + c };
-			};
-			let adder = newAdder(1, 2);
-			adder(8);
-			`,
-			want: 11,
-		},
-		{
-			input: `
-			let newAdder = fn(a, b) {
-				let c = a + b;
-				fn(d) { c + d };
-			};
-			let adder = newAdder(1, 2);
-			adder(8);
-			`,
-			want: 11,
-		},
-		{
-			input: `
-			let newAdderOuter = fn(a, b) {
+		{"concat([1], [], [2, 3])", []int{1, 2, 3}},
+		{"let a = [1]; let b = concat(a, [2]); b[0] = 9; to_str([a, b])", "[[1], [9, 2]]"},
+		{"concat([1], 2)",
+			&object.Error{Message: "argument 2 to `concat` must be Array, got Integer"}},
+		{"concat()", &object.Error{Message: "wrong number of arguments. want at least 1, got=0"}},
+		{`index_of([1, "a", [2]], [2])`, 2},
+		{"index_of([1, 2, 1], 1)", 0},
+		{"index_of([1.0], 1)", 0},
+		{"index_of([], 1)", -1},
+		{"index_of(1, 1)",
+			&object.Error{Message: "first argument to `index_of` must be Array, got Integer"}},
+		{"to_str(flatten([1, [2, 3], [], [[4]]]))", "[1, 2, 3, [4]]"},
+		{"flatten(1)", &object.Error{Message: "argument to `flatten` must be Array, got Integer"}},
+		{`to_str(zip([1, 2, 3], ["a", "b"]))`, "[[1, a], [2, b]]"},
+		{"to_str(zip([1], []))", "[]"},
+		{"zip([1], 1)", &object.Error{Message: "argument 2 to `zip` must be Array, got Integer"}},
+		{"take([1, 2, 3], 2)", []int{1, 2}},
+		{"take([1, 2, 3], 5)", []int{1, 2, 3}},
+		{"drop([1, 2, 3], 1)", []int{2, 3}},
+		{"drop([1, 2, 3], 5)", []int{}},
+		{"let a = [1, 2, 3]; let b = drop(a, 1); b[0] = 9; to_str([a, b])", "[[1, 2, 3], [9, 3]]"},
+		{"take([1], -1)",
+			&object.Error{Message: "second argument to `take` must not be negative, got -1"}},
+		{`drop([1], "a")`,
+			&object.Error{Message: "second argument to `drop` must be Integer, got String"}},
+		{"take(1, 1)",
+			&object.Error{Message: "first argument to `take` must be Array, got Integer"}},
+	}
+
+	runVMTests(t, tests)
+
+	tests = []vmTestCase{
+		{"to_str(concat([1], [], [2, 3]))", "[1, 2, 3]"},
+		{`zip([1, 2, 3], ["a", "b"])[1][1]`, "b"},
+		{"let a = concat([1], [2]); a[0] = 9; to_str(flatten([a, [3]]))", "[9, 2, 3]"},
+		{"to_str([take([1, 2, 3], 2), drop([1, 2, 3], 2)])", "[[1, 2], [3]]"},
+		{"let a = [1, 2]; let b = take(a, 1); b[0] = 9; to_str([a, b])", "[[1, 2], [9]]"},
+	}
+
+	runVMTestsWithOptions(t, tests, WithPersistentCollections())
+}
+
+func TestExec(t *testing.T) {
+	tests := []vmTestCase{
+		{`exec("echo", "hi")`,
+			&object.Error{Message: "`exec` is not allowed: the exec capability is not granted"}},
+	}
+
+	runVMTests(t, tests)
+
+	tests = []vmTestCase{
+		{`exec("echo", "hello", "world")["stdout"]`, "hello world\n"},
+		{`let r = exec("sh", "-c", "echo out; echo err >&2; exit 3");
+		  to_str([r["stdout"], r["stderr"], r["code"]])`, "[out\n, err\n, 3]"},
+		{`exec("true")["code"]`, 0},
+		{`exec("no-such-command")`, &object.Error{Message: `could not run "no-such-command": ` +
+			`exec: "no-such-command": executable file not found in $PATH`}},
+		{`exec("echo", 1)`,
+			&object.Error{Message: "argument 2 to `exec` must be String, got Integer"}},
+		{`exec()`, &object.Error{Message: "wrong number of arguments. want at least 1, got=0"}},
+	}
+
+	runVMTestsWithOptions(t, tests, WithCapabilities(object.CapExec))
+}
+
+func TestPathFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{`path_join("a", "b/", "../c", "d.txt")`, "a/c/d.txt"},
+		{`path_join("/", "usr")`, "/usr"},
+		{`path_join("")`, ""},
+		{`path_join("a", 1)`,
+			&object.Error{Message: "argument 2 to `path_join` must be String, got Integer"}},
+		{`basename("/usr/lib/x.so")`, "x.so"},
+		{`basename("/usr/lib/")`, "lib"},
+		{`basename("")`, "."},
+		{`dirname("/usr/lib/x.so")`, "/usr/lib"},
+		{`dirname("x.so")`, "."},
+		{`dirname(1)`, &object.Error{Message: "argument to `dirname` must be String, got Integer"}},
+		{`basename()`, &object.Error{Message: "wrong number of arguments. want=1, got=0"}},
+		{`glob("*")`,
+			&object.Error{Message: "`glob` is not allowed: the fs capability is not granted"}},
+	}
+
+	runVMTests(t, tests)
+
+	dir, err := ioutil.TempDir("", "monkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"b.txt", "a.txt", "c.md"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests = []vmTestCase{
+		{fmt.Sprintf(`let g = glob(path_join(%q, "*.txt")); to_str([len(g), basename(g[0])])`,
+			dir), "[2, a.txt]"},
+		{fmt.Sprintf(`len(glob(path_join(%q, "*.go")))`, dir), 0},
+		{`glob("[")`, &object.Error{Message: `invalid pattern "["`}},
+	}
+
+	runVMTestsWithOptions(t, tests, WithCapabilities(object.CapFS))
+}
+
+func TestTCP(t *testing.T) {
+	tests := []vmTestCase{
+		{`tcp_listen("127.0.0.1:0")`, &object.Error{Message: "`tcp_listen` is not allowed: " +
+			"the net capability is not granted"}},
+		{`tcp_connect("127.0.0.1:1")`, &object.Error{Message: "`tcp_connect` is not allowed: " +
+			"the net capability is not granted"}},
+	}
+
+	runVMTests(t, tests)
+
+	// Find a free port for the script to listen on and connect to
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	tests = []vmTestCase{
+		{fmt.Sprintf(`
+		  let l = tcp_listen(%[1]q);
+		  let c = tcp_connect(%[1]q);
+		  let s = tcp_accept(l);
+		  tcp_send(c, "ping");
+		  let got = tcp_recv(s);
+		  tcp_send(s, bytes(got + "!"));
+		  let back = [tcp_recv(c, 3), tcp_recv(c)];
+		  tcp_close(c);
+		  let rest = tcp_recv(s);
+		  tcp_close(s);
+		  tcp_close(l);
+		  to_str([got, back, rest, l])`, addr), "[ping, [pin, g!], nil, Handle(TCP listener)]"},
+		{fmt.Sprintf(`let l = tcp_listen(%[1]q); tcp_close(l); tcp_close(l)`, addr),
+			&object.Error{Message: "could not close TCP listener: " +
+				"close tcp " + addr + ": use of closed network connection"}},
+		{fmt.Sprintf(`let l = tcp_listen(%[1]q); let r = tcp_recv(l); tcp_close(l); r`, addr),
+			&object.Error{Message: "first argument to `tcp_recv` must be a TCP connection, " +
+				"got TCP listener"}},
+		{`tcp_accept(1)`,
+			&object.Error{Message: "argument to `tcp_accept` must be a TCP listener, got Integer"}},
+		{`tcp_close("a")`, &object.Error{Message: "argument to `tcp_close` must be " +
+			"a TCP listener or TCP connection, got String"}},
+	}
+
+	runVMTestsWithOptions(t, tests, WithCapabilities(object.CapNet))
+}
+
+func TestServe(t *testing.T) {
+	runVMTests(t, []vmTestCase{
+		{`serve(":0", fn(req) { "" })`,
+			&object.Error{Message: "`serve` is not allowed: the net capability is not granted"}},
+	})
+	runVMTestsWithOptions(t, []vmTestCase{
+		{`serve(":0", 1)`,
+			&object.Error{Message: "second argument to `serve` must be a function, got Integer"}},
+	}, WithCapabilities(object.CapNet))
+
+	tests := []struct {
+		handler string
+		req     func(url string) (*http.Response, error)
+		status  int
+		header  http.Header
+		body    string
+		wantErr string
+	}{
+		{
+			handler: `fn(req) { "hello, " + req["headers"]["x-name"] }`,
+			req: func(url string) (*http.Response, error) {
+				req, _ := http.NewRequest("GET", url+"/hello", nil)
+				req.Header.Set("X-Name", "monkey")
+				return http.DefaultClient.Do(req)
+			},
+			status: 200,
+			body:   "hello, monkey",
+		},
+		{
+			handler: `fn(req) {
+			  let q = req["query"]["q"];
+			  let body = req["method"] + " " + req["path"] + " " + q + " " + req["body"];
+			  {"status": 201, "headers": {"X-Count": 1}, "body": body}
+			}`,
+			req: func(url string) (*http.Response, error) {
+				return http.Post(url+"/items?q=a&q=b", "text/plain", strings.NewReader("data"))
+			},
+			status: 201,
+			header: http.Header{"X-Count": {"1"}},
+			body:   "POST /items a data",
+		},
+		{
+			handler: `fn(req) { {"status": 204, "body": nil} }`,
+			req: func(url string) (*http.Response, error) {
+				return http.Get(url)
+			},
+			status: 204,
+		},
+		{
+			handler: `fn(req) { 1 }`,
+			req: func(url string) (*http.Response, error) {
+				return http.Get(url)
+			},
+			status:  500,
+			body:    "Internal Server Error\n",
+			wantErr: "handler of `serve` failed: response must be String or Hash, got Integer",
+		},
+		{
+			handler: `fn(req) { {"status": 42} }`,
+			req: func(url string) (*http.Response, error) {
+				return http.Get(url)
+			},
+			status: 500,
+			body:   "Internal Server Error\n",
+			wantErr: "handler of `serve` failed: " +
+				"status of response must be Integer in [100, 999], got 42",
+		},
+	}
+
+	for _, tt := range tests {
+		// Every handler stops the server with a panic once the test has been done
+		input := `let h = ` + tt.handler + `;
+		  serve(%[1]q, fn(req) { if (req["path"] == "/quit") { panic("quit") }; h(req) })`
+		url, done := startServer(t, input)
+
+		resp, err := tt.req(url)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("wrong status. want=%d, got=%d", tt.status, resp.StatusCode)
+		}
+		for name := range tt.header {
+			if got := resp.Header.Get(name); got != tt.header.Get(name) {
+				t.Errorf("wrong header %s. want=%q, got=%q", name, tt.header.Get(name), got)
+			}
+		}
+		if string(body) != tt.body {
+			t.Errorf("wrong body. want=%q, got=%q", tt.body, body)
+		}
+
+		wantErr := tt.wantErr
+		if wantErr == "" {
+			if resp, err := http.Get(url + "/quit"); err == nil {
+				resp.Body.Close()
+			}
+			wantErr = "handler of `serve` failed: panic: quit"
+		}
+		if err := <-done; err == nil || !strings.HasPrefix(err.Error(), wantErr) {
+			t.Errorf("wrong error. want=%q, got=%v", wantErr, err)
+		}
+	}
+}
+
+// eventLoopTestCase is a test case of a program which schedules functions, which writes `want`
+// to the standard output until the event loop finishes or fails with an error starting with
+// `wantErr`.
+type eventLoopTestCase struct {
+	input   string
+	want    string
+	wantErr string
+}
+
+func TestTimers(t *testing.T) {
+	tests := []eventLoopTestCase{
+		{`set_timeout(20, fn() { puts("b") }); set_timeout(10, fn() { puts("a") }); puts("main")`,
+			"main\na\nb\n", ""},
+		{`set_timeout(0, fn() { puts(1) }); set_timeout(0, fn() { puts(2) })`, "1\n2\n", ""},
+		{`let n = [0];
+		  let id = set_interval(1, fn() {
+		    n[0] = n[0] + 1;
+		    puts(n[0]);
+		    if (n[0] == 3) { clear_timer(id) }
+		  })`, "1\n2\n3\n", ""},
+		{`set_timeout(1, fn() { set_timeout(1, fn() { puts("inner") }); puts("outer") })`,
+			"outer\ninner\n", ""},
+		{`puts(clear_timer(set_timeout(1, fn() { puts("x") }))); puts(clear_timer(99))`,
+			"true\nfalse\n", ""},
+		{`set_timeout(1, fn() { panic("boom") }); set_timeout(2, fn() { puts("x") })`, "",
+			"panic: boom"},
+	}
+
+	runEventLoopTests(t, tests)
+
+	runVMTests(t, []vmTestCase{
+		{`set_timeout(1, fn() {}) > 0`, true},
+		{`set_interval(0, fn() {})`,
+			&object.Error{Message: "delay 0 ms given to `set_interval` is out of range"}},
+		{`set_timeout(-1, fn() {})`,
+			&object.Error{Message: "delay -1 ms given to `set_timeout` is out of range"}},
+		{`set_timeout(1, 2)`, &object.Error{Message: "second argument to `set_timeout` " +
+			"must be a function, got Integer"}},
+		{`!clear_timer(99)`, true},
+		{`clear_timer("a")`,
+			&object.Error{Message: "argument to `clear_timer` must be Integer, got String"}},
+	})
+}
+
+func TestFutures(t *testing.T) {
+	tests := []eventLoopTestCase{
+		{`let f = async(fn(a, b) { puts("run"); a + b }, 1, 2); puts("main"); puts(await(f))`,
+			"main\nrun\n3\n", ""},
+		{`let f = async(fn() { 1 }); puts(f); await(f); puts(f); puts(await(f))`,
+			"Future(...)\nFuture(1)\n1\n", ""},
+		{`set_timeout(5, fn() { puts("timer") }); await(sleep(10)); puts("slept")`,
+			"timer\nslept\n", ""},
+		{`let a = async(fn() { await(sleep(10)); puts("a"); 1 });
+		  let b = async(fn() { puts("b"); 2 });
+		  puts(await(a) + await(b))`, "b\na\n3\n", ""},
+		{`set_timeout(1, fn() { puts(await(async(fn() { "nested" }))) })`, "nested\n", ""},
+		{`puts(await(5))`, "5\n", ""},
+		{`await(async(fn() { panic("boom") }))`, "", "panic: boom"},
+	}
+
+	runEventLoopTests(t, tests)
+
+	runVMTests(t, []vmTestCase{
+		{`async(1)`, &object.Error{Message: "first argument to `async` must be a function, " +
+			"got Integer"}},
+		{`sleep(-1)`, &object.Error{Message: "delay -1 ms given to `sleep` is out of range"}},
+		{`sleep(3600001)`,
+			&object.Error{Message: "delay 3600001 ms given to `sleep` is out of range"}},
+		{`let f = async(fn() { 1 }); clear_timer(1); await(f)`,
+			&object.Error{Message: "future is never resolved"}},
+	})
+}
+
+// runEventLoopTests runs the programs of `tests` and then the event loop, and checks their
+// output and errors.
+func runEventLoopTests(t *testing.T, tests []eventLoopTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		complr := compiler.New()
+		if err := complr.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var out bytes.Buffer
+		vm := New(complr.Bytecode(), WithStdout(&out))
+		err := vm.Run()
+		if err == nil {
+			err = vm.RunEventLoop()
+		}
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%q failed: %s", tt.input, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)) {
+			t.Errorf("wrong error. want=%q, got=%v", tt.wantErr, err)
+		}
+		if got := out.String(); got != tt.want {
+			t.Errorf("wrong output. want=%q, got=%q", tt.want, got)
+		}
+	}
+}
+
+// startServer runs `input` calling `serve` with an address given as `%[1]q` on a new VM, and
+// returns the URL of the server once it has started listening and a channel receiving the error
+// the VM fails with.
+func startServer(t *testing.T, input string) (string, <-chan error) {
+	t.Helper()
+
+	// Find a free port for the server to listen on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	complr := compiler.New()
+	if err := complr.Compile(parse(fmt.Sprintf(input, addr))); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(complr.Bytecode(), WithCapabilities(object.CapNet))
+
+	done := make(chan error, 1)
+	go func() { done <- vm.Run() }()
+
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("server did not start: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return "http://" + addr, done
+}
+
+func TestThunks(t *testing.T) {
+	tests := []vmTestCase{
+		{`force(delay(fn() { 1 + 2 }))`, 3},
+		{`force(delay(fn() { }))`, Nil},
+		{`force(delay(len))`,
+			&object.Error{Message: "wrong number of arguments. want=1, got=0"}},
+		{`force(1)`, 1},
+		// The function is called only once
+		{`let n = [0];
+		let t = delay(fn() { n[0] = n[0] + 1; n[0] * 10 });
+		[force(t), force(t), n[0]]`, []int{10, 10, 1}},
+		// Lazy infinite list of integers
+		{`let ints = fn(n) { [n, delay(fn() { ints(n + 1) })] };
+		let nth = fn(s, k) { if (k == 0) { s[0] } else { nth(force(s[1]), k - 1) } };
+		nth(ints(0), 100)`, 100},
+		{`delay(1)`, &object.Error{Message: "argument to `delay` must be a function, got Integer"}},
+		{`delay()`, &object.Error{Message: "wrong number of arguments. want=1, got=0"}},
+	}
+
+	runVMTests(t, tests)
+
+	runVMTestErrors(t, []string{
+		`force(delay(fn() { 1 + "a" }))`,
+		`force(delay(fn(x) { x }))`,
+		`let t = delay(fn() { force(t) }); force(t)`,
+	})
+}
+
+func TestApplyAndArity(t *testing.T) {
+	tests := []vmTestCase{
+		{`apply(fn(a, b) { a - b }, [3, 1])`, 2},
+		{`apply(fn() { 1 }, [])`, 1},
+		{`apply(len, ["abc"])`, 3},
+		{`apply(len, [])`, &object.Error{Message: "wrong number of arguments. want=1, got=0"}},
+		{`let add = fn(a, b) { a + b }; apply(add, slice([1, 2, 3], 1, 3))`, 5},
+		{`let x = 10; let f = fn(a) { a + x }; apply(f, [1])`, 11},
+		{`apply(1, [])`,
+			&object.Error{Message: "first argument to `apply` must be a function, got Integer"}},
+		{`apply(fn() { 1 }, 1)`,
+			&object.Error{Message: "second argument to `apply` must be Array, got Integer"}},
+		{`arity(fn() { 1 })`, 0},
+		{`arity(fn(a, b, c) { a })`, 3},
+		{`let x = 1; arity(fn(a) { a + x })`, 1},
+		{`arity(len)`, &object.Error{Message: "arity of built-in functions is not fixed"}},
+		{`arity(1)`, &object.Error{Message: "argument to `arity` must be a function, got Integer"}},
+		// A generic helper calling a function with as many arguments as it takes
+		{`let call = fn(f, args) { apply(f, slice(args, 0, arity(f))) };
+		call(fn(a, b) { a * b }, [2, 3, 4])`, 6},
+	}
+
+	runVMTests(t, tests)
+
+	runVMTestErrors(t, []string{
+		`apply(fn(a) { a }, [1, 2])`,
+		`apply(fn() { 1 + "a" }, [])`,
+	})
+}
+
+func TestComposeAndPartial(t *testing.T) {
+	tests := []vmTestCase{
+		{`let inc = fn(x) { x + 1 }; let double = fn(x) { x * 2 }; compose(inc, double)(5)`, 11},
+		{`let inc = fn(x) { x + 1 }; let double = fn(x) { x * 2 }; compose(double, inc)(5)`, 12},
+		{`compose(len)("abc")`, 3},
+		{`compose(fn(x) { x * 10 }, len, to_str)(12345)`, 50},
+		{`let add = fn(a, b) { a + b }; compose(fn(x) { -x }, add)(1, 2)`, -3},
+		{`let add = fn(a, b, c) { a + b + c }; partial(add, 1)(2, 3)`, 6},
+		{`let add = fn(a, b, c) { a + b + c }; partial(add, 1, 2)(3)`, 6},
+		{`let sub = fn(a, b) { a - b }; let f = partial(sub, 10); [f(1), f(2)]`, []int{9, 8}},
+		{`partial(push, [1])(2)`, []int{1, 2}},
+		{`compose(partial(push, [1]), len)("ab")`, []int{1, 2}},
+		{`compose()`, &object.Error{Message: "wrong number of arguments. want at least 1, got=0"}},
+		{`compose(len, 1)`,
+			&object.Error{Message: "argument 2 to `compose` must be a function, got Integer"}},
+		{`partial(1, 2)`,
+			&object.Error{Message: "first argument to `partial` must be a function, got Integer"}},
+	}
+
+	runVMTests(t, tests)
+
+	runVMTestErrors(t, []string{
+		`partial(fn(a) { a }, 1)(2)`,
+		`compose(fn(x) { x + "a" }, fn(x) { x })(1)`,
+	})
+}
+
+func TestInternedStrings(t *testing.T) {
+	program := parse(`
+	let key = fn(i) { "k" + to_str(i) };
+	let h = {key(1): 1, "k2": 2};
+	h[key(2)] = h[key(1)] + h["k" + "2"];
+	h[key(3)] = 3;
+	[h["k2"], h[key(3)], h["k1"]]
+	`)
+
+	complr := compiler.New()
+	if err := complr.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(complr.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, []int{3, 3, 1}, vm.Result())
+
+	// Only strings produced at runtime are interned
+	if len(vm.strings) != 3 {
+		t.Errorf("wrong number of interned strings. want=3, got=%d", len(vm.strings))
+	}
+	for _, s := range []string{"k1", "k2", "k3"} {
+		if _, ok := vm.strings[s]; !ok {
+			t.Errorf("%q is not interned", s)
+		}
+	}
+
+	// Interned strings are bounded in size and count towards the memory limit
+	program = parse(`
+	let double = fn(s, n) { if (n == 0) { s } else { double(s + s, n - 1) } };
+	let long = double("x", 7);
+	let h = {};
+	let set = fn(k) { h[k] = 1; h[k + "a"] = 1; h[k + "b"] = 1; h[long + k] = 1 };
+	let f = fn(i) { if (i > 0) { set(to_str(i)); f(i - 1) } };
+	f(1000);
+	len(long)
+	`)
+	complr = compiler.New()
+	if err := complr.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm = New(complr.Bytecode(), WithMaxMemory(1<<30))
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 128, vm.Result())
+	if vm.internedBytes > maxInternedBytes {
+		t.Errorf("too many bytes interned: %d", vm.internedBytes)
+	}
+	var size int64
+	for s, interned := range vm.strings {
+		if len(s) > maxInternedStringLen {
+			t.Errorf("long string %q is interned", s)
+		}
+		size += sizeOf(interned)
+	}
+	if size != vm.internedBytes {
+		t.Errorf("wrong number of bytes interned. want=%d, got=%d", size, vm.internedBytes)
+	}
+	if live := vm.liveMemory(); live < vm.internedBytes {
+		t.Errorf("interned strings are not counted as live memory: %d", live)
+	}
+}
+
+func TestPersistentCollections(t *testing.T) {
+	// Pushes 2^n elements, which are their indices, to an array
+	const fill = `
+	let fill = fn(n, a) { if (n == 0) { push(a, len(a)) } else { fill(n - 1, fill(n - 1, a)) } };
+	`
+
+	tests := []vmTestCase{
+		{`[1, 2, 3][1]`, 2},
+		{`[1, 2, 3][3]`, Nil},
+		{`{"a": 1, "b": 2}["b"]`, 2},
+		{`{"a": 1}["c"]`, Nil},
+		{`len(rest([1, 2, 3]))`, 2},
+		{`to_str([first([1, 2]), last([1, 2]), rest([1, 2, 3]), slice([1, 2, 3], 0, 2)])`,
+			"[1, 2, [2, 3], [1, 2]]"},
+		{`let a = [1, 2]; let b = push(a, 3); let c = set(b, 0, 9); to_str([a, b, c])`,
+			"[[1, 2], [1, 2, 3], [9, 2, 3]]"},
+		{`let a = [1, 2, 3]; let b = rest(a); b[0] = 9; to_str([a, b])`, "[[1, 2, 3], [9, 3]]"},
+		{`let h = {"a": 1}; let g = set(h, "b", 2); h["a"] = 3; to_str([h["a"], g["a"], g["b"]])`,
+			"[3, 1, 2]"},
+		{`let h = {"a": 1}; h["b"] = 2; to_str([h["a"], h["b"], h["c"]])`, "[1, 2, nil]"},
+		{`let o = {"double": fn(self, x) { x * 2 }}; o.double(21)`, 42},
+		{`assert_eq([1, {"a": [2]}], [1, {"a": [2]}]); bytes([104, 105])`, []byte("hi")},
+		{"assert_eq(1, 1.0); assert_eq([2.0], [2]); 3", 3},
+		{`let a = freeze([1]); let b = clone(a); b[0] = 2; to_str([a, b])`, "[[1], [2]]"},
+		{fill + `let a = fill(11, []); to_str([len(a), a[0], a[1050], a[2047]])`,
+			"[2048, 0, 1050, 2047]"},
+		{fill + `let s = slice(set(fill(11, []), 1500, -1), 1000, 2000); to_str([len(s), s[500]])`,
+			"[1000, -1]"},
+	}
+
+	runVMTestsWithOptions(t, tests, WithPersistentCollections())
+}
+
+func TestFuel(t *testing.T) {
+	tests := []struct {
+		input   string
+		fuel    int64
+		wantErr error
+	}{
+		{"1 + 2", 4, nil},
+		{"1 + 2", 3, ErrOutOfFuel},
+		{"let f = fn(n) { if (n < 2) { n } else { f(n - 1) + f(n - 2) } }; f(20)", 1000, ErrOutOfFuel},
+		{"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; f(10)", 10000, nil},
+	}
+
+	for _, tt := range tests {
+		complr := compiler.New()
+		if err := complr.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(complr.Bytecode(), WithFuel(tt.fuel))
+		if err := vm.Run(); err != tt.wantErr {
+			t.Errorf("wrong error for %q with fuel %d. want=%v, got=%v",
+				tt.input, tt.fuel, tt.wantErr, err)
+		}
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	// Takes much longer than the deadline
+	slow := "let f = fn(n) { if (n < 2) { n } else { f(n - 1) + f(n - 2) } }; f(40)"
+	complr := compiler.New()
+	if err := complr.Compile(parse(slow)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(complr.Bytecode())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := vm.RunContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("wrong error. want=%v, got=%v", context.DeadlineExceeded, err)
+	}
+
+	// The VM is no longer interrupted once reset
+	complr = compiler.New()
+	if err := complr.Compile(parse("1 + 2")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm.Reset(complr.Bytecode())
+	if err := vm.RunContext(context.Background()); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 3, vm.Result())
+
+	// Interrupting the event loop stops it waiting for timers
+	complr = compiler.New()
+	if err := complr.Compile(parse("set_interval(1000, fn() { 1 })")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm = New(complr.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	time.AfterFunc(10*time.Millisecond, vm.Interrupt)
+	if err := vm.RunEventLoop(); err != ErrInterrupted {
+		t.Errorf("wrong error. want=%v, got=%v", ErrInterrupted, err)
+	}
+
+	// Interrupting built-in functions waiting for connections or data stops them waiting
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	for _, input := range []string{
+		fmt.Sprintf(`serve(%q, fn(req) { "" })`, addr),
+		fmt.Sprintf(`tcp_accept(tcp_listen(%q))`, addr),
+		fmt.Sprintf(`let l = tcp_listen(%[1]q); let c = tcp_connect(%[1]q); tcp_recv(tcp_accept(l))`,
+			addr),
+	} {
+		complr = compiler.New()
+		if err := complr.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm = New(complr.Bytecode(), WithCapabilities(object.CapNet))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if err := vm.RunContext(ctx); err != context.DeadlineExceeded {
+			t.Errorf("wrong error for %q. want=%v, got=%v", input, context.DeadlineExceeded, err)
+		}
+		cancel()
+	}
+}
+
+func TestErrorsInCallbacks(t *testing.T) {
+	slow := "let f = fn(n) { if (n < 2) { n } else { f(n - 1) + f(n - 2) } };"
+	compile := func(input string) *compiler.Bytecode {
+		complr := compiler.New()
+		if err := complr.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		return complr.Bytecode()
+	}
+
+	// Errors of functions called back by built-in functions are reported as they are
+	for _, input := range []string{slow + "apply(f, [40])", slow + "force(delay(fn() { f(40) }))"} {
+		vm := New(compile(input), WithFuel(1000))
+		if err := vm.Run(); !errors.Is(err, ErrOutOfFuel) {
+			t.Errorf("wrong error for %q. want=%v, got=%v", input, ErrOutOfFuel, err)
+		}
+
+		vm = New(compile(input))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if err := vm.RunContext(ctx); err != context.DeadlineExceeded {
+			t.Errorf("wrong error for %q. want=%v, got=%v", input, context.DeadlineExceeded, err)
+		}
+		cancel()
+	}
+
+	err := New(compile(`apply(fn() { panic("boom") }, [])`)).Run()
+	var perr *PanicError
+	if !errors.As(err, &perr) || perr.Message != "boom" {
+		t.Errorf("error is not a panic with message boom. got=%T (%v)", err, err)
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	tests := []struct {
+		input     string
+		maxMemory int64
+		wantErr   error
+	}{
+		{"[1, 2, 3]", 1 << 10, nil},
+		// Doubles a string up to 1 MiB
+		{`let d = fn(s, n) { if (n == 0) { s } else { d(s + s, n - 1) } }; d("a", 20)`, 1 << 20, ErrOutOfMemory},
+		{`let d = fn(s, n) { if (n == 0) { s } else { d(s + s, n - 1) } }; d("a", 20)`, 4 << 20, nil},
+		// Keeps a copy of every intermediate array on the stack
+		{"let f = fn(n, a) { if (n == 0) { a } else { f(n - 1, push(clone(a), n)) } }; f(500, [])", 1 << 20, ErrOutOfMemory},
+		{"let f = fn(n, a) { if (n == 0) { a } else { f(n - 1, push(clone(a), n)) } }; f(500, [])", 16 << 20, nil},
+		// Allocates much more than the limit in total, but keeps little of it
+		{"let f = fn(n) { if (n == 0) { 0 } else { len(push([1, 2, 3, 4, 5, 6, 7, 8], n)); f(n - 1) } }; f(500)", 4 << 10, nil},
+		{`let h = {}; let f = fn(n) { if (n == 0) { h } else { h[n] = n; f(n - 1) } }; f(500)`, 16 << 10, ErrOutOfMemory},
+		{`let h = {}; let f = fn(n) { if (n == 0) { h } else { h[1] = n; f(n - 1) } }; f(500)`, 16 << 10, nil},
+		// Deep copies made by built-in functions are counted
+		{"let a = [[0, 0, 0, 0, 0, 0, 0, 0, 0, 0]]; let f = fn(n) { if (n == 0) { [] } else { push(f(n - 1), clone(a)) } }; f(200)", 16 << 10, ErrOutOfMemory},
+		{"let a = [[0, 0, 0, 0, 0, 0, 0, 0, 0, 0]]; let f = fn(n) { if (n == 0) { [] } else { push(f(n - 1), clone(a)) } }; f(200)", 1 << 20, nil},
+	}
+
+	for _, tt := range tests {
+		complr := compiler.New()
+		if err := complr.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(complr.Bytecode(), WithMaxMemory(tt.maxMemory))
+		if err := vm.Run(); err != tt.wantErr {
+			t.Errorf("wrong error for %q with max memory %d. want=%v, got=%v",
+				tt.input, tt.maxMemory, tt.wantErr, err)
+		}
+	}
+}
+
+func TestArena(t *testing.T) {
+	// Builds an array of n elements, which spans several chunks of the arena
+	const build = `
+	let build = fn(n, s) { if (n == 0) { [] } else { push(build(n - 1, s + "a"), [n * 2, s]) } };
+	`
+
+	tests := []vmTestCase{
+		{"1 + 2 * 3 - -4", 11},
+		{`"foo" + "bar"`, "foobar"},
+		{`bytes("ab")[1]`, 98},
+		{build + "let a = build(300, \"\"); [a[0][0], a[299][0], len(a[0][1]), len(a[299][1])]",
+			[]int{2, 600, 299, 0}},
+	}
+
+	runVMTestsWithOptions(t, tests, WithArena())
+
+	complr := compiler.New()
+	if err := complr.Compile(parse(build + "build(300, \"\")")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := complr.Bytecode()
+
+	allocs := func(opts ...Option) float64 {
+		return testing.AllocsPerRun(10, func() {
+			if err := New(bytecode, opts...).Run(); err != nil {
+				t.Fatalf("vm error: %s", err)
+			}
+		})
+	}
+	if without, with := allocs(), allocs(WithArena()); with >= without {
+		t.Errorf("arena does not reduce allocations. without=%.0f, with=%.0f", without, with)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	complr := compiler.New()
+	input := `let f = fn(x) { len(x) }; fn() { f("ab") }()`
+	if err := complr.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var logger testLogger
+	vm := New(complr.Bytecode(), WithLogger(&logger))
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	want := []string{
+		"push frame function=<anonymous> depth=2",
+		"push frame function=f depth=3",
+		"call builtin name=len args=1",
+	}
+	if !reflect.DeepEqual(logger.messages, want) {
+		t.Errorf("wrong messages.\nwant=%q\ngot=%q", want, logger.messages)
+	}
+}
+
+// testLogger records messages logged to it along with their keys and values.
+type testLogger struct {
+	messages []string
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) {
+	for i := 0; i+1 < len(args); i += 2 {
+		msg += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+	l.messages = append(l.messages, msg)
+}
+
+func TestReset(t *testing.T) {
+	symTbl := compiler.NewSymbolTable()
+	for i, builtin := range object.Builtins {
+		symTbl.DefineBuiltin(i, builtin.Name)
+	}
+	var consts []object.Object
+
+	compile := func(input string) *compiler.Bytecode {
+		complr := compiler.NewWithState(symTbl, consts)
+		if err := complr.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := complr.Bytecode()
+		consts = bytecode.Constants
+		return bytecode
+	}
+
+	vm := New(compile(`
+	let n = 20;
+	let sum = fn(n) { if (n == 0) { 0 } else { n + sum(n - 1) } };
+	sum(n)
+	`))
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 210, vm.Result())
+
+	// The program builds on the global bindings of the previous one
+	vm.Reset(compile(`let double = fn(x) { x * 2 }; double(n)`))
+	for i, obj := range vm.stack {
+		if obj != nil {
+			t.Fatalf("stack[%d] is not cleared: %s", i, obj.Inspect())
+		}
+	}
+	for i, f := range vm.frames[1:] {
+		if f != nil {
+			t.Fatalf("frames[%d] is not cleared", i+1)
+		}
+	}
+	if vm.Result() != nil {
+		t.Errorf("result is not cleared: %s", vm.Result().Inspect())
+	}
+
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 40, vm.Result())
+
+	// Closures cached for the previous constant pool are not reused
+	complr := compiler.New()
+	if err := complr.Compile(parse(`let a = 1; let f = fn() { "x" }; f()`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm.Reset(complr.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, "x", vm.Result())
+}
+
+func TestPool(t *testing.T) {
+	complr := compiler.New()
+	input := `let total = 0; let add = fn(a, b) { a + b }; puts("run"); add(1, 2)`
+	if err := complr.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := complr.Bytecode()
+
+	pool := NewPool(WithFuel(100))
+	for i := 0; i < 3; i++ {
+		var out bytes.Buffer
+		vm := pool.Get(bytecode, WithStdout(&out))
+		if vm.framesIdx != 1 || vm.sp != 0 || vm.globals[0] != nil || vm.globals[1] != nil {
+			t.Fatalf("VM is not reset: framesIdx=%d, sp=%d, globals=%v",
+				vm.framesIdx, vm.sp, vm.globals[:2])
+		}
+
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testExpectedObject(t, 3, vm.Result())
+		if got := out.String(); got != "run\n" {
+			t.Errorf("wrong output. want=%q, got=%q", "run\n", got)
+		}
+		if !vm.fuelLimited {
+			t.Errorf("options of the pool are not applied")
+		}
+
+		pool.Put(vm)
+	}
+
+	// VMs run concurrently do not share their state
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				vm := pool.Get(bytecode, WithStdout(ioutil.Discard))
+				if err := vm.Run(); err != nil {
+					t.Errorf("vm error: %s", err)
+					return
+				}
+				if result, ok := vm.Result().(*object.Integer); !ok || result.Value != 3 {
+					t.Errorf("wrong result: %v", vm.Result())
+				}
+				pool.Put(vm)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPoolForget(t *testing.T) {
+	complr := compiler.New()
+	if err := complr.Compile(parse("1 + 2")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := complr.Bytecode()
+
+	pool := NewPool()
+	vm := pool.Get(bytecode)
+	pool.Forget(bytecode)
+	if n := len(pool.programs); n != 0 {
+		t.Fatalf("bytecode is still kept after Forget: %d programs", n)
+	}
+
+	// A VM taken before Forget is not kept
+	pool.Put(vm)
+	if got := vm.pooled.vms.Get(); got != nil {
+		t.Errorf("VM of forgotten bytecode is kept")
+	}
+
+	// The bytecode can be run again
+	vm = pool.Get(bytecode)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 3, vm.Result())
+	pool.Put(vm)
+	if n := len(pool.programs); n != 1 {
+		t.Errorf("wrong number of programs. want=1, got=%d", n)
+	}
+
+	// Forgetting bytecode not in the pool does nothing
+	pool.Forget(&compiler.Bytecode{})
+}
+
+func TestPoolDoesNotCarryOverOptions(t *testing.T) {
+	complr := compiler.New()
+	if err := complr.Compile(parse(`len("a")`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := complr.Bytecode()
+
+	pool := NewPool()
+	var logger testLogger
+	vm := pool.Get(bytecode, WithCapabilities(object.CapExec), WithLogger(&logger))
+	if !vm.Allows(object.CapExec) {
+		t.Fatalf("capability given to Get is not granted")
+	}
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	vm.Schedule(time.Hour, object.NilValue, true)
+	pool.Put(vm)
+
+	// The pool may or may not reuse the VM, but either way the next run must start afresh
+	for i := 0; i < 3; i++ {
+		vm = pool.Get(bytecode)
+		if vm.Allows(object.CapExec) {
+			t.Errorf("capability of a previous run is still granted")
+		}
+		if vm.logger != nil {
+			t.Errorf("logger of a previous run is still set")
+		}
+		if n := vm.PendingTimers(); n != 0 {
+			t.Errorf("%d timers of a previous run are still pending", n)
+		}
+		pool.Put(vm)
+	}
+}
+
+func TestResult(t *testing.T) {
+	tests := []struct {
+		input string
+		want  interface{}
+	}{
+		{"1; 2", 2},
+		{"if (true) { 5 }", 5},
+		{"let f = fn() { 1 }; f() + 1", 2},
+		{"let a = [1, 2]; a[1]", 2},
+		{"1; let a = 2", nil},
+		{"let a = {}; a[1] = 2", nil},
+		{"", nil},
+		// A return statement at the top level ends the program
+		{"let a = 1; return a + 1; 3", 2},
+		{"if (true) { return 4 } 5", 4},
+	}
+
+	// The value of the program is the same whether or not the last value is kept on the stack
+	for _, keepLast := range []bool{false, true} {
+		for _, tt := range tests {
+			var opts []compiler.Option
+			if keepLast {
+				opts = append(opts, compiler.WithKeepLastValue())
+			}
+			complr := compiler.New(opts...)
+			if err := complr.Compile(parse(tt.input)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			vm := New(complr.Bytecode())
+			if err := vm.Run(); err != nil {
+				t.Fatalf("vm error: %s", err)
+			}
+
+			for _, result := range []object.Object{vm.Result(), vm.ReturnValue()} {
+				if tt.want == nil {
+					if result != nil {
+						t.Errorf("%q: expected no result, got=%s", tt.input, result.Inspect())
+					}
+					continue
+				}
+				if result == nil {
+					t.Errorf("%q: expected a result, got none", tt.input)
+					continue
+				}
+				testExpectedObject(t, tt.want, result)
+			}
+		}
+	}
+
+	// The result is kept apart from the stack, which calls after Run reuse
+	complr := compiler.New()
+	if err := complr.Compile(parse("fn() { 99 }")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(complr.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	fn := vm.Result()
+	if _, err := vm.Call(fn); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if got := vm.Result(); got != fn {
+		t.Errorf("result changed by a call. want=%s, got=%s", fn.Inspect(), got.Inspect())
+	}
+}
+
+func TestCallFunction(t *testing.T) {
+	tests := []struct {
+		input string
+		want  interface{}
+	}{
+		{"1 + 2 * 3", 7},
+		{`len("monkey") + 0.5`, 6.5},
+		{`{"a": [1, 2]}["a"][1]`, 2},
+		{"fn(x) { fn(y) { x * y } }(6)(7)", 42},
+		{"if (1 > 2) { 1 }", Nil},
+	}
+
+	// A single VM can call functions compiled separately, each with its own constant pool
+	vm := New(&compiler.Bytecode{})
+	for _, tt := range tests {
+		fn, err := compiler.CompileExpr(tt.input)
+		if err != nil {
+			t.Fatalf("%q: compiler error: %s", tt.input, err)
+		}
+
+		for i := 0; i < 3; i++ {
+			result, err := vm.CallFunction(fn)
+			if err != nil {
+				t.Fatalf("%q: vm error: %s", tt.input, err)
+			}
+			testExpectedObject(t, tt.want, result)
+		}
+	}
+
+	fn, err := compiler.CompileExpr(`1 + "a"`)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	if _, err := vm.CallFunction(fn); err == nil {
+		t.Errorf("expected VM error but resulted in none")
+	}
+
+	// Functions in the program run by the VM do not get mixed up with those in the expression
+	complr := compiler.New()
+	if err := complr.Compile(parse("let x = 1; let f = fn() { true }; f()")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm = New(complr.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	fn, err = compiler.CompileExpr("fn() { 2 }()")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	result, err := vm.CallFunction(fn)
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 2, result)
+}
+
+func TestEval(t *testing.T) {
+	expr, err := CompileExpr(`age >= min && last(tags) == "vip"`, "age", "tags", "min")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(&compiler.Bytecode{})
+
+	tests := []struct {
+		age  interface{}
+		tags interface{}
+		want bool
+	}{
+		{20, []string{"new", "vip"}, true},
+		{20, []string{"vip", "new"}, false},
+		{int64(17), []interface{}{"vip"}, false},
+		{18.5, &object.Array{Elements: []object.Object{&object.String{Value: "vip"}}}, true},
+	}
+
+	// The same expression is evaluated against each set of variables
+	for _, tt := range tests {
+		result, err := vm.Eval(expr, map[string]interface{}{
+			"age": tt.age, "tags": tt.tags, "min": 18, "unused": 0,
+		})
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testExpectedObject(t, tt.want, result)
+	}
+
+	errTests := []struct {
+		vars map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{"age": 1, "tags": nil}, `variable "min" is not bound`},
+		{
+			map[string]interface{}{"age": struct{}{}, "tags": nil, "min": 18},
+			`variable "age": cannot convert struct {} to an object`,
+		},
+	}
+
+	for _, tt := range errTests {
+		_, err := vm.Eval(expr, tt.vars)
+		if err == nil {
+			t.Errorf("expected VM error but resulted in none")
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("wrong VM error. want=%q, got=%q", tt.want, err)
+		}
+	}
+
+	// The VM can still evaluate the expression after a runtime error
+	_, err = vm.Eval(expr, map[string]interface{}{"age": "18", "tags": nil, "min": 18})
+	if err == nil {
+		t.Errorf("expected VM error but resulted in none")
+	}
+	vars := map[string]interface{}{"age": 18, "tags": []string{"vip"}, "min": 18}
+	result, err := vm.Eval(expr, vars)
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, true, result)
+}
+
+func TestIntrospection(t *testing.T) {
+	program := parse(`let f = fn(a, b) { let c = a + b; c + "x" }; let g = fn() { f(1, 2) }; g()`)
+
+	complr := compiler.New()
+	if err := complr.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(complr.Bytecode())
+	if err := vm.Run(); err == nil {
+		t.Fatalf("expected VM error but resulted in none")
+	}
+
+	// The frames are left as they are at the point of the failure
+	frames := vm.Frames()
+	if len(frames) != 3 {
+		t.Fatalf("wrong number of frames. want=3, got=%d", len(frames))
+	}
+	if f := vm.CurrentFrame(); f != frames[2] {
+		t.Errorf("current frame is not the innermost one")
+	}
+
+	names := []string{"", "g", "f"}
+	for i, f := range frames {
+		if got := f.Closure().Fn.Name; got != names[i] {
+			t.Errorf("wrong function of frame %d. want=%q, got=%q", i, names[i], got)
+		}
+	}
+
+	// The instruction pointer is at the failing OpAdd
+	f := frames[2]
+	insns := f.Instructions()
+	if op := code.Opcode(insns[f.IP()]); op != code.OpAdd {
+		t.Errorf("wrong instruction at IP %d. want=OpAdd, got=%d", f.IP(), op)
+	}
+	if want := frames[1].BasePointer() + 1; f.BasePointer() != want {
+		t.Errorf("wrong base pointer. want=%d, got=%d", want, f.BasePointer())
+	}
+
+	locals := vm.Locals(f)
+	if len(locals) != 3 {
+		t.Fatalf("wrong number of locals. want=3, got=%d", len(locals))
+	}
+	for i, want := range []int{1, 2, 3} {
+		testExpectedObject(t, want, locals[i])
+	}
+}
+
+func TestFramesOfNestedClosures(t *testing.T) {
+	program := parse(`
+	let outer = fn(a) {
+		let middle = fn(b) {
+			let inner = fn(c) { a + b + c + "x" };
+			inner(3)
+		};
+		middle(2)
+	};
+	outer(1)`)
+
+	complr := compiler.New()
+	if err := complr.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(complr.Bytecode())
+	if err := vm.Run(); err == nil {
+		t.Fatalf("expected VM error but resulted in none")
+	}
+
+	frames := vm.Frames()
+	if len(frames) != 4 {
+		t.Fatalf("wrong number of frames. want=4, got=%d", len(frames))
+	}
+
+	// Each frame has the free variables its closure captured from the enclosing frames
+	tests := []struct {
+		name string
+		free []int
+	}{
+		{"", nil},
+		{"outer", nil},
+		{"middle", []int{1}},
+		{"inner", []int{1, 2}},
+	}
+	for i, tt := range tests {
+		f := frames[i]
+		if f.Fn() != f.Closure().Fn {
+			t.Errorf("function of frame %d is not the one of its closure", i)
+		}
+		if got := f.Fn().Name; got != tt.name {
+			t.Errorf("wrong function of frame %d. want=%q, got=%q", i, tt.name, got)
+		}
+		free := f.Closure().Free
+		if len(free) != len(tt.free) {
+			t.Errorf("wrong number of free variables of frame %d. want=%d, got=%d", i,
+				len(tt.free), len(free))
+			continue
+		}
+		for j, want := range tt.free {
+			testExpectedObject(t, want, free[j])
+		}
+	}
+}
+
+func TestInternalErrors(t *testing.T) {
+	tests := []struct {
+		insns []code.Instructions
+		op    code.Opcode
+		ip    int
+	}{
+		// Adding operands which have never been pushed
+		{[]code.Instructions{code.Make(code.OpAdd), code.Make(code.OpPop)}, code.OpAdd, 0},
+		// Loading a constant which does not exist
+		{
+			[]code.Instructions{code.Make(code.OpNil), code.Make(code.OpConstant, 5)},
+			code.OpConstant,
+			3,
+		},
+	}
+
+	for _, tt := range tests {
+		var insns code.Instructions
+		for _, insn := range tt.insns {
+			insns = append(insns, insn...)
+		}
+
+		vm := New(&compiler.Bytecode{Instructions: insns})
+		err := vm.Run()
+		ierr, ok := err.(*InternalError)
+		if !ok {
+			t.Errorf("error is not *InternalError. got=%T (%+v)", err, err)
+			continue
+		}
+		if ierr.Op != tt.op {
+			t.Errorf("wrong opcode. want=%d, got=%d", tt.op, ierr.Op)
+		}
+		if ierr.IP != tt.ip {
+			t.Errorf("wrong instruction pointer. want=%d, got=%d", tt.ip, ierr.IP)
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	program := parse(`let add = fn(a, b) { a + b }; let fail = fn() { 1 + "a" }; 1`)
+
+	complr := compiler.New()
+	if err := complr.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(complr.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	add, fail := vm.globals[0], vm.globals[1]
+
+	got, err := vm.Call(add, &object.Integer{Value: 1}, &object.Integer{Value: 2})
+	if err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	testExpectedObject(t, 3, got)
+
+	if _, err := vm.Call(fail); err == nil {
+		t.Errorf("expected error from Call but resulted in none")
+	}
+	if _, err := vm.Call(add, &object.Integer{Value: 1}); err == nil {
+		t.Errorf("expected error from Call but resulted in none")
+	}
+
+	// The VM must be usable after failed calls
+	got, err = vm.Call(object.GetBuiltinByName("len"), &object.String{Value: "abc"})
+	if err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	testExpectedObject(t, 3, got)
+
+	if vm.sp != 0 || vm.framesIdx != 1 {
+		t.Errorf("stack was not restored. sp=%d, framesIdx=%d", vm.sp, vm.framesIdx)
+	}
+}
+
+func TestTests(t *testing.T) {
+	program := parse(`test("a", fn() { 1 }); test("b", fn() { assert_eq(1, 2) })`)
+
+	complr := compiler.New()
+	if err := complr.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(complr.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	tests := vm.Tests()
+	if len(tests) != 2 || tests[0].Name != "a" || tests[1].Name != "b" {
+		t.Fatalf("wrong tests: %+v", tests)
+	}
+
+	if _, err := vm.Call(tests[0].Fn); err != nil {
+		t.Errorf("test a failed: %s", err)
+	}
+	_, err := vm.Call(tests[1].Fn)
+	if want := "assertion failed: got 1, want 2"; err == nil || err.Error() != want {
+		t.Errorf("wrong error from test b. want=%q, got=%v", want, err)
+	}
+}
+
+func TestAssert(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`assert(true); assert(1, "one"); assert([])`, ""},
+		{`assert(false)`, "assertion failed"},
+		{`assert(nil, "x must be set")`, "assertion failed: x must be set"},
+		{`let f = fn(x) { assert(x > 1, x) }; f(2); f(1)`, "assertion failed: 1"},
+	}
+
+	for _, tt := range tests {
+		complr := compiler.New()
+		if err := complr.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err := New(complr.Bytecode()).Run()
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("unexpected error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("wrong error for %q. want=%q, got=%v", tt.input, tt.want, err)
+		}
+	}
+}
+
+func TestPanic(t *testing.T) {
+	input := `
+	let inner = fn() { panic("boom") };
+	let outer = fn() { fn() { inner() }() };
+	outer();
+	`
+
+	complr := compiler.New()
+	if err := complr.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err := New(complr.Bytecode()).Run()
+	perr, ok := err.(*PanicError)
+	if !ok {
+		t.Fatalf("error is not *PanicError. got=%T (%v)", err, err)
+	}
+
+	if perr.Message != "boom" {
+		t.Errorf("wrong message. want=%q, got=%q", "boom", perr.Message)
+	}
+
+	want := []string{
+		"inner at 0005 (line 2)",
+		"<anonymous> at 0003 (line 3)",
+		"outer at 0004 (line 3)",
+		"main at 0017 (line 4)",
+	}
+	if !reflect.DeepEqual(perr.StackTrace, want) {
+		t.Errorf("wrong stack trace. want=%q, got=%q", want, perr.StackTrace)
+	}
+
+	if !strings.HasPrefix(perr.Error(), "panic: boom\n\nstack trace:\n\tinner at 0005 (line 2)\n") {
+		t.Errorf("wrong error message: %q", perr.Error())
+	}
+}
+
+func TestStdout(t *testing.T) {
+	program := parse(`puts("hello", 1 + 2); puts([1, "a"]); print("x", 4, nil); print()`)
+
+	complr := compiler.New()
+	if err := complr.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	vm := New(complr.Bytecode(), WithStdout(&out))
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	want := "hello\n3\n[1, a]\nx4nil"
+	if got := out.String(); got != want {
+		t.Errorf("wrong output. want=%q, got=%q", want, got)
+	}
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let newClosure = fn(a) {
+				fn() { a; };
+			};
+			let closure = newClosure(99);
+			closure();
+			`,
+			want: 99,
+		},
+		{
+			input: `
+			let newAdder = fn(a, b) {
+				fn(c) { a + b + c };
+			};
+			let adder = newAdder(1, 2);
+			adder(8);
+			`,
+			want: 11,
+		},
+		{
+			input: `
+			let newAdder = fn(a, b) {
+				let c = a + b;
+				fn(d) { c + d };
+			};
+			let adder = newAdder(1, 2);
+			adder(8);
+			`,
+			want: 11,
+		},
+		{
+			input: `
+			let newAdderOuter = fn(a, b) {
 				let c = a + b;
 				fn(d) {
 					let e = c + d;
@@ -760,6 +2955,44 @@ func TestClosures(t *testing.T) {
 			`,
 			want: 99,
 		},
+		{
+			// A variable captured through three levels of nested functions
+			input: `
+			let outer = fn(a) {
+				fn() {
+					fn() {
+						fn() { a };
+					};
+				};
+			};
+			outer(7)()()();
+			`,
+			want: 7,
+		},
+		{
+			// Sibling closures capturing the same variables in different orders
+			input: `
+			let newPair = fn(a, b) {
+				let first = fn() { fn() { a * 10 + b } };
+				let second = fn() { fn() { b * 10 + a } };
+				[first()(), second()()];
+			};
+			newPair(1, 2);
+			`,
+			want: []int{12, 21},
+		},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestClosuresWithoutFreeVariables(t *testing.T) {
+	tests := []vmTestCase{
+		// A closure without free variables is created once per function
+		{"let newFn = fn() { fn() { 1 } }; newFn() == newFn()", true},
+		{"let newFn = fn() { fn() { 1 } }; newFn()() + newFn()()", 2},
+		{"let newFn = fn(x) { fn() { x } }; newFn(1) == newFn(1)", false},
+		{"fn() { 1 } == fn() { 1 }", false},
 	}
 
 	runVMTests(t, tests)
@@ -810,9 +3043,121 @@ func TestRecursiveFunctions(t *testing.T) {
 			`,
 			want: 0,
 		},
+		{
+			// A function nested in a recursive one calls the outer function by its name
+			input: `
+			let count = fn(n) {
+				let step = fn() { count(n - 1) + 1 };
+				if (n == 0) { 0 } else { step() }
+			};
+			count(3);
+			`,
+			want: 3,
+		},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestStackOverflow(t *testing.T) {
+	tests := []string{
+		// Exhausts frames before the stack
+		"let f = fn() { f() }; f()",
+		// Exhausts the stack before frames
+		"let f = fn(a, b, c) { f(a, b, c) }; f(1, 2, 3)",
+	}
+
+	for _, tt := range tests {
+		complr := compiler.New()
+		if err := complr.Compile(parse(tt)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(complr.Bytecode())
+		if err := vm.Run(); !errors.Is(err, ErrStackOverflow) {
+			t.Errorf("wrong vm error for %q. want=%q, got=%v", tt, ErrStackOverflow, err)
+		}
+	}
+}
+
+func TestTypeMismatchErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  TypeMismatchError
+	}{
+		{`1 + "a"`, TypeMismatchError{code.OpAdd, object.IntegerType, object.StringType}},
+		{`[1] * 2.5`, TypeMismatchError{code.OpMul, object.ArrayType, object.FloatType}},
+		{`1 > true`, TypeMismatchError{code.OpGreaterThan, object.IntegerType, object.BooleanType}},
+	}
+
+	for _, tt := range tests {
+		complr := compiler.New()
+		if err := complr.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err := New(complr.Bytecode()).Run()
+		var mismatch *TypeMismatchError
+		if !errors.As(err, &mismatch) {
+			t.Errorf("wrong vm error for %q: %#v", tt.input, err)
+			continue
+		}
+		if *mismatch != tt.want {
+			t.Errorf("wrong error for %q. want=%+v, got=%+v", tt.input, tt.want, *mismatch)
+		}
+	}
+}
+
+func TestOperatorOverloading(t *testing.T) {
+	vec := `
+	let vec = fn(x, y) {
+		{
+			"x": x, "y": y,
+			"__add__": fn(a, b) { vec(a.x + b.x, a.y + b.y) },
+			"__mul__": fn(a, k) { vec(a.x * k, a.y * k) },
+			"__eq__": fn(a, b) { a.x == b.x && a.y == b.y },
+		}
+	};
+	`
+	matrix := `
+	let m = {"rows": [[1, 2], [3, 4]], "__index__": fn(self, idx) { self.rows[idx[0]][idx[1]] }};
+	`
+
+	tests := []vmTestCase{
+		{vec + "let v = vec(1, 2) + vec(3, 4); v.x * 10 + v.y", 46},
+		{vec + "let v = vec(1, 2) * 3; v.x * 10 + v.y", 36},
+		{vec + "vec(1, 2) == vec(1, 2)", true},
+		{vec + "vec(1, 2) != vec(1, 2)", false},
+		{vec + "vec(1, 2) == vec(2, 1)", false},
+		{vec + "vec(1, 2) != vec(2, 1)", true},
+		// The right operand overloads the operator if the left one does not
+		{`let n = {"__sub__": fn(a, b) { a - 1 }}; 10 - n`, 9},
+		{`let n = {"__div__": fn(a, b) { "div" }}; 1.5 / n`, "div"},
+		// Hashes without methods are compared by identity
+		{"let h = {}; h == h", true},
+		{"{} == {}", false},
+		{matrix + "m[[1, 0]]", 3},
+		{matrix + `m["rows"][0][1]`, 2},
+		{`{"a": 1}["b"]`, Nil},
+		// Operands of a chain of additions are evaluated in order with the additions
+		{`
+		let log = {"s": ""};
+		let p = fn(s) { log["s"] = log["s"] + s; s };
+		let h = {"__add__": fn(a, b) { log["s"] = log["s"] + "+"; "h" }};
+		h + "a" + p("b");
+		log["s"]
+		`, "+b"},
 	}
 
 	runVMTests(t, tests)
+	runVMTestsWithOptions(t, tests, WithPersistentCollections())
+
+	runVMTestErrors(t, []string{
+		"{} + 1",
+		`{"__add__": 1} + 1`,
+		`{"__add__": fn(a, b) { a + b }} + 1`,
+		"{}[[1]]",
+	})
 }
 
 func TestRecursiveFibonacci(t *testing.T) {
@@ -839,9 +3184,99 @@ func TestRecursiveFibonacci(t *testing.T) {
 	runVMTests(t, tests)
 }
 
+func TestInlining(t *testing.T) {
+	tick := `
+	let s = {"v": ""};
+	let tick = fn(x) { s["v"] = s["v"] + x; x };
+	`
+
+	tests := []vmTestCase{
+		{"let add = fn(a, b) { a + b }; add(1, 2)", 3},
+		{"let neg = fn(x) { -x }; let f = fn(y) { neg(neg(y)) + 1 }; f(2)", 3},
+		{"let get = fn(h) { h.x }; get({\"x\": 5})", 5},
+		// Arguments are evaluated once in order, even if unused
+		{tick + "let second = fn(a, b) { b }; second(tick(\"a\"), tick(\"b\")); s.v", "ab"},
+		{tick + "let twice = fn(x) { x + x }; twice(tick(\"a\"))", "aa"},
+		{tick + "let twice = fn(x) { x + x }; twice(tick(\"a\")); s.v", "a"},
+		{tick + "let one = fn(x) { 1 }; one(tick(\"a\")); s.v", "a"},
+		// Parameters shadow a global function to inline
+		{"let x = fn(a) { a * 10 }; let apply = fn(x, y) { x(y) }; apply(fn(b) { b * 2 }, 3)", 6},
+		// So do patterns in their arms
+		{"let f = fn(x) { x + 1 }; match 5 { f => f }; f(1)", 2},
+		{"let f = fn(x) { x + 1 }; match fn(x) { x * 3 } { f => f(2) }", 6},
+		// Inlined calls in functions called from an inlined body keep arguments intact
+		{`
+		let add = fn(a, b) { a + b };
+		let call = fn(f, x) { f(x) + x };
+		call(fn(y) { add(y, 100) }, 1)
+		`, 102},
+		{`
+		let sq = fn(x) { x * x };
+		let sum = fn(n) { if (n == 0) { 0 } else { sq(n) + sum(n - 1) } };
+		sum(3)
+		`, 14},
+	}
+
+	for _, level := range []int{0, 1} {
+		for _, tt := range tests {
+			complr := compiler.New(compiler.WithOptimizationLevel(level))
+			if err := complr.Compile(parse(tt.input)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			vm := New(complr.Bytecode())
+			if err := vm.Run(); err != nil {
+				t.Fatalf("vm error at optimization level %d: %s", level, err)
+			}
+
+			testExpectedObject(t, tt.want, vm.Result())
+		}
+	}
+}
+
+func TestFolding(t *testing.T) {
+	tests := []vmTestCase{
+		{`len("abc")`, 3},
+		{`to_str(1.5) + chr(ord("a") + 1)`, "1.5b"},
+		{"first([])", Nil},
+		{`if (len("a") == 1) { 10 } else { 20 }`, 10},
+		{"let f = fn(x) { !(len(x) > 1) }; if (f([1, 2])) { 10 } else { 20 }", 20},
+		{"let sq = fn(x) { x * x }; let f = fn(x, y) { sq(x) + sq(y) }; f(3, 4)", 25},
+		{"let f = fn(x) { -x * 0.5 }; f(3.0)", -1.5},
+		{`let f = fn(x) { len(x) }; let len = fn(x) { 0 }; f("a")`, 1},
+		{`let f = fn(s) { s + s }; len(f(f(f("ab"))))`, 16},
+		{"let f = fn(x) { x * 2 }; f(9223372036854775807)", -2},
+		{`let f = fn(x) { len(x) }; f(1)`, &object.Error{
+			Message: "argument to `len` not supported, got Integer",
+		}},
+	}
+
+	for _, level := range []int{0, 2} {
+		for _, tt := range tests {
+			complr := compiler.New(compiler.WithOptimizationLevel(level))
+			if err := complr.Compile(parse(tt.input)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			vm := New(complr.Bytecode())
+			if err := vm.Run(); err != nil {
+				t.Fatalf("vm error at optimization level %d: %s", level, err)
+			}
+
+			testExpectedObject(t, tt.want, vm.Result())
+		}
+	}
+}
+
 func runVMTests(t *testing.T, tests []vmTestCase) {
 	t.Helper()
 
+	runVMTestsWithOptions(t, tests)
+}
+
+func runVMTestsWithOptions(t *testing.T, tests []vmTestCase, opts ...Option) {
+	t.Helper()
+
 	for _, tt := range tests {
 		program := parse(tt.input)
 
@@ -852,12 +3287,12 @@ func runVMTests(t *testing.T, tests []vmTestCase) {
 
 		// dumpBytecode(complr.Bytecode())
 
-		vm := New(complr.Bytecode())
+		vm := New(complr.Bytecode(), opts...)
 		if err := vm.Run(); err != nil {
 			t.Fatalf("vm error: %s", err)
 		}
 
-		got := vm.LastPoppedStackElem()
+		got := vm.Result()
 
 		testExpectedObject(t, tt.want, got)
 	}
@@ -932,6 +3367,28 @@ func testExpectedObject(t *testing.T, want interface{}, got object.Object) {
 			t.Errorf("testStringObject failed: %s", err)
 		}
 
+	case *big.Int:
+		bi, ok := got.(*object.BigInt)
+		if !ok {
+			t.Errorf("object is not BigInt. got=%T (%#v)", got, got)
+			return
+		}
+
+		if bi.Value.Cmp(want) != 0 {
+			t.Errorf("object has wrong value. want=%s, got=%s", want, bi.Value)
+		}
+
+	case []byte:
+		b, ok := got.(*object.Bytes)
+		if !ok {
+			t.Errorf("object is not Bytes. got=%T (%#v)", got, got)
+			return
+		}
+
+		if string(b.Value) != string(want) {
+			t.Errorf("object has wrong value. want=%v, got=%v", want, b.Value)
+		}
+
 	case []int:
 		arr, ok := got.(*object.Array)
 		if !ok {
@@ -1046,3 +3503,254 @@ func testStringObject(want string, got object.Object) error {
 
 	return nil
 }
+
+func BenchmarkConcatenation(b *testing.B) {
+	// Builds a string from a chain of additions of 9 strings of 1 KiB, with and without the
+	// parentheses preventing the chain from being concatenated at once
+	const prelude = `
+	let k = fn(s, n) { if (n == 0) { s } else { k(s + s, n - 1) } };
+	let s = k("a", 10);
+	`
+
+	benchmarks := []struct {
+		name  string
+		input string
+	}{
+		{"chain", prelude + `"<" + s + "," + s + "," + s + "," + s + ">"`},
+		{"nested", prelude + `"<" + (s + ("," + (s + ("," + (s + ("," + (s + ">")))))))`},
+	}
+
+	for _, bm := range benchmarks {
+		complr := compiler.New()
+		if err := complr.Compile(parse(bm.input)); err != nil {
+			b.Fatalf("compiler error: %s", err)
+		}
+		bytecode := complr.Bytecode()
+
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				vm := New(bytecode)
+				b.StartTimer()
+
+				if err := vm.Run(); err != nil {
+					b.Fatalf("vm error: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPool(b *testing.B) {
+	complr := compiler.New()
+	input := `let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(10)`
+	if err := complr.Compile(parse(input)); err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+	bytecode := complr.Bytecode()
+
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := New(bytecode).Run(); err != nil {
+				b.Fatalf("vm error: %s", err)
+			}
+		}
+	})
+
+	b.Run("pool", func(b *testing.B) {
+		pool := NewPool()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			vm := pool.Get(bytecode)
+			if err := vm.Run(); err != nil {
+				b.Fatalf("vm error: %s", err)
+			}
+			pool.Put(vm)
+		}
+	})
+}
+
+func BenchmarkArrays(b *testing.B) {
+	benchmarks := []struct {
+		name  string
+		input string
+	}{
+		// Builds an array by pushing elements one by one
+		{"push", `
+		let build = fn(n, a) { if (n == 0) { a } else { build(n - 1, push(a, n)) } };
+		build(500, [])
+		`},
+		// Walks an array by taking the rest of it
+		{"rest", `
+		let build = fn(n, a) { if (n == 0) { a } else { build(n - 1, push(a, n)) } };
+		let sum = fn(a) { if (len(a) == 0) { 0 } else { first(a) + sum(rest(a)) } };
+		sum(build(500, []))
+		`},
+		// Updates elements of an array without modifying it
+		{"set", `
+		let build = fn(n, a) { if (n == 0) { a } else { build(n - 1, push(a, n)) } };
+		let update = fn(n, a) { if (n == 0) { a } else { update(n - 1, set(a, n, 0)) } };
+		update(499, build(500, []))
+		`},
+	}
+
+	options := []struct {
+		name string
+		opts []Option
+	}{
+		{"slices", nil},
+		{"persistent", []Option{WithPersistentCollections()}},
+	}
+
+	for _, bm := range benchmarks {
+		complr := compiler.New()
+		if err := complr.Compile(parse(bm.input)); err != nil {
+			b.Fatalf("compiler error: %s", err)
+		}
+		bytecode := complr.Bytecode()
+
+		for _, o := range options {
+			b.Run(bm.name+"/"+o.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					vm := New(bytecode, o.opts...)
+					b.StartTimer()
+
+					if err := vm.Run(); err != nil {
+						b.Fatalf("vm error: %s", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkIntegerAddition(b *testing.B) {
+	benchmarks := []struct {
+		name  string
+		input string
+	}{
+		// Results fit in the cache of small integers
+		{"small", `
+		let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + 1 + 1 + 1 + 1 - 4) } };
+		sum(500, 0)
+		`},
+		// Results are allocated
+		{"large", `
+		let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n + n + n + n) } };
+		sum(500, 100000)
+		`},
+	}
+
+	for _, bm := range benchmarks {
+		complr := compiler.New()
+		if err := complr.Compile(parse(bm.input)); err != nil {
+			b.Fatalf("compiler error: %s", err)
+		}
+		bytecode := complr.Bytecode()
+
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := New(bytecode).Run(); err != nil {
+					b.Fatalf("vm error: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	benchmarks := []struct {
+		name  string
+		input string
+	}{
+		// Mostly arithmetic and jumps within a single frame
+		{"arithmetic", `
+		let f = fn(n) {
+			let a = n + 1 - 2 * 3;
+			let b = if (a > 0) { a } else { -a };
+			[a, b][0] + b
+		};
+		f(1); f(2); f(3); f(4); f(5); f(6); f(7); f(8); f(9); f(10)
+		`},
+		// Dominated by calls and returns
+		{"calls", `
+		let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+		fib(15)
+		`},
+		// Passing function literals to higher-order functions
+		{"closures", `
+		let sum = fn(n, f) { if (n == 0) { 0 } else { f(n) + sum(n - 1, f) } };
+		let run = fn(n) { if (n == 0) { 0 } else { sum(10, fn(x) { x * 2 }) + run(n - 1) } };
+		run(100)
+		`},
+	}
+
+	for _, bm := range benchmarks {
+		complr := compiler.New()
+		if err := complr.Compile(parse(bm.input)); err != nil {
+			b.Fatalf("compiler error: %s", err)
+		}
+		bytecode := complr.Bytecode()
+
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// Exclude allocation of the stack and the globals store
+				b.StopTimer()
+				vm := New(bytecode)
+				b.StartTimer()
+
+				if err := vm.Run(); err != nil {
+					b.Fatalf("vm error: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBuiltinCallsWithMaxMemory(b *testing.B) {
+	// Calls built-in functions returning an integer or one of their arguments on arrays of
+	// different sizes with memory limited, which should take the same time per call
+	for _, size := range []int{1024, 4096, 16384} {
+		symTbl := compiler.NewSymbolTable()
+		for i, builtin := range object.Builtins {
+			symTbl.DefineBuiltin(i, builtin.Name)
+		}
+		var consts []object.Object
+
+		compile := func(input string) *compiler.Bytecode {
+			complr := compiler.NewWithState(symTbl, consts)
+			if err := complr.Compile(parse(input)); err != nil {
+				b.Fatalf("compiler error: %s", err)
+			}
+			bytecode := complr.Bytecode()
+			consts = bytecode.Constants
+			return bytecode
+		}
+
+		vm := New(compile(fmt.Sprintf(`
+		let build = fn(a, n) { if (len(a) >= n) { a } else { build(concat(a, a), n) } };
+		let arr = build([1], %d);
+		let call = fn(n) { if (n == 0) { 0 } else { len(arr) + len(freeze(arr)) + call(n - 1) } };
+		`, size)), WithMaxMemory(1<<30))
+		if err := vm.Run(); err != nil {
+			b.Fatalf("vm error: %s", err)
+		}
+		calls := compile(`call(100)`)
+
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				vm.Reset(calls)
+				if err := vm.Run(); err != nil {
+					b.Fatalf("vm error: %s", err)
+				}
+			}
+		})
+	}
+}
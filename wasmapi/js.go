@@ -0,0 +1,21 @@
+//go:build js && wasm
+// +build js,wasm
+
+package wasmapi
+
+import (
+	"fmt"
+	"syscall/js"
+)
+
+// Register exports RunSource to JavaScript as a global function named `name`, which takes
+// source code as a string and returns the output of the program.
+func Register(name string) {
+	fn := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) != 1 {
+			return fmt.Sprintf("wrong number of arguments. want=1, got=%d", len(args))
+		}
+		return RunSource(args[0].String())
+	})
+	js.Global().Set(name, fn)
+}
@@ -0,0 +1,52 @@
+// Package wasmapi provides a thin API to compile and run Monkey programs, which is designed to
+// be exported to JavaScript when built for WebAssembly (GOOS=js GOARCH=wasm) so that a browser
+// can run Monkey entirely on the client side.
+package wasmapi
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/skatsuta/monkey-compiler/compiler"
+	"github.com/skatsuta/monkey-compiler/eval"
+	"github.com/skatsuta/monkey-compiler/lexer"
+	"github.com/skatsuta/monkey-compiler/object"
+	"github.com/skatsuta/monkey-compiler/parser"
+	"github.com/skatsuta/monkey-compiler/vm"
+)
+
+// RunSource compiles and runs Monkey source code `src`, and returns the output printed by the
+// program. If the program fails to parse, compile or run, the error message is appended to
+// the output.
+func RunSource(src string) string {
+	var out bytes.Buffer
+
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return strings.Join(p.Errors(), "\n") + "\n"
+	}
+
+	// Process macros
+	macroEnv := object.NewEnvironment()
+	eval.DefineMacros(program, macroEnv)
+	expanded, err := eval.ExpandMacros(program, macroEnv)
+	if err != nil {
+		return fmt.Sprintf("Woops! Macro expansion failed: %s\n", err)
+	}
+
+	// Compile the AST to bytecode
+	c := compiler.New()
+	if err := c.Compile(expanded); err != nil {
+		return fmt.Sprintf("Woops! Compilation failed: %s\n", err)
+	}
+
+	// Run bytecode instructions
+	machine := vm.New(c.Bytecode(), vm.WithStdout(&out))
+	if err := machine.Run(); err != nil {
+		fmt.Fprintf(&out, "Woops! Executing bytecode failed: %s\n", err)
+	}
+
+	return out.String()
+}
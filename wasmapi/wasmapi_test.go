@@ -0,0 +1,25 @@
+package wasmapi
+
+import (
+	"testing"
+)
+
+func TestRunSource(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`puts("Hello, world!")`, "Hello, world!\n"},
+		{`let add = fn(a, b) { a + b }; puts(add(1, 2)); add(3, 4)`, "3\n"},
+		{`let x = ;`, "no prefix parse function for ; found\n"},
+		{`puts(y)`, "Woops! Compilation failed: undefined variable \"y\"\n"},
+		{`puts(1); 1 + "a"`, "1\nWoops! Executing bytecode failed: " +
+			"unsupported types for binary operation 2: Integer and String\n"},
+	}
+
+	for _, tt := range tests {
+		if got := RunSource(tt.src); got != tt.want {
+			t.Errorf("wrong output for %q. want=%q, got=%q", tt.src, tt.want, got)
+		}
+	}
+}